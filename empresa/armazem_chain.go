@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Armazém da blockchain local
+// Leitores pegam um snapshot imutável (Snapshot) sem lock: cada versão publicada é uma fatia
+// com capacidade igual ao tamanho, então nenhum append do escritor alcança o que um leitor vê.
+// O escritor acrescenta na própria fatia, depois do último bloco publicado, e publica a nova
+// versão com um ponteiro atômico. Escritas (Acrescentar e Substituir) são feitas com o mutex
+// da blockchain, que também serializa validação e consenso dos blocos.
+type ArmazemChain struct {
+	atual  atomic.Pointer[Blockchain]
+	blocos []Bloco // fatia do escritor; pode ter capacidade além da versão publicada
+}
+
+// Versão atual da blockchain; não deve ser alterada por quem a recebe
+func (a *ArmazemChain) Snapshot() Blockchain {
+	if atual := a.atual.Load(); atual != nil {
+		return *atual
+	}
+	return Blockchain{Chain: []Bloco{}}
+}
+
+// Último bloco da versão atual; a chain sempre tem ao menos o genesis depois da inicialização
+func (a *ArmazemChain) Ultimo() Bloco {
+	chain := a.Snapshot().Chain
+	return chain[len(chain)-1]
+}
+
+func (a *ArmazemChain) Tamanho() int {
+	return len(a.Snapshot().Chain)
+}
+
+// Acrescenta blocos ao fim da chain; chamada com o mutex
+func (a *ArmazemChain) Acrescentar(blocos ...Bloco) {
+	a.blocos = append(a.blocos, blocos...)
+	a.publicar()
+}
+
+// Acrescenta blocos e só publica a nova versão se gravar (o arquivo) tiver sucesso; em caso de
+// erro, a chain fica como estava. Chamada com o mutex
+func (a *ArmazemChain) AcrescentarGravando(gravar func(Blockchain) error, blocos ...Bloco) error {
+	anterior := len(a.blocos)
+	a.blocos = append(a.blocos, blocos...)
+	if erro := gravar(Blockchain{Chain: a.blocos[:len(a.blocos):len(a.blocos)]}); erro != nil {
+		// Os blocos descartados nunca foram publicados; o próximo append os sobrescreve
+		a.blocos = a.blocos[:anterior]
+		return erro
+	}
+	a.publicar()
+	return nil
+}
+
+// Troca a chain inteira (carga do arquivo ou sincronização); chamada com o mutex
+func (a *ArmazemChain) Substituir(chain []Bloco) {
+	a.blocos = append([]Bloco(nil), chain...)
+	a.publicar()
+}
+
+func (a *ArmazemChain) publicar() {
+	a.atual.Store(&Blockchain{Chain: a.blocos[:len(a.blocos):len(a.blocos)]})
+}
+
+// Chain atual, para leitura
+func chainAtual() []Bloco {
+	return blockchain.Snapshot().Chain
+}
+
+func caminhoBlockchain() string {
+	return "data/chain_" + empresa.ID + ".json"
+}
+
+// Adiciona blocos já validados à blockchain local: grava o arquivo uma vez para todos, atualiza os
+// índices e publica os blocos no stream de eventos; chamada com o mutex. Se a gravação falhar,
+// nenhum bloco é adicionado
+func adicionarBlocos(blocos ...Bloco) error {
+	gravar := func(chain Blockchain) error { return SalvarBlockchain(caminhoBlockchain(), chain) }
+	if erro := blockchain.AcrescentarGravando(gravar, blocos...); erro != nil {
+		return erro
+	}
+	indexarChain(chainAtual())
+	anunciarBlocos(blocos...)
+	return nil
+}
+
+// Troca a blockchain local pela preferida (chainPreferida) e válida recebida de outra empresa;
+// retorna false se, sob o mutex, a local já não perder para ela
+func substituirBlockchain(chain_remota Blockchain) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	local := chainAtual()
+	if !chainPreferida(chain_remota.Chain, local) {
+		return false
+	}
+	// Os blocos novos são os que vêm depois do último bloco em comum
+	anteriores := 0
+	for anteriores < len(local) && anteriores < len(chain_remota.Chain) && local[anteriores].Hash == chain_remota.Chain[anteriores].Hash {
+		anteriores++
+	}
+	blockchain.Substituir(chain_remota.Chain)
+	metricaSubstituicoes.Inc()
+	snapshot := blockchain.Snapshot()
+	if erro := SalvarBlockchain(caminhoBlockchain(), snapshot); erro != nil {
+		logConsenso.Error("erro ao salvar blockchain sincronizada", "erro", erro)
+	}
+	indexarChain(snapshot.Chain)
+	anunciarBlocos(snapshot.Chain[anteriores:]...)
+
+	// Blocos desta empresa que ficaram fora da chain adotada são registrados de novo
+	var descartados []Bloco
+	for _, bloco := range local[anteriores:] {
+		if bloco.Autor == empresa.ID {
+			descartados = append(descartados, bloco)
+		}
+	}
+	if len(descartados) > 0 {
+		go registrarDescartados(descartados)
+	}
+	return true
+}
+
+// Registra de novo, em ordem, as transações de blocos desta empresa descartados na sincronização
+// que ainda valem diante da chain que prevaleceu (revalidarDescartado)
+func registrarDescartados(blocos []Bloco) {
+	for _, bloco := range blocos {
+		registrarDescartado(bloco)
+	}
+}
+
+func registrarDescartado(bloco Bloco) {
+	transacao := bloco.Transacao
+	// A reserva é conferida e registrada com o lock do ponto, como nos pedidos de reserva
+	if transacao.Tipo == "RESERVA" {
+		lock := travarPonto(transacao.Ponto)
+		defer lock.Unlock()
+	}
+	if motivo := revalidarDescartado(bloco); motivo != "" {
+		logConsenso.Warn("transação descartada na sincronização não registrada de novo", "tipo", transacao.Tipo, "placa", transacao.Placa,
+			"ponto", transacao.Ponto, "hash_descartado", bloco.Hash, "motivo", motivo)
+		return
+	}
+	ctx := context.Background()
+	novo, erro := registrarTransacao(ctx, transacao, registrarReplicacao(ctx, transacao.Tipo+" registrada de novo após a sincronização"))
+	if erro != nil {
+		logConsenso.Error("erro ao registrar de novo transação descartada", "tipo", transacao.Tipo, "hash_descartado", bloco.Hash, "erro", erro)
+		return
+	}
+	if transacao.Tipo == "RESERVA" {
+		atualizarHashReserva(transacao.Ponto, transacao.Placa, novo.Hash)
+	}
+	logConsenso.Warn("transação descartada na sincronização registrada de novo", "tipo", transacao.Tipo, "placa", transacao.Placa,
+		"ponto", transacao.Ponto, "hash_descartado", bloco.Hash, "hash", novo.Hash)
+}
+
+// Confere se a transação de um bloco descartado ainda vale; retorna o motivo se não valer
+//   - RESERVA: o ponto continua reservado pela placa, com o bloco descartado, e a reserva não expirou
+//   - PAGAMENTO: a chain que prevaleceu ainda tem uma recarga pendente correspondente
+//   - TARIFA: a mesma tarifa não foi publicada na chain que prevaleceu
+func revalidarDescartado(bloco Bloco) string {
+	transacao := bloco.Transacao
+	switch transacao.Tipo {
+	case "RESERVA":
+		controlePontos.RLock()
+		status, existe := controlePontos.pontos[transacao.Ponto]
+		controlePontos.RUnlock()
+		if !existe || status.Status != "RESERVADO" || status.Placa != transacao.Placa || status.HashReserva != bloco.Hash {
+			return "reserva cancelada ou substituída"
+		}
+		if expira, erro := time.Parse(time.RFC3339, status.ExpiraEm); erro == nil && !time.Now().Before(expira) {
+			return "reserva expirada"
+		}
+	case "PAGAMENTO":
+		for _, recarga := range RecargasPendentes(transacao.Placa) {
+			if chavePagamento(recarga) == chavePagamento(transacao) {
+				return ""
+			}
+		}
+		return "nenhuma recarga pendente corresponde"
+	case "TARIFA":
+		if transacao.Tarifa == nil {
+			return "transação sem tarifa"
+		}
+		for _, publicada := range historicoTarifas(transacao.Ponto) {
+			if publicada.Transacao.Tarifa != nil && publicada.Transacao.Tarifa.dadosHash() == transacao.Tarifa.dadosHash() {
+				return "tarifa já publicada"
+			}
+		}
+	}
+	return ""
+}
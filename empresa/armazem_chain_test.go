@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Escritores (AcrescentarGravando, inclusive com falha na gravação, e Substituir) disputam com
+// leitores de Snapshot; rodar com go test -race. Cada leitor confere que a versão lida é uma chain
+// contínua, que nunca contém blocos de gravações que falharam e que não muda depois de lida.
+func TestArmazemChainConcorrente(t *testing.T) {
+	const (
+		escritas = 2000
+		leitores = 8
+	)
+	var armazem ArmazemChain
+	var mutex sync.Mutex // faz o papel do mutex da blockchain, que serializa as escritas
+	armazem.Substituir([]Bloco{{Index: 0, Hash: "genesis"}})
+
+	bloco := func(index int) Bloco {
+		return Bloco{Index: index, Hash: fmt.Sprintf("bloco-%d", index)}
+	}
+	falhar := errors.New("falha simulada")
+
+	var leitura sync.WaitGroup
+	parar := make(chan struct{})
+	erros := make(chan error, leitores)
+	for l := 0; l < leitores; l++ {
+		leitura.Add(1)
+		go func() {
+			defer leitura.Done()
+			for {
+				select {
+				case <-parar:
+					return
+				default:
+				}
+				chain := armazem.Snapshot().Chain
+				hashes := make([]string, len(chain))
+				for i, b := range chain {
+					if b.Index != i || (i > 0 && b.Hash != bloco(i).Hash) {
+						erros <- fmt.Errorf("bloco %d inesperado na posição %d: %q", b.Index, i, b.Hash)
+						return
+					}
+					hashes[i] = b.Hash
+				}
+				if ultimo := armazem.Ultimo(); ultimo.Index < 0 {
+					erros <- fmt.Errorf("último bloco inválido: %d", ultimo.Index)
+					return
+				}
+				for i, b := range chain {
+					if b.Hash != hashes[i] {
+						erros <- fmt.Errorf("snapshot alterado depois de lido na posição %d", i)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for n := 0; n < escritas; n++ {
+		mutex.Lock()
+		switch {
+		case n%97 == 96:
+			// Sincronização: troca por um prefixo da chain atual
+			atual := armazem.Snapshot().Chain
+			armazem.Substituir(atual[:len(atual)/2+1])
+		case n%5 == 4:
+			proximo := armazem.Tamanho()
+			descartado := Bloco{Index: proximo, Hash: "descartado"}
+			if erro := armazem.AcrescentarGravando(func(Blockchain) error { return falhar }, descartado); !errors.Is(erro, falhar) {
+				t.Errorf("gravação com falha retornou %v", erro)
+			}
+			if armazem.Tamanho() != proximo {
+				t.Errorf("gravação com falha publicou a chain: tamanho %d, esperado %d", armazem.Tamanho(), proximo)
+			}
+		default:
+			proximo := armazem.Tamanho()
+			erro := armazem.AcrescentarGravando(func(chain Blockchain) error {
+				if len(chain.Chain) != proximo+1 {
+					return fmt.Errorf("gravando %d blocos, esperado %d", len(chain.Chain), proximo+1)
+				}
+				return nil
+			}, bloco(proximo))
+			if erro != nil {
+				t.Error(erro)
+			}
+		}
+		mutex.Unlock()
+	}
+	close(parar)
+	leitura.Wait()
+	close(erros)
+	for erro := range erros {
+		t.Error(erro)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Autenticação do Mosquitto pelas empresas
+// O Mosquitto do docker-compose usa o plugin mosquitto-go-auth com o backend http: a cada CONNECT
+// ele consulta POST /broker/usuario e a cada assinatura, publicação e entrega consulta
+// POST /broker/acl, com as mesmas credenciais e ACLs do broker embutido. As rotas ficam num
+// servidor à parte, em AUTENTICACAO_BROKER (por exemplo ":8000"), que não é publicado para fora
+// da rede dos containers; todas as empresas atendem no mesmo alias, de modo que o broker continua
+// autenticando com qualquer uma delas fora do ar.
+// O limite de publicações por client ID (limites.go) só é aplicado pelo broker embutido.
+
+// Corpo das consultas do plugin (auth_opt_http_params_mode json)
+type consultaAutenticacaoBroker struct {
+	Usuario   string `json:"username"`
+	Senha     string `json:"password"`
+	ClienteID string `json:"clientid"`
+	Topico    string `json:"topic"`
+	Acesso    int    `json:"acc"`
+}
+
+// Acessos consultados pelo Mosquitto (MOSQ_ACL_*)
+const (
+	acessoLeitura    = 1
+	acessoEscrita    = 2
+	acessoAssinatura = 4
+)
+
+// Sobe o servidor de autenticação do Mosquitto se AUTENTICACAO_BROKER estiver definido
+func inicializaAutenticacaoBroker() {
+	endereco := os.Getenv("AUTENTICACAO_BROKER")
+	if endereco == "" {
+		return
+	}
+	rotas := http.NewServeMux()
+	rotas.HandleFunc("/broker/usuario", handleUsuarioBroker)
+	rotas.HandleFunc("/broker/acl", handleAclBroker)
+	go func() {
+		logBroker.Info("autenticação do Mosquitto escutando", "endereco", endereco)
+		if erro := http.ListenAndServe(endereco, rotas); erro != nil {
+			logBroker.Error("erro no servidor de autenticação do Mosquitto", "endereco", endereco, "erro", erro)
+		}
+	}()
+}
+
+// Responde 200 se o usuário e o token forem válidos; qualquer outro status recusa a conexão
+func handleUsuarioBroker(w http.ResponseWriter, r *http.Request) {
+	var consulta consultaAutenticacaoBroker
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&consulta) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, erro := autenticarClienteMqtt(consulta.ClienteID, consulta.Usuario, []byte(consulta.Senha)); erro != nil {
+		logBroker.Warn("conexão recusada no Mosquitto", "cliente", consulta.ClienteID, "usuario", consulta.Usuario, "erro", erro)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Responde 200 se a ACL do usuário permitir o acesso ao tópico
+func handleAclBroker(w http.ResponseWriter, r *http.Request) {
+	var consulta consultaAutenticacaoBroker
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&consulta) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	permissoes, erro := permissoesDoUsuario(consulta.Usuario, consulta.ClienteID)
+	if erro != nil || !permissoes.permite(consulta.Topico, consulta.Acesso) {
+		logBroker.Debug("acesso negado no Mosquitto", "cliente", consulta.ClienteID, "usuario", consulta.Usuario,
+			"topico", consulta.Topico, "acesso", consulta.Acesso)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Permissões de um cliente já autenticado pelo Mosquitto, a partir do usuário (a consulta de ACL
+// não traz o token). O usuário foi conferido com o token na conexão: empresa_<id> e estacao_<id>
+// só com credenciais desses papéis, e a placa só com o client ID veiculo_<placa>
+func permissoesDoUsuario(usuario, clienteID string) (*permissoesMqtt, error) {
+	if id, ok := strings.CutPrefix(usuario, "empresa_"); ok {
+		if _, existe := empresasAPI[id]; !existe {
+			return nil, errors.New("empresa desconhecida")
+		}
+		return permissoesDoPapel(CredencialMqtt{Papel: "empresa", Sujeito: id}), nil
+	}
+	if id, ok := strings.CutPrefix(usuario, "estacao_"); ok {
+		if _, existe := empresasAPI[id]; !existe {
+			return nil, errors.New("estação desconhecida")
+		}
+		return permissoesDoPapel(CredencialMqtt{Papel: "estacao", Sujeito: id}), nil
+	}
+	if !placaValida(usuario) || clienteID != "veiculo_"+usuario {
+		return nil, errors.New("usuário ou client ID inválido")
+	}
+	return permissoesDoPapel(CredencialMqtt{Papel: "veiculo", Sujeito: usuario}), nil
+}
+
+// Verifica um acesso do Mosquitto: leitura e escrita são de um tópico, assinatura de um filtro
+func (p *permissoesMqtt) permite(topico string, acesso int) bool {
+	corresponde := func(filtros []string, casar func(filtro, topico string) bool) bool {
+		for _, filtro := range filtros {
+			if casar(filtro, topico) {
+				return true
+			}
+		}
+		return false
+	}
+	switch acesso {
+	case acessoLeitura:
+		return corresponde(p.assinar, topicoCorresponde)
+	case acessoEscrita:
+		return corresponde(p.publicar, topicoCorresponde)
+	case acessoLeitura | acessoEscrita:
+		return corresponde(p.assinar, topicoCorresponde) && corresponde(p.publicar, topicoCorresponde)
+	case acessoAssinatura:
+		return filtroValido(topico) && corresponde(p.assinar, filtroContido)
+	}
+	return false
+}
@@ -0,0 +1,798 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Broker MQTT 3.1.1 embutido
+// Com BROKER_EMBUTIDO definido a empresa sobe o próprio broker (sem o container do Mosquitto):
+// "true" escuta em :1883, qualquer outro valor é usado como endereço (ex.: ":1884").
+// Suporta QoS 0 e 1 (assinaturas QoS 2 são rebaixadas para 1 e publicações QoS 2 são aceitas
+// com o fluxo PUBREC/PUBREL/PUBCOMP), mensagens retidas, curingas + e #, sessões persistentes
+// (clean session = false) com fila offline, keep alive e last will.
+// Com autenticação (padrão; BROKER_ANONIMO=true desativa) o CONNECT exige usuário e token e cada
+// cliente só publica e assina os tópicos permitidos ao seu papel (ver credenciais.go). Publicações
+// negadas são confirmadas e descartadas, como no Mosquitto; assinaturas negadas recebem 0x80.
+
+const (
+	tamanhoMaximoPacote  = 2 << 20
+	tamanhoMaximoFila    = 1000
+	tamanhoBufferSaida   = 256
+	tempoMaximoConnect   = 10 * time.Second
+	nomeProtocoloMqtt    = "MQTT"
+	nomeProtocoloMqtt31  = "MQIsdp"
+	nivelProtocoloMqtt   = 4
+	nivelProtocoloMqtt31 = 3
+)
+
+// Tipos de pacote MQTT
+const (
+	pacoteConnect     = 1
+	pacoteConnack     = 2
+	pacotePublish     = 3
+	pacotePuback      = 4
+	pacotePubrec      = 5
+	pacotePubrel      = 6
+	pacotePubcomp     = 7
+	pacoteSubscribe   = 8
+	pacoteSuback      = 9
+	pacoteUnsubscribe = 10
+	pacoteUnsuback    = 11
+	pacotePingreq     = 12
+	pacotePingresp    = 13
+	pacoteDisconnect  = 14
+)
+
+var errPacoteInvalido = errors.New("pacote MQTT malformado")
+
+// Mensagem roteada pelo broker
+type mensagemBroker struct {
+	Topico  string
+	Payload []byte
+	QoS     byte
+	Retida  bool
+}
+
+// Estado de um cliente que sobrevive entre conexões quando a sessão é persistente
+type sessaoBroker struct {
+	clienteID   string
+	persistente bool
+	assinaturas map[string]byte
+	conexao     *conexaoBroker
+	fila        []mensagemBroker          // QoS 1 recebidas enquanto o cliente estava desconectado
+	emVoo       map[uint16]mensagemBroker // enviadas aguardando PUBACK
+	proximoID   uint16
+}
+
+// Conexão TCP ativa de um cliente
+type conexaoBroker struct {
+	conn       net.Conn
+	sessao     *sessaoBroker
+	saida      chan []byte
+	encerrada  chan struct{}
+	fecharUma  sync.Once
+	will       *mensagemBroker
+	recebidas2 map[uint16]bool // publicações QoS 2 aguardando PUBREL
+	permissoes *permissoesMqtt // nil: sem restrições (broker anônimo)
+}
+
+// Valida usuário/senha do CONNECT e retorna as permissões do cliente
+type funcAutenticacao func(clienteID, usuario string, senha []byte) (*permissoesMqtt, error)
+
+type BrokerMqtt struct {
+	sync.Mutex
+	listener net.Listener
+	sessoes  map[string]*sessaoBroker
+	retidas  map[string]mensagemBroker
+	fechado  bool
+	// nil aceita clientes anônimos
+	autenticar funcAutenticacao
+}
+
+// URL usada pelo cliente MQTT da empresa (MQTT_BROKER_URL; com broker embutido, o endereço local dele)
+var urlBroker = lerUrlBroker()
+
+// Lê a URL do broker do ambiente; o padrão é o container do Mosquitto
+func lerUrlBroker() string {
+	if url := os.Getenv("MQTT_BROKER_URL"); url != "" {
+		return url
+	}
+	return "tcp://broker:1883"
+}
+
+// Sobe o broker embutido se BROKER_EMBUTIDO estiver definido
+func inicializaBrokerEmbutido() {
+	endereco := os.Getenv("BROKER_EMBUTIDO")
+	if endereco == "" || endereco == "false" {
+		return
+	}
+	if endereco == "true" {
+		endereco = ":1883"
+	}
+	autenticar := funcAutenticacao(autenticarClienteMqtt)
+	if os.Getenv("BROKER_ANONIMO") == "true" {
+		logBroker.Warn("autenticação desativada (BROKER_ANONIMO=true)")
+		autenticar = nil
+	}
+	broker, erro := iniciarBrokerMqtt(endereco, autenticar)
+	if erro != nil {
+		logBroker.Error("erro ao iniciar broker embutido", "endereco", endereco, "erro", erro)
+		os.Exit(1)
+	}
+	logBroker.Info("broker MQTT embutido escutando", "endereco", broker.Endereco())
+	if os.Getenv("MQTT_BROKER_URL") == "" {
+		urlBroker = "tcp://" + broker.Endereco()
+	}
+}
+
+// Inicia um broker escutando no endereço informado (":0" escolhe uma porta livre)
+func iniciarBrokerMqtt(endereco string, autenticar funcAutenticacao) (*BrokerMqtt, error) {
+	listener, erro := net.Listen("tcp", endereco)
+	if erro != nil {
+		return nil, erro
+	}
+	broker := &BrokerMqtt{
+		listener:   listener,
+		sessoes:    make(map[string]*sessaoBroker),
+		retidas:    make(map[string]mensagemBroker),
+		autenticar: autenticar,
+	}
+	go broker.aceitarConexoes()
+	return broker, nil
+}
+
+// Endereço local do broker acessível pelos clientes da mesma máquina
+func (b *BrokerMqtt) Endereco() string {
+	endereco := b.listener.Addr().(*net.TCPAddr)
+	if endereco.IP == nil || endereco.IP.IsUnspecified() {
+		return fmt.Sprintf("127.0.0.1:%d", endereco.Port)
+	}
+	return endereco.String()
+}
+
+// Encerra o listener e todas as conexões
+func (b *BrokerMqtt) Fechar() {
+	b.Lock()
+	b.fechado = true
+	conexoes := make([]*conexaoBroker, 0, len(b.sessoes))
+	for _, sessao := range b.sessoes {
+		if sessao.conexao != nil {
+			conexoes = append(conexoes, sessao.conexao)
+		}
+	}
+	b.Unlock()
+	b.listener.Close()
+	for _, c := range conexoes {
+		c.fechar()
+	}
+}
+
+func (b *BrokerMqtt) aceitarConexoes() {
+	for {
+		conn, erro := b.listener.Accept()
+		if erro != nil {
+			b.Lock()
+			fechado := b.fechado
+			b.Unlock()
+			if fechado {
+				return
+			}
+			logBroker.Error("erro ao aceitar conexão", "erro", erro)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go b.atenderConexao(conn)
+	}
+}
+
+// Trata uma conexão do CONNECT ao DISCONNECT (ou queda)
+func (b *BrokerMqtt) atenderConexao(conn net.Conn) {
+	leitor := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(tempoMaximoConnect))
+	tipo, _, corpo, erro := lerPacote(leitor)
+	if erro != nil || tipo != pacoteConnect {
+		conn.Close()
+		return
+	}
+	c, keepAlive, erro := b.conectar(conn, corpo)
+	if erro != nil {
+		logBroker.Warn("CONNECT recusado", "remoto", conn.RemoteAddr().String(), "erro", erro)
+		conn.Close()
+		return
+	}
+
+	desconexaoLimpa := false
+	for {
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		tipo, flags, corpo, erro := lerPacote(leitor)
+		if erro != nil {
+			break
+		}
+		if tipo == pacoteDisconnect {
+			desconexaoLimpa = true
+			break
+		}
+		if erro := b.tratarPacote(c, tipo, flags, corpo); erro != nil {
+			logBroker.Info("encerrando sessão", "cliente", c.sessao.clienteID, "erro", erro)
+			break
+		}
+	}
+	b.desconectar(c, desconexaoLimpa)
+}
+
+// Processa o CONNECT: valida, cria ou retoma a sessão e responde CONNACK
+func (b *BrokerMqtt) conectar(conn net.Conn, corpo []byte) (*conexaoBroker, time.Duration, error) {
+	r := &leitorPacote{dados: corpo}
+	protocolo := r.texto()
+	nivel := r.byte()
+	flags := r.byte()
+	keepAlive := time.Duration(r.uint16()) * time.Second
+	clienteID := r.texto()
+	if r.erro != nil {
+		return nil, 0, r.erro
+	}
+	if !(protocolo == nomeProtocoloMqtt && nivel == nivelProtocoloMqtt) &&
+		!(protocolo == nomeProtocoloMqtt31 && nivel == nivelProtocoloMqtt31) {
+		conn.Write([]byte{pacoteConnack << 4, 2, 0, 1})
+		return nil, 0, fmt.Errorf("protocolo %s nível %d não suportado", protocolo, nivel)
+	}
+	sessaoLimpa := flags&0x02 != 0
+	if clienteID == "" {
+		if !sessaoLimpa {
+			conn.Write([]byte{pacoteConnack << 4, 2, 0, 2})
+			return nil, 0, errors.New("client ID vazio exige clean session")
+		}
+		clienteID = "anonimo_" + gerarIDMensagem()
+	}
+
+	c := &conexaoBroker{
+		conn:       conn,
+		saida:      make(chan []byte, tamanhoBufferSaida),
+		encerrada:  make(chan struct{}),
+		recebidas2: make(map[uint16]bool),
+	}
+	if flags&0x04 != 0 {
+		topico := r.texto()
+		payload := r.binario()
+		c.will = &mensagemBroker{Topico: topico, Payload: payload, QoS: min((flags>>3)&0x03, 1), Retida: flags&0x20 != 0}
+	}
+	var usuario string
+	var senha []byte
+	if flags&0x80 != 0 {
+		usuario = r.texto()
+	}
+	if flags&0x40 != 0 {
+		senha = r.binario()
+	}
+	if r.erro != nil {
+		return nil, 0, r.erro
+	}
+	if b.autenticar != nil {
+		permissoes, erro := b.autenticar(clienteID, usuario, senha)
+		if erro != nil {
+			conn.Write([]byte{pacoteConnack << 4, 2, 0, 5})
+			return nil, 0, fmt.Errorf("%s não autorizado: %v", clienteID, erro)
+		}
+		c.permissoes = permissoes
+		if c.will != nil && !c.podePublicar(c.will.Topico) {
+			c.will = nil
+		}
+	}
+	go c.escrever()
+
+	b.Lock()
+	sessao, existe := b.sessoes[clienteID]
+	if existe && sessao.conexao != nil {
+		// Outro cliente com o mesmo ID: a conexão antiga é encerrada
+		antiga := sessao.conexao
+		sessao.conexao = nil
+		go antiga.fechar()
+	}
+	if !existe || sessaoLimpa {
+		sessao = &sessaoBroker{
+			clienteID:   clienteID,
+			assinaturas: make(map[string]byte),
+			emVoo:       make(map[uint16]mensagemBroker),
+		}
+		b.sessoes[clienteID] = sessao
+		existe = false
+	}
+	sessao.persistente = !sessaoLimpa
+	sessao.conexao = c
+	c.sessao = sessao
+
+	sessaoPresente := byte(0)
+	if existe {
+		sessaoPresente = 1
+	}
+	c.enviar([]byte{pacoteConnack << 4, 2, sessaoPresente, 0})
+
+	// Retoma a sessão: reenvia as mensagens sem PUBACK (com DUP) e depois a fila offline
+	ids := make([]int, 0, len(sessao.emVoo))
+	for id := range sessao.emVoo {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		c.enviar(codificarPublish(sessao.emVoo[uint16(id)], uint16(id), true))
+	}
+	fila := sessao.fila
+	sessao.fila = nil
+	for _, mensagem := range fila {
+		b.entregar(sessao, mensagem)
+	}
+	b.Unlock()
+
+	if len(ids)+len(fila) > 0 {
+		logBroker.Info("cliente reconectado", "cliente", clienteID, "reenviadas", len(ids), "fila_offline", len(fila))
+	}
+	return c, keepAlive, nil
+}
+
+// Libera a conexão; sessões não persistentes são descartadas e o last will é publicado em quedas
+func (b *BrokerMqtt) desconectar(c *conexaoBroker, limpa bool) {
+	c.fechar()
+	b.Lock()
+	sessao := c.sessao
+	if sessao.conexao == c {
+		sessao.conexao = nil
+		if !sessao.persistente {
+			delete(b.sessoes, sessao.clienteID)
+		}
+	}
+	if !limpa && c.will != nil {
+		b.publicar(*c.will)
+	}
+	b.Unlock()
+}
+
+// Trata um pacote recebido de um cliente conectado
+func (b *BrokerMqtt) tratarPacote(c *conexaoBroker, tipo, flags byte, corpo []byte) error {
+	r := &leitorPacote{dados: corpo}
+	switch tipo {
+	case pacotePublish:
+		qos := (flags >> 1) & 0x03
+		if qos > 2 {
+			return errPacoteInvalido
+		}
+		mensagem := mensagemBroker{Topico: r.texto(), QoS: min(qos, 1), Retida: flags&0x01 != 0}
+		var id uint16
+		if qos > 0 {
+			id = r.uint16()
+		}
+		if r.erro != nil || mensagem.Topico == "" || strings.ContainsAny(mensagem.Topico, "+#") {
+			return errPacoteInvalido
+		}
+		mensagem.Payload = r.resto()
+
+		if !c.podePublicar(mensagem.Topico) || !c.dentroDaTaxa() {
+			// Confirma para o cliente não retransmitir, mas não repassa
+			logBroker.Warn("publicação negada", "cliente", c.sessao.clienteID, "topico", mensagem.Topico)
+			switch qos {
+			case 1:
+				c.enviar(pacoteComID(pacotePuback<<4, id))
+			case 2:
+				c.enviar(pacoteComID(pacotePubrec<<4, id))
+			}
+			return nil
+		}
+		switch qos {
+		case 1:
+			c.enviar(pacoteComID(pacotePuback<<4, id))
+		case 2:
+			// Entrega apenas na primeira recepção do ID; retransmissões só repetem o PUBREC
+			c.enviar(pacoteComID(pacotePubrec<<4, id))
+			b.Lock()
+			duplicada := c.recebidas2[id]
+			c.recebidas2[id] = true
+			b.Unlock()
+			if duplicada {
+				return nil
+			}
+		}
+		b.Lock()
+		b.publicar(mensagem)
+		b.Unlock()
+
+	case pacotePuback:
+		id := r.uint16()
+		b.Lock()
+		delete(c.sessao.emVoo, id)
+		b.Unlock()
+
+	case pacotePubrel:
+		id := r.uint16()
+		b.Lock()
+		delete(c.recebidas2, id)
+		b.Unlock()
+		c.enviar(pacoteComID(pacotePubcomp<<4, id))
+
+	case pacotePubrec, pacotePubcomp:
+		// O broker nunca entrega com QoS 2
+
+	case pacoteSubscribe:
+		id := r.uint16()
+		concedidas := make(map[string]byte)
+		var filtros []string
+		var codigos []byte
+		for r.erro == nil && r.restante() > 0 {
+			filtro := r.texto()
+			qos := r.byte()
+			if r.erro != nil {
+				break
+			}
+			if !filtroValido(filtro) || qos > 2 {
+				codigos = append(codigos, 0x80)
+				continue
+			}
+			if !c.podeAssinar(filtro) {
+				logBroker.Warn("assinatura negada", "cliente", c.sessao.clienteID, "topico", filtro)
+				codigos = append(codigos, 0x80)
+				continue
+			}
+			filtros = append(filtros, filtro)
+			concedidas[filtro] = min(qos, 1)
+			codigos = append(codigos, min(qos, 1))
+		}
+		if r.erro != nil || len(codigos) == 0 {
+			return errPacoteInvalido
+		}
+		b.Lock()
+		for filtro, qos := range concedidas {
+			c.sessao.assinaturas[filtro] = qos
+		}
+		suback := append(pacoteComID(pacoteSuback<<4, id), codigos...)
+		suback[1] = byte(2 + len(codigos))
+		c.enviar(suback)
+		// Mensagens retidas dos novos filtros
+		for _, filtro := range filtros {
+			for _, retida := range b.retidas {
+				if topicoCorresponde(filtro, retida.Topico) {
+					b.entregarComQoS(c.sessao, retida, min(retida.QoS, c.sessao.assinaturas[filtro]), true)
+				}
+			}
+		}
+		b.Unlock()
+
+	case pacoteUnsubscribe:
+		id := r.uint16()
+		b.Lock()
+		for r.erro == nil && r.restante() > 0 {
+			filtro := r.texto()
+			if r.erro == nil {
+				delete(c.sessao.assinaturas, filtro)
+			}
+		}
+		b.Unlock()
+		if r.erro != nil {
+			return errPacoteInvalido
+		}
+		c.enviar(pacoteComID(pacoteUnsuback<<4, id))
+
+	case pacotePingreq:
+		c.enviar([]byte{pacotePingresp << 4, 0})
+
+	default:
+		return fmt.Errorf("pacote inesperado do tipo %d", tipo)
+	}
+	return r.erro
+}
+
+// Roteia uma mensagem para as sessões assinantes e atualiza as retidas; deve ser chamada com b travado
+func (b *BrokerMqtt) publicar(mensagem mensagemBroker) {
+	if mensagem.Retida {
+		if len(mensagem.Payload) == 0 {
+			delete(b.retidas, mensagem.Topico)
+		} else {
+			b.retidas[mensagem.Topico] = mensagem
+		}
+	}
+	// Retain só é repassado na entrega de mensagens retidas a novas assinaturas
+	mensagem.Retida = false
+	for _, sessao := range b.sessoes {
+		b.entregar(sessao, mensagem)
+	}
+}
+
+// Entrega a mensagem à sessão se algum filtro dela corresponder, com a maior QoS concedida
+func (b *BrokerMqtt) entregar(sessao *sessaoBroker, mensagem mensagemBroker) {
+	qos, assinado := byte(0), false
+	for filtro, qosFiltro := range sessao.assinaturas {
+		if topicoCorresponde(filtro, mensagem.Topico) {
+			assinado = true
+			qos = max(qos, qosFiltro)
+		}
+	}
+	if assinado {
+		b.entregarComQoS(sessao, mensagem, min(mensagem.QoS, qos), false)
+	}
+}
+
+// Envia a mensagem se o cliente estiver conectado; QoS 1 para sessão persistente offline vai para a fila
+func (b *BrokerMqtt) entregarComQoS(sessao *sessaoBroker, mensagem mensagemBroker, qos byte, retida bool) {
+	mensagem.QoS = qos
+	mensagem.Retida = retida
+	if sessao.conexao == nil {
+		if qos > 0 && sessao.persistente {
+			if len(sessao.fila) >= tamanhoMaximoFila {
+				sessao.fila = sessao.fila[1:]
+			}
+			sessao.fila = append(sessao.fila, mensagem)
+		}
+		return
+	}
+	var id uint16
+	if qos > 0 {
+		for {
+			sessao.proximoID++
+			if sessao.proximoID == 0 {
+				continue
+			}
+			if _, ocupado := sessao.emVoo[sessao.proximoID]; !ocupado {
+				break
+			}
+		}
+		id = sessao.proximoID
+		sessao.emVoo[id] = mensagem
+	}
+	sessao.conexao.enviar(codificarPublish(mensagem, id, false))
+}
+
+// Enfileira um pacote para envio; um cliente lento demais para esvaziar o buffer é desconectado
+// (mensagens QoS 1 em voo são reenviadas quando ele voltar)
+func (c *conexaoBroker) enviar(pacote []byte) {
+	select {
+	case <-c.encerrada:
+	case c.saida <- pacote:
+	default:
+		logBroker.Warn("cliente não está consumindo as mensagens; desconectando", "cliente", c.sessao.clienteID)
+		go c.fechar()
+	}
+}
+
+// Escreve os pacotes enfileirados na conexão
+func (c *conexaoBroker) escrever() {
+	for {
+		select {
+		case <-c.encerrada:
+			return
+		case pacote := <-c.saida:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, erro := c.conn.Write(pacote); erro != nil {
+				c.fechar()
+				return
+			}
+		}
+	}
+}
+
+func (c *conexaoBroker) fechar() {
+	c.fecharUma.Do(func() {
+		close(c.encerrada)
+		c.conn.Close()
+	})
+}
+
+// Verifica a ACL de publicação do cliente
+func (c *conexaoBroker) podePublicar(topico string) bool {
+	if c.permissoes == nil {
+		return true
+	}
+	for _, permitido := range c.permissoes.publicar {
+		if topicoCorresponde(permitido, topico) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifica o limite de publicações do cliente; sem autenticação, vale para os client IDs de veículos
+func (c *conexaoBroker) dentroDaTaxa() bool {
+	limitado := strings.HasPrefix(c.sessao.clienteID, "veiculo_")
+	if c.permissoes != nil {
+		limitado = c.permissoes.limitarTaxa
+	}
+	return !limitado || permitirPublicacaoCliente(c.sessao.clienteID)
+}
+
+// Verifica a ACL de assinatura: o filtro pedido deve estar contido em um filtro permitido
+func (c *conexaoBroker) podeAssinar(filtro string) bool {
+	if c.permissoes == nil {
+		return true
+	}
+	for _, permitido := range c.permissoes.assinar {
+		if filtroContido(permitido, filtro) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifica se todo tópico que casa com filtro também casa com permitido
+func filtroContido(permitido, filtro string) bool {
+	niveisPermitidos := strings.Split(permitido, "/")
+	niveisFiltro := strings.Split(filtro, "/")
+	for i, nivel := range niveisPermitidos {
+		if nivel == "#" {
+			return true
+		}
+		if i >= len(niveisFiltro) || niveisFiltro[i] == "#" {
+			return false
+		}
+		if nivel != "+" && (niveisFiltro[i] == "+" || nivel != niveisFiltro[i]) {
+			return false
+		}
+	}
+	return len(niveisPermitidos) == len(niveisFiltro)
+}
+
+// Verifica se o tópico corresponde ao filtro (+ casa um nível, # casa o restante)
+// Tópicos iniciados por $ não casam com curingas no primeiro nível
+func topicoCorresponde(filtro, topico string) bool {
+	if strings.HasPrefix(topico, "$") && (strings.HasPrefix(filtro, "+") || strings.HasPrefix(filtro, "#")) {
+		return false
+	}
+	niveisFiltro := strings.Split(filtro, "/")
+	niveisTopico := strings.Split(topico, "/")
+	for i, nivel := range niveisFiltro {
+		if nivel == "#" {
+			return true
+		}
+		if i >= len(niveisTopico) {
+			return false
+		}
+		if nivel != "+" && nivel != niveisTopico[i] {
+			return false
+		}
+	}
+	return len(niveisFiltro) == len(niveisTopico)
+}
+
+// Valida o posicionamento dos curingas em um filtro de assinatura
+func filtroValido(filtro string) bool {
+	if filtro == "" {
+		return false
+	}
+	niveis := strings.Split(filtro, "/")
+	for i, nivel := range niveis {
+		if strings.Contains(nivel, "#") && (nivel != "#" || i != len(niveis)-1) {
+			return false
+		}
+		if strings.Contains(nivel, "+") && nivel != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// Lê um pacote: tipo, flags do cabeçalho fixo e corpo
+func lerPacote(leitor *bufio.Reader) (byte, byte, []byte, error) {
+	cabecalho, erro := leitor.ReadByte()
+	if erro != nil {
+		return 0, 0, nil, erro
+	}
+	tamanho, multiplicador := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errPacoteInvalido
+		}
+		digito, erro := leitor.ReadByte()
+		if erro != nil {
+			return 0, 0, nil, erro
+		}
+		tamanho += int(digito&0x7f) * multiplicador
+		if digito&0x80 == 0 {
+			break
+		}
+		multiplicador *= 128
+	}
+	if tamanho > tamanhoMaximoPacote {
+		return 0, 0, nil, fmt.Errorf("pacote de %d bytes excede o limite", tamanho)
+	}
+	corpo := make([]byte, tamanho)
+	if _, erro := io.ReadFull(leitor, corpo); erro != nil {
+		return 0, 0, nil, erro
+	}
+	return cabecalho >> 4, cabecalho & 0x0f, corpo, nil
+}
+
+// Monta um PUBLISH com cabeçalho fixo e tamanho restante
+func codificarPublish(mensagem mensagemBroker, id uint16, duplicada bool) []byte {
+	cabecalho := byte(pacotePublish<<4) | mensagem.QoS<<1
+	if duplicada {
+		cabecalho |= 0x08
+	}
+	if mensagem.Retida {
+		cabecalho |= 0x01
+	}
+	corpo := make([]byte, 0, 2+len(mensagem.Topico)+2+len(mensagem.Payload))
+	corpo = binary.BigEndian.AppendUint16(corpo, uint16(len(mensagem.Topico)))
+	corpo = append(corpo, mensagem.Topico...)
+	if mensagem.QoS > 0 {
+		corpo = binary.BigEndian.AppendUint16(corpo, id)
+	}
+	corpo = append(corpo, mensagem.Payload...)
+
+	pacote := []byte{cabecalho}
+	tamanho := len(corpo)
+	for {
+		digito := byte(tamanho % 128)
+		tamanho /= 128
+		if tamanho > 0 {
+			digito |= 0x80
+		}
+		pacote = append(pacote, digito)
+		if tamanho == 0 {
+			break
+		}
+	}
+	return append(pacote, corpo...)
+}
+
+// Pacote de 4 bytes com apenas o identificador (PUBACK, PUBREC, PUBCOMP, UNSUBACK)
+func pacoteComID(cabecalho byte, id uint16) []byte {
+	return []byte{cabecalho, 2, byte(id >> 8), byte(id)}
+}
+
+// Leitura sequencial dos campos de um pacote; o primeiro erro é guardado e os campos seguintes vêm vazios
+type leitorPacote struct {
+	dados []byte
+	pos   int
+	erro  error
+}
+
+func (r *leitorPacote) restante() int {
+	return len(r.dados) - r.pos
+}
+
+func (r *leitorPacote) byte() byte {
+	if r.erro != nil || r.restante() < 1 {
+		r.erro = errPacoteInvalido
+		return 0
+	}
+	r.pos++
+	return r.dados[r.pos-1]
+}
+
+func (r *leitorPacote) uint16() uint16 {
+	if r.erro != nil || r.restante() < 2 {
+		r.erro = errPacoteInvalido
+		return 0
+	}
+	r.pos += 2
+	return binary.BigEndian.Uint16(r.dados[r.pos-2:])
+}
+
+func (r *leitorPacote) binario() []byte {
+	tamanho := int(r.uint16())
+	if r.erro != nil || r.restante() < tamanho {
+		r.erro = errPacoteInvalido
+		return nil
+	}
+	r.pos += tamanho
+	return r.dados[r.pos-tamanho : r.pos]
+}
+
+func (r *leitorPacote) texto() string {
+	return string(r.binario())
+}
+
+func (r *leitorPacote) resto() []byte {
+	dados := append([]byte(nil), r.dados[r.pos:]...)
+	r.pos = len(r.dados)
+	return dados
+}
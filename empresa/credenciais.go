@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Credenciais do broker MQTT
+// Com a autenticação do broker embutido ativa, todo cliente conecta com usuário = identidade e
+// senha = token assinado. Empresas assinam o próprio token com a chave da empresa (usuário
+// empresa_<id>), estações com a chave do medidor (usuário estacao_<id>) e veículos recebem o token
+// de uma empresa em POST /api/veiculos/credencial (usuário = placa), autenticando-se com um segredo
+// registrado no primeiro acesso e replicado entre as empresas (segredos_veiculos.go).
+// Token: base64url do JSON da credencial + "." + assinatura RSA (hex) do primeiro trecho.
+// As permissões de cada papel ficam em permissoesDoPapel.
+
+// Declarações do token
+type CredencialMqtt struct {
+	Papel   string `json:"papel"`             // empresa, estacao ou veiculo
+	Sujeito string `json:"sujeito"`           // ID da empresa/estação ou placa
+	Emissor string `json:"emissor"`           // quem assinou (empresa ou a própria estação)
+	Expira  int64  `json:"expira"`            // unix
+	Segredo string `json:"segredo,omitempty"` // veículos: impressão do segredo registrado da placa
+}
+
+// Requisição e resposta de POST /api/veiculos/credencial
+type CredencialRequest struct {
+	Placa   string `json:"placa"`
+	Segredo string `json:"segredo"`
+}
+
+type CredencialResponse struct {
+	Usuario  string `json:"usuario"`
+	Token    string `json:"token"`
+	Emissor  string `json:"emissor"`
+	ExpiraEm string `json:"expira_em"`
+}
+
+// Filtros de tópico que um cliente autenticado pode publicar e assinar
+type permissoesMqtt struct {
+	publicar    []string
+	assinar     []string
+	limitarTaxa bool // publicações sujeitas ao limite por client ID (limites.go)
+}
+
+const tamanhoMinimoSegredo = 16
+
+var validadeCredencial = lerValidadeCredencial()
+
+// Validade dos tokens (CREDENCIAL_VALIDADE_MINUTOS; padrão 60)
+func lerValidadeCredencial() time.Duration {
+	if valor := os.Getenv("CREDENCIAL_VALIDADE_MINUTOS"); valor != "" {
+		if minutos, erro := strconv.Atoi(valor); erro == nil && minutos > 0 {
+			return time.Duration(minutos) * time.Minute
+		}
+	}
+	return time.Hour
+}
+
+// Assina uma credencial com a chave desta empresa; segredo é a impressão do segredo registrado
+// da placa (só em credenciais de veículo)
+func emitirCredencial(papel, sujeito, segredo string) (string, time.Time, error) {
+	expira := time.Now().Add(validadeCredencial)
+	credencial := CredencialMqtt{Papel: papel, Sujeito: sujeito, Emissor: empresa.ID, Expira: expira.Unix(), Segredo: segredo}
+	dados, erro := json.Marshal(credencial)
+	if erro != nil {
+		return "", expira, erro
+	}
+	corpo := base64.RawURLEncoding.EncodeToString(dados)
+	assinatura, erro := AssinarBloco(corpo, chave_privada_path)
+	if erro != nil {
+		return "", expira, erro
+	}
+	return corpo + "." + assinatura, expira, nil
+}
+
+// Valida assinatura e validade de um token e retorna a credencial
+func verificarCredencial(token string) (CredencialMqtt, error) {
+	var credencial CredencialMqtt
+	corpo, assinatura, ok := strings.Cut(token, ".")
+	if !ok {
+		return credencial, errors.New("token malformado")
+	}
+	dados, erro := base64.RawURLEncoding.DecodeString(corpo)
+	if erro != nil {
+		return credencial, errors.New("token malformado")
+	}
+	if erro := json.Unmarshal(dados, &credencial); erro != nil {
+		return credencial, errors.New("token malformado")
+	}
+	if !identificadorValido(credencial.Emissor) {
+		return credencial, errors.New("emissor inválido")
+	}
+
+	var chave_publica string
+	switch credencial.Papel {
+	case "empresa":
+		if credencial.Sujeito != credencial.Emissor {
+			return credencial, errors.New("empresa só pode assinar a própria credencial")
+		}
+		chave_publica = "data/empresa_" + credencial.Emissor + "_public.pem"
+	case "estacao":
+		if credencial.Sujeito != credencial.Emissor {
+			return credencial, errors.New("estação só pode assinar a própria credencial")
+		}
+		chave_publica = "data/estacao_" + credencial.Emissor + "_public.pem"
+	case "veiculo":
+		chave_publica = "data/empresa_" + credencial.Emissor + "_public.pem"
+	default:
+		return credencial, fmt.Errorf("papel desconhecido: %s", credencial.Papel)
+	}
+	if !ValidarAssinatura(corpo, assinatura, chave_publica) {
+		return credencial, errors.New("assinatura inválida")
+	}
+	if time.Now().Unix() > credencial.Expira {
+		return credencial, errors.New("token expirado")
+	}
+	// Um token de veículo só vale se foi emitido contra o segredo que prevalece para a placa,
+	// qualquer que seja a empresa emissora
+	if credencial.Papel == "veiculo" {
+		registro, existe := segredoDaPlaca(context.Background(), credencial.Sujeito)
+		if !existe || subtle.ConstantTimeCompare([]byte(credencial.Segredo), []byte(impressaoSegredo(registro.Hash))) != 1 {
+			return credencial, errors.New("token não corresponde ao segredo registrado da placa")
+		}
+	}
+	return credencial, nil
+}
+
+// IDs de empresa/estação entram em caminhos de arquivo: apenas letras e dígitos
+func identificadorValido(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Placas viram níveis de tópico: sem separadores nem curingas
+// Os prefixos empresa_ e estacao_ ficam reservados aos usuários desses papéis no broker
+func placaValida(placa string) bool {
+	return placa != "" && len(placa) <= 16 && !strings.ContainsAny(placa, "/+#$ \t\n") &&
+		!strings.HasPrefix(placa, "empresa_") && !strings.HasPrefix(placa, "estacao_")
+}
+
+// Autentica um CONNECT no broker embutido e devolve as permissões do cliente
+func autenticarClienteMqtt(clienteID, usuario string, senha []byte) (*permissoesMqtt, error) {
+	if usuario == "" || len(senha) == 0 {
+		return nil, errors.New("credenciais ausentes")
+	}
+	credencial, erro := verificarCredencial(string(senha))
+	if erro != nil {
+		return nil, erro
+	}
+	switch credencial.Papel {
+	case "empresa", "estacao":
+		if usuario != credencial.Papel+"_"+credencial.Sujeito {
+			return nil, errors.New("usuário não corresponde à credencial")
+		}
+	case "veiculo":
+		if usuario != credencial.Sujeito || clienteID != "veiculo_"+credencial.Sujeito {
+			return nil, errors.New("usuário ou client ID não corresponde à credencial")
+		}
+	}
+	return permissoesDoPapel(credencial), nil
+}
+
+// ACL por papel:
+//   - empresas publicam e assinam qualquer tópico
+//   - estações publicam apenas eventos dos próprios pontos e erros para as empresas, e assinam
+//     apenas os comandos dos próprios pontos
+//   - veículos publicam apenas em mensagens/requisicao/<placa> e leem apenas o próprio tópico,
+//     os próprios erros e os avisos gerais
+func permissoesDoPapel(credencial CredencialMqtt) *permissoesMqtt {
+	switch credencial.Papel {
+	case "empresa":
+		return &permissoesMqtt{publicar: []string{"#"}, assinar: []string{"#"}}
+	case "estacao":
+		permissoes := &permissoesMqtt{assinar: []string{"mensagens/erro/estacao_" + credencial.Sujeito}}
+		for _, ponto := range pontosDaEmpresa(credencial.Sujeito) {
+			for _, evento := range []string{"heartbeat", "falha", "medicao", "sessao", "leitura"} {
+				permissoes.publicar = append(permissoes.publicar, "pontos/"+ponto+"/"+evento)
+			}
+			permissoes.assinar = append(permissoes.assinar, "pontos/"+ponto+"/comando")
+		}
+		for id := range empresasAPI {
+			permissoes.publicar = append(permissoes.publicar, "mensagens/erro/empresa_"+id)
+		}
+		return permissoes
+	default:
+		placa := credencial.Sujeito
+		return &permissoesMqtt{
+			limitarTaxa: true,
+			publicar:    []string{"mensagens/requisicao/" + placa},
+			assinar: []string{
+				"mensagens/cliente/" + placa,
+				"mensagens/cliente/" + placa + "/#",
+				"mensagens/erro/" + placa,
+				"mensagens/geral",
+			},
+		}
+	}
+}
+
+// Pontos cadastrados de uma empresa (data/empresa_<id>.json)
+func pontosDaEmpresa(id string) []string {
+	if id == empresa.ID {
+		return empresa.Pontos
+	}
+	var outra Empresa
+	file, erro := os.ReadFile("data/empresa_" + id + ".json")
+	if erro != nil {
+		return nil
+	}
+	if erro := json.Unmarshal(file, &outra); erro != nil {
+		return nil
+	}
+	return outra.Pontos
+}
+
+// Emite a credencial MQTT de um veículo autenticado pelo segredo
+func handleCredencialVeiculo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	var req CredencialRequest
+	if erro := json.NewDecoder(r.Body).Decode(&req); erro != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	if !placaValida(req.Placa) {
+		http.Error(w, "Placa inválida", http.StatusBadRequest)
+		return
+	}
+	if len(req.Segredo) < tamanhoMinimoSegredo {
+		http.Error(w, "Segredo muito curto", http.StatusBadRequest)
+		return
+	}
+	registro, erro := autenticarVeiculo(r.Context(), req.Placa, req.Segredo)
+	if erro != nil {
+		logCredencial.WarnContext(r.Context(), "credencial negada", "placa", req.Placa, "erro", erro)
+		http.Error(w, "Não autorizado", http.StatusUnauthorized)
+		return
+	}
+	token, expira, erro := emitirCredencial("veiculo", req.Placa, impressaoSegredo(registro.Hash))
+	if erro != nil {
+		http.Error(w, "Erro ao emitir credencial", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CredencialResponse{
+		Usuario:  req.Placa,
+		Token:    token,
+		Emissor:  empresa.ID,
+		ExpiraEm: expira.Format(time.RFC3339),
+	})
+}
+
+// Usuário e token desta empresa para o broker (um token novo a cada conexão)
+func credencialPropriaMqtt() (string, string) {
+	token, _, erro := emitirCredencial("empresa", empresa.ID, "")
+	if erro != nil {
+		logCredencial.Error("erro ao assinar credencial MQTT", "erro", erro)
+	}
+	return "empresa_" + empresa.ID, token
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Encerramento gracioso da empresa
+// Com SIGTERM (ou Ctrl+C), dentro do prazo PRAZO_ENCERRAMENTO_SEGUNDOS (padrão 20), a empresa:
+//  1. para de aceitar requisições: o servidor HTTP fecha a porta e espera as requisições em
+//     andamento (os streams de /api/eventos são encerrados), e as mensagens MQTT recebidas a
+//     partir daí são descartadas enquanto as que estão sendo tratadas são aguardadas;
+//  2. processa os blocos de outras empresas que estão na fila (processar_transacoes);
+//  3. fecha o pipeline de escrita depois de gravar os pedidos já feitos; pedidos novos recebem
+//     errEscritaEncerrada;
+//  4. espera as filas de replicação esvaziarem (uma empresa fora do ar segura a espera até o
+//     prazo; ela recebe os blocos pela sincronização quando voltar);
+//  5. grava os índices e os spans pendentes, publica "offline" em empresas/<id>/status e se
+//     desconecta do broker.
+// As etapas que não terminam no prazo são abandonadas com um aviso no log, mas a gravação do
+// estado (etapa 5) sempre é feita. Prazos de reserva ainda não vencidos não são esperados:
+// recuperarReservas os refaz na próxima inicialização.
+
+const prazoEncerramentoPadrao = 20 * time.Second
+
+var encerramento = struct {
+	iniciado        chan struct{} // fechado quando o encerramento começa
+	escritaFechada  atomic.Bool
+	mensagensMqtt   emAndamento // mensagens MQTT sendo tratadas
+	escritas        emAndamento // pedidos de escrita na fila ou sendo gravados
+	blocosRecebidos emAndamento // blocos de outras empresas na fila ou sendo processados
+	liberacoes      emAndamento // liberações de reservas expiradas em andamento
+}{iniciado: make(chan struct{})}
+
+// Contador de trabalho em andamento, aguardado no encerramento
+type emAndamento struct {
+	atomic.Int64
+}
+
+func (e *emAndamento) iniciar()  { e.Add(1) }
+func (e *emAndamento) concluir() { e.Add(-1) }
+
+// Espera o contador chegar a zero ou o prazo de ctx acabar
+func (e *emAndamento) aguardar(ctx context.Context) error {
+	for e.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// Indica se o encerramento já começou
+func encerrando() bool {
+	select {
+	case <-encerramento.iniciado:
+		return true
+	default:
+		return false
+	}
+}
+
+// Envolve um handler MQTT: descarta as mensagens depois do início do encerramento e conta as
+// que estão sendo tratadas
+func enquantoAtivo(handler mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		encerramento.mensagensMqtt.iniciar()
+		defer encerramento.mensagensMqtt.concluir()
+		if encerrando() {
+			logMQTT.Debug("mensagem descartada: empresa em encerramento", "topico", msg.Topic())
+			return
+		}
+		handler(client, msg)
+	}
+}
+
+// Prazo configurado em PRAZO_ENCERRAMENTO_SEGUNDOS
+func prazoEncerramento() time.Duration {
+	if segundos, erro := strconv.Atoi(os.Getenv("PRAZO_ENCERRAMENTO_SEGUNDOS")); erro == nil && segundos > 0 {
+		return time.Duration(segundos) * time.Second
+	}
+	return prazoEncerramentoPadrao
+}
+
+// Espera SIGTERM/SIGINT e encerra o processo depois das etapas do encerramento
+func aguardarEncerramento(servidor *http.Server) {
+	sinais := make(chan os.Signal, 1)
+	signal.Notify(sinais, syscall.SIGTERM, os.Interrupt)
+	sinal := <-sinais
+	signal.Stop(sinais)
+
+	prazo := prazoEncerramento()
+	logGeral.Info("encerrando", "sinal", sinal.String(), "prazo", prazo.String())
+	inicio := time.Now()
+	ctx, cancelar := context.WithTimeout(context.Background(), prazo)
+	defer cancelar()
+	close(encerramento.iniciado)
+
+	// 1. Requisições HTTP e mensagens MQTT em andamento
+	if erro := servidor.Shutdown(ctx); erro != nil {
+		logGeral.Warn("requisições HTTP ainda em andamento no fim do prazo", "erro", erro)
+	}
+	if erro := encerramento.mensagensMqtt.aguardar(ctx); erro != nil {
+		logGeral.Warn("mensagens MQTT ainda em processamento no fim do prazo", "mensagens", encerramento.mensagensMqtt.Load())
+	}
+
+	// 2. Blocos recebidos de outras empresas
+	if erro := encerramento.blocosRecebidos.aguardar(ctx); erro != nil {
+		logGeral.Warn("blocos recebidos não processados no fim do prazo", "blocos", encerramento.blocosRecebidos.Load())
+	}
+
+	// 3. Pipeline de escrita (depois das liberações de reservas, que gravam o controle dos pontos)
+	if erro := encerramento.liberacoes.aguardar(ctx); erro != nil {
+		logGeral.Warn("liberações de reserva em andamento no fim do prazo", "liberacoes", encerramento.liberacoes.Load())
+	}
+	encerramento.escritaFechada.Store(true)
+	if erro := encerramento.escritas.aguardar(ctx); erro != nil {
+		logGeral.Warn("pedidos de escrita não gravados no fim do prazo", "pedidos", encerramento.escritas.Load())
+	}
+
+	// 4. Replicação dos blocos já gravados
+	if erro := aguardarReplicacao(ctx); erro != nil {
+		logGeral.Warn("blocos não replicados no fim do prazo; as empresas os recebem na sincronização", "pendentes", blocosAguardandoReplicacao())
+	}
+
+	// 5. Estado, spans e broker
+	if erro := salvarIndices(); erro != nil {
+		logIndices.Error("erro ao salvar índices", "erro", erro)
+	}
+	descarregarSpans()
+	publicarStatusEmpresa("offline", "encerramento")
+	if cliente := getClienteMqtt(); cliente != nil {
+		cliente.Disconnect(250)
+	}
+	logGeral.Info("empresa encerrada", "duracao_ms", time.Since(inicio).Milliseconds())
+	os.Exit(0)
+}
+
+// Espera todas as filas de replicação esvaziarem ou o prazo de ctx acabar
+func aguardarReplicacao(ctx context.Context) error {
+	for {
+		total := 0
+		for _, pendentes := range blocosAguardandoReplicacao() {
+			total += pendentes
+		}
+		if total == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// Publica o status da empresa (online/offline) em empresas/<id>/status, retido
+func publicarStatusEmpresa(status, motivo string) {
+	publicarEnvelope(getClienteMqtt(), topicoStatusEmpresa(), "STATUS", StatusEmpresa{EmpresaID: empresa.ID, Status: status, Motivo: motivo}, true)
+}
+
+func topicoStatusEmpresa() string {
+	return "empresas/" + empresa.ID + "/status"
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Pipeline de escrita dos blocos desta empresa (reservas, recargas, pagamentos e tarifas)
+// Os pedidos entram numa fila atendida por um único escritor, que retira de uma vez todos os
+// pedidos que estiverem esperando (até tamanhoMaximoLote) e:
+//  1. sequencia os blocos do lote a partir do último bloco publicado, sem lock;
+//  2. assina os blocos em paralelo, fora do mutex (a assinatura não entra no hash);
+//  3. com o mutex, confere se o último bloco ainda é o mesmo (se um bloco de outra empresa
+//     entrou durante a assinatura, o lote é sequenciado de novo) e grava o arquivo uma única
+//     vez para o lote todo (group commit), indexando e publicando os blocos;
+//  4. responde aos pedidos e entrega os blocos à replicação assíncrona (replicacao.go).
+// Cada pedido tem um span "escrita" (da entrada na fila até a resposta), com os filhos
+// "assinatura" e "gravacao"; a gravação, comum ao lote, aparece no trace de cada pedido.
+// O mutex fica preso só pela conferência e pela gravação; a rede não entra no caminho da escrita.
+
+const (
+	tamanhoMaximoLote  = 64
+	tamanhoFilaEscrita = 1024
+)
+
+var (
+	errGravacaoBloco    = errors.New("falha ao gravar bloco")
+	errEscritaEncerrada = fmt.Errorf("%w: empresa em encerramento", errGravacaoBloco)
+	errBlocoDuplicado   = fmt.Errorf("%w: bloco duplicado", errGravacaoBloco)
+	errBlocoRecusado    = fmt.Errorf("%w: bloco recusado na validação", errGravacaoBloco)
+)
+
+// Converte erro do pipeline de escrita no status HTTP correspondente
+func statusErroEscrita(erro error) int {
+	switch {
+	case errors.Is(erro, errBlocoDuplicado):
+		return http.StatusConflict
+	case errors.Is(erro, errBlocoRecusado):
+		return http.StatusPreconditionFailed
+	case errors.Is(erro, errEscritaEncerrada):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type pedidoEscrita struct {
+	ctx        context.Context
+	transacao  Transacao
+	aoReplicar func(bloco Bloco, recusaram []string)
+	resposta   chan resultadoEscrita
+}
+
+type resultadoEscrita struct {
+	bloco Bloco
+	erro  error
+}
+
+var filaEscrita = make(chan pedidoEscrita, tamanhoFilaEscrita)
+
+// Registra uma transação desta empresa na blockchain local e a envia às outras empresas
+// Retorna quando o bloco está gravado, ou com errBlocoDuplicado, errBlocoRecusado, errGravacaoBloco
+// ou errEscritaEncerrada (statusErroEscrita dá o status HTTP); aoReplicar (opcional) é chamada depois que todas as outras
+// empresas responderem ao envio, com as que recusaram o bloco. O ID de requisição e o rastreamento
+// de ctx acompanham o bloco na replicação
+func registrarTransacao(ctx context.Context, transacao Transacao, aoReplicar func(bloco Bloco, recusaram []string)) (Bloco, error) {
+	ctx, span := iniciarSpan(ctx, "escrita", "tipo", transacao.Tipo)
+	defer span.finalizar()
+	encerramento.escritas.iniciar()
+	defer encerramento.escritas.concluir()
+	if encerramento.escritaFechada.Load() {
+		span.falhar(errEscritaEncerrada)
+		return Bloco{}, errEscritaEncerrada
+	}
+	pedido := pedidoEscrita{ctx: context.WithoutCancel(ctx), transacao: transacao, aoReplicar: aoReplicar, resposta: make(chan resultadoEscrita, 1)}
+	filaEscrita <- pedido
+	resultado := <-pedido.resposta
+	span.falhar(resultado.erro)
+	span.definir("index", resultado.bloco.Index, "hash", resultado.bloco.Hash)
+	return resultado.bloco, resultado.erro
+}
+
+// Inicia o escritor de blocos em goroutine
+func iniciarEscritorBlocos() {
+	go func() {
+		for pedido := range filaEscrita {
+			lote := []pedidoEscrita{pedido}
+		coleta:
+			for len(lote) < tamanhoMaximoLote {
+				select {
+				case outro := <-filaEscrita:
+					lote = append(lote, outro)
+				default:
+					break coleta
+				}
+			}
+			gravarLote(lote)
+		}
+	}()
+}
+
+func gravarLote(lote []pedidoEscrita) {
+	for len(lote) > 0 {
+		base := blockchain.Ultimo()
+		blocos := make([]Bloco, len(lote))
+		anterior := base
+		for i, pedido := range lote {
+			blocos[i] = NovoBloco(pedido.transacao, anterior, empresa.ID, "")
+			anterior = blocos[i]
+		}
+
+		// Pedidos cuja assinatura falhou saem do lote; os demais são sequenciados de novo
+		if erros, falhou := assinarBlocos(lote, blocos); falhou {
+			var restantes []pedidoEscrita
+			for i, pedido := range lote {
+				if erro := erros[i]; erro != nil {
+					logEscrita.ErrorContext(pedido.ctx, "erro ao assinar bloco", "tipo", pedido.transacao.Tipo, "placa", pedido.transacao.Placa, "erro", erro)
+					metricaErrosEscrita.Inc("assinatura")
+					pedido.resposta <- resultadoEscrita{erro: fmt.Errorf("%w: %v", errGravacaoBloco, erro)}
+				} else {
+					restantes = append(restantes, pedido)
+				}
+			}
+			lote = restantes
+			continue
+		}
+
+		inicioGravacao := time.Now()
+		mutex.Lock()
+		if blockchain.Ultimo().Hash != base.Hash {
+			mutex.Unlock()
+			logEscrita.Debug("bloco de outra empresa adicionado durante a assinatura; sequenciando o lote de novo", "blocos", len(lote))
+			continue
+		}
+		// Blocos duplicados ou inválidos saem do lote com o erro próprio; os demais são sequenciados de novo
+		if erros, falhou := validarLote(base, blocos); falhou {
+			mutex.Unlock()
+			var restantes []pedidoEscrita
+			for i, pedido := range lote {
+				if erro := erros[i]; erro != nil {
+					logEscrita.WarnContext(pedido.ctx, "bloco recusado", "tipo", pedido.transacao.Tipo, "placa", pedido.transacao.Placa, "erro", erro)
+					metricaErrosEscrita.Inc("validacao")
+					pedido.resposta <- resultadoEscrita{erro: erro}
+				} else {
+					restantes = append(restantes, pedido)
+				}
+			}
+			lote = restantes
+			continue
+		}
+		erro := adicionarBlocos(blocos...)
+		mutex.Unlock()
+		fimGravacao := time.Now()
+		for _, pedido := range lote {
+			registrarSpan(pedido.ctx, "gravacao", inicioGravacao, fimGravacao, erro, "lote", len(lote))
+		}
+
+		if erro != nil {
+			logEscrita.Error("erro ao gravar lote", "blocos", len(lote), "erro", erro)
+			metricaErrosEscrita.Somar(float64(len(lote)), "gravacao")
+			for _, pedido := range lote {
+				pedido.resposta <- resultadoEscrita{erro: fmt.Errorf("%w: %v", errGravacaoBloco, erro)}
+			}
+			return
+		}
+		metricaTamanhoLote.Observar(float64(len(lote)))
+		for i, pedido := range lote {
+			metricaBlocosGravados.Inc(pedido.transacao.Tipo)
+			logEscrita.DebugContext(pedido.ctx, "bloco gravado", "index", blocos[i].Index, "hash", blocos[i].Hash, "tipo", pedido.transacao.Tipo, "lote", len(lote))
+			replicarBloco(pedido.ctx, blocos[i], pedido.aoReplicar)
+			pedido.resposta <- resultadoEscrita{bloco: blocos[i]}
+		}
+		return
+	}
+}
+
+// Confere os blocos do lote como as outras empresas os conferem ao recebê-los; chamada com o mutex
+func validarLote(base Bloco, blocos []Bloco) ([]error, bool) {
+	erros := make([]error, len(blocos))
+	falhou := false
+	anterior := base
+	for i, bloco := range blocos {
+		switch {
+		case blocoDuplicado(bloco):
+			erros[i], falhou = errBlocoDuplicado, true
+		case !ValidarBloco(bloco, anterior):
+			erros[i], falhou = errBlocoRecusado, true
+		}
+		anterior = bloco
+	}
+	return erros, falhou
+}
+
+// Assina os blocos em paralelo (um por pedido do lote); retorna o erro de cada bloco (nil se
+// assinado) e se algum falhou
+func assinarBlocos(lote []pedidoEscrita, blocos []Bloco) ([]error, bool) {
+	erros := make([]error, len(blocos))
+	var grupo sync.WaitGroup
+	for i := range blocos {
+		grupo.Add(1)
+		go func(i int) {
+			defer grupo.Done()
+			_, span := iniciarSpan(lote[i].ctx, "assinatura", "index", blocos[i].Index)
+			blocos[i].Assinatura, erros[i] = AssinarBloco(blocos[i].Hash, chave_privada_path)
+			span.falhar(erros[i])
+			span.finalizar()
+		}(i)
+	}
+	grupo.Wait()
+	for _, erro := range erros {
+		if erro != nil {
+			return erros, true
+		}
+	}
+	return erros, false
+}
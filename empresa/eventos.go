@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stream de eventos (Server-Sent Events) em GET /api/eventos
+// Envia os blocos adicionados à blockchain local (event: bloco, id: índice do bloco), as mudanças
+// de reserva dos pontos desta empresa (event: reserva) e as mudanças de status dos pontos
+// (event: ponto). Filtros por query: placa, ponto e tipo (lista separada por vírgula com tipos
+// de evento, em minúsculas, ou de transação, em maiúsculas; ex.: tipo=RECARGA,ponto). Com
+// Last-Event-ID (ou ?desde=<índice>), os blocos posteriores ao índice são reenviados antes dos
+// eventos ao vivo; reservas e status de pontos não são reenviados.
+
+const (
+	intervaloPingEventos = 15 * time.Second
+	eventosPendentes     = 64 // assinante mais lento que isso é desconectado e retoma pelo Last-Event-ID
+)
+
+// Evento publicado no stream
+type EventoSistema struct {
+	Tipo          string // bloco, reserva ou ponto
+	Indice        int    // índice do bloco (apenas eventos de bloco)
+	Placa         string // vazio em eventos de ponto
+	Ponto         string
+	TipoTransacao string // apenas eventos de bloco
+	Dados         interface{}
+}
+
+// Mudança de reserva em um ponto desta empresa
+type EventoReserva struct {
+	EmpresaID string `json:"empresa_id"`
+	Ponto     string `json:"ponto"`
+	Placa     string `json:"placa"`
+	Status    string `json:"status"` // RESERVADO ou LIBERADO
+	ExpiraEm  string `json:"expira_em,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// Mudança de status de um ponto desta empresa
+type EventoPonto struct {
+	EmpresaID string `json:"empresa_id"`
+	Ponto     string `json:"ponto"`
+	Status    string `json:"status"` // online ou offline
+	Motivo    string `json:"motivo,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// Filtros de um assinante; todos os informados precisam aceitar o evento
+type filtroEventos struct {
+	placa string
+	ponto string
+	tipos map[string]bool
+}
+
+// Assinantes do stream
+var assinantesEventos = struct {
+	sync.Mutex
+	canais map[chan EventoSistema]filtroEventos
+}{canais: make(map[chan EventoSistema]filtroEventos)}
+
+func lerFiltroEventos(r *http.Request) filtroEventos {
+	consulta := r.URL.Query()
+	filtro := filtroEventos{placa: consulta.Get("placa"), ponto: consulta.Get("ponto")}
+	if tipos := consulta.Get("tipo"); tipos != "" {
+		filtro.tipos = make(map[string]bool)
+		for _, tipo := range strings.Split(tipos, ",") {
+			if tipo = strings.TrimSpace(tipo); tipo != "" {
+				filtro.tipos[tipo] = true
+			}
+		}
+	}
+	return filtro
+}
+
+func (f filtroEventos) aceita(evento EventoSistema) bool {
+	if f.placa != "" && evento.Placa != f.placa {
+		return false
+	}
+	if f.ponto != "" && evento.Ponto != f.ponto {
+		return false
+	}
+	if f.tipos != nil && !f.tipos[evento.Tipo] && (evento.TipoTransacao == "" || !f.tipos[evento.TipoTransacao]) {
+		return false
+	}
+	return true
+}
+
+// Entrega o evento aos assinantes interessados sem bloquear quem publica
+func publicarEvento(evento EventoSistema) {
+	assinantesEventos.Lock()
+	defer assinantesEventos.Unlock()
+	for canal, filtro := range assinantesEventos.canais {
+		if !filtro.aceita(evento) {
+			continue
+		}
+		select {
+		case canal <- evento:
+		default:
+			delete(assinantesEventos.canais, canal)
+			close(canal)
+		}
+	}
+}
+
+func eventoBloco(bloco Bloco) EventoSistema {
+	return EventoSistema{
+		Tipo:          "bloco",
+		Indice:        bloco.Index,
+		Placa:         bloco.Transacao.Placa,
+		Ponto:         bloco.Transacao.Ponto,
+		TipoTransacao: bloco.Transacao.Tipo,
+		Dados:         bloco,
+	}
+}
+
+// Publica blocos recém-adicionados à blockchain local
+func anunciarBlocos(blocos ...Bloco) {
+	for _, bloco := range blocos {
+		publicarEvento(eventoBloco(bloco))
+	}
+}
+
+func anunciarReserva(ponto, placa, status, expiraEm string) {
+	publicarEvento(EventoSistema{Tipo: "reserva", Placa: placa, Ponto: ponto, Dados: EventoReserva{
+		EmpresaID: empresa.ID,
+		Ponto:     ponto,
+		Placa:     placa,
+		Status:    status,
+		ExpiraEm:  expiraEm,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}})
+}
+
+func anunciarStatusPonto(ponto, status, motivo string) {
+	publicarEvento(EventoSistema{Tipo: "ponto", Ponto: ponto, Dados: EventoPonto{
+		EmpresaID: empresa.ID,
+		Ponto:     ponto,
+		Status:    status,
+		Motivo:    motivo,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}})
+}
+
+// Escreve um evento no formato SSE; só blocos levam id, para o Last-Event-ID apontar um índice
+func escreverEvento(w http.ResponseWriter, evento EventoSistema) error {
+	dados, erro := json.Marshal(evento.Dados)
+	if erro != nil {
+		return erro
+	}
+	if evento.Tipo == "bloco" {
+		if _, erro := fmt.Fprintf(w, "id: %d\n", evento.Indice); erro != nil {
+			return erro
+		}
+	}
+	_, erro = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evento.Tipo, dados)
+	return erro
+}
+
+// Handler do stream de eventos
+func handleEventos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming não suportado", http.StatusInternalServerError)
+		return
+	}
+
+	// Índice a partir do qual os blocos são reenviados (-1: apenas eventos ao vivo)
+	desde := -1
+	if valor := r.Header.Get("Last-Event-ID"); valor != "" {
+		desde = indiceEvento(valor)
+	} else if valor := r.URL.Query().Get("desde"); valor != "" {
+		desde = indiceEvento(valor)
+	}
+	if desde < -1 {
+		http.Error(w, "Last-Event-ID deve ser o índice de um bloco", http.StatusBadRequest)
+		return
+	}
+
+	filtro := lerFiltroEventos(r)
+	canal := make(chan EventoSistema, eventosPendentes)
+	// Assina antes de ler a blockchain para não perder blocos adicionados durante o reenvio
+	assinantesEventos.Lock()
+	assinantesEventos.canais[canal] = filtro
+	assinantesEventos.Unlock()
+	defer func() {
+		assinantesEventos.Lock()
+		if _, existe := assinantesEventos.canais[canal]; existe {
+			delete(assinantesEventos.canais, canal)
+			close(canal)
+		}
+		assinantesEventos.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: 2000\n\n")
+
+	ultimoIndice := desde
+	if desde >= 0 {
+		for _, bloco := range chainAtual() {
+			if bloco.Index <= desde {
+				continue
+			}
+			evento := eventoBloco(bloco)
+			if filtro.aceita(evento) {
+				if escreverEvento(w, evento) != nil {
+					return
+				}
+			}
+			ultimoIndice = bloco.Index
+		}
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(intervaloPingEventos)
+	defer ping.Stop()
+	for {
+		select {
+		case evento, aberto := <-canal:
+			if !aberto {
+				// Assinante lento: o cliente reconecta e retoma a partir do último id recebido
+				return
+			}
+			if evento.Tipo == "bloco" {
+				if evento.Indice <= ultimoIndice {
+					continue // já enviado no reenvio
+				}
+				ultimoIndice = evento.Indice
+			}
+			if escreverEvento(w, evento) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ping.C:
+			if _, erro := fmt.Fprintf(w, ": ping\n\n"); erro != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-encerramento.iniciado:
+			return
+		}
+	}
+}
+
+// Converte o Last-Event-ID em índice de bloco; -2 se inválido
+func indiceEvento(valor string) int {
+	indice, erro := strconv.Atoi(strings.TrimSpace(valor))
+	if erro != nil || indice < 0 {
+		return -2
+	}
+	return indice
+}
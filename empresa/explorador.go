@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Explorador da blockchain para auditoria e aplicativos
+//   GET /api/blocos?desde=<índice>&limite=<n>        blocos em ordem de índice
+//   GET /api/blocos/{index}                          um bloco
+//   GET /api/transacoes?tipo=&empresa=&ponto=&placa=&de=&ate=&cursor=&limite=
+//   GET /api/transacoes/{hash}                       bloco da transação
+// As listas vêm em ordem crescente de índice, que não muda com novos blocos. O campo
+// "proximo" da resposta é o índice de onde continuar (em desde ou cursor); ausente na
+// última página. As consultas usam os índices de indices.go, sem percorrer a chain.
+
+const (
+	limitePadraoExplorador = 50
+	limiteMaximoExplorador = 500
+)
+
+type PaginaBlocos struct {
+	EmpresaID string  `json:"empresa_id"`
+	Total     int     `json:"total"`
+	Blocos    []Bloco `json:"blocos"`
+	Proximo   *int    `json:"proximo,omitempty"`
+}
+
+type PaginaTransacoes struct {
+	EmpresaID  string  `json:"empresa_id"`
+	Transacoes []Bloco `json:"transacoes"`
+	Proximo    *int    `json:"proximo,omitempty"`
+}
+
+// Filtros de /api/transacoes; os vazios não restringem
+type filtroTransacoes struct {
+	tipo, empresa, ponto, placa string
+	de, ate                     time.Time
+}
+
+func (f filtroTransacoes) aceita(bloco Bloco) bool {
+	if f.tipo != "" && bloco.Transacao.Tipo != f.tipo {
+		return false
+	}
+	if f.empresa != "" && bloco.Transacao.Empresa != f.empresa {
+		return false
+	}
+	if f.ponto != "" && bloco.Transacao.Ponto != f.ponto {
+		return false
+	}
+	if f.placa != "" && bloco.Transacao.Placa != f.placa {
+		return false
+	}
+	if !f.de.IsZero() || !f.ate.IsZero() {
+		instante, ok := instanteBloco(bloco)
+		if !ok || (!f.de.IsZero() && instante.Before(f.de)) || (!f.ate.IsZero() && instante.After(f.ate)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Chain indexada e posições candidatas: a menor lista entre os índices dos filtros informados;
+// todas=true quando não há filtro e qualquer bloco serve
+func (f filtroTransacoes) candidatos() (chain []Bloco, posicoes []int, todas bool) {
+	indicesBlockchain.RLock()
+	defer indicesBlockchain.RUnlock()
+	listas := [][]int{}
+	for _, filtro := range []struct {
+		valor  string
+		indice map[string][]int
+	}{
+		{f.tipo, indicesBlockchain.PorTipo},
+		{f.empresa, indicesBlockchain.PorEmpresa},
+		{f.ponto, indicesBlockchain.PorPonto},
+		{f.placa, indicesBlockchain.PorPlaca},
+	} {
+		if filtro.valor != "" {
+			listas = append(listas, filtro.indice[filtro.valor])
+		}
+	}
+	chain = indicesBlockchain.chain
+
+	if len(listas) == 0 {
+		if f.de.IsZero() && f.ate.IsZero() {
+			return chain, nil, true
+		}
+		return chain, posicoesPorPeriodo(f.de, f.ate), false
+	}
+	menor := listas[0]
+	for _, lista := range listas[1:] {
+		if len(lista) < len(menor) {
+			menor = lista
+		}
+	}
+	return chain, menor, false
+}
+
+// Lê um inteiro não negativo da query; padrao se ausente
+func parametroInteiro(r *http.Request, nome string, padrao int) (int, bool) {
+	valor := r.URL.Query().Get(nome)
+	if valor == "" {
+		return padrao, true
+	}
+	numero, erro := strconv.Atoi(valor)
+	if erro != nil || numero < 0 {
+		return 0, false
+	}
+	return numero, true
+}
+
+func parametroLimite(r *http.Request) (int, bool) {
+	limite, ok := parametroInteiro(r, "limite", limitePadraoExplorador)
+	if !ok || limite == 0 {
+		return 0, false
+	}
+	if limite > limiteMaximoExplorador {
+		limite = limiteMaximoExplorador
+	}
+	return limite, true
+}
+
+// Lê um instante da query: RFC3339 ou data (AAAA-MM-DD); no fim do período, a data vale até 23:59:59
+func parametroInstante(r *http.Request, nome string, fimDoDia bool) (time.Time, bool) {
+	valor := r.URL.Query().Get(nome)
+	if valor == "" {
+		return time.Time{}, true
+	}
+	if instante, erro := time.Parse(time.RFC3339, valor); erro == nil {
+		return instante, true
+	}
+	dia, erro := time.Parse("2006-01-02", valor)
+	if erro != nil {
+		return time.Time{}, false
+	}
+	if fimDoDia {
+		dia = dia.Add(24*time.Hour - time.Second)
+	}
+	return dia, true
+}
+
+func responderJSON(w http.ResponseWriter, dados interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dados)
+}
+
+// GET /api/blocos
+func handleBlocos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	desde, ok := parametroInteiro(r, "desde", 0)
+	if !ok {
+		http.Error(w, "Parâmetro 'desde' deve ser o índice de um bloco", http.StatusBadRequest)
+		return
+	}
+	limite, ok := parametroLimite(r)
+	if !ok {
+		http.Error(w, "Parâmetro 'limite' deve ser um inteiro positivo", http.StatusBadRequest)
+		return
+	}
+
+	chain := chainAtual()
+	pagina := PaginaBlocos{EmpresaID: empresa.ID, Total: len(chain), Blocos: []Bloco{}}
+	if desde < len(chain) {
+		fim := min(desde+limite, len(chain))
+		pagina.Blocos = chain[desde:fim]
+		if fim < len(chain) {
+			pagina.Proximo = &fim
+		}
+	}
+	responderJSON(w, pagina)
+}
+
+// GET /api/blocos/{index}
+func handleBloco(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	indice, erro := strconv.Atoi(r.PathValue("index"))
+	if erro != nil || indice < 0 {
+		http.Error(w, "Índice de bloco inválido", http.StatusBadRequest)
+		return
+	}
+	chain := chainAtual()
+	if indice >= len(chain) {
+		http.Error(w, "Bloco não encontrado", http.StatusNotFound)
+		return
+	}
+	responderJSON(w, chain[indice])
+}
+
+// GET /api/transacoes
+func handleTransacoes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	consulta := r.URL.Query()
+	filtro := filtroTransacoes{
+		tipo:    strings.ToUpper(consulta.Get("tipo")),
+		empresa: consulta.Get("empresa"),
+		ponto:   consulta.Get("ponto"),
+		placa:   consulta.Get("placa"),
+	}
+	var ok bool
+	if filtro.de, ok = parametroInstante(r, "de", false); !ok {
+		http.Error(w, "Parâmetro 'de' deve ser RFC3339 ou AAAA-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if filtro.ate, ok = parametroInstante(r, "ate", true); !ok {
+		http.Error(w, "Parâmetro 'ate' deve ser RFC3339 ou AAAA-MM-DD", http.StatusBadRequest)
+		return
+	}
+	cursor, ok := parametroInteiro(r, "cursor", 0)
+	if !ok {
+		http.Error(w, "Parâmetro 'cursor' inválido", http.StatusBadRequest)
+		return
+	}
+	limite, ok := parametroLimite(r)
+	if !ok {
+		http.Error(w, "Parâmetro 'limite' deve ser um inteiro positivo", http.StatusBadRequest)
+		return
+	}
+
+	chain, posicoes, todas := filtro.candidatos()
+	pagina := PaginaTransacoes{EmpresaID: empresa.ID, Transacoes: []Bloco{}}
+	// Acrescenta o bloco da posição se passar nos filtros; retorna false quando a página encheu
+	acrescentar := func(posicao int) bool {
+		if !filtro.aceita(chain[posicao]) {
+			return true
+		}
+		if len(pagina.Transacoes) == limite {
+			pagina.Proximo = &posicao
+			return false
+		}
+		pagina.Transacoes = append(pagina.Transacoes, chain[posicao])
+		return true
+	}
+
+	if todas {
+		for posicao := cursor; posicao < len(chain); posicao++ {
+			if !acrescentar(posicao) {
+				break
+			}
+		}
+	} else {
+		inicio := sort.SearchInts(posicoes, cursor)
+		for _, posicao := range posicoes[inicio:] {
+			if !acrescentar(posicao) {
+				break
+			}
+		}
+	}
+	responderJSON(w, pagina)
+}
+
+// GET /api/transacoes/{hash}
+func handleTransacao(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	bloco, existe := blocoPorHash(r.PathValue("hash"))
+	if !existe {
+		http.Error(w, "Transação não encontrada", http.StatusNotFound)
+		return
+	}
+	responderJSON(w, bloco)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"persistencia"
+)
+
+// Índices da blockchain local, usados pelas consultas (explorador, histórico, verificação de hash,
+// detecção de bloco duplicado e recargas pendentes)
+// Guardam posições na chain; como o índice de cada bloco é a sua posição, as listas ficam em
+// ordem crescente de bloco. São atualizados junto de cada bloco adicionado (com o mutex da
+// blockchain); quando a sincronização troca a chain por outra que diverge da indexada, são
+// refeitos. Junto dos índices fica a chain indexada, para as consultas não esperarem o mutex,
+// que fica preso durante o consenso.
+// Persistidos em data/indices_<id>.json a cada intervaloPersistenciaIndices. Na inicialização,
+// o arquivo só é usado se o último bloco indexado estiver na chain; senão (ou sem o arquivo),
+// os índices são reconstruídos a partir da chain.
+
+const intervaloPersistenciaIndices = 10 * time.Second
+
+// Posição de um bloco na ordem de tempo
+type EntradaTempo struct {
+	Instante int64 `json:"instante"` // segundos desde 1970
+	Indice   int   `json:"indice"`
+}
+
+// Conteúdo dos índices, como é persistido
+type IndicesChain struct {
+	Total      int              `json:"total"`
+	UltimoHash string           `json:"ultimo_hash"`
+	PorHash    map[string]int   `json:"por_hash"`
+	PorPlaca   map[string][]int `json:"por_placa"`
+	PorTipo    map[string][]int `json:"por_tipo"`
+	PorEmpresa map[string][]int `json:"por_empresa"`
+	PorPonto   map[string][]int `json:"por_ponto"`
+	PorTempo   []EntradaTempo   `json:"por_tempo"` // ordenado por instante e índice
+	// Recargas sem pagamento correspondente (mesmo ponto, valor e empresa), por placa
+	RecargasAbertas map[string][]int `json:"recargas_abertas"`
+	// Pagamentos que ainda não quitaram uma recarga, por placa e pela chave que os liga às
+	// recargas, com a quantidade
+	PagamentosLivres map[string]map[string]int `json:"pagamentos_livres"`
+}
+
+var indicesBlockchain = struct {
+	sync.RWMutex
+	IndicesChain
+	chain []Bloco
+	sujo  bool // alterado desde a última persistência
+}{}
+
+func caminhoIndices() string {
+	return "data/indices_" + empresa.ID + ".json"
+}
+
+// Instante do bloco; aceita o formato dos blocos ("15:04:05 02/01/2006") e RFC3339 (genesis)
+func instanteBloco(bloco Bloco) (time.Time, bool) {
+	if instante, erro := time.Parse("15:04:05 02/01/2006", bloco.Timestamp); erro == nil {
+		return instante, true
+	}
+	if instante, erro := time.Parse(time.RFC3339, bloco.Timestamp); erro == nil {
+		return instante, true
+	}
+	return time.Time{}, false
+}
+
+// Carrega os índices persistidos e indexa os blocos que faltam; sem arquivo válido, reconstrói
+func carregarIndices(chain []Bloco) {
+	var indices IndicesChain
+	erro := persistencia.LerJSON(caminhoIndices(), &indices)
+	indicesBlockchain.Lock()
+	defer indicesBlockchain.Unlock()
+	switch {
+	case os.IsNotExist(erro):
+		logIndices.Info("arquivo de índices não encontrado; reconstruindo a partir da blockchain")
+		zerarIndices()
+	case erro != nil:
+		logIndices.Warn("arquivo de índices inválido; reconstruindo a partir da blockchain", "erro", erro)
+		zerarIndices()
+	case !indicesCompletos(indices) || indices.Total > len(chain) || (indices.Total > 0 && chain[indices.Total-1].Hash != indices.UltimoHash):
+		logIndices.Warn("índices persistidos não correspondem à blockchain; reconstruindo")
+		zerarIndices()
+	default:
+		indicesBlockchain.IndicesChain = indices
+	}
+	carregados := indicesBlockchain.Total
+	indicesBlockchain.chain = chain
+	for _, bloco := range chain[carregados:] {
+		indexarBloco(bloco)
+	}
+	indicesBlockchain.sujo = indicesBlockchain.Total != carregados || carregados == 0
+	logIndices.Info("blocos indexados", "total", indicesBlockchain.Total, "do_arquivo", carregados)
+}
+
+func indicesCompletos(indices IndicesChain) bool {
+	return indices.PorHash != nil && indices.PorPlaca != nil && indices.PorTipo != nil && indices.PorEmpresa != nil &&
+		indices.PorPonto != nil && indices.RecargasAbertas != nil && indices.PagamentosLivres != nil
+}
+
+// Atualiza os índices com a chain atual: acrescenta os blocos novos ou, se a chain divergir da
+// indexada (substituída na sincronização), refaz tudo
+func indexarChain(chain []Bloco) {
+	indicesBlockchain.Lock()
+	defer indicesBlockchain.Unlock()
+	total := indicesBlockchain.Total
+	if len(chain) < total || (total > 0 && chain[total-1].Hash != indicesBlockchain.UltimoHash) {
+		logIndices.Info("blockchain substituída por outra divergente; reconstruindo índices")
+		zerarIndices()
+	}
+	indicesBlockchain.chain = chain
+	for _, bloco := range chain[indicesBlockchain.Total:] {
+		indexarBloco(bloco)
+	}
+	indicesBlockchain.sujo = true
+}
+
+// Chamada com o lock dos índices
+func zerarIndices() {
+	indicesBlockchain.IndicesChain = IndicesChain{
+		PorHash:          make(map[string]int),
+		PorPlaca:         make(map[string][]int),
+		PorTipo:          make(map[string][]int),
+		PorEmpresa:       make(map[string][]int),
+		PorPonto:         make(map[string][]int),
+		RecargasAbertas:  make(map[string][]int),
+		PagamentosLivres: make(map[string]map[string]int),
+	}
+}
+
+// Chamada com o lock dos índices, depois de a chain indexada incluir o bloco; blocos fora de
+// sequência são ignorados
+func indexarBloco(bloco Bloco) {
+	indices := &indicesBlockchain.IndicesChain
+	if bloco.Index != indices.Total {
+		return
+	}
+	indices.Total++
+	indices.UltimoHash = bloco.Hash
+	indices.PorHash[bloco.Hash] = bloco.Index
+	acrescentarIndice(indices.PorTipo, bloco.Transacao.Tipo, bloco.Index)
+	acrescentarIndice(indices.PorPlaca, bloco.Transacao.Placa, bloco.Index)
+	acrescentarIndice(indices.PorEmpresa, bloco.Transacao.Empresa, bloco.Index)
+	acrescentarIndice(indices.PorPonto, bloco.Transacao.Ponto, bloco.Index)
+	indexarRecarga(bloco)
+
+	instante, ok := instanteBloco(bloco)
+	if !ok {
+		return
+	}
+	entrada := EntradaTempo{Instante: instante.Unix(), Indice: bloco.Index}
+	tempos := indices.PorTempo
+	// Os blocos chegam quase sempre em ordem de tempo; a busca cobre relógios desalinhados entre empresas
+	posicao := sort.Search(len(tempos), func(i int) bool { return tempos[i].Instante > entrada.Instante })
+	tempos = append(tempos, EntradaTempo{})
+	copy(tempos[posicao+1:], tempos[posicao:])
+	tempos[posicao] = entrada
+	indices.PorTempo = tempos
+}
+
+func acrescentarIndice(indice map[string][]int, chave string, posicao int) {
+	if chave == "" {
+		return
+	}
+	indice[chave] = append(indice[chave], posicao)
+}
+
+// Chave que liga um pagamento às recargas que ele quita
+func chavePagamento(transacao Transacao) string {
+	return transacao.Ponto + "|" + transacao.Empresa + "|" + strconv.FormatFloat(transacao.Valor, 'f', -1, 64)
+}
+
+// Mantém as recargas abertas por placa. Cada pagamento quita uma única recarga de mesmo ponto,
+// valor e empresa: a mais antiga em aberto ou, se não houver, a próxima registrada depois dele.
+// Chamada com o lock dos índices
+func indexarRecarga(bloco Bloco) {
+	indices := &indicesBlockchain.IndicesChain
+	placa := bloco.Transacao.Placa
+	if placa == "" {
+		return
+	}
+	chave := chavePagamento(bloco.Transacao)
+	switch bloco.Transacao.Tipo {
+	case "RECARGA":
+		if livres := indices.PagamentosLivres[placa]; livres[chave] > 0 {
+			livres[chave]--
+			if livres[chave] == 0 {
+				delete(livres, chave)
+			}
+			if len(livres) == 0 {
+				delete(indices.PagamentosLivres, placa)
+			}
+			return
+		}
+		indices.RecargasAbertas[placa] = append(indices.RecargasAbertas[placa], bloco.Index)
+	case "PAGAMENTO":
+		// Monta uma lista nova: a anterior pode estar em uso por uma consulta
+		var abertas []int
+		quitou := false
+		for _, posicao := range indices.RecargasAbertas[placa] {
+			if !quitou && chavePagamento(indicesBlockchain.chain[posicao].Transacao) == chave {
+				quitou = true
+				continue
+			}
+			abertas = append(abertas, posicao)
+		}
+		if !quitou {
+			if indices.PagamentosLivres[placa] == nil {
+				indices.PagamentosLivres[placa] = make(map[string]int)
+			}
+			indices.PagamentosLivres[placa][chave]++
+			return
+		}
+		if len(abertas) == 0 {
+			delete(indices.RecargasAbertas, placa)
+		} else {
+			indices.RecargasAbertas[placa] = abertas
+		}
+	}
+}
+
+// Grava os índices periodicamente, quando alterados
+func persistirIndicesPeriodicamente() {
+	for range time.Tick(intervaloPersistenciaIndices) {
+		if erro := salvarIndices(); erro != nil {
+			logIndices.Error("erro ao salvar índices", "erro", erro)
+		}
+	}
+}
+
+func salvarIndices() error {
+	indicesBlockchain.Lock()
+	if !indicesBlockchain.sujo {
+		indicesBlockchain.Unlock()
+		return nil
+	}
+	dados, erro := json.Marshal(indicesBlockchain.IndicesChain)
+	if erro != nil {
+		indicesBlockchain.Unlock()
+		return erro
+	}
+	// Limpo antes de gravar, para que alterações durante a gravação marquem de novo; se a gravação
+	// falhar, volta a sujo e a próxima rodada tenta outra vez
+	indicesBlockchain.sujo = false
+	indicesBlockchain.Unlock()
+	if erro := persistencia.GravarRegistro(caminhoIndices(), dados, 0644); erro != nil {
+		indicesBlockchain.Lock()
+		indicesBlockchain.sujo = true
+		indicesBlockchain.Unlock()
+		return erro
+	}
+	return nil
+}
+
+// Busca um bloco da blockchain pelo hash
+func blocoPorHash(hash string) (Bloco, bool) {
+	indicesBlockchain.RLock()
+	defer indicesBlockchain.RUnlock()
+	posicao, existe := indicesBlockchain.PorHash[hash]
+	if !existe {
+		return Bloco{}, false
+	}
+	return indicesBlockchain.chain[posicao], true
+}
+
+// Blocos da placa, em ordem crescente de índice
+func blocosPorPlaca(placa string) []Bloco {
+	indicesBlockchain.RLock()
+	defer indicesBlockchain.RUnlock()
+	return blocosNasPosicoes(indicesBlockchain.PorPlaca[placa])
+}
+
+// Chamada com o lock dos índices
+func blocosNasPosicoes(posicoes []int) []Bloco {
+	var blocos []Bloco
+	for _, posicao := range posicoes {
+		blocos = append(blocos, indicesBlockchain.chain[posicao])
+	}
+	return blocos
+}
+
+// Recargas da placa sem pagamento correspondente, em ordem crescente de índice
+func RecargasPendentes(placa string) []Transacao {
+	indicesBlockchain.RLock()
+	defer indicesBlockchain.RUnlock()
+	var pendentes []Transacao
+	for _, posicao := range indicesBlockchain.RecargasAbertas[placa] {
+		pendentes = append(pendentes, indicesBlockchain.chain[posicao].Transacao)
+	}
+	return pendentes
+}
+
+// Posições dos blocos entre os instantes (inclusive), em ordem crescente de bloco; chamada com o lock dos índices
+func posicoesPorPeriodo(de, ate time.Time) []int {
+	tempos := indicesBlockchain.PorTempo
+	inicio := 0
+	if !de.IsZero() {
+		inicio = sort.Search(len(tempos), func(i int) bool { return tempos[i].Instante >= de.Unix() })
+	}
+	fim := len(tempos)
+	if !ate.IsZero() {
+		fim = sort.Search(len(tempos), func(i int) bool { return tempos[i].Instante > ate.Unix() })
+	}
+	var posicoes []int
+	for i := inicio; i < fim; i++ {
+		posicoes = append(posicoes, tempos[i].Indice)
+	}
+	sort.Ints(posicoes)
+	return posicoes
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limites de uso e proteção contra abuso
+// Baldes de tokens por identidade (reservas e recargas), por IP (API REST dos veículos) e por client
+// ID MQTT (publicações de veículos no broker embutido), limite de reservas ativas por placa e
+// banimento temporário de identidades com conflitos repetidos. A identidade é a placa apenas quando
+// ela foi autenticada (sujeito da credencial MQTT, ou token do veículo em Authorization no REST);
+// sem credencial, a requisição REST é contada pelo IP de origem, para que ninguém esgote os limites
+// ou provoque o banimento de uma placa alheia. A configuração é por empresa
+// (data/limites_<id>.json) e as rejeições são contadas por motivo em GET /api/limites.
+
+// Configuração de limites da empresa; campos ausentes usam os valores padrão
+type ConfiguracaoLimites struct {
+	RequisicoesMinutoPlaca   float64 `json:"requisicoes_minuto_placa"`
+	RajadaPlaca              int     `json:"rajada_placa"`
+	RequisicoesMinutoIP      float64 `json:"requisicoes_minuto_ip"`
+	RajadaIP                 int     `json:"rajada_ip"`
+	RequisicoesMinutoCliente float64 `json:"requisicoes_minuto_cliente_mqtt"`
+	RajadaCliente            int     `json:"rajada_cliente_mqtt"`
+	MaxReservasAtivas        int     `json:"max_reservas_ativas"` // por placa, nos pontos desta empresa
+	ConflitosParaBanimento   int     `json:"conflitos_para_banimento"`
+	JanelaConflitosSegundos  int     `json:"janela_conflitos_segundos"`
+	BanimentoSegundos        int     `json:"banimento_segundos"`
+}
+
+// Rejeição por limite de uso, com o tempo sugerido até nova tentativa
+type ErroLimite struct {
+	Motivo string
+	Espera time.Duration
+}
+
+func (e *ErroLimite) Error() string {
+	switch e.Motivo {
+	case "banida":
+		return fmt.Sprintf("temporariamente bloqueado por conflitos repetidos; tente novamente em %ds", int(math.Ceil(e.Espera.Seconds())))
+	case "reservas_ativas":
+		return fmt.Sprintf("limite de %d reservas ativas por placa atingido", configLimites.MaxReservasAtivas)
+	}
+	return fmt.Sprintf("limite de requisições excedido; tente novamente em %ds", int(math.Ceil(e.Espera.Seconds())))
+}
+
+// Balde de tokens de uma chave
+type baldeTokens struct {
+	tokens     float64
+	atualizado time.Time
+}
+
+// Conjunto de baldes com a mesma taxa (tokens por segundo) e capacidade
+type limitador struct {
+	sync.Mutex
+	taxa   float64
+	rajada float64
+	baldes map[string]*baldeTokens
+}
+
+const limiteBaldesOciosos = 10000
+
+var configLimites = ConfiguracaoLimites{
+	RequisicoesMinutoPlaca:   30,
+	RajadaPlaca:              10,
+	RequisicoesMinutoIP:      120,
+	RajadaIP:                 30,
+	RequisicoesMinutoCliente: 60,
+	RajadaCliente:            20,
+	MaxReservasAtivas:        2,
+	ConflitosParaBanimento:   5,
+	JanelaConflitosSegundos:  60,
+	BanimentoSegundos:        300,
+}
+
+var (
+	limitePlacas   = novoLimitador(configLimites.RequisicoesMinutoPlaca, configLimites.RajadaPlaca)
+	limiteIPs      = novoLimitador(configLimites.RequisicoesMinutoIP, configLimites.RajadaIP)
+	limiteClientes = novoLimitador(configLimites.RequisicoesMinutoCliente, configLimites.RajadaCliente)
+)
+
+// Conflitos recentes e banimentos por identidade
+var banimentos = struct {
+	sync.Mutex
+	conflitos map[string][]time.Time
+	ate       map[string]time.Time
+}{conflitos: make(map[string][]time.Time), ate: make(map[string]time.Time)}
+
+// Rejeições por motivo (placa, ip, cliente_mqtt, reservas_ativas, banida)
+var rejeicoesLimite = struct {
+	sync.Mutex
+	contagem map[string]uint64
+}{contagem: make(map[string]uint64)}
+
+func novoLimitador(porMinuto float64, rajada int) *limitador {
+	return &limitador{taxa: porMinuto / 60, rajada: float64(rajada), baldes: make(map[string]*baldeTokens)}
+}
+
+// Consome um token da chave; sem token, retorna o tempo até o próximo
+func (l *limitador) permitir(chave string) (bool, time.Duration) {
+	agora := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	if len(l.baldes) > limiteBaldesOciosos {
+		l.descartarCheios(agora)
+	}
+	balde, existe := l.baldes[chave]
+	if !existe {
+		balde = &baldeTokens{tokens: l.rajada, atualizado: agora}
+		l.baldes[chave] = balde
+	}
+	balde.tokens = math.Min(l.rajada, balde.tokens+agora.Sub(balde.atualizado).Seconds()*l.taxa)
+	balde.atualizado = agora
+	if balde.tokens >= 1 {
+		balde.tokens--
+		return true, 0
+	}
+	if l.taxa <= 0 {
+		return false, time.Minute
+	}
+	return false, time.Duration((1 - balde.tokens) / l.taxa * float64(time.Second))
+}
+
+// Remove baldes que já teriam se recarregado por completo; deve ser chamada com l travado
+func (l *limitador) descartarCheios(agora time.Time) {
+	for chave, balde := range l.baldes {
+		if balde.tokens+agora.Sub(balde.atualizado).Seconds()*l.taxa >= l.rajada {
+			delete(l.baldes, chave)
+		}
+	}
+}
+
+// Carrega data/limites_<id>.json sobre os valores padrão
+func inicializaLimites() {
+	file, erro := os.ReadFile("data/limites_" + empresa.ID + ".json")
+	if erro == nil {
+		if erro := json.Unmarshal(file, &configLimites); erro != nil {
+			logLimites.Error("erro ao decodificar configuração de limites", "erro", erro)
+		}
+	}
+	limitePlacas = novoLimitador(configLimites.RequisicoesMinutoPlaca, configLimites.RajadaPlaca)
+	limiteIPs = novoLimitador(configLimites.RequisicoesMinutoIP, configLimites.RajadaIP)
+	limiteClientes = novoLimitador(configLimites.RequisicoesMinutoCliente, configLimites.RajadaCliente)
+	logLimites.Info("limites carregados", "placa_por_minuto", configLimites.RequisicoesMinutoPlaca, "ip_por_minuto", configLimites.RequisicoesMinutoIP,
+		"cliente_mqtt_por_minuto", configLimites.RequisicoesMinutoCliente, "reservas_ativas_por_placa", configLimites.MaxReservasAtivas)
+}
+
+func contarRejeicao(motivo string) {
+	rejeicoesLimite.Lock()
+	rejeicoesLimite.contagem[motivo]++
+	rejeicoesLimite.Unlock()
+	metricaRejeicoesLimite.Inc(motivo)
+}
+
+// Identidade de uma requisição REST de veículo: a placa, se vier com o token de veículo dessa placa,
+// senão "ip:<IP de origem>". Requisições repassadas por outra empresa já passaram pelos limites na
+// origem e não têm identidade ("")
+func identidadeLimite(r *http.Request, placa string) string {
+	if strings.HasPrefix(r.URL.Path, "/peer/") {
+		return ""
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		credencial, erro := verificarCredencial(token)
+		if erro == nil && credencial.Papel == "veiculo" && credencial.Sujeito == placa {
+			return placa
+		}
+	}
+	ip, _, erro := net.SplitHostPort(r.RemoteAddr)
+	if erro != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+// Verifica banimento e taxa de requisições de uma identidade (reservas e recargas)
+func verificarLimite(identidade string) error {
+	if identidade == "" {
+		return nil
+	}
+	banimentos.Lock()
+	ate, banida := banimentos.ate[identidade]
+	if banida && time.Now().After(ate) {
+		delete(banimentos.ate, identidade)
+		banida = false
+	}
+	banimentos.Unlock()
+	if banida {
+		contarRejeicao("banida")
+		return &ErroLimite{Motivo: "banida", Espera: time.Until(ate)}
+	}
+	if ok, espera := limitePlacas.permitir(identidade); !ok {
+		contarRejeicao("placa")
+		return &ErroLimite{Motivo: "placa", Espera: espera}
+	}
+	return nil
+}
+
+// Pontos desta empresa reservados pela placa, exceto o informado; deve ser chamada com controlePontos travado
+func reservasAtivasInterno(placa, exceto string) int {
+	total := 0
+	for ponto, status := range controlePontos.pontos {
+		if ponto != exceto && status.Placa == placa && status.Status == "RESERVADO" {
+			total++
+		}
+	}
+	return total
+}
+
+// Verifica se a placa pode reservar mais um ponto (reservar de novo o mesmo ponto não conta)
+func verificarLimiteReservas(placa, ponto string) error {
+	if configLimites.MaxReservasAtivas <= 0 {
+		return nil
+	}
+	controlePontos.RLock()
+	ativas := reservasAtivasInterno(placa, ponto)
+	controlePontos.RUnlock()
+	if ativas >= configLimites.MaxReservasAtivas {
+		contarRejeicao("reservas_ativas")
+		return &ErroLimite{Motivo: "reservas_ativas"}
+	}
+	return nil
+}
+
+// Registra tentativa de reservar ponto ocupado por outro veículo; conflitos demais na janela banem a identidade
+func registrarConflito(identidade string) {
+	if configLimites.ConflitosParaBanimento <= 0 || identidade == "" {
+		return
+	}
+	agora := time.Now()
+	janela := time.Duration(configLimites.JanelaConflitosSegundos) * time.Second
+
+	banimentos.Lock()
+	defer banimentos.Unlock()
+	recentes := banimentos.conflitos[identidade][:0]
+	for _, instante := range banimentos.conflitos[identidade] {
+		if agora.Sub(instante) <= janela {
+			recentes = append(recentes, instante)
+		}
+	}
+	recentes = append(recentes, agora)
+	if len(recentes) >= configLimites.ConflitosParaBanimento {
+		banimentos.ate[identidade] = agora.Add(time.Duration(configLimites.BanimentoSegundos) * time.Second)
+		delete(banimentos.conflitos, identidade)
+		logLimites.Warn("identidade bloqueada por conflitos", "identidade", identidade, "segundos", configLimites.BanimentoSegundos, "conflitos", len(recentes))
+		return
+	}
+	banimentos.conflitos[identidade] = recentes
+}
+
+// Limita a taxa de publicações de um client ID no broker embutido
+func permitirPublicacaoCliente(clienteID string) bool {
+	ok, _ := limiteClientes.permitir(clienteID)
+	if !ok {
+		contarRejeicao("cliente_mqtt")
+	}
+	return ok
+}
+
+// Limita a taxa de requisições MQTT de um client ID tratadas pela empresa, com qualquer broker
+// (o Mosquitto não limita a taxa e guarda em cache as consultas de ACL); "" não é limitado.
+// A chave é separada da do broker embutido, que conta todas as publicações do cliente
+func verificarLimiteCliente(clienteID string) error {
+	if clienteID == "" {
+		return nil
+	}
+	if ok, espera := limiteClientes.permitir("requisicao:" + clienteID); !ok {
+		contarRejeicao("cliente_mqtt")
+		return &ErroLimite{Motivo: "cliente_mqtt", Espera: espera}
+	}
+	return nil
+}
+
+// Responde 429 com Retry-After
+func responderLimiteHTTP(w http.ResponseWriter, erro error) {
+	if limite, ok := erro.(*ErroLimite); ok && limite.Espera > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limite.Espera.Seconds()))))
+	}
+	http.Error(w, erro.Error(), http.StatusTooManyRequests)
+}
+
+// Limita a taxa de requisições por IP de origem nos endpoints dos veículos
+func limitarPorIP(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip, _, erro := net.SplitHostPort(r.RemoteAddr)
+		if erro != nil {
+			ip = r.RemoteAddr
+		}
+		if ok, espera := limiteIPs.permitir(ip); !ok {
+			contarRejeicao("ip")
+			responderLimiteHTTP(w, &ErroLimite{Motivo: "ip", Espera: espera})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Configuração, rejeições por motivo e identidades bloqueadas
+func handleLimites(w http.ResponseWriter, r *http.Request) {
+	rejeicoesLimite.Lock()
+	rejeicoes := make(map[string]uint64, len(rejeicoesLimite.contagem))
+	for motivo, total := range rejeicoesLimite.contagem {
+		rejeicoes[motivo] = total
+	}
+	rejeicoesLimite.Unlock()
+
+	type Bloqueada struct {
+		Identidade string `json:"identidade"` // placa ou ip:<IP>
+		Ate        string `json:"ate"`
+	}
+	bloqueadas := []Bloqueada{}
+	banimentos.Lock()
+	for identidade, ate := range banimentos.ate {
+		if time.Now().Before(ate) {
+			bloqueadas = append(bloqueadas, Bloqueada{Identidade: identidade, Ate: ate.Format(time.RFC3339)})
+		}
+	}
+	banimentos.Unlock()
+	sort.Slice(bloqueadas, func(i, j int) bool { return bloqueadas[i].Identidade < bloqueadas[j].Identidade })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"empresa_id":   empresa.ID,
+		"configuracao": configLimites,
+		"rejeicoes":    rejeicoes,
+		"bloqueadas":   bloqueadas,
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"persistencia"
+)
+
+// Logs estruturados da empresa: uma linha JSON por evento (log/slog) na saída padrão, com nível,
+// componente (http, mqtt, consenso...), a empresa e atributos da operação (placa, ponto, hash).
+// O nível mínimo vem de LOG_LEVEL (debug, info, warn ou error; padrão info).
+// Cada operação carrega um ID de requisição gerado no veículo, que chega no campo requisicao_id
+// do envelope MQTT ou no cabeçalho X-Request-ID, segue nas chamadas entre empresas e na
+// replicação dos blocos e aparece como requisicao_id em todo log da operação, em todas as empresas.
+
+const cabecalhoRequisicao = "X-Request-ID"
+
+type chaveContexto int
+
+const (
+	chaveRequisicao chaveContexto = iota
+	chaveRastreamento
+)
+
+var logBase = slog.New(&manipuladorLog{slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: nivelLog()})}).
+	With("empresa", os.Getenv("EMPRESA_ID"))
+
+var (
+	logGeral        = logBase.With("componente", "empresa")
+	logHTTP         = logBase.With("componente", "http")
+	logMQTT         = logBase.With("componente", "mqtt")
+	logBroker       = logBase.With("componente", "broker")
+	logConsenso     = logBase.With("componente", "consenso")
+	logEscrita      = logBase.With("componente", "escrita")
+	logReplicacao   = logBase.With("componente", "replicacao")
+	logIndices      = logBase.With("componente", "indices")
+	logReservas     = logBase.With("componente", "reservas")
+	logRecargas     = logBase.With("componente", "recargas")
+	logPrecos       = logBase.With("componente", "precos")
+	logLimites      = logBase.With("componente", "limites")
+	logOutbox       = logBase.With("componente", "outbox")
+	logPontos       = logBase.With("componente", "pontos")
+	logPainel       = logBase.With("componente", "painel")
+	logPeer         = logBase.With("componente", "peer")
+	logCredencial   = logBase.With("componente", "credencial")
+	logRecuperacao  = logBase.With("componente", "recuperacao")
+	logRede         = logBase.With("componente", "rede")
+	logPersistencia = logBase.With("componente", "persistencia")
+)
+
+func init() {
+	persistencia.Log = logPersistencia
+}
+
+// Nível mínimo configurado em LOG_LEVEL
+func nivelLog() slog.Level {
+	var nivel slog.Level
+	if erro := nivel.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); erro != nil {
+		return slog.LevelInfo
+	}
+	return nivel
+}
+
+// Handler que acrescenta o ID de requisição do contexto a cada registro
+type manipuladorLog struct {
+	slog.Handler
+}
+
+func (m *manipuladorLog) Handle(ctx context.Context, registro slog.Record) error {
+	if requisicao := requisicaoDoContexto(ctx); requisicao != "" {
+		registro.AddAttrs(slog.String("requisicao_id", requisicao))
+	}
+	return m.Handler.Handle(ctx, registro)
+}
+
+func (m *manipuladorLog) WithAttrs(atributos []slog.Attr) slog.Handler {
+	return &manipuladorLog{m.Handler.WithAttrs(atributos)}
+}
+
+func (m *manipuladorLog) WithGroup(nome string) slog.Handler {
+	return &manipuladorLog{m.Handler.WithGroup(nome)}
+}
+
+// Contexto com o ID de requisição (inalterado se o ID for vazio)
+func comRequisicao(ctx context.Context, requisicao string) context.Context {
+	if requisicao == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, chaveRequisicao, requisicao)
+}
+
+func requisicaoDoContexto(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requisicao, _ := ctx.Value(chaveRequisicao).(string)
+	return requisicao
+}
+
+// ID de requisição recebido de fora; descarta valores longos ou com caracteres fora de [A-Za-z0-9._-]
+func requisicaoValida(requisicao string) string {
+	if len(requisicao) > 64 {
+		return ""
+	}
+	for _, c := range requisicao {
+		if !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-", c) {
+			return ""
+		}
+	}
+	return requisicao
+}
+
+// Coloca no contexto da requisição HTTP o ID recebido em X-Request-ID (ou um novo) e o devolve
+// no mesmo cabeçalho da resposta
+func comIDRequisicao(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requisicao := requisicaoValida(r.Header.Get(cabecalhoRequisicao))
+		if requisicao == "" {
+			requisicao = gerarIDMensagem()
+		}
+		w.Header().Set(cabecalhoRequisicao, requisicao)
+		handler.ServeHTTP(w, r.WithContext(comRequisicao(r.Context(), requisicao)))
+	})
+}
+
+// Repassa o ID de requisição e o span corrente do contexto numa chamada HTTP para outra empresa
+func propagarContexto(ctx context.Context, req *http.Request) {
+	if requisicao := requisicaoDoContexto(ctx); requisicao != "" {
+		req.Header.Set(cabecalhoRequisicao, requisicao)
+	}
+	if traceparent := traceparentDoContexto(ctx); traceparent != "" {
+		req.Header.Set(cabecalhoTraceparent, traceparent)
+	}
+}
+
+// Registra o erro e encerra o processo
+func encerrarComErro(logger *slog.Logger, mensagem string, atributos ...any) {
+	logger.Error(mensagem, atributos...)
+	os.Exit(1)
+}
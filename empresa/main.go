@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
@@ -10,17 +10,29 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"persistencia"
 )
 
 var mutex sync.Mutex
-var processar_transacoes = make(chan Bloco, 100)
+var processar_transacoes = make(chan blocoRecebido, 100)
+
+// Bloco de outra empresa na fila de processamento, com o contexto (ID de requisição) do envio
+// O processador responde em resultado o status HTTP devolvido à empresa remetente
+type blocoRecebido struct {
+	bloco     Bloco
+	ctx       context.Context
+	recebido  time.Time
+	resultado chan int
+}
 
 type Empresa struct {
 	ID         string          `json:"id"`
@@ -41,6 +53,8 @@ type Transacao struct {
 	Valor   float64 `json:"valor"`
 	Ponto   string  `json:"ponto"`
 	Empresa string  `json:"empresa"`
+	Tarifa  *Tarifa `json:"tarifa,omitempty"`  // apenas em transações TARIFA
+	Cotacao string  `json:"cotacao,omitempty"` // hash da cotação aceita (RESERVA/RECARGA)
 }
 
 type Bloco struct {
@@ -59,21 +73,51 @@ type Blockchain struct {
 
 var (
 	empresa            Empresa
-	blockchain         Blockchain
+	blockchain         ArmazemChain
 	chave_privada_path string
 	chave_publica_path string
-	empresasAPI        = map[string]string{
+	empresasAPI        = lerEmpresasAPI()
+)
+
+// Lê os endereços das APIs das empresas de EMPRESAS_API ("001=http://localhost:8001,002=...")
+// Sem a variável, usa os nomes dos containers
+func lerEmpresasAPI() map[string]string {
+	apis := map[string]string{
 		"001": "http://empresa_001:8001",
 		"002": "http://empresa_002:8002",
 		"003": "http://empresa_003:8003",
 	}
-)
+	valor := os.Getenv("EMPRESAS_API")
+	if valor == "" {
+		return apis
+	}
+	configuradas := make(map[string]string)
+	for _, item := range strings.Split(valor, ",") {
+		id, url, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || id == "" || url == "" {
+			logGeral.Warn("entrada inválida em EMPRESAS_API ignorada", "entrada", item)
+			continue
+		}
+		configuradas[id] = strings.TrimSuffix(url, "/")
+	}
+	if len(configuradas) == 0 {
+		return apis
+	}
+	return configuradas
+}
 
 // Calcula hash SHA256 de um bloco para garantir integridade na blockchain
 func CalcularHash(bloco Bloco) string {
 	index := strconv.Itoa(bloco.Index)
 	valor := fmt.Sprintf("%.2f", bloco.Transacao.Valor)
 	dados := index + bloco.Timestamp + bloco.Transacao.Tipo + bloco.Transacao.Placa + valor + bloco.Transacao.Ponto + bloco.Transacao.Empresa + bloco.HashAnterior + bloco.Autor
+	if bloco.Transacao.Tarifa != nil {
+		// Blocos sem tarifa mantêm o hash original
+		dados += bloco.Transacao.Tarifa.dadosHash()
+	}
+	if bloco.Transacao.Cotacao != "" {
+		dados += bloco.Transacao.Cotacao
+	}
 	hash := sha256.Sum256([]byte(dados))
 	return hex.EncodeToString(hash[:])
 }
@@ -105,27 +149,27 @@ func ValidarBloco(novo_bloco, bloco_anterior Bloco) bool {
 	if CalcularHash(novo_bloco) != novo_bloco.Hash {
 		return false
 	}
+	// Só a empresa dona do ponto pode publicar a tarifa dele
+	if novo_bloco.Transacao.Tipo == "TARIFA" {
+		transacao := novo_bloco.Transacao
+		if transacao.Tarifa == nil || transacao.Empresa != novo_bloco.Autor || !empresaPossuiPonto(novo_bloco.Autor, transacao.Ponto) {
+			return false
+		}
+	}
 	return true
 }
 
 // Carrega blockchain existente do arquivo JSON ou cria blockchain vazia
 func CarregarBlockchain(path string) (Blockchain, error) {
 	var chain Blockchain
-	file, erro := os.ReadFile(path)
-	if erro != nil {
-		return chain, erro
-	}
-	erro = json.Unmarshal(file, &chain)
+	erro := persistencia.LerJSON(path, &chain)
 	return chain, erro
 }
 
-// Salva blockchain completa no arquivo JSON
+// Salva blockchain completa no arquivo JSON (gravação atômica com checksum, ver persistencia.go)
 func SalvarBlockchain(path string, chain Blockchain) error {
-	data, erro := json.MarshalIndent(chain, "", "  ")
-	if erro != nil {
-		return erro
-	}
-	return os.WriteFile(path, data, 0644)
+	defer metricaGravacaoBlockchain.ObservarDesde(time.Now())
+	return persistencia.GravarJSON(path, chain, 0644)
 }
 
 // Gera par de chaves RSA (privada/pública) para assinatura digital dos blocos
@@ -136,18 +180,19 @@ func GerarChaves(privada_path, publica_path string) error {
 	}
 	privada_bytes := x509.MarshalPKCS1PrivateKey(privada)
 	privada_pem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: privada_bytes})
-	erro = os.WriteFile(privada_path, privada_pem, 0600)
+	erro = persistencia.GravarArquivo(privada_path, privada_pem, 0600)
 	if erro != nil {
 		return erro
 	}
 	publica_bytes := x509.MarshalPKCS1PublicKey(&privada.PublicKey)
 	pub_pem := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: publica_bytes})
-	return os.WriteFile(publica_path, pub_pem, 0644)
+	return persistencia.GravarArquivo(publica_path, pub_pem, 0644)
 }
 
 // assina o bloco com a chave privada da empresa
 // Assina hash do bloco usando chave privada RSA para autenticação
 func AssinarBloco(hash string, privada_path string) (string, error) {
+	defer metricaAssinatura.ObservarDesde(time.Now())
 	privada_pem, erro := os.ReadFile(privada_path)
 	if erro != nil {
 		return "", erro
@@ -174,6 +219,9 @@ func ValidarAssinatura(hash, assinatura, publica_path string) bool {
 		return false
 	}
 	block, _ := pem.Decode(pub_pem)
+	if block == nil {
+		return false
+	}
 	publica, erro := x509.ParsePKCS1PublicKey(block.Bytes)
 	if erro != nil {
 		return false
@@ -192,17 +240,17 @@ func ValidarAssinatura(hash, assinatura, publica_path string) bool {
 func inicializarAPI() {
 	empresa_id := os.Getenv("EMPRESA_ID")
 	if empresa_id == "" {
-		log.Fatal("EMPRESA_ID indefinido")
+		encerrarComErro(logGeral, "EMPRESA_ID indefinido")
 	}
 
 	// Carrega dados da empresa
 	empresa_path := "data/empresa_" + empresa_id + ".json"
 	file, erro := os.ReadFile(empresa_path)
 	if erro != nil {
-		log.Fatalf("Erro ao carregar empresa: %v", erro)
+		encerrarComErro(logGeral, "erro ao carregar empresa", "erro", erro)
 	}
 	if erro := json.Unmarshal(file, &empresa); erro != nil {
-		log.Fatalf("Erro ao decodificar empresa: %v", erro)
+		encerrarComErro(logGeral, "erro ao decodificar empresa", "erro", erro)
 	}
 
 	// Define caminhos das chaves
@@ -211,9 +259,9 @@ func inicializarAPI() {
 
 	// Gera chaves se ainda nao existirem
 	if _, erro := os.Stat(chave_privada_path); os.IsNotExist(erro) {
-		log.Println("Gerando par de chaves...")
+		logGeral.Info("gerando par de chaves")
 		if erro := GerarChaves(chave_privada_path, chave_publica_path); erro != nil {
-			log.Fatalf("Erro ao gerar chaves: %v", erro)
+			encerrarComErro(logGeral, "erro ao gerar chaves", "erro", erro)
 		}
 	}
 
@@ -221,16 +269,16 @@ func inicializarAPI() {
 	chain_path := "data/chain_" + empresa_id + ".json"
 	if _, erro := os.Stat(chain_path); os.IsNotExist(erro) {
 		// Cria arquivo o vazio se ainda nao existir
-		blockchain = Blockchain{Chain: []Bloco{}}
-		SalvarBlockchain(chain_path, blockchain)
+		SalvarBlockchain(chain_path, Blockchain{Chain: []Bloco{}})
 	}
 
-	blockchain, erro = CarregarBlockchain(chain_path)
+	carregada, erro := CarregarBlockchain(chain_path)
 	if erro != nil {
-		log.Fatalf("Erro ao carregar blockchain: %v", erro)
+		encerrarComErro(logConsenso, "erro ao carregar blockchain", "erro", erro)
 	}
+	blockchain.Substituir(carregada.Chain)
 	// Cria bloco genesis
-	if len(blockchain.Chain) == 0 {
+	if blockchain.Tamanho() == 0 {
 		blocoGenesis := Bloco{
 			Index:        0,
 			Timestamp:    "2025-01-01T00:00:00Z",
@@ -240,9 +288,10 @@ func inicializarAPI() {
 			Assinatura:   "",
 		}
 		blocoGenesis.Hash = CalcularHash(blocoGenesis)
-		blockchain.Chain = append(blockchain.Chain, blocoGenesis)
-		SalvarBlockchain(chain_path, blockchain)
+		blockchain.Acrescentar(blocoGenesis)
+		SalvarBlockchain(chain_path, blockchain.Snapshot())
 	}
+	carregarIndices(chainAtual())
 }
 
 // Aguarda outras empresas ficarem disponíveis para sincronização da blockchain
@@ -258,13 +307,13 @@ func aguardarEmpresasDisponiveis() {
 			resp, err := http.Get(api + "/blockchain")
 			if err != nil || resp.StatusCode != 200 {
 				todasOk = false
-				fmt.Printf("[LOG] Empresa %s ainda não está disponível. Tentando novamente...\n", id)
+				logConsenso.Info("empresa ainda indisponível; tentando novamente", "empresa_remota", id)
 				break
 			}
 			resp.Body.Close()
 		}
 		if todasOk {
-			fmt.Println("Todas as empresas estão disponíveis")
+			logConsenso.Info("todas as empresas estão disponíveis")
 			break
 		}
 		time.Sleep(1 * time.Second)
@@ -275,71 +324,116 @@ func aguardarEmpresasDisponiveis() {
 // Handler HTTP para retornar blockchain completa da empresa
 func blockchainHandler(writer http.ResponseWriter, r *http.Request) {
 	writer.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(writer).Encode(blockchain)
+	json.NewEncoder(writer).Encode(blockchain.Snapshot())
 }
 
 // processa transacoes em sequencia
 // Inicia processador de blocos em goroutine para validação e adição à blockchain
 func iniciarProcessadorDeBlocos() {
 	go func() {
-		for bloco := range processar_transacoes {
+		for recebido := range processar_transacoes {
+			bloco, ctx := recebido.bloco, recebido.ctx
 			mutex.Lock()
-			if blocoDuplicado(bloco) {
-				fmt.Printf("Bloco duplicado detectado - index [%d] hash (%s). Rejeitando...\n", bloco.Index, bloco.Hash)
-				mutex.Unlock()
-				continue
-			}
-			ultimo := blockchain.Chain[len(blockchain.Chain)-1]
+			resultado, status := "aceito", http.StatusOK
+			var erroGravacao error
+			ultimo := blockchain.Ultimo()
 			chave_publica_path := "data/empresa_" + bloco.Autor + "_public.pem"
-			if ValidarBloco(bloco, ultimo) && ValidarAssinatura(bloco.Hash, bloco.Assinatura, chave_publica_path) {
-				blockchain.Chain = append(blockchain.Chain, bloco)
-				SalvarBlockchain("data/chain_"+empresa.ID+".json", blockchain)
-				fmt.Printf("Bloco da empresa %s ACEITO index [%d]\n", bloco.Autor, bloco.Index)
-			} else {
-				fmt.Printf("Bloco da empresa %s REJEITADO index [%d]\n", bloco.Autor, bloco.Index)
+			switch {
+			case blocoConhecido(bloco):
+				// Reenvio de um bloco já aceito (a resposta anterior se perdeu)
+				logConsenso.InfoContext(ctx, "bloco já aceito", "autor", bloco.Autor, "index", bloco.Index, "hash", bloco.Hash)
+				metricaBlocosRecebidos.Inc(bloco.Autor, "duplicado")
+				resultado = "duplicado"
+			case blocoDuplicado(bloco) || bloco.Index > ultimo.Index+1 || (bloco.Index == ultimo.Index+1 && bloco.HashAnterior != ultimo.Hash):
+				// Outro bloco no mesmo índice ou encadeado em outro anterior: as chains divergiram
+				logConsenso.WarnContext(ctx, "bloco recusado: blockchain divergente", "autor", bloco.Autor, "index", bloco.Index, "hash", bloco.Hash, "altura_local", ultimo.Index)
+				metricaBlocosRecebidos.Inc(bloco.Autor, "divergente")
+				resultado, status = "divergente", http.StatusConflict
+				agendarSincronizacao()
+			case !ValidarBloco(bloco, ultimo) || !ValidarAssinatura(bloco.Hash, bloco.Assinatura, chave_publica_path):
+				logConsenso.WarnContext(ctx, "bloco rejeitado", "autor", bloco.Autor, "index", bloco.Index, "hash", bloco.Hash)
+				metricaBlocosRecebidos.Inc(bloco.Autor, "rejeitado")
+				resultado, status = "rejeitado", http.StatusConflict
+			default:
+				if erro := adicionarBlocos(bloco); erro != nil {
+					logConsenso.ErrorContext(ctx, "erro ao gravar bloco recebido", "autor", bloco.Autor, "index", bloco.Index, "hash", bloco.Hash, "erro", erro)
+					metricaBlocosRecebidos.Inc(bloco.Autor, "erro_gravacao")
+					resultado, status, erroGravacao = "erro_gravacao", http.StatusInternalServerError, erro
+				} else {
+					logConsenso.InfoContext(ctx, "bloco aceito", "autor", bloco.Autor, "index", bloco.Index, "hash", bloco.Hash,
+						"tipo", bloco.Transacao.Tipo, "placa", bloco.Transacao.Placa, "ponto", bloco.Transacao.Ponto)
+					metricaBlocosRecebidos.Inc(bloco.Autor, "aceito")
+				}
 			}
 			mutex.Unlock()
+			recebido.resultado <- status
+			// Da chegada do bloco até o fim do processamento (inclui a espera na fila e no mutex)
+			registrarSpan(ctx, "consenso.bloco", recebido.recebido, time.Now(), erroGravacao,
+				"autor", bloco.Autor, "index", bloco.Index, "hash", bloco.Hash, "resultado", resultado)
+			encerramento.blocosRecebidos.concluir()
 		}
 	}()
 }
 
+// Indica se o mesmo bloco (mesmo hash, no mesmo índice) já está na blockchain local
+func blocoConhecido(bloco Bloco) bool {
+	indicesBlockchain.RLock()
+	defer indicesBlockchain.RUnlock()
+	index, existe := indicesBlockchain.PorHash[bloco.Hash]
+	return existe && index == bloco.Index
+}
+
+// Indica se o índice ou o hash do bloco já estão ocupados na blockchain local
 func blocoDuplicado(bloco Bloco) bool {
-	for _, b := range blockchain.Chain {
-		if b.Index == bloco.Index || b.Hash == bloco.Hash {
-			return true
-		}
+	indicesBlockchain.RLock()
+	defer indicesBlockchain.RUnlock()
+	if bloco.Index >= 0 && bloco.Index < indicesBlockchain.Total {
+		return true
 	}
-	return false
+	_, existe := indicesBlockchain.PorHash[bloco.Hash]
+	return existe
 }
 
 // recebe bloco de outra empresa
 func receberBlocoHandler(writer http.ResponseWriter, request *http.Request) {
 	var bloco Bloco
 	if erro := json.NewDecoder(request.Body).Decode(&bloco); erro != nil {
-		fmt.Println("Erro ao decodificar bloco recebido:", erro)
+		logConsenso.WarnContext(request.Context(), "erro ao decodificar bloco recebido", "erro", erro)
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	// Enfileira o bloco recebidp no canal para processar em sequencia
-	processar_transacoes <- bloco
-	writer.WriteHeader(http.StatusAccepted)
+	// Cada empresa só propaga os blocos de que é autora
+	if bloco.Autor != request.Header.Get("X-Empresa-ID") {
+		logConsenso.WarnContext(request.Context(), "bloco recusado: remetente não é o autor", "hash", bloco.Hash, "autor", bloco.Autor,
+			"remetente", request.Header.Get("X-Empresa-ID"))
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// Enfileira o bloco recebido no canal para processar em sequência e responde com o resultado
+	// da validação: 200 aceito (ou já aceito antes), 409 recusado, 500 erro ao gravar
+	encerramento.blocosRecebidos.iniciar()
+	recebido := blocoRecebido{bloco: bloco, ctx: context.WithoutCancel(request.Context()), recebido: time.Now(), resultado: make(chan int, 1)}
+	processar_transacoes <- recebido
+	select {
+	case status := <-recebido.resultado:
+		writer.WriteHeader(status)
+	case <-request.Context().Done():
+	}
 }
 
 // sincronizacao inicial
 func sincronizarHandler(writer http.ResponseWriter, request *http.Request) {
 	var chain_remota Blockchain
 	if erro := json.NewDecoder(request.Body).Decode(&chain_remota); erro != nil {
-		fmt.Println("Erro ao decodificar blockchain recebida:", erro)
+		logConsenso.WarnContext(request.Context(), "erro ao decodificar blockchain recebida", "erro", erro)
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if len(chain_remota.Chain) > len(blockchain.Chain) && validarBlockchainCompleta(chain_remota) {
-		blockchain = chain_remota
-		SalvarBlockchain("data/chain_"+empresa.ID+".json", blockchain)
-		fmt.Println("Blockchain local atualizada via sincronização inicial.")
+	if chainPreferida(chain_remota.Chain, chainAtual()) && validarBlockchainCompleta(chain_remota) && substituirBlockchain(chain_remota) {
+		logConsenso.InfoContext(request.Context(), "blockchain local atualizada pela sincronização", "remetente", request.Header.Get("X-Empresa-ID"))
 		writer.WriteHeader(http.StatusOK)
 	} else {
-		fmt.Println("Blockchain recebida ignorada - (inválida).")
+		logConsenso.WarnContext(request.Context(), "blockchain recebida ignorada", "remetente", request.Header.Get("X-Empresa-ID"))
 		writer.WriteHeader(http.StatusForbidden)
 	}
 }
@@ -351,7 +445,7 @@ func validarBlockchainCompleta(chain Blockchain) bool {
 		atual := chain.Chain[i]
 		pub_path := "data/empresa_" + atual.Autor + "_public.pem"
 		if !ValidarBloco(atual, anterior) || !ValidarAssinatura(atual.Hash, atual.Assinatura, pub_path) {
-			fmt.Printf("Falha ao validar bloco index [%d] da blockchain\n", atual.Index)
+			logConsenso.Warn("falha ao validar bloco da blockchain", "index", atual.Index, "hash", atual.Hash)
 			return false
 		}
 	}
@@ -363,20 +457,20 @@ func tentarCorrigirBlockchainCorrompida(chain_path string) bool {
 		if id == empresa.ID {
 			continue
 		}
-		fmt.Printf("Buscando blockchain válida da empresa %s para correção...\n", id)
+		logConsenso.Info("buscando blockchain válida para correção", "empresa_remota", id)
 		resp, err := http.Get(api + "/blockchain")
 		if err != nil {
-			fmt.Printf("[LOG] Erro ao buscar blockchain de %s: %v\n", id, err)
+			logConsenso.Warn("erro ao buscar blockchain", "empresa_remota", id, "erro", err)
 			continue
 		}
 		defer resp.Body.Close()
 		var chain_remota Blockchain
 		if err := json.NewDecoder(resp.Body).Decode(&chain_remota); err != nil {
-			fmt.Printf("Erro ao decodificar blockchain de %s: %v\n", id, err)
+			logConsenso.Warn("erro ao decodificar blockchain", "empresa_remota", id, "erro", err)
 			continue
 		}
 		if validarBlockchainCompleta(chain_remota) {
-			fmt.Printf("Blockchain válida encontrada na empresa %s. Corrigindo\n", id)
+			logConsenso.Info("blockchain válida encontrada; corrigindo", "empresa_remota", id)
 			SalvarBlockchain(chain_path, chain_remota)
 			return true
 		}
@@ -393,137 +487,220 @@ func formatarTimestamp(data_hora string) string {
 }
 
 func sincronizarComOutrasEmpresas() {
-	fmt.Println("Sincronizando blockchain...")
+	logConsenso.Info("sincronizando blockchain")
 	max_tentativas := 3
 	for tentativa := 1; tentativa <= max_tentativas; tentativa++ {
-		sincronizou := false
-		for id, api := range empresasAPI {
-			if id == empresa.ID {
-				continue
-			}
-			resp, erro := http.Get(api + "/blockchain")
-			if erro != nil {
-				continue
-			}
-			defer resp.Body.Close()
-			var chain_remota Blockchain
-			if erro := json.NewDecoder(resp.Body).Decode(&chain_remota); erro != nil {
-				continue
-			}
-			if len(chain_remota.Chain) == len(blockchain.Chain) && len(chain_remota.Chain) > 0 {
-				hashLocal := blockchain.Chain[len(blockchain.Chain)-1].Hash
-				hashRemoto := chain_remota.Chain[len(chain_remota.Chain)-1].Hash
-				if hashLocal == hashRemoto {
-					continue
-				}
-			}
-			if len(chain_remota.Chain) > len(blockchain.Chain) && validarBlockchainCompleta(chain_remota) {
-				blockchain = chain_remota
-				SalvarBlockchain("data/chain_"+empresa.ID+".json", blockchain)
-				fmt.Printf("Blockchain sincronizada com a da empresa %s.\n", id)
-				sincronizou = true
-			}
-		}
-		if sincronizou {
+		if sincronizarUmaVez(context.Background()) {
 			break
 		}
 		if tentativa < max_tentativas {
 			time.Sleep(10 * time.Second)
 		}
 	}
-	fmt.Println("Sincronização concluída")
+	logConsenso.Info("sincronização concluída")
+}
+
+// Indica se a chain remota deve substituir a local: a mais longa vence e, no empate entre chains
+// divergentes, a de menor hash no último bloco, para que todas as empresas escolham a mesma
+func chainPreferida(remota, local []Bloco) bool {
+	if len(remota) != len(local) {
+		return len(remota) > len(local)
+	}
+	return len(remota) > 0 && remota[len(remota)-1].Hash < local[len(local)-1].Hash
+}
+
+// Busca a blockchain de cada outra empresa e adota a preferida, se for válida; depois envia a local
+// (POST /peer/sincronizar) às empresas cuja chain ela deve substituir. Retorna se a local mudou
+func sincronizarUmaVez(ctx context.Context) bool {
+	cliente := &http.Client{Timeout: 10 * time.Second}
+	sincronizou := false
+	atrasadas := []string{}
+	for id, api := range empresasAPI {
+		if id == empresa.ID {
+			continue
+		}
+		resp, erro := cliente.Get(api + "/blockchain")
+		if erro != nil {
+			continue
+		}
+		var chain_remota Blockchain
+		erro = json.NewDecoder(resp.Body).Decode(&chain_remota)
+		resp.Body.Close()
+		if erro != nil {
+			continue
+		}
+		local := chainAtual()
+		if chainPreferida(chain_remota.Chain, local) && validarBlockchainCompleta(chain_remota) && substituirBlockchain(chain_remota) {
+			logConsenso.InfoContext(ctx, "blockchain sincronizada", "empresa_remota", id, "altura", blockchain.Tamanho())
+			sincronizou = true
+		} else if chainPreferida(local, chain_remota.Chain) {
+			atrasadas = append(atrasadas, id)
+		}
+	}
+	if len(atrasadas) > 0 {
+		corpo, _ := json.Marshal(blockchain.Snapshot())
+		for _, id := range atrasadas {
+			resp, erro := postPeer(ctx, empresasAPI[id]+"/peer/sincronizar", corpo)
+			if erro != nil {
+				logConsenso.WarnContext(ctx, "blockchain local não enviada", "empresa_remota", id, "erro", erro)
+				continue
+			}
+			resp.Body.Close()
+			logConsenso.InfoContext(ctx, "blockchain local enviada", "empresa_remota", id, "status", resp.StatusCode)
+		}
+	}
+	return sincronizou
+}
+
+// Sincronização pedida quando uma empresa recusa um bloco desta ou envia um bloco que diverge da
+// chain local; pedidos feitos durante uma sincronização em andamento geram uma única rodada a mais
+var sincronizacaoAgendada = make(chan struct{}, 1)
+
+func agendarSincronizacao() {
+	select {
+	case sincronizacaoAgendada <- struct{}{}:
+	default:
+	}
+}
+
+// Atende os pedidos de sincronização em goroutine
+func iniciarSincronizacaoSobDemanda() {
+	go func() {
+		for range sincronizacaoAgendada {
+			if encerrando() {
+				return
+			}
+			logConsenso.Info("blockchain divergente; sincronizando com as outras empresas")
+			metricaSincronizacoes.Inc()
+			sincronizarUmaVez(context.Background())
+		}
+	}()
 }
 
 // Handler para recarga
+// O valor não é aceito do cliente: a recarga é registrada a partir da leitura
+// final assinada pelo medidor do ponto (ver medicao.go)
 func recargaHandler(writer http.ResponseWriter, request *http.Request) {
 	var transacao Transacao
 	if erro := json.NewDecoder(request.Body).Decode(&transacao); erro != nil {
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
-	ultimo := blockchain.Chain[len(blockchain.Chain)-1]
-	hash := CalcularHash(Bloco{
-		Index:        (ultimo.Index + 1),
-		Timestamp:    formatarTimestamp(time.Now().Format(time.RFC3339)),
-		Transacao:    transacao,
-		HashAnterior: ultimo.Hash,
-		Autor:        empresa.ID,
-	})
-	assinatura, erro := AssinarBloco(hash, chave_privada_path)
+	sessao, criada, erro := recargaPorLeitura(request.Context(), transacao.Placa, transacao.Ponto)
+	writer.Header().Set("Content-Type", "application/json")
 	if erro != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	novo_bloco := NovoBloco(transacao, ultimo, empresa.ID, assinatura)
-	if blocoDuplicado(novo_bloco) {
-		fmt.Printf("Bloco duplicado detectado - index [%d] hash (%s). Rejeitando...\n", novo_bloco.Index, novo_bloco.Hash)
-		writer.WriteHeader(http.StatusConflict)
-		return
-	}
-	if !propagarBlocoComConsenso(novo_bloco) {
-		fmt.Println("Consenso não atingido. Bloco REJEITADO")
-		writer.WriteHeader(http.StatusPreconditionFailed)
+		status := http.StatusConflict
+		if !errors.Is(erro, errSemLeitura) {
+			status = statusErroEscrita(erro)
+		}
+		writer.WriteHeader(status)
+		json.NewEncoder(writer).Encode(map[string]string{
+			"status":  "error",
+			"message": erro.Error(),
+		})
 		return
 	}
-	blockchain.Chain = append(blockchain.Chain, novo_bloco)
-	SalvarBlockchain("data/chain_"+empresa.ID+".json", blockchain)
-
-	// Libera automaticamente o ponto após recarga completa
-	liberarPontoCompleto(transacao.Ponto, transacao.Placa)
 
-	fmt.Printf("[HTTP] Recarga processada e ponto %s liberado para %s - Hash: %s\n",
-		transacao.Ponto, transacao.Placa, novo_bloco.Hash)
-	fmt.Println("Consenso atingido. Bloco ADICIONADO")
-	writer.WriteHeader(http.StatusCreated)
+	logRecargas.InfoContext(request.Context(), "recarga registrada", "placa", sessao.Placa, "ponto", sessao.Ponto,
+		"kwh", sessao.KWh, "valor", sessao.Valor, "hash", sessao.HashRecarga)
+	if criada {
+		writer.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"status": "success",
+		"hash":   sessao.HashRecarga,
+		"valor":  sessao.Valor,
+		"kwh":    sessao.KWh,
+		"sessao": sessao.Sessao,
+	})
 }
 
+// Serializa a conferência da recarga pendente e o registro do pagamento, para que dois
+// pagamentos simultâneos não quitem a mesma recarga
+var pagamento_mutex sync.Mutex
+
+// Handler para pagamento
+// Só aceita PAGAMENTO (RECARGA vem do medidor e TARIFA do operador) e apenas de uma recarga
+// pendente da placa, com o mesmo ponto, empresa e valor
 func pagamentoHandler(writer http.ResponseWriter, r *http.Request) {
 	var transacao Transacao
 	if erro := json.NewDecoder(r.Body).Decode(&transacao); erro != nil {
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
-	ultimo := blockchain.Chain[len(blockchain.Chain)-1]
-	hash := CalcularHash(Bloco{
-		Index:        (ultimo.Index + 1),
-		Timestamp:    formatarTimestamp(time.Now().Format(time.RFC3339)),
-		Transacao:    transacao,
-		HashAnterior: ultimo.Hash,
-		Autor:        empresa.ID,
-	})
-	assinatura, erro := AssinarBloco(hash, chave_privada_path)
-	if erro != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+	if transacao.Tipo != "PAGAMENTO" || transacao.Tarifa != nil || transacao.Cotacao != "" {
+		logHTTP.WarnContext(r.Context(), "pagamento recusado: transação inválida", "tipo", transacao.Tipo, "placa", transacao.Placa)
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(writer).Encode(map[string]string{
+			"status":  "error",
+			"message": "Apenas transações PAGAMENTO, sem tarifa nem cotação, são aceitas",
+		})
 		return
 	}
-	novo_bloco := NovoBloco(transacao, ultimo, empresa.ID, assinatura)
-	if blocoDuplicado(novo_bloco) {
-		fmt.Printf("Bloco duplicado detectado - index [%d] hash (%s). Rejeitando...\n", novo_bloco.Index, novo_bloco.Hash)
+
+	pagamento_mutex.Lock()
+	defer pagamento_mutex.Unlock()
+	pendente := false
+	for _, recarga := range RecargasPendentes(transacao.Placa) {
+		if chavePagamento(recarga) == chavePagamento(transacao) {
+			pendente = true
+			break
+		}
+	}
+	if !pendente {
+		logHTTP.WarnContext(r.Context(), "pagamento recusado: nenhuma recarga pendente corresponde", "placa", transacao.Placa,
+			"ponto", transacao.Ponto, "empresa", transacao.Empresa, "valor", transacao.Valor)
+		writer.Header().Set("Content-Type", "application/json")
 		writer.WriteHeader(http.StatusConflict)
+		json.NewEncoder(writer).Encode(map[string]string{
+			"status":  "error",
+			"message": fmt.Sprintf("Nenhuma recarga pendente de %s no ponto %s com valor %.2f", transacao.Placa, transacao.Ponto, transacao.Valor),
+		})
 		return
 	}
-	if !propagarBlocoComConsenso(novo_bloco) {
-		fmt.Println("Consenso não atingido. Bloco REJEITADO")
-		writer.WriteHeader(http.StatusPreconditionFailed)
+	if _, erro := registrarTransacao(r.Context(), transacao, registrarReplicacao(r.Context(), transacao.Tipo+" de "+transacao.Placa)); erro != nil {
+		logHTTP.ErrorContext(r.Context(), "erro ao registrar transação", "tipo", transacao.Tipo, "placa", transacao.Placa, "erro", erro)
+		writer.WriteHeader(statusErroEscrita(erro))
 		return
 	}
-	blockchain.Chain = append(blockchain.Chain, novo_bloco)
-	SalvarBlockchain("data/chain_"+empresa.ID+".json", blockchain)
 	if transacao.Tipo == "PAGAMENTO" && transacao.Empresa == empresa.ID {
 		// Atualiza o saldo da empresa se for pagamento
+		mutex.Lock()
 		empresa.SaldoAtual += transacao.Valor
-		empresa_path := "data/empresa_" + empresa.ID + ".json"
-		data, _ := json.MarshalIndent(empresa, "", "  ")
-		os.WriteFile(empresa_path, data, 0644)
+		if erro := salvarSaldoEmpresa(empresa.SaldoAtual); erro != nil {
+			logHTTP.ErrorContext(r.Context(), "erro ao salvar saldo da empresa", "erro", erro)
+		}
+		mutex.Unlock()
 	}
-	fmt.Println("Consenso atingido. Bloco ADICIONADO")
 	writer.WriteHeader(http.StatusCreated)
 }
 
+// Grava o saldo em data/empresa_<id>.json, preservando o que tiver sido editado nos outros campos
+// O arquivo é de configuração (editado à mão e lido pelas estações), então fica sem envelope
+func salvarSaldoEmpresa(saldo float64) error {
+	empresa_path := "data/empresa_" + empresa.ID + ".json"
+	trava, erro := persistencia.Travar(empresa_path)
+	if erro != nil {
+		return erro
+	}
+	defer trava.Destravar()
+	var dados Empresa
+	file, erro := os.ReadFile(empresa_path)
+	if erro != nil {
+		return erro
+	}
+	if erro := json.Unmarshal(file, &dados); erro != nil {
+		return erro
+	}
+	dados.SaldoAtual = saldo
+	data, erro := json.MarshalIndent(dados, "", "  ")
+	if erro != nil {
+		return erro
+	}
+	return persistencia.GravarArquivo(empresa_path, data, 0644)
+}
+
 // Handler para reserva com controle de concorrência PBL2
 func reservaHandler(writer http.ResponseWriter, request *http.Request) {
 	var transacao Transacao
@@ -548,17 +725,71 @@ func reservaHandler(writer http.ResponseWriter, request *http.Request) {
 
 	ponto := transacao.Ponto
 	placa := transacao.Placa
+	ctx, span := iniciarSpan(request.Context(), "reserva", "placa", placa, "ponto", ponto, "canal", "rest")
+	defer span.finalizar()
+	identidade := identidadeLimite(request, placa)
+	if erro := verificarLimite(identidade); erro != nil {
+		logLimites.InfoContext(ctx, "reserva recusada", "placa", placa, "ponto", ponto, "canal", "rest", "erro", erro)
+		metricaReservas.Inc(ponto, "rest", "limite")
+		span.definir("resultado", "limite")
+		responderLimiteHTTP(writer, erro)
+		return
+	}
 
 	// PBL2 CONCURRENCY: Acquire per-point lock before any operations
-	lock := ponto_locks[ponto]
-	lock.Lock()
+	lock := travarPonto(ponto)
 	defer lock.Unlock()
 
-	fmt.Printf("[HTTP] Processando reserva para %s no ponto %s\n", placa, ponto)
+	logReservas.DebugContext(ctx, "processando reserva", "placa", placa, "ponto", ponto, "canal", "rest")
+	transacao.Tarifa = nil
+
+	// Ponto em manutenção ou desconectado não aceita reservas
+	if motivo := indisponibilidadePonto(ponto); motivo != "" {
+		logReservas.InfoContext(ctx, "reserva recusada: ponto indisponível", "placa", placa, "ponto", ponto, "canal", "rest", "motivo", motivo)
+		metricaReservas.Inc(ponto, "rest", "ponto_offline")
+		span.definir("resultado", "ponto_offline")
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(writer).Encode(map[string]string{
+			"status":  "error",
+			"message": motivo,
+		})
+		return
+	}
+
+	// O preço cotado só vale se a cotação ainda estiver válida
+	desfazerCotacao, erro := vincularCotacaoReserva(transacao.Cotacao, placa, ponto)
+	if erro != nil {
+		logPrecos.InfoContext(ctx, "reserva recusada: cotação inválida", "placa", placa, "ponto", ponto, "cotacao", transacao.Cotacao, "canal", "rest", "erro", erro)
+		metricaReservas.Inc(ponto, "rest", "cotacao_recusada")
+		span.definir("resultado", "cotacao_recusada")
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(writer).Encode(map[string]string{
+			"status":  "error",
+			"message": fmt.Sprintf("Cotação recusada: %v", erro),
+		})
+		return
+	}
+
+	if erro := verificarLimiteReservas(placa, ponto); erro != nil {
+		desfazerCotacao()
+		logLimites.InfoContext(ctx, "reserva recusada", "placa", placa, "ponto", ponto, "canal", "rest", "erro", erro)
+		metricaReservas.Inc(ponto, "rest", "limite")
+		span.definir("resultado", "limite")
+		responderLimiteHTTP(writer, erro)
+		return
+	}
 
 	// PBL2 CONCURRENCY: Check point availability within lock
 	if !marcarPontoReservado(ponto, placa) {
-		fmt.Printf("[HTTP] Ponto %s não disponível para %s\n", ponto, placa)
+		desfazerCotacao()
+		if !verificarPontoDisponivel(ponto, placa) {
+			registrarConflito(identidade)
+		}
+		logReservas.InfoContext(ctx, "reserva recusada: ponto indisponível", "placa", placa, "ponto", ponto, "canal", "rest")
+		metricaReservas.Inc(ponto, "rest", "conflito")
+		span.definir("resultado", "conflito")
 		response := map[string]string{
 			"status":  "error",
 			"message": fmt.Sprintf("Ponto %s não está disponível para reserva", ponto),
@@ -569,39 +800,20 @@ func reservaHandler(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// PBL2 CONCURRENCY: Process blockchain transaction within lock
-	mutex.Lock()
-	ultimo := blockchain.Chain[len(blockchain.Chain)-1]
-	hash := CalcularHash(Bloco{
-		Index:        (ultimo.Index + 1),
-		Timestamp:    formatarTimestamp(time.Now().UTC().Format(time.RFC3339)),
-		Transacao:    transacao,
-		HashAnterior: ultimo.Hash,
-		Autor:        empresa.ID,
-	})
-	assinatura, erro := AssinarBloco(hash, chave_privada_path)
+	// O bloco é gravado pelo pipeline de escrita (escrita.go), fora do lock global
+	novo_bloco, erro := registrarTransacao(ctx, transacao, registrarReplicacao(ctx, "Reserva de "+placa+" em "+ponto))
 	if erro != nil {
-		mutex.Unlock()
 		// PBL2 CONCURRENCY: Rollback reservation on error
 		liberarPontoCompleto(ponto, placa)
-		fmt.Printf("[HTTP] Erro ao assinar bloco para %s: %v\n", placa, erro)
-		writer.WriteHeader(http.StatusInternalServerError)
+		desfazerCotacao()
+		logReservas.ErrorContext(ctx, "erro ao registrar reserva", "placa", placa, "ponto", ponto, "canal", "rest", "erro", erro)
+		span.falhar(erro)
+		metricaReservas.Inc(ponto, "rest", "erro")
+		span.definir("resultado", "erro")
+		writer.WriteHeader(statusErroEscrita(erro))
 		return
 	}
 
-	novo_bloco := NovoBloco(transacao, ultimo, empresa.ID, assinatura)
-	if blocoDuplicado(novo_bloco) {
-		mutex.Unlock()
-		// PBL2 CONCURRENCY: Rollback reservation on duplicate
-		liberarPontoCompleto(ponto, placa)
-		fmt.Printf("[HTTP] Bloco duplicado detectado para %s - index [%d] hash (%s). Rejeitando...\n", placa, novo_bloco.Index, novo_bloco.Hash)
-		writer.WriteHeader(http.StatusConflict)
-		return
-	}
-
-	blockchain.Chain = append(blockchain.Chain, novo_bloco)
-	SalvarBlockchain("data/chain_"+empresa.ID+".json", blockchain)
-	mutex.Unlock()
 	// PBL2 CONCURRENCY: Update reservation memory within lock
 	reservas_mutex.Lock()
 	if _, existe := reservas[placa]; !existe {
@@ -613,13 +825,13 @@ func reservaHandler(writer http.ResponseWriter, request *http.Request) {
 	// Update hash in point control
 	atualizarHashReserva(ponto, placa, novo_bloco.Hash)
 
-	// Propagate block
-	propagarBlocoComConsenso(novo_bloco)
-
 	// PBL2 CONCURRENCY: Start timeout system
-	go liberaPorTimeout(placa, []string{ponto}, 5*time.Minute)
+	liberaPorTimeout(placa, []string{ponto}, tempoExpiracaoReserva)
 
-	fmt.Printf("[HTTP] Reserva confirmada para %s no ponto %s (Hash: %s)\n", placa, ponto, novo_bloco.Hash)
+	logReservas.InfoContext(ctx, "reserva confirmada", "placa", placa, "ponto", ponto, "canal", "rest", "hash", novo_bloco.Hash)
+	span.definir("hash", novo_bloco.Hash)
+	metricaReservas.Inc(ponto, "rest", "confirmada")
+	span.definir("resultado", "confirmada")
 
 	// Retorna o hash da reserva para o cliente
 	response := map[string]string{
@@ -628,121 +840,75 @@ func reservaHandler(writer http.ResponseWriter, request *http.Request) {
 		"message": fmt.Sprintf("Reserva confirmada para %s no ponto %s", placa, ponto),
 	}
 	writer.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(writer).Encode(response)
 	writer.WriteHeader(http.StatusCreated)
-}
-
-func propagarBloco(bloco Bloco) {
-	jsonBloco, _ := json.Marshal(bloco)
-	for id, api := range empresasAPI {
-		if id == empresa.ID {
-			continue
-		}
-		fmt.Printf("Enviando bloco para empresa %s...\n", id)
-		resp, err := http.Post(api+"/bloco", "application/json", bytes.NewBuffer(jsonBloco))
-		if err != nil {
-			fmt.Printf("Erro ao enviar bloco para %s: %v\n", id, err)
-			continue
-		}
-		resp.Body.Close()
-	}
-}
-
-func propagarBlocoComConsenso(bloco Bloco) bool {
-	sucesso := true
-	jsonBloco, _ := json.Marshal(bloco)
-
-	for id, api := range empresasAPI {
-		if id == empresa.ID {
-			continue
-		}
-		fmt.Printf("Enviando bloco para consenso na empresa %s...\n", id)
-		resp, err := http.Post(api+"/bloco", "application/json", bytes.NewBuffer(jsonBloco))
-		if err != nil {
-			fmt.Printf("Erro ao enviar bloco para empresa %s: %v\n", id, err)
-			sucesso = false
-			break
-		}
-		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
-			fmt.Printf("Empresa %s rejeitou o bloco (status %d)\n", id, resp.StatusCode)
-			sucesso = false
-			break
-		}
-		fmt.Printf("Empresa %s aceitou o bloco.\n", id)
-	}
-	return sucesso
-}
-
-func RecargasPendentes(placa string, chain Blockchain) []Transacao {
-	var recargas []Transacao
-	var pagamentos []Transacao
-	//identifica o tipo das transacoes
-	for _, bloco := range chain.Chain {
-		if bloco.Transacao.Placa == placa {
-			if bloco.Transacao.Tipo == "RECARGA" {
-				recargas = append(recargas, bloco.Transacao)
-			} else if bloco.Transacao.Tipo == "PAGAMENTO" {
-				pagamentos = append(pagamentos, bloco.Transacao)
-			}
-		}
-	}
-	//identifica as recargas que nao tem pagamento correspondente
-	var pendentes []Transacao
-	for _, recarga := range recargas {
-		pago := false
-		for _, pagamento := range pagamentos {
-			if pagamento.Ponto == recarga.Ponto && pagamento.Valor == recarga.Valor && pagamento.Empresa == recarga.Empresa {
-				pago = true
-				break
-			}
-		}
-		if !pago {
-			pendentes = append(pendentes, recarga)
-		}
-	}
-	return pendentes
+	json.NewEncoder(writer).Encode(response)
 }
 
 // Função principal da empresa - inicializa servidor HTTP, MQTT e processamento de transações
 func main() {
 	inicializarAPI() // carrega empresa, blockchain, chaves, bloco gênese
+	carregarSegredosVeiculos()
+	inicializaLimites()
+	inicializaBrokerEmbutido()
+	inicializaAutenticacaoBroker()
+	carregarCotacoes()
+	iniciarRastreamento()
 	iniciarProcessadorDeBlocos()
+	iniciarSincronizacaoSobDemanda()
+	iniciarReplicacao()
+	iniciarEscritorBlocos()
+	go persistirIndicesPeriodicamente()
 
 	// Inicializa os handlers REST ANTES de subir o servidor
 	inicializaREST()
 
 	//sobe a api
+	servidor := &http.Server{Addr: ":8" + empresa.ID, Handler: comIDRequisicao(rastrearHTTP(medirHTTP(http.DefaultServeMux)))}
 	go func() {
-		porta := ":8" + empresa.ID
-		log.Printf("Empresa %s [%s] iniciada na porta %s", empresa.Nome, empresa.ID, porta)
-		log.Fatal(http.ListenAndServe(porta, nil))
+		logGeral.Info("empresa iniciada", "nome", empresa.Nome, "porta", servidor.Addr)
+		if erro := servidor.ListenAndServe(); !errors.Is(erro, http.ErrServerClosed) {
+			encerrarComErro(logHTTP, "servidor HTTP encerrado", "erro", erro)
+		}
 	}()
 
+	// Encerramento ordenado com SIGTERM, inclusive durante a sincronização inicial (encerramento.go)
+	go aguardarEncerramento(servidor)
+
 	go func() {
 		time.Sleep(1 * time.Second) // pequena espera para garantir que a API subiu
 		aguardarEmpresasDisponiveis()
 		chain_path := "data/chain_" + empresa.ID + ".json"
-		if !validarBlockchainCompleta(blockchain) {
-			fmt.Println("Blockchain corrompida! Corrigindo...")
+		if !validarBlockchainCompleta(blockchain.Snapshot()) {
+			logConsenso.Warn("blockchain corrompida; corrigindo")
 			if !tentarCorrigirBlockchainCorrompida(chain_path) {
-				log.Fatalf("Blockchain inválida e não foi possível corrigir com as outras empresas. Arquivo %s", chain_path)
+				encerrarComErro(logConsenso, "blockchain inválida e sem correção nas outras empresas", "arquivo", chain_path)
 			}
-			var erro error
-			blockchain, erro = CarregarBlockchain(chain_path)
+			corrigida, erro := CarregarBlockchain(chain_path)
 			if erro != nil {
-				log.Fatalf("Erro ao recarregar blockchain corrigida: %v", erro)
+				encerrarComErro(logConsenso, "erro ao recarregar blockchain corrigida", "erro", erro)
 			}
-			if !validarBlockchainCompleta(blockchain) {
-				log.Fatalf("Blockchain ainda inválida após tentativa de correção. Arquivo %s", chain_path)
+			if !validarBlockchainCompleta(corrigida) {
+				encerrarComErro(logConsenso, "blockchain ainda inválida após a correção", "arquivo", chain_path)
 			}
-			fmt.Println("Blockchain corrigida com sucesso!")
+			mutex.Lock()
+			blockchain.Substituir(corrigida.Chain)
+			indexarChain(chainAtual())
+			mutex.Unlock()
+			logConsenso.Info("blockchain corrigida")
 		}
 		sincronizarComOutrasEmpresas()
-		fmt.Println("Sincronização concluída")
+
+		// Publica as tarifas padrão dos pontos que ainda não têm tarifa na blockchain
+		publicarTarifasIniciais()
 	}()
 
 	sincronizarComOutrasEmpresas() // Inicia sistemas de comunicação
+	inicializaOutbox()
 	inicializaMqtt(empresa.ID)
+	iniciarReenvioOutbox()
+
+	// Reconstrói reservas e timers de expiração a partir do controle de pontos e da blockchain
+	recuperarReservas()
 
 	// Mantém o programa em execução
 	select {}
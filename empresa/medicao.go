@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Medição de energia das recargas
+// A empresa comanda a estação (pontos/<ponto>/comando), recebe as amostras do medidor
+// (pontos/<ponto>/medicao) e a leitura final assinada (pontos/<ponto>/leitura). A transação
+// RECARGA é criada pela empresa a partir dessa leitura, nunca a partir de valores do cliente.
+
+// Estados de uma sessão de recarga
+const (
+	sessaoAguardando = "AGUARDANDO" // comando enviado à estação
+	sessaoCarregando = "CARREGANDO"
+	sessaoMedida     = "MEDIDA"     // leitura final recebida e validada
+	sessaoRegistrada = "REGISTRADA" // transação RECARGA adicionada à blockchain
+	sessaoRecusada   = "RECUSADA"
+)
+
+// Sessão de recarga em um ponto desta empresa
+type SessaoRecarga struct {
+	Sessao      string  `json:"sessao"`
+	Placa       string  `json:"placa"`
+	Ponto       string  `json:"ponto"`
+	HashReserva string  `json:"hash_reserva"`
+	KWhAlvo     float64 `json:"kwh_alvo"`
+	KWh         float64 `json:"kwh"`
+	PotenciaKW  float64 `json:"potencia_kw"`
+	Inicio      string  `json:"inicio"`
+	Fim         string  `json:"fim"`
+	Estado      string  `json:"estado"`
+	Valor       float64 `json:"valor"`
+	HashTarifa  string  `json:"hash_tarifa,omitempty"`
+	HashCotacao string  `json:"hash_cotacao,omitempty"`
+	HashRecarga string  `json:"hash_recarga"`
+	Correlacao  string  `json:"correlacao,omitempty"`
+	Requisicao  string  `json:"requisicao_id,omitempty"` // ID de requisição de quem iniciou a sessão (logs)
+}
+
+// Requisição para iniciar ou parar uma recarga
+type RecargaRequest struct {
+	Placa       string  `json:"placa"`
+	Ponto       string  `json:"ponto"`
+	HashReserva string  `json:"hash_reserva"`
+	KWhAlvo     float64 `json:"kwh_alvo"`
+	// Correlação ecoada nas notificações MQTT da sessão (padrão: o ID da sessão)
+	Correlacao string `json:"correlacao,omitempty"`
+}
+
+var errSemLeitura = errors.New("nenhuma leitura de medidor disponível para esta placa e ponto")
+
+// Por quanto tempo uma sessão encerrada (registrada ou recusada) continua consultável antes de
+// sair da memória; nesse intervalo, repetir o pedido de recarga devolve o mesmo bloco
+const retencaoSessaoEncerrada = 10 * time.Minute
+
+// Controle das sessões de recarga (sessao -> dados)
+var sessoes_recarga = struct {
+	sync.Mutex
+	sessoes map[string]*SessaoRecarga
+}{sessoes: make(map[string]*SessaoRecarga)}
+
+// Locks de registro por sessão: garantem que apenas uma leitura por vez da mesma sessão seja
+// transformada em RECARGA (e o ponto liberado uma vez), sem que sessões diferentes esperem umas
+// pelas outras
+var registro_recarga = struct {
+	sync.Mutex
+	travas map[string]*sync.Mutex
+}{travas: make(map[string]*sync.Mutex)}
+
+// Adquire o lock de registro da sessão
+func travarRegistroRecarga(id string) *sync.Mutex {
+	registro_recarga.Lock()
+	trava, existe := registro_recarga.travas[id]
+	if !existe {
+		trava = &sync.Mutex{}
+		registro_recarga.travas[id] = trava
+	}
+	registro_recarga.Unlock()
+	trava.Lock()
+	return trava
+}
+
+// Gera identificador aleatório para a sessão de recarga
+func gerarIDSessao() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Calcula o hash da leitura final; é o que a estação assina com sua chave privada
+func calcularHashLeitura(ponto, placa, sessao string, kwh float64, inicio, fim string) string {
+	dados := strings.Join([]string{ponto, placa, sessao, strconv.FormatFloat(kwh, 'f', 3, 64), inicio, fim}, "|")
+	hash := sha256.Sum256([]byte(dados))
+	return hex.EncodeToString(hash[:])
+}
+
+// Busca a sessão ativa (não finalizada) de um ponto
+func sessaoAtivaDoPonto(ponto string) *SessaoRecarga {
+	for _, sessao := range sessoes_recarga.sessoes {
+		if sessao.Ponto == ponto && (sessao.Estado == sessaoAguardando || sessao.Estado == sessaoCarregando) {
+			return sessao
+		}
+	}
+	return nil
+}
+
+// Indica se a placa tem uma recarga em andamento (aguardando ou carregando) no ponto
+func recargaEmAndamento(ponto, placa string) bool {
+	sessoes_recarga.Lock()
+	defer sessoes_recarga.Unlock()
+	sessao := sessaoAtivaDoPonto(ponto)
+	return sessao != nil && sessao.Placa == placa
+}
+
+// Remove a sessão encerrada da memória depois de retencaoSessaoEncerrada
+func descartarSessaoDepois(id string) {
+	time.AfterFunc(retencaoSessaoEncerrada, func() {
+		sessoes_recarga.Lock()
+		delete(sessoes_recarga.sessoes, id)
+		sessoes_recarga.Unlock()
+		registro_recarga.Lock()
+		delete(registro_recarga.travas, id)
+		registro_recarga.Unlock()
+	})
+}
+
+// Handler para iniciar a recarga em um ponto reservado
+func handleIniciarRecarga(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RecargaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Erro ao decodificar JSON", http.StatusBadRequest)
+		return
+	}
+
+	if erro := verificarLimite(identidadeLimite(r, req.Placa)); erro != nil {
+		responderLimiteHTTP(w, erro)
+		return
+	}
+
+	sessao, status, err := iniciarSessaoRecarga(r.Context(), req)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "success",
+		"sessao":   sessao.Sessao,
+		"kwh_alvo": sessao.KWhAlvo,
+		"message":  fmt.Sprintf("Recarga solicitada à estação do ponto %s", sessao.Ponto),
+	})
+}
+
+// Valida a reserva e envia o comando de início para a estação
+func iniciarSessaoRecarga(ctx context.Context, req RecargaRequest) (*SessaoRecarga, int, error) {
+	if !pontoDaEmpresa(req.Ponto) {
+		return nil, http.StatusNotFound, fmt.Errorf("ponto %s não pertence a esta empresa", req.Ponto)
+	}
+
+	status_ponto.RLock()
+	conectado := status_ponto.status[req.Ponto]
+	status_ponto.RUnlock()
+	if !conectado {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("ponto %s está offline", req.Ponto)
+	}
+
+	// A recarga só pode ocorrer no conector reservado para a placa
+	controlePontos.RLock()
+	reserva, existe := controlePontos.pontos[req.Ponto]
+	controlePontos.RUnlock()
+	if !existe || reserva.Status != "RESERVADO" || reserva.Placa != req.Placa {
+		return nil, http.StatusConflict, fmt.Errorf("ponto %s não está reservado para %s", req.Ponto, req.Placa)
+	}
+	if req.HashReserva != "" && reserva.HashReserva != "" && req.HashReserva != reserva.HashReserva {
+		return nil, http.StatusConflict, fmt.Errorf("hash de reserva não confere para o ponto %s", req.Ponto)
+	}
+
+	sessoes_recarga.Lock()
+	if ativa := sessaoAtivaDoPonto(req.Ponto); ativa != nil {
+		sessoes_recarga.Unlock()
+		return nil, http.StatusConflict, fmt.Errorf("ponto %s já possui uma recarga em andamento", req.Ponto)
+	}
+	sessao := &SessaoRecarga{
+		Sessao:      gerarIDSessao(),
+		Placa:       req.Placa,
+		Ponto:       req.Ponto,
+		HashReserva: reserva.HashReserva,
+		KWhAlvo:     req.KWhAlvo,
+		Estado:      sessaoAguardando,
+		Correlacao:  req.Correlacao,
+		Requisicao:  requisicaoDoContexto(ctx),
+	}
+	if sessao.Correlacao == "" {
+		sessao.Correlacao = sessao.Sessao
+	}
+	sessoes_recarga.sessoes[sessao.Sessao] = sessao
+	sessoes_recarga.Unlock()
+
+	if mqttClient == nil || !mqttClient.IsConnected() {
+		sessoes_recarga.Lock()
+		sessao.Estado = sessaoRecusada
+		sessoes_recarga.Unlock()
+		descartarSessaoDepois(sessao.Sessao)
+		return nil, http.StatusServiceUnavailable, errors.New("sem conexão com as estações")
+	}
+	publicarEnvelope(mqttClient, "pontos/"+sessao.Ponto+"/comando", "INICIAR", MensagemPonto{
+		Ponto:   sessao.Ponto,
+		Placa:   sessao.Placa,
+		Sessao:  sessao.Sessao,
+		KWhAlvo: sessao.KWhAlvo,
+	}, false)
+
+	logRecargas.InfoContext(ctx, "sessão de recarga iniciada", "sessao", sessao.Sessao, "placa", sessao.Placa, "ponto", sessao.Ponto)
+	return sessao, http.StatusAccepted, nil
+}
+
+// Handler para interromper uma recarga em andamento
+func handlePararRecarga(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RecargaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Erro ao decodificar JSON", http.StatusBadRequest)
+		return
+	}
+
+	sessoes_recarga.Lock()
+	sessao := sessaoAtivaDoPonto(req.Ponto)
+	if sessao == nil || sessao.Placa != req.Placa {
+		sessoes_recarga.Unlock()
+		http.Error(w, "Nenhuma recarga em andamento para esta placa no ponto", http.StatusNotFound)
+		return
+	}
+	id := sessao.Sessao
+	sessoes_recarga.Unlock()
+
+	publicarEnvelope(mqttClient, "pontos/"+req.Ponto+"/comando", "PARAR", MensagemPonto{Ponto: req.Ponto, Placa: req.Placa, Sessao: id}, false)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success", "sessao": id})
+}
+
+// Handler para amostras do medidor (sessão, kWh acumulado e potência)
+func handleMedicaoMqtt(client mqtt.Client, msg mqtt.Message) {
+	var dados MensagemPonto
+	envelope, ok := receberMensagem(client, msg, envelopePontoDeCSV, &dados)
+	if !ok || envelope.Tipo != "MEDICAO" || !pontoDaEmpresa(dados.Ponto) {
+		return
+	}
+	kwh, kw := dados.KWh, dados.KW
+
+	sessoes_recarga.Lock()
+	sessao, existe := sessoes_recarga.sessoes[dados.Sessao]
+	if !existe || sessao.Ponto != dados.Ponto {
+		sessoes_recarga.Unlock()
+		return
+	}
+	sessao.KWh = kwh
+	sessao.PotenciaKW = kw
+	origem := OrigemRequisicao{Placa: sessao.Placa, Correlacao: sessao.Correlacao, Requisicao: sessao.Requisicao}
+	sessoes_recarga.Unlock()
+
+	// Repassa a telemetria apenas para o veículo da sessão
+	responderVeiculo(origem, "recarga_medicao", MensagemVeiculo{Ponto: dados.Ponto, Sessao: dados.Sessao, KWh: kwh, KW: kw})
+}
+
+// Handler para eventos de sessão da estação (INICIADA, RECUSADA, ...)
+func handleSessaoEstacaoMqtt(client mqtt.Client, msg mqtt.Message) {
+	var dados MensagemPonto
+	envelope, ok := receberMensagem(client, msg, envelopePontoDeCSV, &dados)
+	if !ok || envelope.Tipo != "SESSAO" || !pontoDaEmpresa(dados.Ponto) {
+		return
+	}
+	detalhe := dados.Detalhe
+
+	sessoes_recarga.Lock()
+	sessao, existe := sessoes_recarga.sessoes[dados.Sessao]
+	if !existe || sessao.Ponto != dados.Ponto {
+		sessoes_recarga.Unlock()
+		return
+	}
+	origem := OrigemRequisicao{Placa: sessao.Placa, Correlacao: sessao.Correlacao, Requisicao: sessao.Requisicao}
+	estado := dados.Estado
+	switch estado {
+	case "INICIADA":
+		sessao.Estado = sessaoCarregando
+		sessao.Inicio = detalhe
+	case "RECUSADA":
+		sessao.Estado = sessaoRecusada
+		descartarSessaoDepois(sessao.Sessao)
+	}
+	sessoes_recarga.Unlock()
+
+	switch estado {
+	case "INICIADA":
+		responderVeiculo(origem, "recarga_iniciada", MensagemVeiculo{Ponto: dados.Ponto, Sessao: dados.Sessao})
+	case "RECUSADA":
+		logRecargas.WarnContext(origem.contexto(), "estação recusou a sessão", "sessao", dados.Sessao, "ponto", dados.Ponto, "placa", origem.Placa, "detalhe", detalhe)
+		responderVeiculo(origem, "recarga_negada", MensagemVeiculo{Ponto: dados.Ponto, Sessao: dados.Sessao, Mensagem: detalhe})
+	}
+}
+
+// Handler para leitura final assinada pela estação
+func handleLeituraMqtt(client mqtt.Client, msg mqtt.Message) {
+	var dados MensagemPonto
+	envelope, ok := receberMensagem(client, msg, envelopePontoDeCSV, &dados)
+	if !ok || envelope.Tipo != "LEITURA" || !pontoDaEmpresa(dados.Ponto) {
+		return
+	}
+	ponto, placa, id := dados.Ponto, dados.Placa, dados.Sessao
+	kwh := dados.KWh
+	inicio, fim, assinatura := dados.Inicio, dados.Fim, dados.Assinatura
+
+	// Só aceita leituras assinadas pela estação desta empresa
+	hash := calcularHashLeitura(ponto, placa, id, kwh, inicio, fim)
+	chave_estacao := "data/estacao_" + empresa.ID + "_public.pem"
+	if !ValidarAssinatura(hash, assinatura, chave_estacao) {
+		logRecargas.Warn("leitura com assinatura inválida descartada", "sessao", id, "ponto", ponto)
+		return
+	}
+
+	sessoes_recarga.Lock()
+	sessao, existe := sessoes_recarga.sessoes[id]
+	if !existe || sessao.Ponto != ponto || sessao.Placa != placa {
+		sessoes_recarga.Unlock()
+		logRecargas.Warn("leitura de sessão desconhecida descartada", "sessao", id, "ponto", ponto, "placa", placa)
+		return
+	}
+	if sessao.Estado == sessaoMedida || sessao.Estado == sessaoRegistrada {
+		sessoes_recarga.Unlock()
+		return
+	}
+	sessao.KWh = kwh
+	sessao.Inicio = inicio
+	sessao.Fim = fim
+	sessao.Estado = sessaoMedida
+	origem := OrigemRequisicao{Placa: placa, Correlacao: sessao.Correlacao, Requisicao: sessao.Requisicao}
+	sessoes_recarga.Unlock()
+	ctx := origem.contexto()
+
+	logRecargas.InfoContext(ctx, "leitura final recebida", "sessao", id, "kwh", kwh, "ponto", ponto, "placa", placa)
+
+	registrada, _, err := registrarRecargaMedida(ctx, id)
+	if err != nil {
+		logRecargas.ErrorContext(ctx, "erro ao registrar recarga", "sessao", id, "ponto", ponto, "placa", placa, "erro", err)
+		responderVeiculo(origem, "recarga_erro", MensagemVeiculo{Ponto: ponto, Sessao: id, Mensagem: "Falha ao registrar recarga na blockchain"})
+		return
+	}
+
+	responderVeiculo(origem, "recarga_confirmada", MensagemVeiculo{
+		Ponto:  ponto,
+		Sessao: id,
+		Valor:  registrada.Valor,
+		KWh:    registrada.KWh,
+		Hash:   registrada.HashRecarga,
+	})
+}
+
+// Transforma a leitura validada de uma sessão em transação RECARGA na blockchain e libera o ponto
+// Retorna uma cópia da sessão já registrada e se o bloco foi criado nesta chamada; a conferência
+// do estado e a marcação como registrada ficam sob o lock de registro da sessão, de modo que leituras
+// concorrentes da mesma sessão (MQTT e REST) criam um único bloco e liberam o ponto uma vez
+// Se o preço não puder ser definido, a sessão é recusada (a reserva segue o prazo normal)
+func registrarRecargaMedida(ctx context.Context, id string) (SessaoRecarga, bool, error) {
+	trava := travarRegistroRecarga(id)
+	defer trava.Unlock()
+
+	sessoes_recarga.Lock()
+	sessao, existe := sessoes_recarga.sessoes[id]
+	if !existe {
+		sessoes_recarga.Unlock()
+		return SessaoRecarga{}, false, errSemLeitura
+	}
+	if sessao.Estado == sessaoRegistrada {
+		copia := *sessao
+		sessoes_recarga.Unlock()
+		return copia, false, nil
+	}
+	if sessao.Estado != sessaoMedida {
+		sessoes_recarga.Unlock()
+		return SessaoRecarga{}, false, errSemLeitura
+	}
+	// Vale o preço cotado na reserva ou, sem cotação, a tarifa em vigor no início da recarga
+	inicio, erro := time.Parse(time.RFC3339, sessao.Inicio)
+	if erro != nil {
+		inicio = time.Now()
+	}
+	placa, ponto, kwh, hashReserva := sessao.Placa, sessao.Ponto, sessao.KWh, sessao.HashReserva
+	sessoes_recarga.Unlock()
+
+	tarifa, hashTarifa, hashCotacao, erro := precoDaRecarga(ponto, hashReserva, inicio)
+	if erro != nil {
+		sessoes_recarga.Lock()
+		sessao.Estado = sessaoRecusada
+		sessoes_recarga.Unlock()
+		descartarSessaoDepois(id)
+		logRecargas.ErrorContext(ctx, "recarga recusada: preço não definido", "sessao", id, "placa", placa, "ponto", ponto, "erro", erro)
+		return SessaoRecarga{}, false, fmt.Errorf("preço da recarga não definido: %w", erro)
+	}
+	// A estação ainda não informa quando o conector é retirado, então não há ociosidade a cobrar
+	transacao := Transacao{
+		Tipo:    "RECARGA",
+		Placa:   placa,
+		Valor:   calcularValorRecarga(tarifa, kwh, 0),
+		Ponto:   ponto,
+		Empresa: empresa.ID,
+		Cotacao: hashCotacao,
+	}
+
+	bloco, err := registrarTransacao(ctx, transacao, registrarReplicacao(ctx, "Recarga de "+placa+" em "+ponto))
+	if err != nil {
+		return SessaoRecarga{}, false, err
+	}
+
+	sessoes_recarga.Lock()
+	sessao.Valor = transacao.Valor
+	sessao.HashTarifa = hashTarifa
+	sessao.HashCotacao = hashCotacao
+	sessao.HashRecarga = bloco.Hash
+	sessao.Estado = sessaoRegistrada
+	copia := *sessao
+	sessoes_recarga.Unlock()
+	descartarSessaoDepois(id)
+
+	logRecargas.InfoContext(ctx, "recarga registrada", "sessao", copia.Sessao, "placa", copia.Placa, "ponto", copia.Ponto,
+		"kwh", copia.KWh, "valor", copia.Valor, "hash", copia.HashRecarga)
+
+	// Libera automaticamente o ponto após recarga completa
+	liberarPontoAposRecarga(placa, ponto)
+	return copia, true, nil
+}
+
+// Localiza a leitura mais recente da placa no ponto e garante que ela virou RECARGA
+// Retorna a sessão e se o bloco foi criado nesta chamada
+func recargaPorLeitura(ctx context.Context, placa, ponto string) (SessaoRecarga, bool, error) {
+	sessoes_recarga.Lock()
+	var maisRecente *SessaoRecarga
+	for _, sessao := range sessoes_recarga.sessoes {
+		if sessao.Placa != placa || sessao.Ponto != ponto {
+			continue
+		}
+		if sessao.Estado != sessaoMedida && sessao.Estado != sessaoRegistrada {
+			continue
+		}
+		if maisRecente == nil || sessao.Fim > maisRecente.Fim {
+			maisRecente = sessao
+		}
+	}
+	if maisRecente == nil {
+		sessoes_recarga.Unlock()
+		return SessaoRecarga{}, false, errSemLeitura
+	}
+	id := maisRecente.Sessao
+	sessoes_recarga.Unlock()
+
+	return registrarRecargaMedida(ctx, id)
+}
+
+// Handler para consultar as sessões de recarga (opcionalmente por placa)
+func handleSessoesRecarga(w http.ResponseWriter, r *http.Request) {
+	placa := r.URL.Query().Get("placa")
+
+	sessoes_recarga.Lock()
+	lista := make([]SessaoRecarga, 0, len(sessoes_recarga.sessoes))
+	for _, sessao := range sessoes_recarga.sessoes {
+		if placa == "" || sessao.Placa == placa {
+			lista = append(lista, *sessao)
+		}
+	}
+	sessoes_recarga.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"empresa_id": empresa.ID,
+		"sessoes":    lista,
+		"timestamp":  time.Now().Format(time.RFC3339),
+	})
+}
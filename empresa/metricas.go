@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Métricas da empresa no formato texto do Prometheus, em GET /metrics
+// Contadores e histogramas são atualizados nos pontos instrumentados (REST, MQTT, processamento
+// de blocos, pipeline de escrita, replicação e reservas); os gauges são lidos do estado atual a
+// cada coleta. Toda série leva o rótulo empresa, além dos rótulos próprios (ponto, tipo...).
+
+const (
+	tipoContador  = "counter"
+	tipoGauge     = "gauge"
+	tipoHistogram = "histogram"
+)
+
+// Limites (em segundos) dos histogramas de duração
+var baldesDuracao = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Uma métrica e as suas séries, uma por combinação de valores dos rótulos
+type familiaMetrica struct {
+	sync.Mutex
+	nome    string
+	ajuda   string
+	tipo    string
+	rotulos []string
+	baldes  []float64 // só histogramas
+	series  map[string]*serieMetrica
+}
+
+type serieMetrica struct {
+	valores  []string
+	valor    float64  // contador ou gauge
+	baldes   []uint64 // histograma: observações em cada faixa (não acumuladas)
+	soma     float64
+	contagem uint64
+}
+
+var familiasMetricas []*familiaMetrica
+
+func novaMetrica(nome, ajuda, tipo string, baldes []float64, rotulos ...string) *familiaMetrica {
+	familia := &familiaMetrica{nome: nome, ajuda: ajuda, tipo: tipo, rotulos: rotulos, baldes: baldes, series: make(map[string]*serieMetrica)}
+	familiasMetricas = append(familiasMetricas, familia)
+	return familia
+}
+
+func novoContador(nome, ajuda string, rotulos ...string) *familiaMetrica {
+	return novaMetrica(nome, ajuda, tipoContador, nil, rotulos...)
+}
+
+func novoGauge(nome, ajuda string, rotulos ...string) *familiaMetrica {
+	return novaMetrica(nome, ajuda, tipoGauge, nil, rotulos...)
+}
+
+func novoHistograma(nome, ajuda string, baldes []float64, rotulos ...string) *familiaMetrica {
+	return novaMetrica(nome, ajuda, tipoHistogram, baldes, rotulos...)
+}
+
+// Série dos valores de rótulos; chamada com o lock da família
+func (f *familiaMetrica) serie(valores []string) *serieMetrica {
+	if len(valores) != len(f.rotulos) {
+		panic(fmt.Sprintf("métrica %s: %d valores para %d rótulos", f.nome, len(valores), len(f.rotulos)))
+	}
+	chave := strings.Join(valores, "\xff")
+	serie, existe := f.series[chave]
+	if !existe {
+		serie = &serieMetrica{valores: append([]string(nil), valores...)}
+		if f.tipo == tipoHistogram {
+			serie.baldes = make([]uint64, len(f.baldes))
+		}
+		f.series[chave] = serie
+	}
+	return serie
+}
+
+func (f *familiaMetrica) Inc(valores ...string) {
+	f.Somar(1, valores...)
+}
+
+func (f *familiaMetrica) Somar(valor float64, valores ...string) {
+	f.Lock()
+	f.serie(valores).valor += valor
+	f.Unlock()
+}
+
+// Gauges: valor atual
+func (f *familiaMetrica) Definir(valor float64, valores ...string) {
+	f.Lock()
+	f.serie(valores).valor = valor
+	f.Unlock()
+}
+
+// Gauges recalculados a cada coleta: descarta as séries anteriores
+func (f *familiaMetrica) Zerar() {
+	f.Lock()
+	f.series = make(map[string]*serieMetrica)
+	f.Unlock()
+}
+
+func (f *familiaMetrica) Observar(valor float64, valores ...string) {
+	f.Lock()
+	serie := f.serie(valores)
+	for i, limite := range f.baldes {
+		if valor <= limite {
+			serie.baldes[i]++
+			break
+		}
+	}
+	serie.soma += valor
+	serie.contagem++
+	f.Unlock()
+}
+
+// Observa a duração desde inicio, em segundos
+func (f *familiaMetrica) ObservarDesde(inicio time.Time, valores ...string) {
+	f.Observar(time.Since(inicio).Seconds(), valores...)
+}
+
+var (
+	metricaAlturaBlockchain = novoGauge("empresa_blockchain_altura", "Blocos na blockchain local")
+	metricaBlocosRecebidos  = novoContador("empresa_blocos_recebidos_total",
+		"Blocos de outras empresas processados, por autor e resultado (aceito, duplicado, divergente, rejeitado, erro_gravacao)", "autor", "resultado")
+	metricaBlocosGravados = novoContador("empresa_blocos_gravados_total", "Blocos desta empresa gravados pelo pipeline de escrita, por tipo de transação", "tipo")
+	metricaErrosEscrita   = novoContador("empresa_erros_escrita_total", "Pedidos de escrita que falharam, por etapa (assinatura, validacao, gravacao)", "etapa")
+	metricaTamanhoLote    = novoHistograma("empresa_lote_escrita_blocos", "Blocos por lote gravado pelo pipeline de escrita",
+		[]float64{1, 2, 4, 8, 16, 32, 64})
+	metricaGravacaoBlockchain = novoHistograma("empresa_gravacao_blockchain_segundos", "Duração da gravação do arquivo da blockchain", baldesDuracao)
+	metricaSubstituicoes      = novoContador("empresa_blockchain_substituicoes_total", "Trocas da blockchain local pela preferida na sincronização")
+	metricaSincronizacoes     = novoContador("empresa_sincronizacoes_sob_demanda_total", "Sincronizações iniciadas por bloco recusado ou divergente")
+	metricaAssinatura         = novoHistograma("empresa_assinatura_segundos", "Duração das assinaturas RSA (blocos, requisições entre empresas, cotações e credenciais)", baldesDuracao)
+	metricaReplicacaoEnvios   = novoContador("empresa_replicacao_envios_total",
+		"Envios de blocos às outras empresas, por destino e resultado (aceito, recusado, falha)", "destino", "resultado")
+	metricaReplicacaoPendente = novoGauge("empresa_replicacao_pendente", "Blocos aguardando envio, por empresa de destino", "destino")
+	metricaReservas           = novoContador("empresa_reservas_total",
+		"Pedidos de reserva, por ponto, canal (rest, mqtt, coordenada) e resultado (confirmada, conflito, limite, cotacao_recusada, ponto_offline, erro)",
+		"ponto", "canal", "resultado")
+	metricaReservasExpiradas = novoContador("empresa_reservas_expiradas_total", "Reservas liberadas por timeout, por ponto", "ponto")
+	metricaEsperaLockPonto   = novoHistograma("empresa_espera_lock_ponto_segundos", "Espera pelo lock do ponto", baldesDuracao, "ponto")
+	metricaPontoOnline       = novoGauge("empresa_ponto_online", "1 se o ponto está online", "ponto")
+	metricaPontoReservado    = novoGauge("empresa_ponto_reservado", "1 se o ponto está reservado", "ponto")
+	metricaMqttRecebidas     = novoContador("empresa_mqtt_mensagens_recebidas_total", "Mensagens MQTT recebidas, por tipo do envelope (invalida se não decodificou)", "tipo")
+	metricaMqttEnviadas      = novoContador("empresa_mqtt_mensagens_enviadas_total", "Mensagens MQTT publicadas, por tipo do envelope", "tipo")
+	metricaOutboxReenvios    = novoContador("empresa_outbox_reenvios_total", "Mensagens da outbox reenviadas aos veículos")
+	metricaRejeicoesLimite   = novoContador("empresa_rejeicoes_limite_total", "Requisições recusadas pelos limites de uso, por motivo", "motivo")
+	metricaSpansDescartados  = novoContador("empresa_spans_descartados_total", "Spans descartados com a fila de exportação cheia")
+	metricaHTTP              = novoHistograma("empresa_http_requisicao_segundos",
+		"Duração das requisições REST, por rota, método e status", baldesDuracao, "rota", "metodo", "status")
+)
+
+// Atualiza os gauges a partir do estado atual
+func coletarGauges() {
+	metricaAlturaBlockchain.Definir(float64(blockchain.Tamanho()))
+
+	metricaReplicacaoPendente.Zerar()
+	for destino, pendentes := range blocosAguardandoReplicacao() {
+		metricaReplicacaoPendente.Definir(float64(pendentes), destino)
+	}
+
+	status_ponto.RLock()
+	for _, ponto := range empresa.Pontos {
+		metricaPontoOnline.Definir(booleanoMetrica(status_ponto.status[ponto]), ponto)
+	}
+	status_ponto.RUnlock()
+
+	controlePontos.RLock()
+	for _, ponto := range empresa.Pontos {
+		metricaPontoReservado.Definir(booleanoMetrica(controlePontos.pontos[ponto].Status == "RESERVADO"), ponto)
+	}
+	controlePontos.RUnlock()
+}
+
+func booleanoMetrica(valor bool) float64 {
+	if valor {
+		return 1
+	}
+	return 0
+}
+
+// GET /metrics
+func handleMetricas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	coletarGauges()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	var texto strings.Builder
+	for _, familia := range familiasMetricas {
+		familia.escrever(&texto)
+	}
+	w.Write([]byte(texto.String()))
+}
+
+func (f *familiaMetrica) escrever(texto *strings.Builder) {
+	f.Lock()
+	defer f.Unlock()
+	fmt.Fprintf(texto, "# HELP %s %s\n# TYPE %s %s\n", f.nome, f.ajuda, f.nome, f.tipo)
+	chaves := make([]string, 0, len(f.series))
+	for chave := range f.series {
+		chaves = append(chaves, chave)
+	}
+	sort.Strings(chaves)
+	for _, chave := range chaves {
+		serie := f.series[chave]
+		if f.tipo != tipoHistogram {
+			fmt.Fprintf(texto, "%s%s %s\n", f.nome, f.rotulosTexto(serie.valores, ""), numeroMetrica(serie.valor))
+			continue
+		}
+		var acumulado uint64
+		for i, limite := range f.baldes {
+			acumulado += serie.baldes[i]
+			fmt.Fprintf(texto, "%s_bucket%s %d\n", f.nome, f.rotulosTexto(serie.valores, numeroMetrica(limite)), acumulado)
+		}
+		fmt.Fprintf(texto, "%s_bucket%s %d\n", f.nome, f.rotulosTexto(serie.valores, "+Inf"), serie.contagem)
+		fmt.Fprintf(texto, "%s_sum%s %s\n", f.nome, f.rotulosTexto(serie.valores, ""), numeroMetrica(serie.soma))
+		fmt.Fprintf(texto, "%s_count%s %d\n", f.nome, f.rotulosTexto(serie.valores, ""), serie.contagem)
+	}
+}
+
+// {empresa="001",rotulo="valor",...}, com le no fim para os baldes de histograma
+func (f *familiaMetrica) rotulosTexto(valores []string, le string) string {
+	var texto strings.Builder
+	texto.WriteString(`{empresa="` + escaparRotulo(empresa.ID) + `"`)
+	for i, rotulo := range f.rotulos {
+		texto.WriteString("," + rotulo + `="` + escaparRotulo(valores[i]) + `"`)
+	}
+	if le != "" {
+		texto.WriteString(`,le="` + le + `"`)
+	}
+	texto.WriteString("}")
+	return texto.String()
+}
+
+func escaparRotulo(valor string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(valor)
+}
+
+func numeroMetrica(valor float64) string {
+	return strconv.FormatFloat(valor, 'g', -1, 64)
+}
+
+// Envolve o servidor HTTP para medir as requisições; a rota é o padrão registrado no ServeMux
+func medirHTTP(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inicio := time.Now()
+		resposta := &respostaMedida{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(resposta, r)
+		rota := r.Pattern
+		if rota == "" {
+			rota = "desconhecida"
+		}
+		metricaHTTP.ObservarDesde(inicio, rota, r.Method, strconv.Itoa(resposta.status))
+	})
+}
+
+// ResponseWriter que guarda o status; repassa Flush (stream de eventos) e Hijack (WebSocket do painel)
+type respostaMedida struct {
+	http.ResponseWriter
+	status  int
+	escrito bool
+}
+
+func (r *respostaMedida) WriteHeader(status int) {
+	if !r.escrito {
+		r.status = status
+		r.escrito = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *respostaMedida) Write(dados []byte) (int, error) {
+	r.escrito = true
+	return r.ResponseWriter.Write(dados)
+}
+
+func (r *respostaMedida) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *respostaMedida) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("conexão não suporta hijack")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (r *respostaMedida) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
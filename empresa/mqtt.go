@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -25,14 +29,71 @@ func liberarPontoCompleto(ponto, placa string) {
 	}
 	reservas_mutex.Unlock()
 
-	fmt.Printf("[CLEANUP] Ponto %s liberado completamente para %s\n", ponto, placa)
+	logReservas.Debug("ponto liberado", "ponto", ponto, "placa", placa)
 }
 
-// Publica mensagem em um tópico MQTT específico
-func publicaMensagemMqtt(client mqtt.Client, topico string, mensagem string) {
-	token := client.Publish(topico, 0, false, mensagem)
+// Destino da resposta a uma requisição de veículo
+type OrigemRequisicao struct {
+	Placa       string
+	Topico      string
+	Correlacao  string
+	Requisicao  string // ID de requisição gerado pelo veículo, ecoado nas respostas
+	Traceparent string // span do veículo que enviou a requisição
+	Identidade  string // placa garantida pela ACL do broker (tópico por placa); "" no tópico compartilhado
+	ClienteID   string // client ID que publicou (veiculo_<placa> no tópico por placa); "" no tópico compartilhado
+}
+
+// Contexto para os logs e o rastreamento da requisição
+func (origem OrigemRequisicao) contexto() context.Context {
+	return comTraceparent(comRequisicao(context.Background(), origem.Requisicao), origem.Traceparent)
+}
+
+// Extrai o destino da resposta de uma requisição
+// O tópico pedido só é aceito dentro de mensagens/cliente/<placa>, para que um veículo não
+// direcione respostas a outro; mensagens sem correlação explícita usam o próprio ID
+func origemDaRequisicao(envelope Envelope, placa string) OrigemRequisicao {
+	origem := OrigemRequisicao{Placa: placa, Correlacao: envelope.Correlacao, Requisicao: requisicaoValida(envelope.Requisicao), Traceparent: envelope.Traceparent}
+	if origem.Correlacao == "" {
+		origem.Correlacao = envelope.ID
+	}
+	topicoVeiculo := "mensagens/cliente/" + placa
+	if envelope.ResponderPara == topicoVeiculo || strings.HasPrefix(envelope.ResponderPara, topicoVeiculo+"/") {
+		origem.Topico = envelope.ResponderPara
+	}
+	return origem
+}
+
+// Responde ao veículo no tópico pedido, ecoando a correlação da requisição
+// Exceto a telemetria, a mensagem entra na outbox até o veículo confirmar o recebimento
+func responderVeiculo(origem OrigemRequisicao, tipo string, dados MensagemVeiculo) {
+	topico := origem.Topico
+	if topico == "" {
+		topico = "mensagens/cliente/" + origem.Placa
+	}
+	envelope, erro := novoEnvelope(tipo, dados, origem.Correlacao)
+	if erro != nil {
+		logMQTT.ErrorContext(origem.contexto(), "erro ao codificar mensagem", "tipo", tipo, "erro", erro)
+		return
+	}
+	envelope.Requisicao = origem.Requisicao
+	envelope.Confirmar = tipo != "recarga_medicao"
+	mensagem, _ := json.Marshal(envelope)
+	if envelope.Confirmar {
+		registrarEntrega(envelope.ID, origem.Placa, topico, tipo, mensagem)
+	}
+	if mqttClient == nil || !mqttClient.IsConnected() {
+		logMQTT.WarnContext(origem.contexto(), "desconectado do broker; mensagem aguardará reenvio", "tipo", tipo, "placa", origem.Placa)
+		return
+	}
+	token := mqttClient.Publish(topico, qosMqtt, false, mensagem)
 	token.Wait()
-	fmt.Printf("\n[MQTT] Mensagem enviada para %s: %s\n", topico, mensagem)
+	metricaMqttEnviadas.Inc(tipo)
+	logMQTT.DebugContext(origem.contexto(), "mensagem enviada", "tipo", tipo, "placa", origem.Placa, "ponto", dados.Ponto)
+}
+
+// Publica notificação não solicitada para o tópico exclusivo de um veículo
+func notificarVeiculo(placa, tipo string, dados MensagemVeiculo) {
+	responderVeiculo(OrigemRequisicao{Placa: placa}, tipo, dados)
 }
 
 // Retorna o cliente MQTT atual
@@ -43,95 +104,173 @@ func getClienteMqtt() mqtt.Client {
 // Inicializa a conexão MQTT com o broker e configura inscrição nos tópicos
 func inicializaMqtt(idCliente string) {
 	// O servidor se conecta via TCP ao broker
-	opts := mqtt.NewClientOptions().AddBroker("tcp://broker:1883")
+	opts := mqtt.NewClientOptions().AddBroker(urlBroker)
 	opts.SetClientID(idCliente)
+	remetenteProtocolo = "empresa_" + idCliente
+	// Token novo a cada (re)conexão, para não reconectar com uma credencial expirada
+	opts.SetCredentialsProvider(credencialPropriaMqtt)
+	// Sessão persistente: o broker guarda as mensagens QoS 1+ enquanto a empresa está desconectada
+	opts.SetCleanSession(false)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(2 * time.Second)
+	opts.SetMaxReconnectInterval(30 * time.Second)
+	// Handlers publicam e aguardam o PUBACK (QoS 1+); com ordem estrita isso bloquearia o cliente
+	opts.SetOrderMatters(false)
+	// Se a conexão cair sem o encerramento ordenado, o broker publica o status offline da empresa
+	if will, erro := novoEnvelope("STATUS", StatusEmpresa{EmpresaID: idCliente, Status: "offline", Motivo: "conexão perdida"}, ""); erro == nil {
+		dados, _ := json.Marshal(will)
+		opts.SetBinaryWill(topicoStatusEmpresa(), dados, qosMqtt, true)
+	}
 
 	opts.OnConnect = func(c mqtt.Client) {
-		fmt.Println("[MQTT] Servidor inicializado - Empresa " + idCliente + " conectado ao broker")
+		logMQTT.Info("conectado ao broker", "cliente", idCliente)
 
-		// Subscribe para mensagens de clientes
-		if token := c.Subscribe("mensagens/cliente", 0, handleMensagens); token.Wait() && token.Error() != nil {
-			fmt.Println("[MQTT] Erro ao assinar tópico:", token.Error())
+		// Subscribe para requisições dos veículos (cada veículo só publica no tópico da própria placa)
+		if token := c.Subscribe("mensagens/requisicao/+", qosMqtt, enquantoAtivo(handleMensagens)); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", "mensagens/requisicao/+", "erro", token.Error())
+		}
+		// Tópico compartilhado dos veículos antigos (só alcançável em brokers sem ACL)
+		if token := c.Subscribe("mensagens/cliente", qosMqtt, enquantoAtivo(handleMensagens)); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", "mensagens/cliente", "erro", token.Error())
 		}
 
 		// Subscribe para mensagens específicas da empresa
 		topicoEmpresa := "mensagens/empresa/" + idCliente
-		if token := c.Subscribe(topicoEmpresa, 0, handleMensagensEmpresa); token.Wait() && token.Error() != nil {
-			fmt.Println("[MQTT] Erro ao assinar tópico da empresa:", token.Error())
+		if token := c.Subscribe(topicoEmpresa, qosMqtt, enquantoAtivo(handleMensagensEmpresa)); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", topicoEmpresa, "erro", token.Error())
+		}
+
+		// Subscribe para erros de protocolo reportados a esta empresa
+		if token := c.Subscribe("mensagens/erro/"+remetenteProtocolo, qosMqtt, enquantoAtivo(handleErroProtocoloMqtt)); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", "mensagens/erro/"+remetenteProtocolo, "erro", token.Error())
+		}
+
+		// Subscribe para heartbeats e falhas dos pontos de recarga
+		if token := c.Subscribe("pontos/+/heartbeat", qosMqtt, enquantoAtivo(handleHeartbeatMqtt)); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", "pontos/+/heartbeat", "erro", token.Error())
+		}
+		if token := c.Subscribe("pontos/+/falha", qosMqtt, enquantoAtivo(handleFalhaPontoMqtt)); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", "pontos/+/falha", "erro", token.Error())
 		}
+
+		// Subscribe para telemetria e leituras do medidor das estações
+		if token := c.Subscribe("pontos/+/medicao", qosMqtt, enquantoAtivo(handleMedicaoMqtt)); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", "pontos/+/medicao", "erro", token.Error())
+		}
+		if token := c.Subscribe("pontos/+/sessao", qosMqtt, enquantoAtivo(handleSessaoEstacaoMqtt)); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", "pontos/+/sessao", "erro", token.Error())
+		}
+		if token := c.Subscribe("pontos/+/leitura", max(qosMqtt, 1), enquantoAtivo(handleLeituraMqtt)); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", "pontos/+/leitura", "erro", token.Error())
+		}
+
+		// Reenvia de imediato o que ficou sem confirmação enquanto a empresa estava desconectada
+		go reenviarEntregasPendentes(true)
+
+		go publicarStatusEmpresa("online", "")
 	}
 
-	// Conecta ao broker (Mosquitto)
-	mqttClient = mqtt.NewClient(opts)
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	opts.OnConnectionLost = func(c mqtt.Client, err error) {
+		logMQTT.Warn("conexão com o broker perdida; reconectando", "erro", err)
 	}
+
+	// Conecta ao broker (Mosquitto); as tentativas continuam em segundo plano até conseguir
+	mqttClient = mqtt.NewClient(opts)
+	token := mqttClient.Connect()
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao conectar ao broker", "erro", token.Error())
+		}
+	}()
 }
 
 // Handler para mensagens gerais de clientes
 func handleMensagens(client mqtt.Client, msg mqtt.Message) {
-	mensagem := string(msg.Payload())
-	fmt.Printf("[MQTT] Mensagem recebida: %s\n", mensagem)
-
-	// Parse da mensagem: "TIPO,PLACA,DADOS"
-	partes := strings.Split(mensagem, ",")
-	if len(partes) < 2 {
+	var dados MensagemVeiculo
+	envelope, ok := receberMensagem(client, msg, envelopeVeiculoDeCSV, &dados)
+	if !ok {
+		return
+	}
+	if envelope.Tipo != "ACK" {
+		logMQTT.InfoContext(comRequisicao(context.Background(), requisicaoValida(envelope.Requisicao)), "mensagem recebida",
+			"tipo", envelope.Tipo, "placa", dados.Placa, "ponto", dados.Ponto)
+	}
+	// No tópico por placa, a placa do tópico (garantida pela ACL do broker) prevalece
+	if placaTopico, porPlaca := strings.CutPrefix(msg.Topic(), "mensagens/requisicao/"); porPlaca {
+		if dados.Placa != placaTopico {
+			publicarErroProtocolo(client, msg.Topic(), envelope, errors.New("placa diferente da placa do tópico"))
+			return
+		}
+	}
+	if dados.Placa == "" {
+		publicarErroProtocolo(client, msg.Topic(), envelope, errors.New("campo placa ausente"))
 		return
 	}
 
-	tipo := partes[0]
-	placa := partes[1]
-
-	switch tipo {
+	origem := origemDaRequisicao(envelope, dados.Placa)
+	if strings.HasPrefix(msg.Topic(), "mensagens/requisicao/") {
+		origem.Identidade = dados.Placa
+		origem.ClienteID = "veiculo_" + dados.Placa
+	}
+	switch envelope.Tipo {
 	case "RESERVA":
-		if len(partes) >= 3 {
-			ponto := partes[2]
-			handleReservaMqtt(placa, ponto)
-		}
+		// Hash da cotação aceita pelo veículo (opcional)
+		handleReservaMqtt(origem, dados.Ponto, dados.Cotacao)
 	case "RECARGA":
-		if len(partes) >= 4 {
-			ponto := partes[2]
-			valor := partes[3]
-			handleRecargaMqtt(placa, ponto, valor)
-		}
+		handleRecargaMqtt(origem, dados.Ponto)
 	case "STATUS":
-		handleStatusMqtt(placa)
+		handleStatusMqtt(origem)
 	case "CANCELAR":
-		if len(partes) >= 3 {
-			ponto := partes[2]
-			handleCancelamentoMqtt(placa, ponto)
-		}
+		handleCancelamentoMqtt(origem, dados.Ponto)
+	case "ACK":
+		// Confirmação de recebimento de uma mensagem da outbox (Correlacao = ID da mensagem)
+		confirmarEntrega(dados.Placa, envelope.Correlacao)
+	default:
+		publicarErroProtocolo(client, msg.Topic(), envelope, fmt.Errorf("tipo desconhecido: %s", envelope.Tipo))
 	}
 }
 
 // Handler para mensagens específicas da empresa
 func handleMensagensEmpresa(client mqtt.Client, msg mqtt.Message) {
-	mensagem := string(msg.Payload())
-	fmt.Printf("[MQTT] Mensagem da empresa recebida: %s\n", mensagem)
-
-	// Processa mensagens específicas da empresa
-	partes := strings.Split(mensagem, ",")
-	if len(partes) < 2 {
+	var dados MensagemEmpresa
+	envelope, ok := receberMensagem(client, msg, envelopeEmpresaDeCSV, &dados)
+	if !ok {
 		return
 	}
+	logMQTT.Info("mensagem da empresa recebida", "tipo", envelope.Tipo)
 
-	tipo := partes[0]
-	switch tipo {
+	switch envelope.Tipo {
 	case "SYNC":
 		// Sincronização de blockchain
 		handleSyncMqtt()
 	case "STATUS_UPDATE":
 		// Atualização de status de pontos
-		if len(partes) >= 3 {
-			ponto := partes[1]
-			status := partes[2]
-			handleStatusUpdateMqtt(ponto, status)
-		}
+		handleStatusUpdateMqtt(dados.Ponto, dados.Status)
+	default:
+		publicarErroProtocolo(client, msg.Topic(), envelope, fmt.Errorf("tipo desconhecido: %s", envelope.Tipo))
 	}
 }
 
+// Handler para erros de protocolo reportados por outros nós
+func handleErroProtocoloMqtt(client mqtt.Client, msg mqtt.Message) {
+	var dados ErroProtocolo
+	envelope, erro := decodificarEnvelope(msg.Payload())
+	if erro == nil {
+		erro = envelope.lerPayload(&dados)
+	}
+	if erro != nil {
+		return
+	}
+	logMQTT.Warn("mensagem rejeitada pelo destinatário", "remetente", envelope.Remetente, "id_original", dados.IDOriginal, "topico", dados.Topico, "motivo", dados.Motivo)
+}
+
 // Processa reserva via MQTT com controle de concorrência COMPLETO (modelo PBL2)
-func handleReservaMqtt(placa, ponto string) {
+func handleReservaMqtt(origem OrigemRequisicao, ponto, cotacao string) {
+	placa := origem.Placa
+	ctx, span := iniciarSpan(origem.contexto(), "reserva", "placa", placa, "ponto", ponto, "canal", "mqtt")
+	defer span.finalizar()
+
 	// Verifica se o ponto pertence a esta empresa
 	pontoValido := false
 	for _, pontoDaEmpresa := range empresa.Pontos {
@@ -146,37 +285,67 @@ func handleReservaMqtt(placa, ponto string) {
 		return
 	}
 
+	erro := verificarLimiteCliente(origem.ClienteID)
+	if erro == nil {
+		erro = verificarLimite(origem.Identidade)
+	}
+	if erro != nil {
+		responderVeiculo(origem, "reserva_erro", MensagemVeiculo{Ponto: ponto, Mensagem: erro.Error()})
+		logLimites.InfoContext(ctx, "reserva recusada", "placa", placa, "ponto", ponto, "canal", "mqtt", "erro", erro)
+		metricaReservas.Inc(ponto, "mqtt", "limite")
+		span.definir("resultado", "limite")
+		return
+	}
+
 	// *** CONTROLE DE CONCORRÊNCIA ATÔMICO (PBL2) ***
 	// Adquire lock específico para este ponto ANTES de qualquer verificação
-	lock := ponto_locks[ponto]
-	lock.Lock()
+	lock := travarPonto(ponto)
 	defer lock.Unlock()
 
-	// Verifica status de conectividade do ponto
-	status_ponto.RLock()
-	conectado := status_ponto.status[ponto]
-	status_ponto.RUnlock()
-
-	if !conectado {
-		resposta := fmt.Sprintf("ponto_desconectado,%s,Ponto %s está desconectado", ponto, ponto)
-		publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, resposta)
-		fmt.Printf("[ERRO] Tentativa de reserva no ponto %s falhou: ponto desconectado.\n", ponto)
+	// Ponto em manutenção ou desconectado não aceita reservas
+	if motivo := indisponibilidadePonto(ponto); motivo != "" {
+		responderVeiculo(origem, "ponto_desconectado", MensagemVeiculo{Ponto: ponto, Mensagem: motivo})
+		logReservas.InfoContext(ctx, "reserva recusada: ponto indisponível", "placa", placa, "ponto", ponto, "canal", "mqtt", "motivo", motivo)
+		metricaReservas.Inc(ponto, "mqtt", "ponto_offline")
+		span.definir("resultado", "ponto_offline")
 		return
 	}
 
 	// Verifica se o ponto está disponível ATOMICAMENTE dentro do lock
 	if !verificarPontoDisponivel(ponto, placa) {
-		resposta := fmt.Sprintf("reserva_erro,%s,Ponto já está reservado por outro veículo", ponto)
-		publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, resposta)
-		fmt.Printf("[CONFLITO] Tentativa de reserva rejeitada para %s em %s: ponto já ocupado\n", placa, ponto)
+		registrarConflito(origem.Identidade)
+		responderVeiculo(origem, "reserva_erro", MensagemVeiculo{Ponto: ponto, Mensagem: "Ponto já está reservado por outro veículo"})
+		logReservas.InfoContext(ctx, "reserva recusada: ponto já ocupado", "placa", placa, "ponto", ponto, "canal", "mqtt")
+		metricaReservas.Inc(ponto, "mqtt", "conflito")
+		span.definir("resultado", "conflito")
+		return
+	}
+
+	if erro := verificarLimiteReservas(placa, ponto); erro != nil {
+		responderVeiculo(origem, "reserva_erro", MensagemVeiculo{Ponto: ponto, Mensagem: erro.Error()})
+		logLimites.InfoContext(ctx, "reserva recusada", "placa", placa, "ponto", ponto, "canal", "mqtt", "erro", erro)
+		metricaReservas.Inc(ponto, "mqtt", "limite")
+		span.definir("resultado", "limite")
+		return
+	}
+
+	// O preço cotado só vale se a cotação ainda estiver válida
+	desfazerCotacao, erro := vincularCotacaoReserva(cotacao, placa, ponto)
+	if erro != nil {
+		responderVeiculo(origem, "reserva_erro", MensagemVeiculo{Ponto: ponto, Cotacao: cotacao, Mensagem: fmt.Sprintf("Cotação recusada: %v", erro)})
+		logPrecos.InfoContext(ctx, "reserva recusada: cotação inválida", "placa", placa, "ponto", ponto, "cotacao", cotacao, "canal", "mqtt", "erro", erro)
+		metricaReservas.Inc(ponto, "mqtt", "cotacao_recusada")
+		span.definir("resultado", "cotacao_recusada")
 		return
 	}
 
 	// Marca o ponto como reservado ATOMICAMENTE
 	if !marcarPontoReservado(ponto, placa) {
-		resposta := fmt.Sprintf("reserva_erro,%s,Falha ao marcar ponto como reservado", ponto)
-		publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, resposta)
-		fmt.Printf("[ERRO] Falha ao marcar ponto %s como reservado para %s\n", ponto, placa)
+		desfazerCotacao()
+		responderVeiculo(origem, "reserva_erro", MensagemVeiculo{Ponto: ponto, Mensagem: "Falha ao marcar ponto como reservado"})
+		logReservas.ErrorContext(ctx, "falha ao marcar ponto como reservado", "placa", placa, "ponto", ponto, "canal", "mqtt")
+		metricaReservas.Inc(ponto, "mqtt", "erro")
+		span.definir("resultado", "erro")
 		return
 	}
 
@@ -188,7 +357,7 @@ func handleReservaMqtt(placa, ponto string) {
 	reservas[placa][ponto] = "confirmado"
 	reservas_mutex.Unlock()
 
-	fmt.Printf("[CONCORRÊNCIA] Ponto %s reservado atomicamente para %s\n", ponto, placa)
+	logReservas.DebugContext(ctx, "ponto reservado", "placa", placa, "ponto", ponto)
 
 	// Cria transação de reserva no blockchain
 	transacao := Transacao{
@@ -197,133 +366,81 @@ func handleReservaMqtt(placa, ponto string) {
 		Valor:   0.0,
 		Ponto:   ponto,
 		Empresa: empresa.ID,
+		Cotacao: cotacao,
 	}
 
-	// Adiciona ao blockchain com tratamento de erro robusto
-	mutex.Lock()
-	ultimo := blockchain.Chain[len(blockchain.Chain)-1]
-	hash := CalcularHash(Bloco{
-		Index:        (ultimo.Index + 1),
-		Timestamp:    formatarTimestamp(time.Now().UTC().Format(time.RFC3339)),
-		Transacao:    transacao,
-		HashAnterior: ultimo.Hash,
-		Autor:        empresa.ID,
-	})
-
-	assinatura, erro := AssinarBloco(hash, chave_privada_path)
+	// Grava o bloco pelo pipeline de escrita (escrita.go)
+	novo_bloco, erro := registrarTransacao(ctx, transacao, registrarReplicacao(ctx, "Reserva de "+placa+" em "+ponto))
 	if erro != nil {
-		mutex.Unlock()
 		// Desfaz a reserva em caso de erro
 		liberarPontoCompleto(ponto, placa)
-		resposta := fmt.Sprintf("reserva_erro,%s,Erro na assinatura digital", ponto)
-		publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, resposta)
-		fmt.Printf("[ERRO] Falha na assinatura para reserva %s em %s: %v\n", placa, ponto, erro)
-		return
-	}
-
-	novo_bloco := NovoBloco(transacao, ultimo, empresa.ID, assinatura)
-	if blocoDuplicado(novo_bloco) {
-		mutex.Unlock()
-		// Desfaz a reserva em caso de duplicação
-		liberarPontoCompleto(ponto, placa)
-		resposta := fmt.Sprintf("reserva_erro,%s,Bloco duplicado", ponto)
-		publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, resposta)
-		fmt.Printf("[ERRO] Bloco duplicado para reserva %s em %s\n", placa, ponto)
+		desfazerCotacao()
+		responderVeiculo(origem, "reserva_erro", MensagemVeiculo{Ponto: ponto, Mensagem: "Erro ao registrar a reserva na blockchain"})
+		logReservas.ErrorContext(ctx, "erro ao registrar reserva", "placa", placa, "ponto", ponto, "canal", "mqtt", "erro", erro)
+		span.falhar(erro)
+		metricaReservas.Inc(ponto, "mqtt", "erro")
+		span.definir("resultado", "erro")
 		return
 	}
 
-	blockchain.Chain = append(blockchain.Chain, novo_bloco)
-	SalvarBlockchain("data/chain_"+empresa.ID+".json", blockchain)
-	mutex.Unlock()
-
 	// Atualiza o hash da reserva no controle de pontos
 	atualizarHashReserva(ponto, placa, novo_bloco.Hash)
 
-	// Propaga o bloco para outras empresas
-	propagarBloco(novo_bloco)
+	// Inicia sistema de timeout da reserva
+	liberaPorTimeout(placa, []string{ponto}, tempoExpiracaoReserva)
 
 	// Notifica sucesso com hash
-	resposta := fmt.Sprintf("reserva_confirmada,%s,%s", ponto, novo_bloco.Hash)
-	publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, resposta)
+	responderVeiculo(origem, "reserva_confirmada", MensagemVeiculo{Ponto: ponto, Hash: novo_bloco.Hash, Cotacao: cotacao})
 
-	fmt.Printf("[BLOCKCHAIN] Reserva atômica confirmada: %s -> %s (Hash: %s)\n", placa, ponto, novo_bloco.Hash)
+	logReservas.InfoContext(ctx, "reserva confirmada", "placa", placa, "ponto", ponto, "canal", "mqtt", "hash", novo_bloco.Hash)
+	span.definir("hash", novo_bloco.Hash)
+	metricaReservas.Inc(ponto, "mqtt", "confirmada")
+	span.definir("resultado", "confirmada")
 }
 
 // Processa recarga via MQTT
-func handleRecargaMqtt(placa, ponto, valorStr string) {
-	// Converte valor
-	var valor float64
-	fmt.Sscanf(valorStr, "%f", &valor)
-
-	// Verifica se o ponto pertence a esta empresa
-	pontoValido := false
-	for _, pontoDaEmpresa := range empresa.Pontos {
-		if ponto == pontoDaEmpresa {
-			pontoValido = true
-			break
-		}
+func handleRecargaMqtt(origem OrigemRequisicao, ponto string) {
+	placa := origem.Placa
+	// O valor enviado pelo cliente é ignorado: a recarga é registrada a partir da leitura do medidor
+	if !pontoDaEmpresa(ponto) {
+		responderVeiculo(origem, "recarga_negada", MensagemVeiculo{Ponto: ponto, Mensagem: "Ponto não pertence a esta empresa"})
+		return
 	}
-
-	if !pontoValido {
-		resposta := fmt.Sprintf("recarga_negada,%s,Ponto não pertence a esta empresa", ponto)
-		publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, resposta)
+	erro := verificarLimiteCliente(origem.ClienteID)
+	if erro == nil {
+		erro = verificarLimite(origem.Identidade)
+	}
+	if erro != nil {
+		responderVeiculo(origem, "recarga_negada", MensagemVeiculo{Ponto: ponto, Mensagem: erro.Error()})
 		return
 	}
 
-	// Cria transação de recarga no blockchain
-	transacao := Transacao{
-		Tipo:    "RECARGA",
-		Placa:   placa,
-		Valor:   valor,
-		Ponto:   ponto,
-		Empresa: empresa.ID,
+	sessao, _, erro := recargaPorLeitura(origem.contexto(), placa, ponto)
+	if erro == errSemLeitura {
+		responderVeiculo(origem, "recarga_negada", MensagemVeiculo{Ponto: ponto, Mensagem: "Nenhuma leitura do medidor para esta recarga"})
+		return
 	}
-
-	// Adiciona ao blockchain
-	mutex.Lock()
-	ultimo := blockchain.Chain[len(blockchain.Chain)-1]
-	hash := CalcularHash(Bloco{
-		Index:        (ultimo.Index + 1),
-		Timestamp:    formatarTimestamp(time.Now().UTC().Format(time.RFC3339)),
-		Transacao:    transacao,
-		HashAnterior: ultimo.Hash,
-		Autor:        empresa.ID,
-	})
-
-	assinatura, erro := AssinarBloco(hash, chave_privada_path)
 	if erro != nil {
-		mutex.Unlock()
-		resposta := fmt.Sprintf("recarga_erro,%s,Erro na assinatura digital", ponto)
-		publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, resposta)
+		responderVeiculo(origem, "recarga_erro", MensagemVeiculo{Ponto: ponto, Mensagem: "Falha ao registrar recarga na blockchain"})
 		return
 	}
 
-	novo_bloco := NovoBloco(transacao, ultimo, empresa.ID, assinatura)
-	blockchain.Chain = append(blockchain.Chain, novo_bloco)
-	SalvarBlockchain("data/chain_"+empresa.ID+".json", blockchain)
-	mutex.Unlock()
-
-	// Propaga o bloco
-	propagarBloco(novo_bloco)
-	// Libera automaticamente o ponto após recarga completa
-	liberarPontoAposRecarga(placa, ponto)
-
 	// Notifica sucesso com hash
-	resposta := fmt.Sprintf("recarga_confirmada,%s,%.2f,%s", ponto, valor, novo_bloco.Hash)
-	publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, resposta)
-
-	fmt.Printf("[BLOCKCHAIN] Recarga registrada para %s no ponto %s - Valor: R$ %.2f - Hash: %s\n", placa, ponto, valor, novo_bloco.Hash)
+	responderVeiculo(origem, "recarga_confirmada", MensagemVeiculo{
+		Ponto:  ponto,
+		Sessao: sessao.Sessao,
+		Valor:  sessao.Valor,
+		KWh:    sessao.KWh,
+		Hash:   sessao.HashRecarga,
+	})
 }
 
 // Processa solicitação de status via MQTT
-func handleStatusMqtt(placa string) {
-	// Busca histórico do veículo no blockchain
-	var transacoes []Bloco
-	for _, bloco := range blockchain.Chain {
-		if bloco.Transacao.Placa == placa {
-			transacoes = append(transacoes, bloco)
-		}
-	}
+func handleStatusMqtt(origem OrigemRequisicao) {
+	placa := origem.Placa
+
+	// Busca histórico do veículo no índice da blockchain
+	transacoes := blocosPorPlaca(placa)
 
 	// Prepara resposta com resumo
 	totalRecargas := 0
@@ -344,78 +461,134 @@ func handleStatusMqtt(placa string) {
 
 	saldoPendente := valorRecargas - valorPagamentos
 
-	resposta := fmt.Sprintf("status_resposta,%d,%d,%.2f,%.2f,%.2f",
-		totalRecargas, totalPagamentos, valorRecargas, valorPagamentos, saldoPendente)
-
-	publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, resposta)
+	responderVeiculo(origem, "status_resposta", MensagemVeiculo{Placa: placa, Resumo: &ResumoStatus{
+		Recargas:        totalRecargas,
+		Pagamentos:      totalPagamentos,
+		ValorRecargas:   valorRecargas,
+		ValorPagamentos: valorPagamentos,
+		SaldoPendente:   saldoPendente,
+	}})
 }
 
 // Processa sincronização via MQTT
 func handleSyncMqtt() {
-	fmt.Println("[MQTT] Solicitação de sincronização recebida")
+	logMQTT.Info("solicitação de sincronização recebida")
 	// Aqui poderia implementar sincronização adicional se necessário
 }
 
 // Processa atualização de status de pontos via MQTT
+// "offline" bloqueia o ponto manualmente até um "online" explícito
 func handleStatusUpdateMqtt(ponto, status string) {
-	fmt.Printf("[MQTT] Atualização de status recebida - Ponto: %s, Status: %s\n", ponto, status)
-	// Implementar lógica de atualização de status se necessário
+	logPontos.Info("atualização de status recebida", "ponto", ponto, "status", status)
+	if !pontoDaEmpresa(ponto) {
+		return
+	}
+	switch status {
+	case "offline":
+		definirBloqueioManual(ponto, true, "Desativado via STATUS_UPDATE")
+	case "online":
+		definirBloqueioManual(ponto, false, "")
+	}
 }
 
 // Libera automaticamente o ponto após recarga completa
 func liberarPontoAposRecarga(placa, ponto string) {
-	fmt.Printf("[RECARGA] Liberando ponto %s após recarga de %s\n", ponto, placa)
+	logRecargas.Info("liberando ponto após a recarga", "ponto", ponto, "placa", placa)
 
 	// Usa liberação completa (controle + reservas)
 	liberarPontoCompleto(ponto, placa)
 
 	// Notifica via MQTT que o ponto foi liberado
-	mensagem := fmt.Sprintf("ponto_liberado,%s,Ponto liberado após recarga", ponto)
-	publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, mensagem)
+	notificarVeiculo(placa, "ponto_liberado", MensagemVeiculo{Ponto: ponto, Mensagem: "Ponto liberado após recarga"})
 }
 
+// Timers de expiração ativos, um por placa e ponto: armar um timer novo (reserva renovada,
+// refeita pelo REST/MQTT ou rearmada por recuperarReservas) cancela o anterior
+var timersReserva = struct {
+	sync.Mutex
+	cancelar map[string]chan struct{}
+}{cancelar: make(map[string]chan struct{})}
+
 // Sistema de timeout para reservas (modelo PBL2)
 // Libera automaticamente reservas após período definido
+// No encerramento, o prazo que ainda não venceu é abandonado (recuperarReservas o refaz)
 func liberaPorTimeout(placa string, pontos []string, tempo time.Duration) {
+	for _, ponto := range pontos {
+		armarExpiracaoReserva(placa, ponto, tempo)
+	}
+}
+
+func armarExpiracaoReserva(placa, ponto string, tempo time.Duration) {
+	chave := placa + "|" + ponto
+	cancelado := make(chan struct{})
+	timersReserva.Lock()
+	if anterior, existe := timersReserva.cancelar[chave]; existe {
+		close(anterior)
+	}
+	timersReserva.cancelar[chave] = cancelado
+	timersReserva.Unlock()
+
 	go func() {
-		time.Sleep(tempo)
-		fmt.Printf("[TIMEOUT] Verificando timeout para reservas do veículo %s...\n", placa)
-
-		for _, ponto := range pontos {
-			// Adquire lock específico do ponto
-			lock := ponto_locks[ponto]
-			lock.Lock()
-
-			// Verifica se a reserva ainda existe
-			reservas_mutex.Lock()
-			if pontosMap, existe := reservas[placa]; existe {
-				if _, reservado := pontosMap[ponto]; reservado {
-					// Remove da memória
-					delete(pontosMap, ponto)
-					if len(pontosMap) == 0 {
-						delete(reservas, placa)
-					}
-
-					// Libera o controle do ponto
-					liberarPonto(ponto, placa)
-
-					fmt.Printf("[TIMEOUT] Reserva para %s no ponto %s expirada por timeout\n", placa, ponto)
-
-					// Notifica o cliente via MQTT
-					if mqttClient != nil && mqttClient.IsConnected() {
-						mensagem := fmt.Sprintf("reserva_expirada,%s,Reserva expirou por timeout", ponto)
-						publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, mensagem)
-					}
+		select {
+		case <-time.After(tempo):
+		case <-cancelado:
+			return
+		case <-encerramento.iniciado:
+			return
+		}
+		timersReserva.Lock()
+		if timersReserva.cancelar[chave] != cancelado {
+			// Substituído por outro timer enquanto este disparava
+			timersReserva.Unlock()
+			return
+		}
+		delete(timersReserva.cancelar, chave)
+		timersReserva.Unlock()
+
+		encerramento.liberacoes.iniciar()
+		defer encerramento.liberacoes.concluir()
+		logReservas.Debug("verificando prazo da reserva", "placa", placa, "ponto", ponto)
+
+		// Adquire lock específico do ponto
+		lock := travarPonto(ponto)
+		defer lock.Unlock()
+
+		// O prazo fica suspenso enquanto a placa recarrega no ponto: é adiado e conferido de novo
+		if recargaEmAndamento(ponto, placa) {
+			logReservas.Debug("prazo da reserva adiado: recarga em andamento", "placa", placa, "ponto", ponto)
+			prorrogarReserva(ponto, placa, tempoExpiracaoReserva)
+			armarExpiracaoReserva(placa, ponto, tempoExpiracaoReserva)
+			return
+		}
+
+		// Verifica se a reserva ainda existe e se o prazo não foi renovado
+		reservas_mutex.Lock()
+		defer reservas_mutex.Unlock()
+		if pontosMap, existe := reservas[placa]; existe && prazoReservaEsgotado(ponto, placa) {
+			if _, reservado := pontosMap[ponto]; reservado {
+				// Remove da memória
+				delete(pontosMap, ponto)
+				if len(pontosMap) == 0 {
+					delete(reservas, placa)
 				}
+
+				// Libera o controle do ponto
+				liberarPonto(ponto, placa)
+
+				logReservas.Info("reserva expirada", "placa", placa, "ponto", ponto)
+				metricaReservasExpiradas.Inc(ponto)
+
+				// Notifica o cliente via MQTT (a outbox reenvia se estiver desconectado)
+				notificarVeiculo(placa, "reserva_expirada", MensagemVeiculo{Ponto: ponto, Mensagem: "Reserva expirou por timeout"})
 			}
-			reservas_mutex.Unlock()
-			lock.Unlock()
 		}
 	}()
 }
 
 // Processa cancelamento via MQTT com controle de concorrência
-func handleCancelamentoMqtt(placa, ponto string) {
+func handleCancelamentoMqtt(origem OrigemRequisicao, ponto string) {
+	placa := origem.Placa
+
 	// Verifica se o ponto pertence a esta empresa
 	pontoValido := false
 	for _, pontoDaEmpresa := range empresa.Pontos {
@@ -430,16 +603,14 @@ func handleCancelamentoMqtt(placa, ponto string) {
 	}
 
 	// *** CONTROLE DE CONCORRÊNCIA ATÔMICO ***
-	lock := ponto_locks[ponto]
-	lock.Lock()
+	lock := travarPonto(ponto)
 	defer lock.Unlock()
 
 	// Cancela a reserva atomicamente
 	liberarPontoCompleto(ponto, placa)
 
 	// Notifica sucesso
-	resposta := fmt.Sprintf("cancelamento_confirmado,%s,Reserva cancelada com sucesso", ponto)
-	publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, resposta)
+	responderVeiculo(origem, "cancelamento_confirmado", MensagemVeiculo{Ponto: ponto, Mensagem: "Reserva cancelada com sucesso"})
 
-	fmt.Printf("[CANCELAMENTO] Reserva de %s no ponto %s cancelada\n", placa, ponto)
+	logReservas.InfoContext(origem.contexto(), "reserva cancelada", "placa", placa, "ponto", ponto, "canal", "mqtt")
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"persistencia"
+)
+
+// Caixa de saída das mensagens enviadas aos veículos
+// Toda mensagem com confirmação (todas exceto a telemetria da recarga) fica registrada até o veículo
+// responder com ACK. As não confirmadas são reenviadas com o mesmo ID - o veículo descarta duplicatas -
+// com intervalo crescente, até expirarem. A fila sobrevive a reinícios em data/outbox_<id>.json.
+
+// Mensagem aguardando confirmação do veículo
+type EntregaPendente struct {
+	ID               string          `json:"id"`
+	Placa            string          `json:"placa"`
+	Topico           string          `json:"topico"`
+	Tipo             string          `json:"tipo"`
+	Mensagem         json.RawMessage `json:"mensagem"`
+	Tentativas       int             `json:"tentativas"`
+	CriadaEm         time.Time       `json:"criada_em"`
+	ProximaTentativa time.Time       `json:"proxima_tentativa"`
+}
+
+var outbox = struct {
+	sync.Mutex
+	entregas map[string]*EntregaPendente
+}{entregas: make(map[string]*EntregaPendente)}
+
+var (
+	intervaloOutbox      = 10 * time.Second
+	intervaloMaximoEnvio = 5 * time.Minute
+	validadeOutbox       = 24 * time.Hour
+)
+
+// Lê a configuração do ambiente e recupera a fila salva
+func inicializaOutbox() {
+	if valor := os.Getenv("OUTBOX_INTERVALO_SEGUNDOS"); valor != "" {
+		if segundos, erro := strconv.Atoi(valor); erro == nil && segundos > 0 {
+			intervaloOutbox = time.Duration(segundos) * time.Second
+		}
+	}
+	if valor := os.Getenv("OUTBOX_VALIDADE_MINUTOS"); valor != "" {
+		if minutos, erro := strconv.Atoi(valor); erro == nil && minutos > 0 {
+			validadeOutbox = time.Duration(minutos) * time.Minute
+		}
+	}
+
+	outbox.Lock()
+	defer outbox.Unlock()
+	if erro := persistencia.LerJSON("data/outbox_"+empresa.ID+".json", &outbox.entregas); errors.Is(erro, fs.ErrNotExist) {
+		return
+	} else if erro != nil {
+		logOutbox.Error("erro ao decodificar fila de entregas", "erro", erro)
+		outbox.entregas = make(map[string]*EntregaPendente)
+	}
+	if len(outbox.entregas) > 0 {
+		logOutbox.Info("mensagens aguardando confirmação recuperadas", "quantidade", len(outbox.entregas))
+	}
+}
+
+// Inicia o reenvio periódico; chamada depois de criado o cliente MQTT
+func iniciarReenvioOutbox() {
+	go func() {
+		for {
+			time.Sleep(intervaloOutbox)
+			reenviarEntregasPendentes(false)
+		}
+	}()
+}
+
+// Registra mensagem enviada a um veículo para reenvio até a confirmação
+func registrarEntrega(id, placa, topico, tipo string, mensagem []byte) {
+	agora := time.Now()
+	outbox.Lock()
+	defer outbox.Unlock()
+	outbox.entregas[id] = &EntregaPendente{
+		ID:               id,
+		Placa:            placa,
+		Topico:           topico,
+		Tipo:             tipo,
+		Mensagem:         mensagem,
+		CriadaEm:         agora,
+		ProximaTentativa: agora.Add(intervaloOutbox),
+	}
+	salvarOutboxInterno()
+}
+
+// Remove a mensagem da fila ao receber o ACK do veículo destinatário
+func confirmarEntrega(placa, id string) {
+	outbox.Lock()
+	defer outbox.Unlock()
+	entrega, existe := outbox.entregas[id]
+	if !existe || entrega.Placa != placa {
+		return
+	}
+	delete(outbox.entregas, id)
+	salvarOutboxInterno()
+	if entrega.Tentativas > 0 {
+		logOutbox.Info("entrega confirmada após reenvios", "placa", placa, "tipo", entrega.Tipo, "reenvios", entrega.Tentativas)
+	}
+}
+
+// Reenvia as mensagens não confirmadas cujo prazo chegou (todas, se imediato) e descarta as expiradas
+// O intervalo entre reenvios dobra a cada tentativa, até intervaloMaximoEnvio
+func reenviarEntregasPendentes(imediato bool) {
+	if mqttClient == nil || !mqttClient.IsConnected() {
+		return
+	}
+	agora := time.Now()
+	var reenviar []*EntregaPendente
+
+	outbox.Lock()
+	alterado := false
+	for id, entrega := range outbox.entregas {
+		if agora.Sub(entrega.CriadaEm) > validadeOutbox {
+			logOutbox.Warn("entrega expirou sem confirmação", "placa", entrega.Placa, "tipo", entrega.Tipo)
+			delete(outbox.entregas, id)
+			alterado = true
+			continue
+		}
+		if !imediato && agora.Before(entrega.ProximaTentativa) {
+			continue
+		}
+		entrega.Tentativas++
+		espera := intervaloOutbox << min(entrega.Tentativas, 8)
+		if espera > intervaloMaximoEnvio {
+			espera = intervaloMaximoEnvio
+		}
+		entrega.ProximaTentativa = agora.Add(espera)
+		copia := *entrega
+		reenviar = append(reenviar, &copia)
+		alterado = true
+	}
+	if alterado {
+		salvarOutboxInterno()
+	}
+	outbox.Unlock()
+
+	for _, entrega := range reenviar {
+		token := mqttClient.Publish(entrega.Topico, qosMqtt, false, []byte(entrega.Mensagem))
+		token.Wait()
+	}
+	if len(reenviar) > 0 {
+		metricaOutboxReenvios.Somar(float64(len(reenviar)))
+		logOutbox.Info("mensagens reenviadas aguardando confirmação", "quantidade", len(reenviar))
+	}
+}
+
+// Salva a fila de entregas; deve ser chamada com outbox travado
+func salvarOutboxInterno() {
+	if erro := persistencia.GravarJSON("data/outbox_"+empresa.ID+".json", outbox.entregas, 0644); erro != nil {
+		logOutbox.Error("erro ao salvar fila de entregas", "erro", erro)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Painel de operação da empresa
+// GET /painel/ serve a página (painel/index.html, embutida no binário) e /painel/ws envia por
+// WebSocket, a cada intervaloPainel, o estado atual do nó: topo da blockchain e blocos recentes,
+// status e reservas dos pontos, sincronização com as outras empresas e receita. As ações de
+// operador (liberar ponto, manutenção) exigem "Authorization: Bearer <OPERADOR_TOKEN>".
+
+//go:embed painel
+var arquivosPainel embed.FS
+
+const (
+	intervaloPainel        = 2 * time.Second
+	intervaloPeersPainel   = 5 * time.Second
+	blocosRecentesPainel   = 10
+	limiteEscritaPainel    = 5 * time.Second
+	mensagensPendentesWS   = 4
+	tamanhoMaximoLeituraWS = 512
+)
+
+// Ponto da empresa visto no painel
+type PainelPonto struct {
+	Ponto           string `json:"ponto"`
+	Online          bool   `json:"online"`
+	Motivo          string `json:"motivo,omitempty"`
+	Manutencao      bool   `json:"manutencao"`
+	Reservado       bool   `json:"reservado"`
+	Placa           string `json:"placa,omitempty"`
+	SessaoRecarga   string `json:"sessao_recarga,omitempty"`
+	UltimoHeartbeat string `json:"ultimo_heartbeat,omitempty"`
+}
+
+// Reserva aberta em um ponto da empresa
+type PainelReserva struct {
+	Ponto             string `json:"ponto"`
+	Placa             string `json:"placa"`
+	HashReserva       string `json:"hash_reserva"`
+	ExpiraEm          string `json:"expira_em"`
+	SegundosRestantes int    `json:"segundos_restantes"`
+}
+
+// Estado de sincronização com outra empresa, a partir de GET /api/status
+type PainelPeer struct {
+	EmpresaID     string `json:"empresa_id"`
+	API           string `json:"api"`
+	Online        bool   `json:"online"`
+	TotalBlocos   int    `json:"total_blocos"`
+	UltimoHash    string `json:"ultimo_hash"`
+	Situacao      string `json:"situacao"` // sincronizado, atrasado, adiantado, divergente ou indisponivel
+	UltimoContato string `json:"ultimo_contato,omitempty"`
+	Erro          string `json:"erro,omitempty"`
+}
+
+// Receita dos pontos da empresa registrada na blockchain
+type PainelReceita struct {
+	Recargas   int     `json:"recargas"`
+	Faturado   float64 `json:"faturado"`
+	Pagamentos int     `json:"pagamentos"`
+	Recebido   float64 `json:"recebido"`
+	AReceber   float64 `json:"a_receber"`
+}
+
+// Estado completo enviado aos painéis
+type EstadoPainel struct {
+	EmpresaID      string          `json:"empresa_id"`
+	Nome           string          `json:"nome"`
+	Gerado         string          `json:"gerado"`
+	TotalBlocos    int             `json:"total_blocos"`
+	UltimoHash     string          `json:"ultimo_hash"`
+	BlocosRecentes []Bloco         `json:"blocos_recentes"`
+	Pontos         []PainelPonto   `json:"pontos"`
+	Reservas       []PainelReserva `json:"reservas"`
+	Peers          []PainelPeer    `json:"peers"`
+	Receita        PainelReceita   `json:"receita"`
+	AcoesOperador  bool            `json:"acoes_operador"` // OPERADOR_TOKEN definido
+}
+
+// Requisição das ações de operador
+type AcaoOperadorRequest struct {
+	Ponto  string `json:"ponto"`
+	Ativa  bool   `json:"ativa"` // manutenção: true coloca, false retira
+	Motivo string `json:"motivo"`
+}
+
+var tokenOperador = os.Getenv("OPERADOR_TOKEN")
+
+var atualizadorWS = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// Painéis conectados; cada um recebe as mensagens pelo próprio canal
+var clientesPainel = struct {
+	sync.Mutex
+	canais map[*websocket.Conn]chan []byte
+}{canais: make(map[*websocket.Conn]chan []byte)}
+
+// Último estado das outras empresas, atualizado enquanto houver painéis conectados
+var peersPainel = struct {
+	sync.Mutex
+	estados map[string]PainelPeer
+}{estados: make(map[string]PainelPeer)}
+
+// Sinaliza que o estado mudou por uma ação e deve ser enviado antes do próximo intervalo
+var atualizarPainelAgora = make(chan struct{}, 1)
+
+// Registra as rotas do painel e inicia o envio periódico
+func inicializaPainel() {
+	http.Handle("/painel/", http.FileServer(http.FS(arquivosPainel)))
+	http.HandleFunc("/painel/ws", handlePainelWS)
+	http.HandleFunc("/painel/estado", handleEstadoPainel)
+	http.HandleFunc("/painel/acoes/liberar", apenasOperador(handleLiberarPontoOperador))
+	http.HandleFunc("/painel/acoes/manutencao", apenasOperador(handleManutencaoPonto))
+
+	go transmitirPainel()
+	go acompanharPeers()
+	if tokenOperador == "" {
+		logPainel.Warn("OPERADOR_TOKEN não definido: ações de operador desabilitadas")
+	}
+}
+
+func painelAtivo() bool {
+	clientesPainel.Lock()
+	defer clientesPainel.Unlock()
+	return len(clientesPainel.canais) > 0
+}
+
+// Envia o estado a todos os painéis a cada intervalo ou após uma ação de operador
+func transmitirPainel() {
+	ticker := time.NewTicker(intervaloPainel)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-atualizarPainelAgora:
+		}
+		if !painelAtivo() {
+			continue
+		}
+		mensagem, erro := json.Marshal(montarEstadoPainel())
+		if erro != nil {
+			logPainel.Error("erro ao codificar estado", "erro", erro)
+			continue
+		}
+		clientesPainel.Lock()
+		for conexao, canal := range clientesPainel.canais {
+			select {
+			case canal <- mensagem:
+			default:
+				// Painel lento: desconecta em vez de acumular estados antigos
+				logPainel.Warn("painel não acompanha as atualizações, desconectando", "remoto", conexao.RemoteAddr().String())
+				delete(clientesPainel.canais, conexao)
+				close(canal)
+			}
+		}
+		clientesPainel.Unlock()
+	}
+}
+
+func solicitarAtualizacaoPainel() {
+	select {
+	case atualizarPainelAgora <- struct{}{}:
+	default:
+	}
+}
+
+// Consulta periodicamente o topo da blockchain das outras empresas
+func acompanharPeers() {
+	cliente := &http.Client{Timeout: 3 * time.Second}
+	for {
+		if painelAtivo() {
+			for id, api := range empresasAPI {
+				if id == empresa.ID {
+					continue
+				}
+				peer := consultarPeer(cliente, id, api)
+				peersPainel.Lock()
+				if !peer.Online {
+					peer.UltimoContato = peersPainel.estados[id].UltimoContato
+				}
+				peersPainel.estados[id] = peer
+				peersPainel.Unlock()
+			}
+		}
+		time.Sleep(intervaloPeersPainel)
+	}
+}
+
+func consultarPeer(cliente *http.Client, id, api string) PainelPeer {
+	peer := PainelPeer{EmpresaID: id, API: api, Situacao: "indisponivel"}
+	resp, erro := cliente.Get(api + "/api/status")
+	if erro != nil {
+		peer.Erro = erro.Error()
+		return peer
+	}
+	defer resp.Body.Close()
+	var status struct {
+		Blockchain struct {
+			TotalBlocos int    `json:"total_blocos"`
+			UltimoHash  string `json:"ultimo_hash"`
+		} `json:"blockchain_info"`
+	}
+	if erro := json.NewDecoder(resp.Body).Decode(&status); erro != nil {
+		peer.Erro = "resposta inválida: " + erro.Error()
+		return peer
+	}
+	peer.Online = true
+	peer.TotalBlocos = status.Blockchain.TotalBlocos
+	peer.UltimoHash = status.Blockchain.UltimoHash
+	peer.UltimoContato = time.Now().Format(time.RFC3339)
+	return peer
+}
+
+// Compara o topo de outra empresa com a blockchain local
+func situacaoPeer(peer PainelPeer, chain []Bloco) string {
+	if !peer.Online {
+		return "indisponivel"
+	}
+	switch {
+	case peer.TotalBlocos > len(chain):
+		return "adiantado"
+	case peer.TotalBlocos < len(chain):
+		if peer.TotalBlocos > 0 && chain[peer.TotalBlocos-1].Hash != peer.UltimoHash {
+			return "divergente"
+		}
+		return "atrasado"
+	case len(chain) > 0 && chain[len(chain)-1].Hash != peer.UltimoHash:
+		return "divergente"
+	}
+	return "sincronizado"
+}
+
+// Monta o estado atual do nó para o painel
+func montarEstadoPainel() EstadoPainel {
+	agora := time.Now()
+	estado := EstadoPainel{
+		EmpresaID:     empresa.ID,
+		Nome:          empresa.Nome,
+		Gerado:        agora.Format(time.RFC3339),
+		AcoesOperador: tokenOperador != "",
+	}
+
+	// Blockchain: topo, blocos recentes, receita e situação das outras empresas
+	chain := chainAtual()
+	estado.TotalBlocos = len(chain)
+	if len(chain) > 0 {
+		estado.UltimoHash = chain[len(chain)-1].Hash
+	}
+	for i := len(chain) - 1; i >= 0 && len(estado.BlocosRecentes) < blocosRecentesPainel; i-- {
+		estado.BlocosRecentes = append(estado.BlocosRecentes, chain[i])
+	}
+	for _, bloco := range chain {
+		if bloco.Transacao.Empresa != empresa.ID {
+			continue
+		}
+		switch bloco.Transacao.Tipo {
+		case "RECARGA":
+			estado.Receita.Recargas++
+			estado.Receita.Faturado += bloco.Transacao.Valor
+		case "PAGAMENTO":
+			estado.Receita.Pagamentos++
+			estado.Receita.Recebido += bloco.Transacao.Valor
+		}
+	}
+	peersPainel.Lock()
+	for id := range empresasAPI {
+		if id == empresa.ID {
+			continue
+		}
+		peer, existe := peersPainel.estados[id]
+		if !existe {
+			peer = PainelPeer{EmpresaID: id, API: empresasAPI[id]}
+		}
+		peer.Situacao = situacaoPeer(peer, chain)
+		estado.Peers = append(estado.Peers, peer)
+	}
+	peersPainel.Unlock()
+	estado.Receita.AReceber = estado.Receita.Faturado - estado.Receita.Recebido
+	sort.Slice(estado.Peers, func(i, j int) bool { return estado.Peers[i].EmpresaID < estado.Peers[j].EmpresaID })
+
+	// Pontos: saúde, bloqueio manual, reservas e sessões de recarga
+	sessoes := make(map[string]string)
+	sessoes_recarga.Lock()
+	for _, ponto := range empresa.Pontos {
+		if sessao := sessaoAtivaDoPonto(ponto); sessao != nil {
+			sessoes[ponto] = sessao.Sessao
+		}
+	}
+	sessoes_recarga.Unlock()
+
+	controlePontos.RLock()
+	reservados := make(map[string]PontoStatus, len(controlePontos.pontos))
+	for ponto, status := range controlePontos.pontos {
+		reservados[ponto] = status
+	}
+	controlePontos.RUnlock()
+
+	for _, ponto := range empresa.Pontos {
+		online, motivo := avaliarSaudePonto(ponto, agora)
+		item := PainelPonto{Ponto: ponto, Online: online, Motivo: motivo, SessaoRecarga: sessoes[ponto]}
+		saude_pontos.Lock()
+		if saude, existe := saude_pontos.pontos[ponto]; existe {
+			item.Manutencao = saude.CodigoFalha == codigoBloqueioManual
+			item.UltimoHeartbeat = saude.UltimoHeartbeat.Format(time.RFC3339)
+		}
+		saude_pontos.Unlock()
+
+		if status, existe := reservados[ponto]; existe && status.Status == "RESERVADO" {
+			item.Reservado = true
+			item.Placa = status.Placa
+			expira := prazoReserva(status, nil)
+			restante := int(expira.Sub(agora).Seconds())
+			if restante < 0 {
+				restante = 0
+			}
+			estado.Reservas = append(estado.Reservas, PainelReserva{
+				Ponto:             ponto,
+				Placa:             status.Placa,
+				HashReserva:       status.HashReserva,
+				ExpiraEm:          expira.Format(time.RFC3339),
+				SegundosRestantes: restante,
+			})
+		}
+		estado.Pontos = append(estado.Pontos, item)
+	}
+	sort.Slice(estado.Reservas, func(i, j int) bool {
+		return estado.Reservas[i].SegundosRestantes < estado.Reservas[j].SegundosRestantes
+	})
+	return estado
+}
+
+// Conexão WebSocket de um painel: recebe o estado atual e depois as atualizações
+func handlePainelWS(w http.ResponseWriter, r *http.Request) {
+	conexao, erro := atualizadorWS.Upgrade(w, r, nil)
+	if erro != nil {
+		return
+	}
+	canal := make(chan []byte, mensagensPendentesWS)
+	if mensagem, erro := json.Marshal(montarEstadoPainel()); erro == nil {
+		canal <- mensagem
+	}
+	clientesPainel.Lock()
+	clientesPainel.canais[conexao] = canal
+	clientesPainel.Unlock()
+	logPainel.InfoContext(r.Context(), "painel conectado", "remoto", conexao.RemoteAddr().String())
+
+	// Leitura só para detectar o fechamento; o painel não envia comandos pelo WebSocket
+	encerrado := make(chan struct{})
+	go func() {
+		defer close(encerrado)
+		conexao.SetReadLimit(tamanhoMaximoLeituraWS)
+		for {
+			if _, _, erro := conexao.ReadMessage(); erro != nil {
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		clientesPainel.Lock()
+		if _, existe := clientesPainel.canais[conexao]; existe {
+			delete(clientesPainel.canais, conexao)
+			close(canal)
+		}
+		clientesPainel.Unlock()
+		conexao.Close()
+		logPainel.InfoContext(r.Context(), "painel desconectado", "remoto", conexao.RemoteAddr().String())
+	}()
+
+	for {
+		select {
+		case mensagem, aberto := <-canal:
+			if !aberto {
+				return
+			}
+			conexao.SetWriteDeadline(time.Now().Add(limiteEscritaPainel))
+			if erro := conexao.WriteMessage(websocket.TextMessage, mensagem); erro != nil {
+				return
+			}
+		case <-encerrado:
+			return
+		}
+	}
+}
+
+// Estado atual em JSON, para consultas sem WebSocket
+func handleEstadoPainel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(montarEstadoPainel())
+}
+
+// Exige o token de operador (Authorization: Bearer <token>) e POST
+func apenasOperador(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		if tokenOperador == "" {
+			http.Error(w, "Ações de operador desabilitadas (OPERADOR_TOKEN não definido)", http.StatusServiceUnavailable)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(tokenOperador)) != 1 {
+			logPainel.WarnContext(r.Context(), "ação de operador recusada: token inválido", "remoto", r.RemoteAddr)
+			http.Error(w, "Token de operador inválido", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Lê a ação e confere se o ponto é desta empresa
+func lerAcaoOperador(w http.ResponseWriter, r *http.Request) (AcaoOperadorRequest, bool) {
+	var req AcaoOperadorRequest
+	if erro := json.NewDecoder(r.Body).Decode(&req); erro != nil {
+		http.Error(w, "Erro ao decodificar JSON", http.StatusBadRequest)
+		return req, false
+	}
+	if !pontoDaEmpresa(req.Ponto) {
+		http.Error(w, "Ponto não pertence a esta empresa", http.StatusNotFound)
+		return req, false
+	}
+	return req, true
+}
+
+// Libera à força a reserva de um ponto; recusa se houver recarga em andamento
+func handleLiberarPontoOperador(w http.ResponseWriter, r *http.Request) {
+	req, ok := lerAcaoOperador(w, r)
+	if !ok {
+		return
+	}
+	lock := travarPonto(req.Ponto)
+	defer lock.Unlock()
+
+	sessoes_recarga.Lock()
+	sessao := sessaoAtivaDoPonto(req.Ponto)
+	sessoes_recarga.Unlock()
+	if sessao != nil {
+		http.Error(w, "Ponto com recarga em andamento (sessão "+sessao.Sessao+")", http.StatusConflict)
+		return
+	}
+
+	controlePontos.RLock()
+	status, existe := controlePontos.pontos[req.Ponto]
+	controlePontos.RUnlock()
+	if !existe || status.Status != "RESERVADO" {
+		http.Error(w, "Ponto não está reservado", http.StatusConflict)
+		return
+	}
+
+	liberarPontoCompleto(req.Ponto, status.Placa)
+	mensagem := "Reserva encerrada pelo operador"
+	if req.Motivo != "" {
+		mensagem += ": " + req.Motivo
+	}
+	notificarVeiculo(status.Placa, "reserva_cancelada", MensagemVeiculo{Ponto: req.Ponto, Mensagem: mensagem})
+	logPainel.InfoContext(r.Context(), "operador liberou o ponto", "ponto", req.Ponto, "placa", status.Placa, "motivo", req.Motivo)
+	solicitarAtualizacaoPainel()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success", "ponto": req.Ponto, "placa": status.Placa})
+}
+
+// Coloca ou retira o ponto de manutenção (bloqueio manual; reservas do ponto são canceladas)
+func handleManutencaoPonto(w http.ResponseWriter, r *http.Request) {
+	req, ok := lerAcaoOperador(w, r)
+	if !ok {
+		return
+	}
+	descricao := "Manutenção"
+	if req.Motivo != "" {
+		descricao += ": " + req.Motivo
+	}
+	definirBloqueioManual(req.Ponto, req.Ativa, descricao)
+	if req.Ativa {
+		logPainel.InfoContext(r.Context(), "operador colocou o ponto em manutenção", "ponto", req.Ponto, "motivo", req.Motivo)
+	} else {
+		logPainel.InfoContext(r.Context(), "operador retirou o ponto de manutenção", "ponto", req.Ponto)
+	}
+	solicitarAtualizacaoPainel()
+
+	online, motivo := avaliarSaudePonto(req.Ponto, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "ponto": req.Ponto, "manutencao": req.Ativa, "online": online, "motivo": motivo})
+}
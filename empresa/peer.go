@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Autenticação das chamadas REST entre empresas
+// Os endpoints usados apenas pelas outras empresas ficam sob /peer/ e exigem requisição assinada
+// com a chave RSA da empresa remetente (a mesma que assina os blocos):
+//   X-Empresa-ID   ID da empresa remetente
+//   X-Timestamp    unix (segundos); fora de janelaRequisicaoPeer a requisição é recusada
+//   X-Nonce        valor aleatório; repetido dentro da janela é recusado (replay)
+//   X-Assinatura   assinatura de "MÉTODO\nURI\ntimestamp\nnonce\nsha256(corpo)"
+
+const (
+	janelaRequisicaoPeer = 5 * time.Minute
+	tamanhoMaximoCorpo   = 32 << 20
+)
+
+// Nonces já aceitos, com o instante a partir do qual podem ser esquecidos
+var noncesPeer = struct {
+	sync.Mutex
+	vistos map[string]time.Time
+}{vistos: make(map[string]time.Time)}
+
+// Texto assinado de uma requisição entre empresas
+func textoAssinaturaPeer(metodo, uri, timestamp, nonce string, corpo []byte) string {
+	hash := sha256.Sum256(corpo)
+	return metodo + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(hash[:])
+}
+
+// Cria requisição para outra empresa assinada com a chave desta empresa, levando o ID de requisição e o rastreamento de ctx
+func novaRequisicaoPeer(ctx context.Context, metodo, url string, corpo []byte) (*http.Request, error) {
+	req, erro := http.NewRequest(metodo, url, bytes.NewReader(corpo))
+	if erro != nil {
+		return nil, erro
+	}
+	propagarContexto(ctx, req)
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	assinatura, erro := AssinarBloco(textoAssinaturaPeer(metodo, req.URL.RequestURI(), timestamp, hex.EncodeToString(nonce), corpo), chave_privada_path)
+	if erro != nil {
+		return nil, fmt.Errorf("erro ao assinar requisição: %v", erro)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Empresa-ID", empresa.ID)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Nonce", hex.EncodeToString(nonce))
+	req.Header.Set("X-Assinatura", assinatura)
+	return req, nil
+}
+
+// POST assinado para outra empresa
+func postPeer(ctx context.Context, url string, corpo []byte) (*http.Response, error) {
+	req, erro := novaRequisicaoPeer(ctx, http.MethodPost, url, corpo)
+	if erro != nil {
+		return nil, erro
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	return client.Do(req)
+}
+
+// Valida a assinatura, a janela de tempo e o nonce de uma requisição recebida
+// Retorna o ID da empresa remetente e o corpo lido
+func verificarRequisicaoPeer(r *http.Request) (string, []byte, error) {
+	id := r.Header.Get("X-Empresa-ID")
+	timestamp := r.Header.Get("X-Timestamp")
+	nonce := r.Header.Get("X-Nonce")
+	assinatura := r.Header.Get("X-Assinatura")
+	if id == "" || timestamp == "" || nonce == "" || assinatura == "" {
+		return "", nil, errors.New("cabeçalhos de autenticação ausentes")
+	}
+	if _, conhecida := empresasAPI[id]; !conhecida || !identificadorValido(id) || id == empresa.ID {
+		return "", nil, fmt.Errorf("empresa desconhecida: %s", id)
+	}
+	segundos, erro := strconv.ParseInt(timestamp, 10, 64)
+	if erro != nil {
+		return "", nil, errors.New("timestamp inválido")
+	}
+	enviada := time.Unix(segundos, 0)
+	if diferenca := time.Since(enviada); diferenca > janelaRequisicaoPeer || diferenca < -janelaRequisicaoPeer {
+		return "", nil, errors.New("timestamp fora da janela")
+	}
+
+	corpo, erro := io.ReadAll(io.LimitReader(r.Body, tamanhoMaximoCorpo))
+	if erro != nil {
+		return "", nil, errors.New("erro ao ler corpo")
+	}
+	texto := textoAssinaturaPeer(r.Method, r.URL.RequestURI(), timestamp, nonce, corpo)
+	if !ValidarAssinatura(texto, assinatura, "data/empresa_"+id+"_public.pem") {
+		return "", nil, errors.New("assinatura inválida")
+	}
+
+	// O nonce só é registrado depois da assinatura, para que terceiros não esgotem nonces alheios
+	chave := id + ":" + nonce
+	agora := time.Now()
+	noncesPeer.Lock()
+	defer noncesPeer.Unlock()
+	if _, repetido := noncesPeer.vistos[chave]; repetido {
+		return "", nil, errors.New("nonce repetido")
+	}
+	noncesPeer.vistos[chave] = enviada.Add(janelaRequisicaoPeer)
+	for outra, expira := range noncesPeer.vistos {
+		if agora.After(expira) {
+			delete(noncesPeer.vistos, outra)
+		}
+	}
+	return id, corpo, nil
+}
+
+// Restringe um handler às outras empresas; o corpo já lido é devolvido à requisição
+// e o ID autenticado fica em X-Empresa-ID
+func apenasEmpresas(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, corpo, erro := verificarRequisicaoPeer(r)
+		if erro != nil {
+			logPeer.WarnContext(r.Context(), "requisição recusada", "metodo", r.Method, "caminho", r.URL.Path, "origem", r.RemoteAddr, "erro", erro)
+			http.Error(w, "Não autorizado", http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(corpo))
+		r.Header.Set("X-Empresa-ID", id)
+		handler(w, r)
+	}
+}
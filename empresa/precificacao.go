@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"persistencia"
+)
+
+// Precificação dinâmica
+// O preço por kWh da tarifa vigente é ajustado por regras da empresa (janelas de horário,
+// dias da semana e ocupação dos pontos). A empresa emite cotações assinadas com validade; o
+// hash da cotação vai na transação RESERVA e o preço cotado é o cobrado na recarga.
+
+// Regra de ajuste de preço; todos os critérios preenchidos precisam ser atendidos
+type RegraPreco struct {
+	Nome          string   `json:"nome"`
+	DiasSemana    []int    `json:"dias_semana,omitempty"`       // 0 = domingo; vazio = todos os dias
+	Inicio        string   `json:"inicio,omitempty"`            // "HH:MM"
+	Fim           string   `json:"fim,omitempty"`               // "HH:MM"; pode atravessar a meia-noite
+	OcupacaoAcima float64  `json:"ocupacao_acima_de,omitempty"` // fração de pontos da empresa reservados
+	Pontos        []string `json:"pontos,omitempty"`            // vazio = todos os pontos da empresa
+	Multiplicador float64  `json:"multiplicador"`
+}
+
+// Configuração de preços da empresa (data/regras_preco_<id>.json)
+type ConfiguracaoPrecos struct {
+	FusoUTC                 int          `json:"fuso_utc"` // horas em relação a UTC usadas nas janelas
+	ValidadeCotacaoSegundos int          `json:"validade_cotacao_segundos"`
+	Regras                  []RegraPreco `json:"regras"`
+}
+
+// Cotação assinada pela empresa dona do ponto
+type CotacaoAssinada struct {
+	Hash           string   `json:"hash"`
+	Ponto          string   `json:"ponto"`
+	Empresa        string   `json:"empresa"`
+	Placa          string   `json:"placa"`
+	HashTarifa     string   `json:"hash_tarifa"`
+	PrecoKWh       float64  `json:"preco_kwh"` // já com o multiplicador aplicado
+	TaxaSessao     float64  `json:"taxa_sessao"`
+	TaxaOciosidade float64  `json:"taxa_ociosidade"`
+	Multiplicador  float64  `json:"multiplicador"`
+	Regras         []string `json:"regras,omitempty"`
+	Ocupacao       float64  `json:"ocupacao"`
+	EmitidaEm      string   `json:"emitida_em"`
+	ExpiraEm       string   `json:"expira_em"`
+	Assinatura     string   `json:"assinatura"`
+	Vinculada      bool     `json:"vinculada"` // usada em uma reserva
+}
+
+const validadePadraoCotacao = 10 * time.Minute
+
+var (
+	errCotacaoInexistente = errors.New("cotação não encontrada")
+	errCotacaoExpirada    = errors.New("cotação expirada")
+	errCotacaoInvalida    = errors.New("cotação não corresponde à reserva")
+	errCotacaoUsada       = errors.New("cotação já usada em outra reserva")
+)
+
+// Cotações emitidas por esta empresa (hash -> cotação)
+var cotacoes = struct {
+	sync.Mutex
+	emitidas map[string]*CotacaoAssinada
+}{emitidas: make(map[string]*CotacaoAssinada)}
+
+// Carrega a configuração de preços; sem arquivo, nenhuma regra é aplicada
+func carregarConfiguracaoPrecos() ConfiguracaoPrecos {
+	config := ConfiguracaoPrecos{}
+	file, erro := os.ReadFile("data/regras_preco_" + empresa.ID + ".json")
+	if erro != nil {
+		return config
+	}
+	if erro := json.Unmarshal(file, &config); erro != nil {
+		logPrecos.Error("erro ao decodificar regras de preço", "erro", erro)
+	}
+	return config
+}
+
+// Fração dos pontos desta empresa que estão reservados
+func ocupacaoEmpresa() float64 {
+	if len(empresa.Pontos) == 0 {
+		return 0
+	}
+	controlePontos.RLock()
+	defer controlePontos.RUnlock()
+
+	reservados := 0
+	for _, ponto := range empresa.Pontos {
+		if status, existe := controlePontos.pontos[ponto]; existe && status.Status == "RESERVADO" {
+			reservados++
+		}
+	}
+	return float64(reservados) / float64(len(empresa.Pontos))
+}
+
+// Converte "HH:MM" em minutos desde a meia-noite
+func minutosDoDia(horario string) (int, bool) {
+	var hora, minuto int
+	if _, erro := fmt.Sscanf(horario, "%d:%d", &hora, &minuto); erro != nil {
+		return 0, false
+	}
+	return hora*60 + minuto, true
+}
+
+// Verifica se a regra se aplica ao ponto no instante e ocupação informados
+func (regra RegraPreco) aplica(ponto string, em time.Time, ocupacao float64) bool {
+	if len(regra.Pontos) > 0 {
+		encontrado := false
+		for _, p := range regra.Pontos {
+			if p == ponto {
+				encontrado = true
+				break
+			}
+		}
+		if !encontrado {
+			return false
+		}
+	}
+	if len(regra.DiasSemana) > 0 {
+		encontrado := false
+		for _, dia := range regra.DiasSemana {
+			if time.Weekday(dia) == em.Weekday() {
+				encontrado = true
+				break
+			}
+		}
+		if !encontrado {
+			return false
+		}
+	}
+	if regra.Inicio != "" && regra.Fim != "" {
+		inicio, ok1 := minutosDoDia(regra.Inicio)
+		fim, ok2 := minutosDoDia(regra.Fim)
+		if !ok1 || !ok2 {
+			return false
+		}
+		agora := em.Hour()*60 + em.Minute()
+		if inicio <= fim {
+			if agora < inicio || agora >= fim {
+				return false
+			}
+		} else if agora < inicio && agora >= fim {
+			// Janela que atravessa a meia-noite
+			return false
+		}
+	}
+	if regra.OcupacaoAcima > 0 && ocupacao <= regra.OcupacaoAcima {
+		return false
+	}
+	return true
+}
+
+// Calcula o multiplicador de preço do ponto; os multiplicadores das regras aplicáveis se acumulam
+func avaliarRegrasPreco(ponto string, em time.Time, ocupacao float64) (float64, []string) {
+	config := carregarConfiguracaoPrecos()
+	local := em.In(time.FixedZone("empresa", config.FusoUTC*3600))
+
+	multiplicador := 1.0
+	var aplicadas []string
+	for _, regra := range config.Regras {
+		if regra.Multiplicador <= 0 || !regra.aplica(ponto, local, ocupacao) {
+			continue
+		}
+		multiplicador *= regra.Multiplicador
+		aplicadas = append(aplicadas, regra.Nome)
+	}
+	return multiplicador, aplicadas
+}
+
+// Aplica a precificação dinâmica sobre a tarifa vigente
+func tarifaDinamica(ponto string, tarifa Tarifa, em time.Time) (Tarifa, float64, []string) {
+	multiplicador, regras := avaliarRegrasPreco(ponto, em, ocupacaoEmpresa())
+	tarifa.PrecoKWh *= multiplicador
+	return tarifa, multiplicador, regras
+}
+
+// Calcula o hash de uma cotação (assinado pela empresa)
+func calcularHashCotacao(c CotacaoAssinada) string {
+	dados := strings.Join([]string{
+		c.Ponto, c.Empresa, c.Placa, c.HashTarifa,
+		fmt.Sprintf("%.4f", c.PrecoKWh), fmt.Sprintf("%.2f", c.TaxaSessao), fmt.Sprintf("%.2f", c.TaxaOciosidade),
+		fmt.Sprintf("%.4f", c.Multiplicador), c.EmitidaEm, c.ExpiraEm,
+	}, "|")
+	hash := sha256.Sum256([]byte(dados))
+	return hex.EncodeToString(hash[:])
+}
+
+// Emite uma cotação assinada para a placa no ponto desta empresa
+func emitirCotacao(ctx context.Context, ponto, placa string) (CotacaoAssinada, error) {
+	if !pontoDaEmpresa(ponto) {
+		return CotacaoAssinada{}, fmt.Errorf("ponto %s não pertence a esta empresa", ponto)
+	}
+	if placa == "" {
+		return CotacaoAssinada{}, errors.New("a cotação precisa da placa")
+	}
+	agora := time.Now()
+	tarifa, hashTarifa, erro := tarifaParaRecarga(ponto, agora)
+	if erro != nil {
+		return CotacaoAssinada{}, erro
+	}
+
+	validade := validadePadraoCotacao
+	if segundos := carregarConfiguracaoPrecos().ValidadeCotacaoSegundos; segundos > 0 {
+		validade = time.Duration(segundos) * time.Second
+	}
+
+	ocupacao := ocupacaoEmpresa()
+	multiplicador, regras := avaliarRegrasPreco(ponto, agora, ocupacao)
+	cotacao := CotacaoAssinada{
+		Ponto:          ponto,
+		Empresa:        empresa.ID,
+		Placa:          placa,
+		HashTarifa:     hashTarifa,
+		PrecoKWh:       tarifa.PrecoKWh * multiplicador,
+		TaxaSessao:     tarifa.TaxaSessao,
+		TaxaOciosidade: tarifa.TaxaOciosidade,
+		Multiplicador:  multiplicador,
+		Regras:         regras,
+		Ocupacao:       ocupacao,
+		EmitidaEm:      agora.UTC().Format(time.RFC3339),
+		ExpiraEm:       agora.Add(validade).UTC().Format(time.RFC3339),
+	}
+	cotacao.Hash = calcularHashCotacao(cotacao)
+	cotacao.Assinatura, erro = AssinarBloco(cotacao.Hash, chave_privada_path)
+	if erro != nil {
+		return CotacaoAssinada{}, erro
+	}
+
+	cotacoes.Lock()
+	cotacoes.emitidas[cotacao.Hash] = &cotacao
+	salvarCotacoesInterno()
+	cotacoes.Unlock()
+
+	logPrecos.InfoContext(ctx, "cotação emitida", "placa", placa, "ponto", ponto, "hash", cotacao.Hash, "preco_kwh", cotacao.PrecoKWh,
+		"multiplicador", multiplicador, "regras", regras, "ocupacao", ocupacao, "expira_em", cotacao.ExpiraEm)
+	return cotacao, nil
+}
+
+// Busca uma cotação emitida por esta empresa e confere a assinatura
+func buscarCotacao(hash string) (CotacaoAssinada, error) {
+	cotacoes.Lock()
+	cotacao, existe := cotacoes.emitidas[hash]
+	var copia CotacaoAssinada
+	if existe {
+		copia = *cotacao
+	}
+	cotacoes.Unlock()
+
+	if !existe {
+		return CotacaoAssinada{}, errCotacaoInexistente
+	}
+	if calcularHashCotacao(copia) != hash || !ValidarAssinatura(hash, copia.Assinatura, chave_publica_path) {
+		return CotacaoAssinada{}, errCotacaoInvalida
+	}
+	return copia, nil
+}
+
+// Valida a cotação informada em uma reserva e a consome (marca como vinculada)
+// Reservas sem cotação continuam aceitas e pagam o preço dinâmico do início da recarga
+// Uma cotação vale para uma única reserva: já vinculada, só é aceita de novo enquanto o ponto
+// estiver reservado para a mesma placa (reenvio da mesma reserva, por exemplo pelo fallback HTTP
+// depois de a resposta MQTT se perder). Deve ser chamada com o lock do ponto; a função retornada
+// desfaz o vínculo feito nesta chamada, para quando a reserva não se concretizar
+func vincularCotacaoReserva(hash, placa, ponto string) (func(), error) {
+	desfazer := func() {}
+	if hash == "" {
+		return desfazer, nil
+	}
+	cotacao, erro := buscarCotacao(hash)
+	if erro != nil {
+		return desfazer, erro
+	}
+	if cotacao.Ponto != ponto || cotacao.Placa == "" || cotacao.Placa != placa {
+		return desfazer, errCotacaoInvalida
+	}
+	if expira, erro := time.Parse(time.RFC3339, cotacao.ExpiraEm); erro != nil || time.Now().After(expira) {
+		return desfazer, errCotacaoExpirada
+	}
+
+	cotacoes.Lock()
+	defer cotacoes.Unlock()
+	emitida, existe := cotacoes.emitidas[hash]
+	if !existe {
+		return desfazer, errCotacaoInexistente
+	}
+	if emitida.Vinculada {
+		if !pontoReservadoPara(ponto, placa) {
+			return desfazer, errCotacaoUsada
+		}
+		return desfazer, nil
+	}
+	emitida.Vinculada = true
+	salvarCotacoesInterno()
+	return func() {
+		cotacoes.Lock()
+		defer cotacoes.Unlock()
+		if emitida, existe := cotacoes.emitidas[hash]; existe && emitida.Vinculada {
+			emitida.Vinculada = false
+			salvarCotacoesInterno()
+		}
+	}, nil
+}
+
+// Indica se o ponto está reservado para a placa no controle de pontos
+func pontoReservadoPara(ponto, placa string) bool {
+	controlePontos.RLock()
+	defer controlePontos.RUnlock()
+	status, existe := controlePontos.pontos[ponto]
+	return existe && status.Status == "RESERVADO" && status.Placa == placa
+}
+
+// Define o preço de uma recarga: o cotado na reserva ou, sem cotação, a tarifa dinâmica do início
+// Retorna a tarifa efetiva, o hash da tarifa base e o hash da cotação usada
+func precoDaRecarga(ponto, hashReserva string, inicio time.Time) (Tarifa, string, string, error) {
+	if reserva, existe := blocoPorHash(hashReserva); existe && reserva.Transacao.Cotacao != "" {
+		cotacao, erro := buscarCotacao(reserva.Transacao.Cotacao)
+		if erro == nil {
+			tarifa := Tarifa{
+				PrecoKWh:       cotacao.PrecoKWh,
+				TaxaSessao:     cotacao.TaxaSessao,
+				TaxaOciosidade: cotacao.TaxaOciosidade,
+			}
+			return tarifa, cotacao.HashTarifa, cotacao.Hash, nil
+		}
+		logPrecos.Warn("cotação da reserva indisponível; usando preço dinâmico", "cotacao", reserva.Transacao.Cotacao, "hash", hashReserva, "erro", erro)
+	}
+
+	tarifa, hashTarifa, erro := tarifaParaRecarga(ponto, inicio)
+	if erro != nil {
+		return Tarifa{}, "", "", erro
+	}
+	tarifa, _, _ = tarifaDinamica(ponto, tarifa, inicio)
+	return tarifa, hashTarifa, "", nil
+}
+
+// Carrega as cotações emitidas (data/cotacoes_<id>.json)
+func carregarCotacoes() {
+	cotacoes.Lock()
+	defer cotacoes.Unlock()
+	if erro := persistencia.LerJSON("data/cotacoes_"+empresa.ID+".json", &cotacoes.emitidas); errors.Is(erro, fs.ErrNotExist) {
+		return
+	} else if erro != nil {
+		logPrecos.Error("erro ao decodificar cotações", "erro", erro)
+		cotacoes.emitidas = make(map[string]*CotacaoAssinada)
+	}
+}
+
+// Salva as cotações; as não vinculadas a reservas são descartadas um dia após expirarem
+// Deve ser chamada com cotacoes travado
+func salvarCotacoesInterno() {
+	limite := time.Now().Add(-24 * time.Hour)
+	for hash, cotacao := range cotacoes.emitidas {
+		expira, erro := time.Parse(time.RFC3339, cotacao.ExpiraEm)
+		if !cotacao.Vinculada && (erro != nil || expira.Before(limite)) {
+			delete(cotacoes.emitidas, hash)
+		}
+	}
+	if erro := persistencia.GravarJSON("data/cotacoes_"+empresa.ID+".json", cotacoes.emitidas, 0644); erro != nil {
+		logPrecos.Error("erro ao salvar cotações", "erro", erro)
+	}
+}
+
+// Handler de cotações assinadas
+// POST {ponto, placa} emite uma cotação; GET ?hash=<hash> consulta uma cotação emitida
+func handleCotacoes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Ponto string `json:"ponto"`
+			Placa string `json:"placa"`
+		}
+		if erro := json.NewDecoder(r.Body).Decode(&req); erro != nil {
+			http.Error(w, "Erro ao decodificar JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Placa == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Parâmetro placa é obrigatório"})
+			return
+		}
+		cotacao, erro := emitirCotacao(r.Context(), req.Ponto, req.Placa)
+		if erro != nil {
+			status := http.StatusNotFound
+			if !errors.Is(erro, errSemTarifa) && pontoDaEmpresa(req.Ponto) {
+				status = http.StatusInternalServerError
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": erro.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(cotacao)
+
+	case http.MethodGet:
+		cotacao, erro := buscarCotacao(r.URL.Query().Get("hash"))
+		if erro != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": erro.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(cotacao)
+
+	default:
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Protocolo de mensagens MQTT
+// Toda mensagem é um envelope JSON versionado (tipo, versão, ID, timestamp, remetente e payload).
+// Requisições trazem um ID de correlação e o tópico de resposta; as respostas ecoam a correlação.
+// Durante a transição, mensagens CSV antigas ("TIPO,campo,campo") continuam aceitas enquanto
+// PROTOCOLO_CSV_LEGADO não for "false". Mensagens malformadas são reportadas ao remetente no
+// tópico mensagens/erro/<remetente>, com o remetente deduzido do tópico em que a mensagem chegou
+// (garantido pela ACL do broker), nunca do campo remetente do envelope.
+
+const versaoProtocolo = 1
+
+// Envelope comum a todas as mensagens
+// Correlacao e ResponderPara só são usados em requisições e nas respectivas respostas
+// Confirmar pede ao destinatário um ACK com Correlacao = ID (ver outbox.go)
+// Requisicao é o ID gerado pelo veículo para a operação, ecoado nas respostas (ver logs.go)
+// Traceparent é o span do remetente no formato W3C Trace Context (ver rastreamento.go)
+type Envelope struct {
+	Tipo          string          `json:"tipo"`
+	Versao        int             `json:"versao"`
+	ID            string          `json:"id"`
+	Timestamp     string          `json:"timestamp"`
+	Remetente     string          `json:"remetente"`
+	Correlacao    string          `json:"correlacao,omitempty"`
+	ResponderPara string          `json:"responder_para,omitempty"`
+	Confirmar     bool            `json:"confirmar,omitempty"`
+	Requisicao    string          `json:"requisicao_id,omitempty"`
+	Traceparent   string          `json:"traceparent,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+}
+
+// Payload da mensagem de erro enviada ao remetente de uma mensagem malformada
+type ErroProtocolo struct {
+	IDOriginal string `json:"id_original,omitempty"`
+	Topico     string `json:"topico"`
+	Motivo     string `json:"motivo"`
+}
+
+var (
+	errMensagemLegada     = errors.New("mensagem no formato CSV legado")
+	errVersaoNaoSuportada = errors.New("versão de protocolo não suportada")
+)
+
+// Aceita mensagens CSV antigas durante a janela de transição
+var aceitaCSVLegado = os.Getenv("PROTOCOLO_CSV_LEGADO") != "false"
+
+// Identificador deste nó nos envelopes enviados
+var remetenteProtocolo string
+
+// QoS usada nas publicações e inscrições (MQTT_QOS: 0, 1 ou 2; padrão 1)
+var qosMqtt = lerQosMqtt()
+
+// Lê a QoS configurada; valores inválidos usam o padrão
+func lerQosMqtt() byte {
+	switch os.Getenv("MQTT_QOS") {
+	case "0":
+		return 0
+	case "2":
+		return 2
+	}
+	return 1
+}
+
+// Gera identificador aleatório de mensagem
+func gerarIDMensagem() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Monta um envelope novo com o payload serializado (correlacao vazia para mensagens não solicitadas)
+func novoEnvelope(tipo string, payload interface{}, correlacao string) (Envelope, error) {
+	envelope := Envelope{
+		Tipo:       tipo,
+		Versao:     versaoProtocolo,
+		ID:         gerarIDMensagem(),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Remetente:  remetenteProtocolo,
+		Correlacao: correlacao,
+	}
+	if payload != nil {
+		dados, erro := json.Marshal(payload)
+		if erro != nil {
+			return envelope, erro
+		}
+		envelope.Payload = dados
+	}
+	return envelope, nil
+}
+
+// Decodifica um envelope; retorna errMensagemLegada se a mensagem não for JSON
+func decodificarEnvelope(bruto []byte) (Envelope, error) {
+	var envelope Envelope
+	bruto = bytes.TrimSpace(bruto)
+	if len(bruto) == 0 || bruto[0] != '{' {
+		return envelope, errMensagemLegada
+	}
+	if erro := json.Unmarshal(bruto, &envelope); erro != nil {
+		return envelope, fmt.Errorf("JSON inválido: %v", erro)
+	}
+	if envelope.Versao < 1 || envelope.Versao > versaoProtocolo {
+		return envelope, fmt.Errorf("%w: %d", errVersaoNaoSuportada, envelope.Versao)
+	}
+	if envelope.Tipo == "" {
+		return envelope, errors.New("campo tipo ausente")
+	}
+	return envelope, nil
+}
+
+// Decodifica o payload do envelope no destino informado
+func (e Envelope) lerPayload(destino interface{}) error {
+	if len(e.Payload) == 0 {
+		return errors.New("payload ausente")
+	}
+	if erro := json.Unmarshal(e.Payload, destino); erro != nil {
+		return fmt.Errorf("payload inválido para %s: %v", e.Tipo, erro)
+	}
+	return nil
+}
+
+// Publica um envelope em um tópico
+func publicarEnvelope(client mqtt.Client, topico, tipo string, payload interface{}, retido bool) {
+	enviarEnvelope(client, topico, tipo, payload, retido, "")
+}
+
+// Publica a resposta a uma requisição, ecoando a sua correlação
+func publicarResposta(client mqtt.Client, topico, tipo string, payload interface{}, correlacao string) {
+	enviarEnvelope(client, topico, tipo, payload, false, correlacao)
+}
+
+// Codifica e publica o envelope
+func enviarEnvelope(client mqtt.Client, topico, tipo string, payload interface{}, retido bool, correlacao string) {
+	if client == nil || !client.IsConnected() {
+		logMQTT.Warn("cliente desconectado; mensagem descartada", "tipo", tipo, "topico", topico)
+		return
+	}
+	envelope, erro := novoEnvelope(tipo, payload, correlacao)
+	if erro != nil {
+		logMQTT.Error("erro ao codificar mensagem", "tipo", tipo, "erro", erro)
+		return
+	}
+	dados, _ := json.Marshal(envelope)
+	token := client.Publish(topico, qosMqtt, retido, dados)
+	token.Wait()
+	metricaMqttEnviadas.Inc(tipo)
+}
+
+// Reporta ao remetente que a mensagem recebida não pôde ser processada
+// O campo remetente do envelope não é autenticado e só vai para o log
+func publicarErroProtocolo(client mqtt.Client, topico string, envelope Envelope, motivo error) {
+	remetente := remetenteDoTopico(topico)
+	logMQTT.Warn("mensagem inválida", "remetente", remetente, "remetente_declarado", envelope.Remetente, "topico", topico, "motivo", motivo)
+	if remetente == "" {
+		return
+	}
+	publicarResposta(client, "mensagens/erro/"+remetente, "erro", ErroProtocolo{
+		IDOriginal: envelope.ID,
+		Topico:     topico,
+		Motivo:     motivo.Error(),
+	}, envelope.ID)
+}
+
+// Remetente de uma mensagem pelo tópico em que chegou, conforme a ACL do broker: só o veículo
+// publica em mensagens/requisicao/<placa> e só a estação da empresa publica nos tópicos dos
+// pontos dela. Nos demais tópicos (mensagens/cliente, mensagens/empresa/<id>) o remetente não é
+// conhecido e o erro fica só no log
+func remetenteDoTopico(topico string) string {
+	if placa, ok := strings.CutPrefix(topico, "mensagens/requisicao/"); ok && placa != "" && !strings.Contains(placa, "/") {
+		return placa
+	}
+	if partes := strings.Split(topico, "/"); len(partes) == 3 && partes[0] == "pontos" && pontoDaEmpresa(partes[1]) {
+		return "estacao_" + empresa.ID
+	}
+	return ""
+}
+
+// Dados trocados entre veículos e empresas; cada tipo usa apenas os campos de que precisa
+type MensagemVeiculo struct {
+	Placa    string        `json:"placa,omitempty"`
+	Ponto    string        `json:"ponto,omitempty"`
+	Hash     string        `json:"hash,omitempty"`
+	Cotacao  string        `json:"cotacao,omitempty"`
+	Valor    float64       `json:"valor,omitempty"`
+	Mensagem string        `json:"mensagem,omitempty"`
+	Sessao   string        `json:"sessao,omitempty"`
+	KWh      float64       `json:"kwh,omitempty"`
+	KW       float64       `json:"kw,omitempty"`
+	Resumo   *ResumoStatus `json:"resumo,omitempty"`
+}
+
+// Resumo financeiro enviado em status_resposta
+type ResumoStatus struct {
+	Recargas        int     `json:"recargas"`
+	Pagamentos      int     `json:"pagamentos"`
+	ValorRecargas   float64 `json:"valor_recargas"`
+	ValorPagamentos float64 `json:"valor_pagamentos"`
+	SaldoPendente   float64 `json:"saldo_pendente"`
+}
+
+// Dados trocados entre empresas e estações de recarga
+type MensagemPonto struct {
+	Ponto      string  `json:"ponto"`
+	Codigo     string  `json:"codigo,omitempty"`
+	Descricao  string  `json:"descricao,omitempty"`
+	Status     string  `json:"status,omitempty"`
+	Motivo     string  `json:"motivo,omitempty"`
+	Placa      string  `json:"placa,omitempty"`
+	Sessao     string  `json:"sessao,omitempty"`
+	Estado     string  `json:"estado,omitempty"`
+	Detalhe    string  `json:"detalhe,omitempty"`
+	KWh        float64 `json:"kwh,omitempty"`
+	KW         float64 `json:"kw,omitempty"`
+	KWhAlvo    float64 `json:"kwh_alvo,omitempty"`
+	Inicio     string  `json:"inicio,omitempty"`
+	Fim        string  `json:"fim,omitempty"`
+	Assinatura string  `json:"assinatura,omitempty"`
+}
+
+// Status da empresa publicado (retido) em empresas/<id>/status: online ao conectar, offline no
+// encerramento ou, como last will, quando a conexão cai
+type StatusEmpresa struct {
+	EmpresaID string `json:"empresa_id"`
+	Status    string `json:"status"`
+	Motivo    string `json:"motivo,omitempty"`
+}
+
+// Dados trocados entre empresas
+type MensagemEmpresa struct {
+	Ponto  string `json:"ponto,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+// Monta o envelope equivalente a uma mensagem CSV antiga
+func envelopeLegado(tipo, remetente string, payload interface{}) Envelope {
+	dados, _ := json.Marshal(payload)
+	return Envelope{Tipo: tipo, Versao: 0, Remetente: remetente, Payload: dados}
+}
+
+// Converte requisição CSV antiga de veículo: RESERVA,placa,ponto[,cotacao] | RECARGA,placa,ponto,valor |
+// STATUS,placa | CANCELAR,placa,ponto
+func envelopeVeiculoDeCSV(texto string) (Envelope, error) {
+	partes := strings.Split(texto, ",")
+	if len(partes) < 2 {
+		return Envelope{}, errors.New("mensagem CSV incompleta")
+	}
+	tipo := partes[0]
+	dados := MensagemVeiculo{Placa: partes[1]}
+	minimo := map[string]int{"RESERVA": 3, "RECARGA": 4, "STATUS": 2, "CANCELAR": 3}
+	if n, conhecido := minimo[tipo]; !conhecido || len(partes) < n {
+		return envelopeLegado(tipo, dados.Placa, nil), fmt.Errorf("mensagem CSV %s inválida", tipo)
+	}
+	if len(partes) >= 3 {
+		dados.Ponto = partes[2]
+	}
+	switch tipo {
+	case "RESERVA":
+		if len(partes) >= 4 {
+			dados.Cotacao = partes[3]
+		}
+	case "RECARGA":
+		dados.Valor, _ = strconv.ParseFloat(partes[3], 64)
+	}
+	return envelopeLegado(tipo, dados.Placa, dados), nil
+}
+
+// Converte mensagem CSV antiga de estação: HEARTBEAT,ponto,codigo | FALHA,ponto,codigo,descricao |
+// MEDICAO,ponto,sessao,kwh,kw | SESSAO,ponto,sessao,estado,detalhe |
+// LEITURA,ponto,placa,sessao,kwh,inicio,fim,assinatura
+func envelopePontoDeCSV(texto string) (Envelope, error) {
+	partes := strings.Split(texto, ",")
+	if len(partes) < 2 {
+		return Envelope{}, errors.New("mensagem CSV incompleta")
+	}
+	tipo := partes[0]
+	dados := MensagemPonto{Ponto: partes[1]}
+	invalida := fmt.Errorf("mensagem CSV %s inválida", tipo)
+	switch tipo {
+	case "HEARTBEAT":
+		dados.Codigo = "OK"
+		if len(partes) >= 3 {
+			dados.Codigo = partes[2]
+		}
+	case "FALHA":
+		if len(partes) < 3 {
+			return Envelope{}, invalida
+		}
+		dados.Codigo = partes[2]
+		if len(partes) >= 4 {
+			dados.Descricao = strings.Join(partes[3:], ",")
+		}
+	case "MEDICAO":
+		if len(partes) < 5 {
+			return Envelope{}, invalida
+		}
+		dados.Sessao = partes[2]
+		var erro1, erro2 error
+		dados.KWh, erro1 = strconv.ParseFloat(partes[3], 64)
+		dados.KW, erro2 = strconv.ParseFloat(partes[4], 64)
+		if erro1 != nil || erro2 != nil {
+			return Envelope{}, invalida
+		}
+	case "SESSAO":
+		if len(partes) < 4 {
+			return Envelope{}, invalida
+		}
+		dados.Sessao, dados.Estado = partes[2], partes[3]
+		if len(partes) >= 5 {
+			dados.Detalhe = strings.Join(partes[4:], ",")
+		}
+	case "LEITURA":
+		if len(partes) < 8 {
+			return Envelope{}, invalida
+		}
+		var erro error
+		dados.Placa, dados.Sessao = partes[2], partes[3]
+		if dados.KWh, erro = strconv.ParseFloat(partes[4], 64); erro != nil {
+			return Envelope{}, invalida
+		}
+		dados.Inicio, dados.Fim, dados.Assinatura = partes[5], partes[6], partes[7]
+	default:
+		return Envelope{}, fmt.Errorf("tipo CSV desconhecido: %s", tipo)
+	}
+	return envelopeLegado(tipo, "", dados), nil
+}
+
+// Converte mensagem CSV antiga entre empresas: SYNC,... | STATUS_UPDATE,ponto,status
+func envelopeEmpresaDeCSV(texto string) (Envelope, error) {
+	partes := strings.Split(texto, ",")
+	if len(partes) < 2 {
+		return Envelope{}, errors.New("mensagem CSV incompleta")
+	}
+	switch partes[0] {
+	case "SYNC":
+		return envelopeLegado("SYNC", "", MensagemEmpresa{}), nil
+	case "STATUS_UPDATE":
+		if len(partes) >= 3 {
+			return envelopeLegado("STATUS_UPDATE", "", MensagemEmpresa{Ponto: partes[1], Status: partes[2]}), nil
+		}
+	}
+	return Envelope{}, fmt.Errorf("mensagem CSV %s inválida", partes[0])
+}
+
+// Decodifica uma mensagem recebida (envelope ou CSV legado) e o seu payload em destino
+// Em caso de erro, reporta ao remetente e retorna ok = false
+func receberMensagem(client mqtt.Client, msg mqtt.Message, converterCSV func(string) (Envelope, error), destino interface{}) (Envelope, bool) {
+	envelope, erro := decodificarEnvelope(msg.Payload())
+	if errors.Is(erro, errMensagemLegada) {
+		envelope, erro = converterCSV(string(msg.Payload()))
+		if erro == nil && !aceitaCSVLegado {
+			erro = errors.New("formato CSV legado desativado; use o envelope JSON versionado")
+		}
+	}
+	if erro == nil {
+		erro = envelope.lerPayload(destino)
+	}
+	if erro != nil {
+		metricaMqttRecebidas.Inc("invalida")
+		publicarErroProtocolo(client, msg.Topic(), envelope, erro)
+		return envelope, false
+	}
+	metricaMqttRecebidas.Inc(envelope.Tipo)
+	return envelope, true
+}
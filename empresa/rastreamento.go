@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rastreamento distribuído das operações (reserva, assinatura, gravação e replicação dos blocos)
+// O contexto segue o formato W3C Trace Context: cabeçalho traceparent nas chamadas REST (do
+// veículo e entre empresas, inclusive na replicação) e campo traceparent do envelope MQTT.
+// Os spans desta empresa vão para um coletor em memória (os últimos RASTREAMENTO_MAX_SPANS,
+// padrão 20000) e, com RASTREAMENTO_ARQUIVO, também para um arquivo com um span JSON por linha.
+// GET /api/rastreamento/{requisicao} junta os spans do ID de requisição nesta e nas outras
+// empresas e os devolve em árvore.
+
+const (
+	cabecalhoTraceparent = "traceparent"
+	maxSpansPadrao       = 20000
+	tamanhoFilaSpans     = 4096
+)
+
+type Span struct {
+	Trace      string            `json:"trace_id"`
+	ID         string            `json:"span_id"`
+	Pai        string            `json:"pai_id,omitempty"`
+	Nome       string            `json:"nome"`
+	No         string            `json:"no"`
+	Requisicao string            `json:"requisicao_id,omitempty"`
+	Inicio     time.Time         `json:"inicio"`
+	Fim        time.Time         `json:"fim"`
+	DuracaoMs  float64           `json:"duracao_ms"`
+	Atributos  map[string]string `json:"atributos,omitempty"`
+	Erro       string            `json:"erro,omitempty"`
+}
+
+// Span corrente de um contexto: local ou recebido de outro nó (traceparent)
+type contextoRastreamento struct {
+	trace string
+	span  string
+}
+
+// Coletor em memória: anel com os últimos spans finalizados
+var coletorSpans = struct {
+	sync.Mutex
+	spans   []Span
+	maximo  int
+	proximo int
+}{maximo: maxSpansPadrao}
+
+var filaSpans = make(chan Span, tamanhoFilaSpans)
+
+// Pedidos de descarga: o exportador grava os spans da fila e responde fechando o canal
+var descargaSpans = make(chan chan struct{})
+
+// Lê a configuração e inicia a exportação dos spans em goroutine
+func iniciarRastreamento() {
+	if valor, erro := strconv.Atoi(os.Getenv("RASTREAMENTO_MAX_SPANS")); erro == nil && valor > 0 {
+		coletorSpans.maximo = valor
+	}
+
+	var arquivo *bufio.Writer
+	if caminho := os.Getenv("RASTREAMENTO_ARQUIVO"); caminho != "" {
+		f, erro := os.OpenFile(caminho, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if erro != nil {
+			logGeral.Error("erro ao abrir arquivo de rastreamento; spans ficam só em memória", "arquivo", caminho, "erro", erro)
+		} else {
+			arquivo = bufio.NewWriter(f)
+			logGeral.Info("spans exportados para arquivo", "arquivo", caminho)
+		}
+	}
+
+	exportar := func(span Span) {
+		coletarSpan(span)
+		if arquivo == nil {
+			return
+		}
+		linha, _ := json.Marshal(span)
+		arquivo.Write(append(linha, '\n'))
+		if len(filaSpans) == 0 {
+			arquivo.Flush()
+		}
+	}
+	go func() {
+		for {
+			select {
+			case span := <-filaSpans:
+				exportar(span)
+			case pronto := <-descargaSpans:
+				for len(filaSpans) > 0 {
+					exportar(<-filaSpans)
+				}
+				if arquivo != nil {
+					arquivo.Flush()
+				}
+				close(pronto)
+			}
+		}
+	}()
+}
+
+// Exporta os spans que estão na fila e grava o buffer do arquivo (usada no encerramento)
+func descarregarSpans() {
+	pronto := make(chan struct{})
+	descargaSpans <- pronto
+	<-pronto
+}
+
+func coletarSpan(span Span) {
+	coletorSpans.Lock()
+	defer coletorSpans.Unlock()
+	if len(coletorSpans.spans) < coletorSpans.maximo {
+		coletorSpans.spans = append(coletorSpans.spans, span)
+		return
+	}
+	coletorSpans.spans[coletorSpans.proximo] = span
+	coletorSpans.proximo = (coletorSpans.proximo + 1) % coletorSpans.maximo
+}
+
+// Spans coletados de um ID de requisição
+func spansDaRequisicao(requisicao string) []Span {
+	coletorSpans.Lock()
+	defer coletorSpans.Unlock()
+	var spans []Span
+	for _, span := range coletorSpans.spans {
+		if span.Requisicao == requisicao {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func novoIDTrace() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func rastreamentoDoContexto(ctx context.Context) (contextoRastreamento, bool) {
+	if ctx == nil {
+		return contextoRastreamento{}, false
+	}
+	atual, ok := ctx.Value(chaveRastreamento).(contextoRastreamento)
+	return atual, ok
+}
+
+// Inicia um span filho do span corrente de ctx (ou a raiz de um trace novo); o contexto
+// devolvido tem o novo span como corrente
+func iniciarSpan(ctx context.Context, nome string, atributos ...any) (context.Context, *Span) {
+	pai, _ := rastreamentoDoContexto(ctx)
+	span := &Span{
+		Trace:      pai.trace,
+		ID:         gerarIDMensagem(),
+		Pai:        pai.span,
+		Nome:       nome,
+		No:         "empresa_" + empresa.ID,
+		Requisicao: requisicaoDoContexto(ctx),
+		Inicio:     time.Now(),
+	}
+	if span.Trace == "" {
+		span.Trace = novoIDTrace()
+	}
+	span.definir(atributos...)
+	return context.WithValue(ctx, chaveRastreamento, contextoRastreamento{trace: span.Trace, span: span.ID}), span
+}
+
+// Acrescenta atributos em pares chave, valor
+func (s *Span) definir(atributos ...any) {
+	for i := 0; i+1 < len(atributos); i += 2 {
+		if s.Atributos == nil {
+			s.Atributos = make(map[string]string)
+		}
+		s.Atributos[fmt.Sprint(atributos[i])] = fmt.Sprint(atributos[i+1])
+	}
+}
+
+// Marca o span com o erro (nada se erro for nil)
+func (s *Span) falhar(erro error) {
+	if erro != nil {
+		s.Erro = erro.Error()
+	}
+}
+
+func (s *Span) finalizar() {
+	s.encerrarEm(time.Now())
+}
+
+func (s *Span) encerrarEm(fim time.Time) {
+	s.Fim = fim
+	s.DuracaoMs = float64(fim.Sub(s.Inicio).Microseconds()) / 1000
+	select {
+	case filaSpans <- *s:
+	default:
+		metricaSpansDescartados.Inc()
+	}
+}
+
+// Registra um span de uma etapa já concluída (ex.: a gravação de um lote, comum a vários pedidos)
+func registrarSpan(ctx context.Context, nome string, inicio, fim time.Time, erro error, atributos ...any) {
+	_, span := iniciarSpan(ctx, nome, atributos...)
+	span.Inicio = inicio
+	span.falhar(erro)
+	span.encerrarEm(fim)
+}
+
+// Valor do cabeçalho traceparent para o span corrente de ctx ("" fora de um trace)
+func traceparentDoContexto(ctx context.Context) string {
+	atual, ok := rastreamentoDoContexto(ctx)
+	if !ok {
+		return ""
+	}
+	return "00-" + atual.trace + "-" + atual.span + "-01"
+}
+
+// Contexto que continua o trace de um traceparent recebido (inalterado se o valor for inválido)
+func comTraceparent(ctx context.Context, traceparent string) context.Context {
+	partes := strings.Split(traceparent, "-")
+	if len(partes) != 4 || len(partes[0]) != 2 || partes[0] == "ff" || len(partes[1]) != 32 || len(partes[2]) != 16 || len(partes[3]) != 2 {
+		return ctx
+	}
+	for _, parte := range partes {
+		if _, erro := hex.DecodeString(parte); erro != nil {
+			return ctx
+		}
+	}
+	// IDs só com zeros são inválidos
+	if strings.Trim(partes[1], "0") == "" || strings.Trim(partes[2], "0") == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, chaveRastreamento, contextoRastreamento{trace: partes[1], span: partes[2]})
+}
+
+// Span do lado servidor das requisições REST que fazem parte de uma operação: as que trazem
+// traceparent e as que não são GET (consultas, métricas e streams ficam de fora)
+func rastrearHTTP(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent := r.Header.Get(cabecalhoTraceparent)
+		if r.Method == http.MethodGet && traceparent == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ctx, span := iniciarSpan(comTraceparent(r.Context(), traceparent), "HTTP "+r.Method)
+		r = r.WithContext(ctx)
+		resposta := &respostaMedida{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(resposta, r)
+		if r.Pattern != "" {
+			span.Nome = r.Pattern
+		}
+		span.definir("metodo", r.Method, "caminho", r.URL.Path, "status", resposta.status)
+		if resposta.status >= http.StatusInternalServerError {
+			span.falhar(fmt.Errorf("status %d", resposta.status))
+		}
+		span.finalizar()
+	})
+}
+
+// Nó da árvore de spans
+type NoSpan struct {
+	Span
+	Filhos []*NoSpan `json:"filhos,omitempty"`
+}
+
+type RespostaRastreamento struct {
+	Requisicao string    `json:"requisicao_id"`
+	Traces     []string  `json:"traces"`
+	Spans      int       `json:"spans"`
+	Arvore     []*NoSpan `json:"arvore"`
+}
+
+var clienteRastreamento = &http.Client{Timeout: 3 * time.Second}
+
+// Árvore de spans de um ID de requisição
+// GET /api/rastreamento/{requisicao}[?formato=texto]; com ?local=true devolve só os spans desta
+// empresa, sem montar a árvore (usado na consulta às outras empresas)
+func handleRastreamento(w http.ResponseWriter, r *http.Request) {
+	requisicao := requisicaoValida(r.PathValue("requisicao"))
+	if requisicao == "" {
+		http.Error(w, "ID de requisição inválido", http.StatusBadRequest)
+		return
+	}
+	spans := spansDaRequisicao(requisicao)
+	if r.URL.Query().Get("local") == "true" {
+		if spans == nil {
+			spans = []Span{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(spans)
+		return
+	}
+
+	spans = append(spans, spansDasOutrasEmpresas(requisicao)...)
+	if len(spans) == 0 {
+		http.Error(w, "Nenhum span registrado para a requisição", http.StatusNotFound)
+		return
+	}
+	arvore, traces := montarArvoreSpans(spans)
+
+	if r.URL.Query().Get("formato") == "texto" {
+		var texto strings.Builder
+		fmt.Fprintf(&texto, "requisição %s: %d spans em %d traces\n", requisicao, len(spans), len(traces))
+		escreverArvoreSpans(&texto, arvore, 0, arvore[0].Inicio)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(texto.String()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RespostaRastreamento{Requisicao: requisicao, Traces: traces, Spans: len(spans), Arvore: arvore})
+}
+
+// Consulta em paralelo os spans da requisição nas outras empresas; as que não respondem são ignoradas
+func spansDasOutrasEmpresas(requisicao string) []Span {
+	var (
+		grupo sync.WaitGroup
+		trava sync.Mutex
+		spans []Span
+	)
+	for id, api := range empresasAPI {
+		if id == empresa.ID {
+			continue
+		}
+		grupo.Add(1)
+		go func(id, api string) {
+			defer grupo.Done()
+			resp, erro := clienteRastreamento.Get(api + "/api/rastreamento/" + requisicao + "?local=true")
+			if erro != nil {
+				logPeer.Debug("empresa não respondeu à consulta de rastreamento", "empresa", id, "erro", erro)
+				return
+			}
+			defer resp.Body.Close()
+			var recebidos []Span
+			if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&recebidos) != nil {
+				return
+			}
+			trava.Lock()
+			spans = append(spans, recebidos...)
+			trava.Unlock()
+		}(id, api)
+	}
+	grupo.Wait()
+	return spans
+}
+
+// Monta a árvore pelos IDs dos pais; spans cujo pai não foi coletado (ex.: o span do veículo)
+// ficam na raiz. Irmãos em ordem de início. Devolve também os traces encontrados
+func montarArvoreSpans(spans []Span) ([]*NoSpan, []string) {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Inicio.Before(spans[j].Inicio) })
+	nos := make(map[string]*NoSpan, len(spans))
+	var ordem []*NoSpan
+	for _, span := range spans {
+		chave := span.Trace + "/" + span.ID
+		if _, repetido := nos[chave]; repetido {
+			continue
+		}
+		no := &NoSpan{Span: span}
+		nos[chave] = no
+		ordem = append(ordem, no)
+	}
+
+	var raizes []*NoSpan
+	var traces []string
+	vistos := make(map[string]bool)
+	for _, no := range ordem {
+		if !vistos[no.Trace] {
+			vistos[no.Trace] = true
+			traces = append(traces, no.Trace)
+		}
+		if pai, existe := nos[no.Trace+"/"+no.Pai]; existe && no.Pai != "" {
+			pai.Filhos = append(pai.Filhos, no)
+		} else {
+			raizes = append(raizes, no)
+		}
+	}
+	return raizes, traces
+}
+
+// Uma linha por span, indentada pela profundidade, com o deslocamento desde o primeiro span
+func escreverArvoreSpans(texto *strings.Builder, nos []*NoSpan, nivel int, origem time.Time) {
+	for _, no := range nos {
+		fmt.Fprintf(texto, "%s%s [%s] +%.1f ms, %.1f ms", strings.Repeat("  ", nivel), no.Nome, no.No,
+			float64(no.Inicio.Sub(origem).Microseconds())/1000, no.DuracaoMs)
+		chaves := make([]string, 0, len(no.Atributos))
+		for chave := range no.Atributos {
+			chaves = append(chaves, chave)
+		}
+		sort.Strings(chaves)
+		for _, chave := range chaves {
+			fmt.Fprintf(texto, " %s=%s", chave, no.Atributos[chave])
+		}
+		if no.Erro != "" {
+			fmt.Fprintf(texto, " ERRO: %s", no.Erro)
+		}
+		texto.WriteString("\n")
+		escreverArvoreSpans(texto, no.Filhos, nivel+1, origem)
+	}
+}
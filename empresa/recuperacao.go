@@ -0,0 +1,183 @@
+package main
+
+import (
+	"time"
+)
+
+// Recuperação de estado após reinício do nó
+// O mapa de reservas e os timers de expiração vivem apenas em memória, enquanto o
+// controle de pontos é persistido em disco. Ao subir, o nó reconstrói as reservas a
+// partir do arquivo de controle e da blockchain e reconcilia as diferenças entre os dois.
+
+// Formato usado no campo Timestamp dos blocos (ver formatarTimestamp)
+const formatoTimestampBloco = "15:04:05 02/01/2006"
+
+// Reserva reconstruída que ainda precisa de timer de expiração
+type reservaRecuperada struct {
+	placa    string
+	ponto    string
+	restante time.Duration
+}
+
+// Retorna as reservas desta empresa na blockchain que ainda não tiveram recarga,
+// indexadas por ponto (vale sempre a reserva mais recente de cada ponto)
+func reservasAbertasNaChain() map[string]Bloco {
+	abertas := make(map[string]Bloco)
+	for _, bloco := range chainAtual() {
+		if bloco.Transacao.Empresa != empresa.ID {
+			continue
+		}
+		switch bloco.Transacao.Tipo {
+		case "RESERVA":
+			abertas[bloco.Transacao.Ponto] = bloco
+		case "RECARGA":
+			if reserva, existe := abertas[bloco.Transacao.Ponto]; existe && reserva.Transacao.Placa == bloco.Transacao.Placa {
+				delete(abertas, bloco.Transacao.Ponto)
+			}
+		}
+	}
+	return abertas
+}
+
+// Calcula o prazo final de uma reserva a partir do controle de pontos ou, na falta dele, do bloco
+func prazoReserva(status PontoStatus, bloco *Bloco) time.Time {
+	if expira, erro := time.Parse(time.RFC3339, status.ExpiraEm); erro == nil {
+		return expira
+	}
+	if inicio, erro := time.Parse(time.RFC3339, status.TimestampReserva); erro == nil {
+		return inicio.Add(tempoExpiracaoReserva)
+	}
+	if bloco != nil {
+		if inicio, erro := time.ParseInLocation(formatoTimestampBloco, bloco.Timestamp, time.Local); erro == nil {
+			return inicio.Add(tempoExpiracaoReserva)
+		}
+	}
+	// Sem referência de tempo confiável: considera a reserva recém-feita
+	return time.Now().Add(tempoExpiracaoReserva)
+}
+
+// Verifica se o prazo da reserva do ponto para a placa já passou
+// Usado pelos timers para não expirar uma reserva que foi renovada ou que está em uso por uma
+// recarga em andamento
+func prazoReservaEsgotado(ponto, placa string) bool {
+	if recargaEmAndamento(ponto, placa) {
+		return false
+	}
+	controlePontos.RLock()
+	defer controlePontos.RUnlock()
+
+	status, existe := controlePontos.pontos[ponto]
+	if !existe || status.Placa != placa {
+		return true
+	}
+	return !time.Now().Before(prazoReserva(status, nil))
+}
+
+// Reconstrói o índice de reservas e rearma os timers de expiração com o tempo restante
+func recuperarReservas() {
+	logRecuperacao.Info("reconstruindo reservas a partir do controle de pontos e da blockchain")
+
+	// Bloqueia todos os pontos para que nenhuma reserva em andamento seja
+	// vista marcada no controle e ainda ausente da blockchain
+	for _, ponto := range empresa.Pontos {
+		travarPonto(ponto)
+	}
+	defer func() {
+		for _, ponto := range empresa.Pontos {
+			ponto_locks[ponto].Unlock()
+		}
+	}()
+
+	abertas := reservasAbertasNaChain()
+	agora := time.Now()
+
+	pontosDaEmpresa := make(map[string]bool)
+	for _, ponto := range empresa.Pontos {
+		pontosDaEmpresa[ponto] = true
+	}
+
+	var recuperadas []reservaRecuperada
+	var expiradas []reservaRecuperada
+
+	controlePontos.Lock()
+	alterado := false
+
+	// 1. Reconcilia cada entrada persistida com a blockchain
+	for ponto, status := range controlePontos.pontos {
+		if !pontosDaEmpresa[ponto] || status.Status != "RESERVADO" {
+			logRecuperacao.Warn("entrada inválida removida do controle", "ponto", ponto, "status", status.Status)
+			delete(controlePontos.pontos, ponto)
+			alterado = true
+			continue
+		}
+
+		bloco, naChain := abertas[ponto]
+		if !naChain || bloco.Transacao.Placa != status.Placa {
+			// Reserva marcada sem bloco correspondente (falha antes do registro) ou já encerrada por recarga
+			logRecuperacao.Warn("reserva não confirmada pela blockchain; liberando", "placa", status.Placa, "ponto", ponto)
+			delete(controlePontos.pontos, ponto)
+			alterado = true
+			continue
+		}
+
+		if status.HashReserva != bloco.Hash {
+			logRecuperacao.Info("hash da reserva corrigido", "placa", status.Placa, "ponto", ponto, "hash", bloco.Hash)
+			status.HashReserva = bloco.Hash
+			alterado = true
+		}
+
+		expira := prazoReserva(status, &bloco)
+		if status.ExpiraEm == "" {
+			status.ExpiraEm = expira.Format(time.RFC3339)
+			alterado = true
+		}
+		controlePontos.pontos[ponto] = status
+
+		reserva := reservaRecuperada{placa: status.Placa, ponto: ponto, restante: expira.Sub(agora)}
+		if reserva.restante <= 0 {
+			delete(controlePontos.pontos, ponto)
+			alterado = true
+			expiradas = append(expiradas, reserva)
+			continue
+		}
+		recuperadas = append(recuperadas, reserva)
+	}
+
+	// 2. Reservas abertas na blockchain sem marcação no controle foram canceladas ou
+	// expiradas (cancelamentos não geram bloco), então o controle prevalece
+	for ponto, bloco := range abertas {
+		if _, existe := controlePontos.pontos[ponto]; !existe && pontosDaEmpresa[ponto] {
+			logRecuperacao.Info("reserva sem marcação no controle considerada encerrada", "placa", bloco.Transacao.Placa, "ponto", ponto, "indice", bloco.Index)
+		}
+	}
+
+	if alterado {
+		if erro := salvarControlePontosInterno(); erro != nil {
+			logRecuperacao.Error("falha ao salvar controle de pontos reconciliado", "erro", erro)
+		}
+	}
+	controlePontos.Unlock()
+
+	// 3. Reconstrói o mapa em memória e rearma os timers
+	reservas_mutex.Lock()
+	for _, reserva := range recuperadas {
+		if _, existe := reservas[reserva.placa]; !existe {
+			reservas[reserva.placa] = make(map[string]string)
+		}
+		reservas[reserva.placa][reserva.ponto] = "confirmado"
+	}
+	reservas_mutex.Unlock()
+
+	for _, reserva := range recuperadas {
+		liberaPorTimeout(reserva.placa, []string{reserva.ponto}, reserva.restante)
+		logRecuperacao.Info("reserva rearmada", "placa", reserva.placa, "ponto", reserva.ponto, "restante", reserva.restante.Round(time.Second).String())
+	}
+
+	// 4. Notifica os veículos cujas reservas expiraram enquanto o nó estava fora
+	for _, reserva := range expiradas {
+		logRecuperacao.Info("reserva expirou durante a indisponibilidade", "placa", reserva.placa, "ponto", reserva.ponto)
+		notificarVeiculo(reserva.placa, "reserva_expirada", MensagemVeiculo{Ponto: reserva.ponto, Mensagem: "Reserva expirou por timeout"})
+	}
+
+	logRecuperacao.Info("recuperação concluída", "ativas", len(recuperadas), "expiradas", len(expiradas))
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"os"
 	"strings"
 )
@@ -33,7 +32,7 @@ var ConfiguracaoRede = struct {
 func ObterServidoresDistribuidos() []string {
 	// Verifica se está em ambiente Docker
 	if _, err := os.Stat("/.dockerenv"); err == nil {
-		fmt.Printf("[REDE] Detectado ambiente Docker - usando nomes de containers\n")
+		logRede.Info("detectado ambiente Docker - usando nomes de containers")
 		return []string{
 			"http://empresa_001:8001",
 			"http://empresa_002:8002",
@@ -42,7 +41,7 @@ func ObterServidoresDistribuidos() []string {
 	}
 
 	// Caso contrário, usa IPs das máquinas físicas
-	fmt.Printf("[REDE] Detectado ambiente físico - usando IPs das máquinas\n")
+	logRede.Info("detectado ambiente físico - usando IPs das máquinas")
 	return []string{
 		"http://" + ConfiguracaoRede.IP_Maquina_001 + ":" + ConfiguracaoRede.Porta_001,
 		"http://" + ConfiguracaoRede.IP_Maquina_002 + ":" + ConfiguracaoRede.Porta_002,
@@ -106,10 +105,7 @@ func ObterOutrosServidoresDistribuidos(empresaID string) []string {
 		}
 	}
 
-	fmt.Printf("[REDE] Configurados %d outros servidores para comunicação\n", len(outrosServidores))
-	for _, servidor := range outrosServidores {
-		fmt.Printf("[REDE] - %s\n", servidor)
-	}
+	logRede.Info("outros servidores configurados para comunicação", "servidores", outrosServidores)
 
 	return outrosServidores
 }
@@ -126,8 +122,6 @@ func ConfigurarIPsMaquinas(ip001, ip002, ip003 string) {
 		ConfiguracaoRede.IP_Maquina_003 = ip003
 	}
 
-	fmt.Printf("[REDE] IPs das máquinas atualizados:\n")
-	fmt.Printf("[REDE] - Máquina 001: %s\n", ConfiguracaoRede.IP_Maquina_001)
-	fmt.Printf("[REDE] - Máquina 002: %s\n", ConfiguracaoRede.IP_Maquina_002)
-	fmt.Printf("[REDE] - Máquina 003: %s\n", ConfiguracaoRede.IP_Maquina_003)
+	logRede.Info("IPs das máquinas atualizados", "maquina_001", ConfiguracaoRede.IP_Maquina_001,
+		"maquina_002", ConfiguracaoRede.IP_Maquina_002, "maquina_003", ConfiguracaoRede.IP_Maquina_003)
 }
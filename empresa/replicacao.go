@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replicação assíncrona dos blocos desta empresa para as outras
+// Cada empresa tem uma fila própria, atendida por uma goroutine que envia os blocos em ordem
+// (POST /peer/bloco), um de cada vez. Se a empresa estiver fora do ar ou responder com erro 5xx,
+// o mesmo bloco é reenviado com intervalo dobrando até intervaloMaximoReplicacao; assim uma
+// empresa lenta ou fora do ar atrasa apenas a própria fila, e não as escritas nem as outras
+// empresas. A empresa valida o bloco antes de responder; um bloco recusado (4xx, 409 quando as
+// chains divergem) não é reenviado e inicia uma sincronização (agendarSincronizacao), que adota a
+// chain preferida ou a envia à empresa que ficou para trás. Quando todas as empresas respondem a um bloco, a chamada de conclusão
+// registrada com ele é executada na goroutine da última fila (deve ser rápida).
+// O span "replicacao" de um bloco vai da entrada nas filas até a resposta da última empresa, com
+// um filho "replicacao.envio" por tentativa de envio a cada empresa.
+
+const (
+	intervaloInicialReplicacao = 500 * time.Millisecond
+	intervaloMaximoReplicacao  = 30 * time.Second
+)
+
+type blocoReplicado struct {
+	ctx        context.Context // ID de requisição e span de replicação da operação que gerou o bloco
+	span       *Span
+	bloco      Bloco
+	corpo      []byte
+	pendentes  int      // empresas que ainda não responderam
+	recusaram  []string // empresas que recusaram o bloco
+	aoConcluir func(bloco Bloco, recusaram []string)
+}
+
+var replicacao = struct {
+	sync.Mutex
+	filas  map[string][]*blocoReplicado
+	avisos map[string]chan struct{} // sinaliza bloco novo na fila da empresa
+}{filas: make(map[string][]*blocoReplicado), avisos: make(map[string]chan struct{})}
+
+// Inicia uma fila de replicação para cada outra empresa
+func iniciarReplicacao() {
+	replicacao.Lock()
+	defer replicacao.Unlock()
+	for id, api := range empresasAPI {
+		if id == empresa.ID {
+			continue
+		}
+		aviso := make(chan struct{}, 1)
+		replicacao.avisos[id] = aviso
+		go replicarParaEmpresa(id, api, aviso)
+	}
+}
+
+// Coloca um bloco recém-gravado na fila de cada outra empresa; aoConcluir pode ser nil
+func replicarBloco(ctx context.Context, bloco Bloco, aoConcluir func(bloco Bloco, recusaram []string)) {
+	corpo, _ := json.Marshal(bloco)
+	ctx, span := iniciarSpan(ctx, "replicacao", "index", bloco.Index, "hash", bloco.Hash)
+	replicacao.Lock()
+	defer replicacao.Unlock()
+	item := &blocoReplicado{ctx: ctx, span: span, bloco: bloco, corpo: corpo, pendentes: len(replicacao.avisos), aoConcluir: aoConcluir}
+	if item.pendentes == 0 {
+		span.finalizar()
+		if aoConcluir != nil {
+			go aoConcluir(bloco, nil)
+		}
+		return
+	}
+	for id, aviso := range replicacao.avisos {
+		replicacao.filas[id] = append(replicacao.filas[id], item)
+		select {
+		case aviso <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Envia em ordem os blocos da fila de uma empresa
+func replicarParaEmpresa(id, api string, aviso chan struct{}) {
+	espera := intervaloInicialReplicacao
+	for range aviso {
+		for {
+			replicacao.Lock()
+			if len(replicacao.filas[id]) == 0 {
+				replicacao.Unlock()
+				break
+			}
+			item := replicacao.filas[id][0]
+			replicacao.Unlock()
+
+			ctx, span := iniciarSpan(item.ctx, "replicacao.envio", "destino", id)
+			aceito, erro := enviarBlocoReplicado(ctx, api, item.corpo)
+			span.definir("aceito", aceito)
+			span.falhar(erro)
+			span.finalizar()
+			if erro != nil {
+				metricaReplicacaoEnvios.Inc(id, "falha")
+				if espera == intervaloInicialReplicacao {
+					logReplicacao.WarnContext(item.ctx, "empresa indisponível; reenviando o bloco até conseguir", "destino", id, "index", item.bloco.Index, "erro", erro)
+				}
+				time.Sleep(espera)
+				espera = min(espera*2, intervaloMaximoReplicacao)
+				continue
+			}
+			if espera != intervaloInicialReplicacao {
+				logReplicacao.Info("empresa disponível novamente; retomando a fila", "destino", id)
+				espera = intervaloInicialReplicacao
+			}
+			if aceito {
+				metricaReplicacaoEnvios.Inc(id, "aceito")
+			} else {
+				logReplicacao.WarnContext(item.ctx, "empresa recusou o bloco", "destino", id, "index", item.bloco.Index, "hash", item.bloco.Hash)
+				metricaReplicacaoEnvios.Inc(id, "recusado")
+				agendarSincronizacao()
+			}
+
+			replicacao.Lock()
+			replicacao.filas[id] = replicacao.filas[id][1:]
+			item.pendentes--
+			if !aceito {
+				item.recusaram = append(item.recusaram, id)
+			}
+			concluido := item.pendentes == 0
+			replicacao.Unlock()
+			if !concluido {
+				continue
+			}
+			if len(item.recusaram) > 0 {
+				item.span.definir("recusaram", strings.Join(item.recusaram, ","))
+			}
+			item.span.finalizar()
+			if item.aoConcluir != nil {
+				item.aoConcluir(item.bloco, item.recusaram)
+			}
+		}
+	}
+}
+
+// Envia um bloco; erro quando vale tentar de novo (rede ou 5xx), aceito=false quando a empresa o recusou
+func enviarBlocoReplicado(ctx context.Context, api string, corpo []byte) (bool, error) {
+	resp, erro := postPeer(ctx, api+"/peer/bloco", corpo)
+	if erro != nil {
+		return false, erro
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// Blocos aguardando envio, por empresa
+func blocosAguardandoReplicacao() map[string]int {
+	replicacao.Lock()
+	defer replicacao.Unlock()
+	pendentes := make(map[string]int)
+	for id := range replicacao.avisos {
+		pendentes[id] = len(replicacao.filas[id])
+	}
+	return pendentes
+}
+
+// Chamada de conclusão que registra no log o resultado da replicação
+func registrarReplicacao(ctx context.Context, descricao string) func(bloco Bloco, recusaram []string) {
+	return func(bloco Bloco, recusaram []string) {
+		if len(recusaram) > 0 {
+			logReplicacao.WarnContext(ctx, "bloco recusado por outras empresas", "descricao", descricao, "index", bloco.Index, "hash", bloco.Hash, "recusaram", recusaram)
+			return
+		}
+		logReplicacao.InfoContext(ctx, "bloco replicado em todas as empresas", "descricao", descricao, "index", bloco.Index, "hash", bloco.Hash)
+	}
+}
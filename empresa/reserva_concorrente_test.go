@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Veículos disputam os mesmos pontos pelo reservaHandler enquanto a sincronização troca a chain
+// por outras que descartam o último bloco (substituirBlockchain, que registra de novo as reservas
+// descartadas) e leitores consultam /blockchain, /api/status e /api/historico; rodar com
+// go test -race. Cada ponto deve terminar com uma única reserva confirmada, a do controle de
+// pontos, e com o bloco dela na chain.
+func TestReservasConcorrentes(t *testing.T) {
+	const (
+		veiculos      = 24
+		leitores      = 4
+		substituicoes = 6
+	)
+	pontos := []string{"Salvador", "Aracaju", "Maceio"}
+
+	t.Chdir(t.TempDir())
+	t.Setenv("EMPRESA_ID", "001")
+	t.Setenv("HEARTBEAT_INTERVALO_SEGUNDOS", "0")
+	if erro := os.Mkdir("data", 0755); erro != nil {
+		t.Fatal(erro)
+	}
+	dados, _ := json.Marshal(Empresa{ID: "001", Nome: "Teste", Placas: map[string]bool{}, Pontos: pontos})
+	if erro := os.WriteFile("data/empresa_001.json", dados, 0644); erro != nil {
+		t.Fatal(erro)
+	}
+	empresasAPI = map[string]string{"001": "http://127.0.0.1:0"}
+	inicializarAPI()
+	inicializaControlePontos()
+	iniciarEscritorBlocos()
+
+	var leitura sync.WaitGroup
+	parar := make(chan struct{})
+	erros := make(chan error, veiculos+leitores+1)
+	for l := 0; l < leitores; l++ {
+		leitura.Add(1)
+		go func() {
+			defer leitura.Done()
+			consultas := []struct {
+				url     string
+				handler http.HandlerFunc
+			}{
+				{"/blockchain", blockchainHandler},
+				{"/api/status", handleStatus},
+				{"/api/historico?placa=TST0001", handleHistorico},
+			}
+			for {
+				select {
+				case <-parar:
+					return
+				default:
+				}
+				for _, consulta := range consultas {
+					resposta := httptest.NewRecorder()
+					consulta.handler(resposta, httptest.NewRequest(http.MethodGet, consulta.url, nil))
+					if resposta.Code != http.StatusOK {
+						erros <- fmt.Errorf("%s respondeu %d", consulta.url, resposta.Code)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	// Sincronização: adota uma chain mais longa que descarta o último bloco local, enquanto houver
+	// reservas em andamento e ao menos substituicoes vezes
+	leitura.Add(1)
+	go func() {
+		defer leitura.Done()
+		for s := 0; ; s++ {
+			if s >= substituicoes {
+				select {
+				case <-parar:
+					return
+				default:
+				}
+			}
+			local := chainAtual()
+			remota := append([]Bloco(nil), local[:max(len(local)-1, 1)]...)
+			for len(remota) <= len(local) {
+				anterior := remota[len(remota)-1]
+				bloco := Bloco{
+					Index:        anterior.Index + 1,
+					Timestamp:    time.Now().Format(formatoTimestampBloco),
+					Transacao:    Transacao{Tipo: "PAGAMENTO", Empresa: "002"},
+					HashAnterior: anterior.Hash,
+					Autor:        "002",
+				}
+				bloco.Hash = CalcularHash(bloco)
+				remota = append(remota, bloco)
+			}
+			substituirBlockchain(Blockchain{Chain: remota})
+			time.Sleep(2 * time.Millisecond)
+		}
+	}()
+
+	var confirmadas = struct {
+		sync.Mutex
+		placas map[string][]string
+	}{placas: make(map[string][]string)}
+	var reservas sync.WaitGroup
+	for v := 0; v < veiculos; v++ {
+		reservas.Add(1)
+		go func(v int) {
+			defer reservas.Done()
+			placa, ponto := fmt.Sprintf("TST%04d", v), pontos[v%len(pontos)]
+			corpo, _ := json.Marshal(Transacao{Tipo: "RESERVA", Placa: placa, Ponto: ponto, Empresa: "001"})
+			requisicao := httptest.NewRequest(http.MethodPost, "/reserva", bytes.NewReader(corpo))
+			// Um IP por veículo, para que os conflitos não levem ao banimento de uma identidade comum
+			requisicao.RemoteAddr = fmt.Sprintf("192.0.2.%d:40000", v+1)
+			resposta := httptest.NewRecorder()
+			reservaHandler(resposta, requisicao)
+			switch resposta.Code {
+			case http.StatusCreated:
+				confirmadas.Lock()
+				confirmadas.placas[ponto] = append(confirmadas.placas[ponto], placa)
+				confirmadas.Unlock()
+			case http.StatusConflict:
+			default:
+				erros <- fmt.Errorf("reserva de %s em %s respondeu %d: %s", placa, ponto, resposta.Code, resposta.Body.String())
+			}
+		}(v)
+	}
+	reservas.Wait()
+	close(parar)
+	leitura.Wait()
+	close(erros)
+	for erro := range erros {
+		t.Error(erro)
+	}
+
+	for _, ponto := range pontos {
+		placas := confirmadas.placas[ponto]
+		if len(placas) != 1 {
+			t.Errorf("ponto %s com %d reservas confirmadas: %v", ponto, len(placas), placas)
+			continue
+		}
+		controlePontos.RLock()
+		status := controlePontos.pontos[ponto]
+		controlePontos.RUnlock()
+		if status.Status != "RESERVADO" || status.Placa != placas[0] {
+			t.Errorf("controle do ponto %s com %s/%s, esperado RESERVADO/%s", ponto, status.Status, status.Placa, placas[0])
+		}
+		// Reservas descartadas pela sincronização são registradas de novo em segundo plano
+		prazo := time.Now().Add(5 * time.Second)
+		for !reservaNaChain(ponto, placas[0]) {
+			if time.Now().After(prazo) {
+				t.Errorf("reserva de %s em %s ausente da chain", placas[0], ponto)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func reservaNaChain(ponto, placa string) bool {
+	for _, bloco := range blocosPorPlaca(placa) {
+		if bloco.Transacao.Tipo == "RESERVA" && bloco.Transacao.Ponto == ponto {
+			return true
+		}
+	}
+	return false
+}
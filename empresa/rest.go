@@ -1,14 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"persistencia"
 )
 
 // Estruturas para comunicação REST
@@ -47,6 +51,9 @@ type VerificacaoHashResponse struct {
 var reservas_mutex sync.Mutex
 var reservas = make(map[string]map[string]string)
 
+// Tempo máximo que uma reserva fica ativa sem recarga
+const tempoExpiracaoReserva = 5 * time.Minute
+
 // Status dos pontos de recarga
 var status_ponto = struct {
 	sync.RWMutex
@@ -77,14 +84,24 @@ var servidores_fisicos = []string{
 
 // Detecta automaticamente se está rodando em Docker ou máquina física
 func obterServidores() []string {
+	// Endereços configurados explicitamente têm prioridade (ex.: todas as empresas na mesma máquina)
+	if os.Getenv("EMPRESAS_API") != "" {
+		servidores := make([]string, 0, len(empresasAPI))
+		for _, api := range empresasAPI {
+			servidores = append(servidores, api)
+		}
+		sort.Strings(servidores)
+		return servidores
+	}
+
 	// Verifica se está em ambiente Docker
 	if _, err := os.Stat("/.dockerenv"); err == nil {
-		fmt.Printf("[REDE] Detectado ambiente Docker - usando nomes de containers\n")
+		logGeral.Debug("ambiente Docker detectado; usando nomes de containers")
 		return servidores_docker
 	}
 
 	// Caso contrário, usa IPs das máquinas físicas
-	fmt.Printf("[REDE] Detectado ambiente físico - usando IPs das máquinas\n")
+	logGeral.Debug("ambiente físico detectado; usando IPs das máquinas")
 	return servidores_fisicos
 }
 
@@ -94,6 +111,7 @@ type PontoStatus struct {
 	TimestampReserva string `json:"timestamp_reserva"`
 	Status           string `json:"status"`
 	HashReserva      string `json:"hash_reserva"`
+	ExpiraEm         string `json:"expira_em,omitempty"`
 }
 
 type ControlePontos struct {
@@ -109,23 +127,56 @@ var controlePontos = ControlePontos{
 func inicializaREST() {
 	// Endpoints principais
 	http.HandleFunc("/blockchain", blockchainHandler)
-	http.HandleFunc("/bloco", receberBlocoHandler)
-	http.HandleFunc("/reserva", reservaHandler)
-	http.HandleFunc("/recarga", recargaHandler)
-	http.HandleFunc("/pagamento", pagamentoHandler)
-	http.HandleFunc("/sincronizar", sincronizarHandler)
+	http.HandleFunc("/reserva", limitarPorIP(reservaHandler))
+	http.HandleFunc("/recarga", limitarPorIP(recargaHandler))
+	http.HandleFunc("/recarga/iniciar", limitarPorIP(handleIniciarRecarga))
+	http.HandleFunc("/recarga/parar", limitarPorIP(handlePararRecarga))
+	http.HandleFunc("/pagamento", limitarPorIP(pagamentoHandler))
+
+	// Endpoints exclusivos das outras empresas (requisições assinadas, ver peer.go)
+	http.HandleFunc("/peer/bloco", apenasEmpresas(receberBlocoHandler))
+	http.HandleFunc("/peer/sincronizar", apenasEmpresas(sincronizarHandler))
+	http.HandleFunc("/peer/reserva", apenasEmpresas(reservaHandler))
+	http.HandleFunc("/peer/cancelamento", apenasEmpresas(handleCancelamento))
+	http.HandleFunc("/peer/veiculos/segredo", apenasEmpresas(handleSegredoPeer))
 
 	// Novos endpoints para integração completa
 	http.HandleFunc("/api/status", handleStatus)
 	http.HandleFunc("/api/verificar-hash", handleVerificarHash)
 	http.HandleFunc("/api/historico", handleHistorico)
-	http.HandleFunc("/api/reservas", handleReservasCoordnadas)
-	http.HandleFunc("/api/cancelamento", handleCancelamento)
+	http.HandleFunc("/api/reservas", limitarPorIP(handleReservasCoordnadas))
 	http.HandleFunc("/api/pontos/status", handleStatusPontos)
+	http.HandleFunc("/api/pontos/disponibilidade", handleDisponibilidadePontos)
+	http.HandleFunc("/api/recargas/sessoes", handleSessoesRecarga)
+	http.HandleFunc("/api/tarifas", handleTarifas)
+	http.HandleFunc("/api/cotacao", limitarPorIP(handleCotacao))
+	http.HandleFunc("/api/cotacoes", handleCotacoes)
+	http.HandleFunc("/api/veiculos/credencial", limitarPorIP(handleCredencialVeiculo))
+	http.HandleFunc("/api/limites", handleLimites)
+	http.HandleFunc("/api/eventos", limitarPorIP(handleEventos))
+	http.HandleFunc("/api/blocos", handleBlocos)
+	http.HandleFunc("/api/blocos/{index}", handleBloco)
+	http.HandleFunc("/api/transacoes", handleTransacoes)
+	http.HandleFunc("/api/transacoes/{hash}", handleTransacao)
+	http.HandleFunc("/metrics", handleMetricas)
+	http.HandleFunc("/api/rastreamento/{requisicao}", handleRastreamento)
+
+	// Painel de operação (ver painel.go)
+	inicializaPainel()
+
 	// Inicializa controle de pontos
 	inicializaControlePontos()
 
-	fmt.Printf("[REST] Handlers registrados para empresa %s\n", empresa.ID)
+	logHTTP.Info("handlers registrados")
+}
+
+// Adquire o lock do ponto, medindo a espera
+func travarPonto(ponto string) *sync.Mutex {
+	lock := ponto_locks[ponto]
+	inicio := time.Now()
+	lock.Lock()
+	metricaEsperaLockPonto.ObservarDesde(inicio, ponto)
+	return lock
 }
 
 // Inicializa o controle de status dos pontos
@@ -142,78 +193,72 @@ func inicializaControlePontos() {
 	// Carrega o controle de pontos do arquivo
 	err := carregarControlePontos()
 	if err != nil {
-		fmt.Printf("[ERRO] Falha ao carregar controle de pontos: %v\n", err)
+		logPontos.Error("erro ao carregar controle de pontos", "erro", err)
 	}
 
-	// Inicia monitoramento periódico
+	// Inicia monitoramento periódico por heartbeats
+	inicializaSaudePontos()
 	go monitorarPontos()
 }
 
 // Monitora periodicamente o status dos pontos
 func monitorarPontos() {
 	for {
-		time.Sleep(30 * time.Second)
+		time.Sleep(intervaloHeartbeat)
 		verificarStatusPontos()
 	}
 }
 
-// Verifica o status de todos os pontos
+// Verifica o status de todos os pontos a partir dos heartbeats recebidos
 func verificarStatusPontos() {
+	agora := time.Now()
 	for _, ponto := range empresa.Pontos {
-		// Simula verificação de conectividade
-		// Em implementação real, faria ping ou verificação de rede
-		status := true // Por enquanto, sempre online
-
-		status_ponto.Lock()
-		statusAnterior := status_ponto.status[ponto]
-		status_ponto.status[ponto] = status
-		status_ponto.Unlock()
-
-		if statusAnterior != status {
-			if status {
-				fmt.Printf("[PONTOS] Ponto %s voltou online\n", ponto)
-			} else {
-				fmt.Printf("[PONTOS] Ponto %s está offline\n", ponto)
-				cancelarReservasPontoOffline(ponto)
-			}
-		}
+		online, motivo := avaliarSaudePonto(ponto, agora)
+		atualizarStatusPonto(ponto, online, motivo)
 	}
 }
 
 // Cancela reservas de pontos offline
 func cancelarReservasPontoOffline(ponto string) {
-	reservas_mutex.Lock()
-	defer reservas_mutex.Unlock()
+	lock := travarPonto(ponto)
+	defer lock.Unlock()
 
+	var placas []string
+	reservas_mutex.Lock()
 	for placa, pontosMap := range reservas {
 		if _, reservado := pontosMap[ponto]; reservado {
-			delete(pontosMap, ponto)
-			fmt.Printf("[PONTOS] Reserva cancelada para %s no ponto %s (offline)\n", placa, ponto)
-
-			// Notifica via MQTT se disponível
-			if mqttClient != nil && mqttClient.IsConnected() {
-				mensagem := fmt.Sprintf("reserva_cancelada,%s,Ponto offline", ponto)
-				publicaMensagemMqtt(mqttClient, "mensagens/cliente/"+placa, mensagem)
-			}
+			placas = append(placas, placa)
 		}
 	}
+	reservas_mutex.Unlock()
+
+	for _, placa := range placas {
+		// Libera controle e memória para que o ponto não fique preso como reservado
+		liberarPontoCompleto(ponto, placa)
+		logReservas.Info("reserva cancelada: ponto offline", "placa", placa, "ponto", ponto)
+
+		// Notifica via MQTT (a outbox reenvia até o veículo confirmar)
+		notificarVeiculo(placa, "reserva_cancelada", MensagemVeiculo{Ponto: ponto, Mensagem: "Ponto offline"})
+	}
 }
 
 // Handler para status da empresa
 func handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	chain := chainAtual()
 	response := StatusResponse{
 		Status:    "online",
 		EmpresaID: empresa.ID,
 		Blockchain: map[string]interface{}{
-			"total_blocos": len(blockchain.Chain),
-			"ultimo_hash":  "",
+			"total_blocos":        len(chain),
+			"ultimo_hash":         "",
+			"replicacao_pendente": blocosAguardandoReplicacao(),
 		},
 	}
 
-	if len(blockchain.Chain) > 0 {
-		response.Blockchain["ultimo_hash"] = blockchain.Chain[len(blockchain.Chain)-1].Hash
+	if len(chain) > 0 {
+		response.Blockchain["ultimo_hash"] = chain[len(chain)-1].Hash
 	}
 
 	json.NewEncoder(w).Encode(response)
@@ -234,29 +279,27 @@ func handleVerificarHash(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
-	// Procura o hash na blockchain local
-	for _, bloco := range blockchain.Chain {
-		if bloco.Hash == req.Hash {
-			response := VerificacaoHashResponse{
-				Encontrado: true,
-				EmpresaID:  empresa.ID,
-				Bloco: map[string]interface{}{
-					"index":         bloco.Index,
-					"timestamp":     bloco.Timestamp,
-					"tipo":          bloco.Transacao.Tipo,
-					"placa":         bloco.Transacao.Placa,
-					"ponto":         bloco.Transacao.Ponto,
-					"valor":         bloco.Transacao.Valor,
-					"empresa":       bloco.Transacao.Empresa,
-					"hash":          bloco.Hash,
-					"hash_anterior": bloco.HashAnterior,
-					"autor":         bloco.Autor,
-				},
-				Mensagem: "Hash encontrado na blockchain",
-			}
-			json.NewEncoder(w).Encode(response)
-			return
+	// Procura o hash no índice da blockchain local
+	if bloco, existe := blocoPorHash(req.Hash); existe {
+		response := VerificacaoHashResponse{
+			Encontrado: true,
+			EmpresaID:  empresa.ID,
+			Bloco: map[string]interface{}{
+				"index":         bloco.Index,
+				"timestamp":     bloco.Timestamp,
+				"tipo":          bloco.Transacao.Tipo,
+				"placa":         bloco.Transacao.Placa,
+				"ponto":         bloco.Transacao.Ponto,
+				"valor":         bloco.Transacao.Valor,
+				"empresa":       bloco.Transacao.Empresa,
+				"hash":          bloco.Hash,
+				"hash_anterior": bloco.HashAnterior,
+				"autor":         bloco.Autor,
+			},
+			Mensagem: "Hash encontrado na blockchain",
 		}
+		json.NewEncoder(w).Encode(response)
+		return
 	}
 
 	// Hash não encontrado
@@ -279,19 +322,17 @@ func handleHistorico(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	var transacoes []map[string]interface{}
-	for _, bloco := range blockchain.Chain {
-		if bloco.Transacao.Placa == placa {
-			transacao := map[string]interface{}{
-				"index":     bloco.Index,
-				"timestamp": bloco.Timestamp,
-				"tipo":      bloco.Transacao.Tipo,
-				"ponto":     bloco.Transacao.Ponto,
-				"valor":     bloco.Transacao.Valor,
-				"empresa":   bloco.Transacao.Empresa,
-				"hash":      bloco.Hash,
-			}
-			transacoes = append(transacoes, transacao)
+	for _, bloco := range blocosPorPlaca(placa) {
+		transacao := map[string]interface{}{
+			"index":     bloco.Index,
+			"timestamp": bloco.Timestamp,
+			"tipo":      bloco.Transacao.Tipo,
+			"ponto":     bloco.Transacao.Ponto,
+			"valor":     bloco.Transacao.Valor,
+			"empresa":   bloco.Transacao.Empresa,
+			"hash":      bloco.Hash,
 		}
+		transacoes = append(transacoes, transacao)
 	}
 
 	response := map[string]interface{}{
@@ -317,6 +358,12 @@ func handleReservasCoordnadas(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	identidade := identidadeLimite(r, req.PlacaVeiculo)
+	if erro := verificarLimite(identidade); erro != nil {
+		responderLimiteHTTP(w, erro)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
 	// Processa reservas em pontos desta empresa
@@ -334,24 +381,7 @@ func handleReservasCoordnadas(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if pertenceEmpresa {
-			// Processa reserva local
-			hash := processarReservaLocal(req.PlacaVeiculo, ponto)
-			if hash != "" {
-				respostasLocais = append(respostasLocais, ReservaResponse{
-					Status:    "confirmado",
-					Ponto:     ponto,
-					Mensagem:  "Reserva confirmada",
-					EmpresaID: empresa.ID,
-					Hash:      hash,
-				})
-			} else {
-				respostasLocais = append(respostasLocais, ReservaResponse{
-					Status:    "falha",
-					Ponto:     ponto,
-					Mensagem:  "Erro ao processar reserva",
-					EmpresaID: empresa.ID,
-				})
-			}
+			respostasLocais = append(respostasLocais, reservarPontoLocal(r.Context(), identidade, req.PlacaVeiculo, ponto))
 		} else {
 			pontosOutrasEmpresas = append(pontosOutrasEmpresas, ponto)
 		}
@@ -360,7 +390,7 @@ func handleReservasCoordnadas(w http.ResponseWriter, r *http.Request) {
 	// Se há pontos de outras empresas, coordena com elas
 	var respostasExternas []ReservaResponse
 	if len(pontosOutrasEmpresas) > 0 {
-		respostasExternas = coordenarReservasExternas(req.PlacaVeiculo, pontosOutrasEmpresas, req.EmpresaID)
+		respostasExternas = coordenarReservasExternas(r.Context(), req.PlacaVeiculo, pontosOutrasEmpresas, req.EmpresaID)
 	}
 
 	// Combina todas as respostas
@@ -376,8 +406,46 @@ func handleReservasCoordnadas(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// Processa reserva local na empresa
-func processarReservaLocal(placa, ponto string) string {
+// Reserva um ponto desta empresa pedido numa reserva coordenada, com o lock do ponto
+func reservarPontoLocal(ctx context.Context, identidade, placa, ponto string) ReservaResponse {
+	lock := travarPonto(ponto)
+	defer lock.Unlock()
+
+	falha := func(mensagem string) ReservaResponse {
+		return ReservaResponse{Status: "falha", Ponto: ponto, Mensagem: mensagem, EmpresaID: empresa.ID}
+	}
+	if motivo := indisponibilidadePonto(ponto); motivo != "" {
+		metricaReservas.Inc(ponto, "coordenada", "ponto_offline")
+		return falha(motivo)
+	}
+	if !verificarPontoDisponivel(ponto, placa) {
+		registrarConflito(identidade)
+		metricaReservas.Inc(ponto, "coordenada", "conflito")
+		return falha("Ponto já está reservado por outro veículo")
+	}
+	if erro := verificarLimiteReservas(placa, ponto); erro != nil {
+		metricaReservas.Inc(ponto, "coordenada", "limite")
+		return falha(erro.Error())
+	}
+	// Processa reserva local
+	hash, erro := processarReservaLocal(ctx, placa, ponto)
+	if erro != nil {
+		return falha(erro.Error())
+	}
+	return ReservaResponse{
+		Status:    "confirmado",
+		Ponto:     ponto,
+		Mensagem:  "Reserva confirmada",
+		EmpresaID: empresa.ID,
+		Hash:      hash,
+	}
+}
+
+// Processa reserva local na empresa; deve ser chamada com o lock do ponto
+func processarReservaLocal(ctx context.Context, placa, ponto string) (string, error) {
+	ctx, span := iniciarSpan(ctx, "reserva", "placa", placa, "ponto", ponto, "canal", "coordenada")
+	defer span.finalizar()
+
 	// Cria transação de reserva
 	transacao := Transacao{
 		Tipo:    "RESERVA",
@@ -387,26 +455,29 @@ func processarReservaLocal(placa, ponto string) string {
 		Empresa: empresa.ID,
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	ultimo := blockchain.Chain[len(blockchain.Chain)-1]
-	hash := CalcularHash(Bloco{
-		Index:        ultimo.Index + 1,
-		Timestamp:    formatarTimestamp(time.Now().UTC().Format(time.RFC3339)),
-		Transacao:    transacao,
-		HashAnterior: ultimo.Hash,
-		Autor:        empresa.ID,
-	})
-
-	assinatura, err := AssinarBloco(hash, chave_privada_path)
-	if err != nil {
-		return ""
+	// Marca o ponto antes de gravar o bloco; a marcação pode ser recusada (ponto ocupado,
+	// indisponível ou limite de reservas ativas)
+	if !marcarPontoReservado(ponto, placa) {
+		logReservas.InfoContext(ctx, "reserva recusada: ponto indisponível", "placa", placa, "ponto", ponto, "canal", "coordenada")
+		metricaReservas.Inc(ponto, "coordenada", "conflito")
+		span.definir("resultado", "conflito")
+		return "", fmt.Errorf("Ponto %s não está disponível para reserva", ponto)
 	}
 
-	novo_bloco := NovoBloco(transacao, ultimo, empresa.ID, assinatura)
-	blockchain.Chain = append(blockchain.Chain, novo_bloco)
-	SalvarBlockchain("data/chain_"+empresa.ID+".json", blockchain)
+	novo_bloco, err := registrarTransacao(ctx, transacao, registrarReplicacao(ctx, "Reserva de "+placa+" em "+ponto))
+	if err != nil {
+		// Desfaz a marcação do ponto
+		liberarPontoCompleto(ponto, placa)
+		logReservas.ErrorContext(ctx, "erro ao registrar reserva", "placa", placa, "ponto", ponto, "canal", "coordenada", "erro", err)
+		span.falhar(err)
+		metricaReservas.Inc(ponto, "coordenada", "erro")
+		span.definir("resultado", "erro")
+		return "", errors.New("Erro ao processar reserva")
+	}
+	metricaReservas.Inc(ponto, "coordenada", "confirmada")
+	span.definir("resultado", "confirmada")
+	logReservas.InfoContext(ctx, "reserva confirmada", "placa", placa, "ponto", ponto, "canal", "coordenada", "hash", novo_bloco.Hash)
+	span.definir("hash", novo_bloco.Hash)
 
 	// Registra reserva
 	reservas_mutex.Lock()
@@ -416,16 +487,14 @@ func processarReservaLocal(placa, ponto string) string {
 	reservas[placa][ponto] = "confirmado"
 	reservas_mutex.Unlock()
 
-	propagarBloco(novo_bloco)
-
-	// Marca ponto como reservado
-	marcarPontoReservado(ponto, placa)
+	atualizarHashReserva(ponto, placa, novo_bloco.Hash)
+	liberaPorTimeout(placa, []string{ponto}, tempoExpiracaoReserva)
 
-	return novo_bloco.Hash
+	return novo_bloco.Hash, nil
 }
 
 // Coordena reservas com outras empresas
-func coordenarReservasExternas(placa string, pontos []string, empresaOrigem string) []ReservaResponse {
+func coordenarReservasExternas(ctx context.Context, placa string, pontos []string, empresaOrigem string) []ReservaResponse {
 	var respostas []ReservaResponse
 	servidores := obterServidores() // Usa detecção automática de ambiente
 
@@ -435,7 +504,7 @@ func coordenarReservasExternas(placa string, pontos []string, empresaOrigem stri
 			continue
 		}
 
-		fmt.Printf("[REST] Enviando requisição de reserva para %s\n", servidor)
+		logPeer.DebugContext(ctx, "enviando pedido de reserva", "servidor", servidor, "placa", placa, "pontos", pontos)
 
 		req := ReservaRequest{
 			PlacaVeiculo: placa,
@@ -444,15 +513,15 @@ func coordenarReservasExternas(placa string, pontos []string, empresaOrigem stri
 		}
 
 		var response ReservaResponse
-		err := requisicaoRest("POST", servidor+"/reserva", req, &response)
+		err := requisicaoRest(ctx, "POST", servidor+"/peer/reserva", req, &response)
 		if err != nil {
-			fmt.Printf("[REST] Erro na comunicação com %s: %v\n", servidor, err)
+			logPeer.WarnContext(ctx, "erro no pedido de reserva", "servidor", servidor, "placa", placa, "erro", err)
 			continue
 		}
 
 		if response.Status == "confirmado" || response.Status == "sucesso" {
 			respostas = append(respostas, response)
-			fmt.Printf("[REST] Reserva confirmada em %s: %s\n", servidor, response.Mensagem)
+			logPeer.InfoContext(ctx, "reserva confirmada em outra empresa", "servidor", servidor, "placa", placa, "ponto", response.Ponto, "hash", response.Hash)
 		}
 	}
 
@@ -477,15 +546,12 @@ func handleCancelamento(w http.ResponseWriter, r *http.Request) {
 	placa := req.PlacaVeiculo
 	cancelados := 0
 
-	fmt.Printf("[HTTP] Processando cancelamento para %s (pontos: %v)\n", placa, req.Pontos)
+	logReservas.DebugContext(r.Context(), "processando cancelamento", "placa", placa, "pontos", req.Pontos)
 
 	// PBL2 CONCURRENCY: Process each point with individual locks
 	for _, ponto := range req.Pontos {
 		// PBL2 CONCURRENCY: Acquire per-point lock
-		lock := ponto_locks[ponto]
-		lock.Lock()
-
-		fmt.Printf("[HTTP] Verificando cancelamento de %s no ponto %s\n", placa, ponto)
+		lock := travarPonto(ponto)
 
 		// Check if this point is reserved by this vehicle
 		reservas_mutex.Lock()
@@ -501,9 +567,9 @@ func handleCancelamento(w http.ResponseWriter, r *http.Request) {
 			// PBL2 CONCURRENCY: Release point completely within lock
 			liberarPontoCompleto(ponto, placa)
 			cancelados++
-			fmt.Printf("[HTTP] Reserva cancelada para %s no ponto %s\n", placa, ponto)
+			logReservas.InfoContext(r.Context(), "reserva cancelada", "placa", placa, "ponto", ponto, "canal", "rest")
 		} else {
-			fmt.Printf("[HTTP] Ponto %s não estava reservado para %s\n", ponto, placa)
+			logReservas.DebugContext(r.Context(), "ponto não estava reservado para a placa", "placa", placa, "ponto", ponto)
 		}
 
 		lock.Unlock()
@@ -539,27 +605,31 @@ func handleStatusPontos(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// Utilitário para fazer requisições REST para outras empresas
-func requisicaoRest(metodo, url string, corpo interface{}, resposta interface{}) error {
+// Utilitário para fazer requisições REST para outras empresas (assinadas com a chave da empresa)
+func requisicaoRest(ctx context.Context, metodo, url string, corpo interface{}, resposta interface{}) error {
 	jsonCorpo, err := json.Marshal(corpo)
 	if err != nil {
 		return fmt.Errorf("erro na codificação JSON: %v", err)
 	}
 
-	req, err := http.NewRequest(metodo, url, bytes.NewBuffer(jsonCorpo))
+	ctx, span := iniciarSpan(ctx, "peer "+metodo, "url", url)
+	defer span.finalizar()
+	req, err := novaRequisicaoPeer(ctx, metodo, url, jsonCorpo)
 	if err != nil {
 		return fmt.Errorf("erro na criação da requisição: %v", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
+		span.falhar(err)
 		return fmt.Errorf("erro na execução da requisição: %v", err)
 	}
 	defer resp.Body.Close()
 
+	span.definir("status", resp.StatusCode)
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		span.falhar(fmt.Errorf("status %d", resp.StatusCode))
 		return fmt.Errorf("status de resposta inválido: %d", resp.StatusCode)
 	}
 
@@ -578,17 +648,13 @@ func carregarControlePontos() error {
 	defer controlePontos.Unlock()
 
 	fileName := fmt.Sprintf("data/controle_pontos_%s.json", empresa.ID)
-	file, err := os.ReadFile(fileName)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// Arquivo não existe, inicializa com pontos vazios
-			controlePontos.pontos = make(map[string]PontoStatus)
-			return nil
-		}
-		return err
+	err := persistencia.LerJSON(fileName, &controlePontos.pontos)
+	if os.IsNotExist(err) {
+		// Arquivo não existe, inicializa com pontos vazios
+		controlePontos.pontos = make(map[string]PontoStatus)
+		return nil
 	}
-
-	return json.Unmarshal(file, &controlePontos.pontos)
+	return err
 }
 
 // Salva o controle de pontos no arquivo
@@ -597,12 +663,23 @@ func salvarControlePontos() error {
 	defer controlePontos.RUnlock()
 
 	fileName := fmt.Sprintf("data/controle_pontos_%s.json", empresa.ID)
-	file, err := json.MarshalIndent(controlePontos.pontos, "", "  ")
-	if err != nil {
-		return err
-	}
+	return persistencia.GravarJSON(fileName, controlePontos.pontos, 0644)
+}
 
-	return os.WriteFile(fileName, file, 0644)
+// Adia o prazo da reserva do ponto para a placa; deve ser chamada com o lock do ponto
+func prorrogarReserva(ponto, placa string, tempo time.Duration) {
+	controlePontos.Lock()
+	defer controlePontos.Unlock()
+	status, existe := controlePontos.pontos[ponto]
+	if !existe || status.Status != "RESERVADO" || status.Placa != placa {
+		return
+	}
+	status.ExpiraEm = time.Now().Add(tempo).Format(time.RFC3339)
+	controlePontos.pontos[ponto] = status
+	if erro := salvarControlePontosInterno(); erro != nil {
+		logPontos.Error("erro ao salvar controle de pontos", "erro", erro)
+	}
+	anunciarReserva(ponto, placa, "RESERVADO", status.ExpiraEm)
 }
 
 // Verifica se um ponto está disponível para reserva
@@ -623,15 +700,39 @@ func verificarPontoDisponivel(ponto, placa string) bool {
 
 	// Se está reservado para outra placa, não permite
 	if status.Status == "RESERVADO" && status.Placa != placa {
-		fmt.Printf("[CONTROLE] Ponto %s já reservado por %s\n", ponto, status.Placa)
+		logReservas.Debug("ponto já reservado", "ponto", ponto, "placa", status.Placa)
 		return false
 	}
 
 	return true
 }
 
+// Motivo pelo qual o ponto não aceita reservas (manutenção ou desconexão); vazio se aceita
+func indisponibilidadePonto(ponto string) string {
+	saude_pontos.Lock()
+	saude, existe := saude_pontos.pontos[ponto]
+	manutencao := existe && saude.CodigoFalha == codigoBloqueioManual
+	saude_pontos.Unlock()
+	if manutencao {
+		return fmt.Sprintf("Ponto %s está em manutenção", ponto)
+	}
+	status_ponto.RLock()
+	conectado := status_ponto.status[ponto]
+	status_ponto.RUnlock()
+	if !conectado {
+		return fmt.Sprintf("Ponto %s está desconectado", ponto)
+	}
+	return ""
+}
+
 // Marca um ponto como reservado
 func marcarPontoReservado(ponto, placa string) bool {
+	// Nenhum canal reserva ponto em manutenção ou desconectado
+	if motivo := indisponibilidadePonto(ponto); motivo != "" {
+		logReservas.Debug("ponto indisponível para reserva", "ponto", ponto, "placa", placa, "motivo", motivo)
+		return false
+	}
+
 	controlePontos.Lock()
 	defer controlePontos.Unlock()
 
@@ -640,23 +741,30 @@ func marcarPontoReservado(ponto, placa string) bool {
 	if existe && status.Status == "RESERVADO" && status.Placa != placa {
 		return false
 	}
+	if configLimites.MaxReservasAtivas > 0 && reservasAtivasInterno(placa, ponto) >= configLimites.MaxReservasAtivas {
+		logLimites.Info("reservas ativas no limite; ponto recusado", "placa", placa, "ponto", ponto, "maximo", configLimites.MaxReservasAtivas)
+		return false
+	}
 
 	// Marca como reservado
+	agora := time.Now()
 	controlePontos.pontos[ponto] = PontoStatus{
 		Placa:            placa,
-		TimestampReserva: time.Now().Format(time.RFC3339),
+		TimestampReserva: agora.Format(time.RFC3339),
 		Status:           "RESERVADO",
 		HashReserva:      "", // Será preenchido quando a transação for criada
+		ExpiraEm:         agora.Add(tempoExpiracaoReserva).Format(time.RFC3339),
 	}
 
 	// Salva no arquivo
 	err := salvarControlePontosInterno()
 	if err != nil {
-		fmt.Printf("[ERRO] Falha ao salvar controle de pontos: %v\n", err)
+		logPontos.Error("erro ao salvar controle de pontos", "erro", err)
 		return false
 	}
 
-	fmt.Printf("[CONTROLE] Ponto %s reservado para %s\n", ponto, placa)
+	logReservas.Debug("ponto marcado como reservado", "ponto", ponto, "placa", placa)
+	anunciarReserva(ponto, placa, "RESERVADO", controlePontos.pontos[ponto].ExpiraEm)
 	return true
 }
 
@@ -680,18 +788,15 @@ func liberarPonto(ponto, placa string) {
 	if status, existe := controlePontos.pontos[ponto]; existe && status.Placa == placa {
 		delete(controlePontos.pontos, ponto)
 		salvarControlePontosInterno()
-		fmt.Printf("[CONTROLE] Ponto %s liberado por %s\n", ponto, placa)
+		logReservas.Debug("ponto liberado no controle", "ponto", ponto, "placa", placa)
+		anunciarReserva(ponto, placa, "LIBERADO", "")
 	}
 }
 
 // Função interna para salvar sem lock (deve ser chamada dentro de um lock)
 func salvarControlePontosInterno() error {
 	fileName := fmt.Sprintf("data/controle_pontos_%s.json", empresa.ID)
-	file, err := json.MarshalIndent(controlePontos.pontos, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(fileName, file, 0644)
+	return persistencia.GravarJSON(fileName, controlePontos.pontos, 0644)
 }
 
 // Cancela reserva em servidor externo
@@ -716,11 +821,11 @@ func cancelarReservaExterna(empresaID, placa string, pontos []string) {
 		}
 
 		var resposta ReservaResponse
-		err := requisicaoRest("POST", servidor+"/api/cancelamento", req, &resposta)
+		err := requisicaoRest(context.Background(), "POST", servidor+"/peer/cancelamento", req, &resposta)
 		if err != nil {
-			fmt.Printf("[ERRO] Cancelamento não realizado no servidor %s: %v\n", empresaID, err)
+			logPeer.Warn("cancelamento não realizado em outra empresa", "empresa_remota", empresaID, "placa", placa, "erro", err)
 		} else {
-			fmt.Printf("[INFO] Reserva cancelada no servidor %s: %s\n", empresaID, resposta.Status)
+			logPeer.Info("reserva cancelada em outra empresa", "empresa_remota", empresaID, "placa", placa, "status", resposta.Status)
 		}
 		break
 	}
@@ -731,18 +836,18 @@ func propagarBlocoDistribuido(bloco Bloco) {
 	servidores := obterServidores()
 	meuEndereco := obterMeuEndereco()
 
-	fmt.Printf("[BLOCKCHAIN] Propagando bloco %s para outras empresas\n", bloco.Hash)
+	logReplicacao.Info("propagando bloco para outras empresas", "hash", bloco.Hash)
 	for _, servidor := range servidores {
 		if servidor == meuEndereco {
 			continue
 		}
 
 		go func(servidor_url string) {
-			err := requisicaoRest("POST", servidor_url+"/bloco", bloco, nil)
+			err := requisicaoRest(context.Background(), "POST", servidor_url+"/peer/bloco", bloco, nil)
 			if err != nil {
-				fmt.Printf("[BLOCKCHAIN] Erro ao propagar para %s: %v\n", servidor_url, err)
+				logReplicacao.Warn("erro ao propagar bloco", "servidor", servidor_url, "hash", bloco.Hash, "erro", err)
 			} else {
-				fmt.Printf("[BLOCKCHAIN] Bloco propagado com sucesso para %s\n", servidor_url)
+				logReplicacao.Debug("bloco propagado", "servidor", servidor_url, "hash", bloco.Hash)
 			}
 		}(servidor)
 	}
@@ -750,6 +855,9 @@ func propagarBlocoDistribuido(bloco Bloco) {
 
 // Obter endereço da empresa atual baseado no ambiente
 func obterMeuEndereco() string {
+	if api, existe := empresasAPI[empresa.ID]; existe && os.Getenv("EMPRESAS_API") != "" {
+		return api
+	}
 	servidores := obterServidores()
 	for _, servidor := range servidores {
 		if strings.Contains(servidor, empresa.ID) {
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"persistencia"
+)
+
+// Monitoramento de saúde dos pontos de recarga
+// Cada ponto (ou o simulador de estação) publica heartbeats em pontos/<ponto>/heartbeat
+// e falhas em pontos/<ponto>/falha. O ponto é considerado offline após N heartbeats perdidos.
+
+// Máximo de eventos guardados no histórico de cada ponto
+const maxEventosDisponibilidade = 200
+
+// Configuração do monitoramento (sobrescrita por variáveis de ambiente)
+var (
+	intervaloHeartbeat    = 10 * time.Second
+	maxHeartbeatsPerdidos = 3
+	monitoramentoAtivo    = true
+)
+
+// Estado de saúde de um ponto
+type SaudePonto struct {
+	UltimoHeartbeat time.Time
+	CodigoFalha     string // vazio quando o ponto não reportou falha
+	DescricaoFalha  string
+}
+
+// Evento no histórico de disponibilidade
+type EventoDisponibilidade struct {
+	Timestamp string `json:"timestamp"`
+	Status    string `json:"status"` // "online" ou "offline"
+	Motivo    string `json:"motivo"`
+}
+
+var saude_pontos = struct {
+	sync.Mutex
+	pontos map[string]*SaudePonto
+}{pontos: make(map[string]*SaudePonto)}
+
+var historico_disponibilidade = struct {
+	sync.Mutex
+	eventos map[string][]EventoDisponibilidade
+}{eventos: make(map[string][]EventoDisponibilidade)}
+
+// Lê a configuração de heartbeat do ambiente e prepara o estado inicial dos pontos
+func inicializaSaudePontos() {
+	if valor := os.Getenv("HEARTBEAT_INTERVALO_SEGUNDOS"); valor != "" {
+		if segundos, erro := strconv.Atoi(valor); erro == nil {
+			if segundos <= 0 {
+				// Sem monitoramento: pontos permanecem sempre online
+				monitoramentoAtivo = false
+			} else {
+				intervaloHeartbeat = time.Duration(segundos) * time.Second
+			}
+		}
+	}
+	if valor := os.Getenv("HEARTBEAT_MAX_PERDIDOS"); valor != "" {
+		if n, erro := strconv.Atoi(valor); erro == nil && n > 0 {
+			maxHeartbeatsPerdidos = n
+		}
+	}
+
+	carregarHistoricoDisponibilidade()
+
+	// Os pontos começam online com um período de tolerância até o primeiro heartbeat
+	inicio := time.Now()
+	saude_pontos.Lock()
+	for _, ponto := range empresa.Pontos {
+		saude_pontos.pontos[ponto] = &SaudePonto{UltimoHeartbeat: inicio}
+	}
+	saude_pontos.Unlock()
+
+	for _, ponto := range empresa.Pontos {
+		registrarEventoDisponibilidade(ponto, "online", "Nó da empresa iniciado")
+	}
+
+	if monitoramentoAtivo {
+		logPontos.Info("monitoramento por heartbeat ativo", "intervalo", intervaloHeartbeat.String(), "max_perdidos", maxHeartbeatsPerdidos)
+	} else {
+		logPontos.Info("monitoramento por heartbeat desativado")
+	}
+}
+
+// Verifica se o ponto pertence a esta empresa
+func pontoDaEmpresa(ponto string) bool {
+	for _, p := range empresa.Pontos {
+		if p == ponto {
+			return true
+		}
+	}
+	return false
+}
+
+// Calcula o status atual do ponto a partir do último heartbeat e de falhas reportadas
+func avaliarSaudePonto(ponto string, agora time.Time) (bool, string) {
+	saude_pontos.Lock()
+	defer saude_pontos.Unlock()
+
+	saude, existe := saude_pontos.pontos[ponto]
+	if !existe {
+		return false, "Ponto desconhecido"
+	}
+	if saude.CodigoFalha != "" {
+		return false, fmt.Sprintf("Falha %s: %s", saude.CodigoFalha, saude.DescricaoFalha)
+	}
+	if !monitoramentoAtivo {
+		return true, ""
+	}
+	limite := intervaloHeartbeat * time.Duration(maxHeartbeatsPerdidos)
+	if agora.Sub(saude.UltimoHeartbeat) > limite {
+		return false, fmt.Sprintf("%d heartbeats perdidos", maxHeartbeatsPerdidos)
+	}
+	return true, ""
+}
+
+// Aplica mudança de status do ponto: atualiza o estado, registra histórico,
+// publica a mudança e cancela reservas se o ponto ficou offline
+func atualizarStatusPonto(ponto string, online bool, motivo string) {
+	status_ponto.Lock()
+	statusAnterior := status_ponto.status[ponto]
+	status_ponto.status[ponto] = online
+	status_ponto.Unlock()
+
+	if statusAnterior == online {
+		return
+	}
+
+	status := "offline"
+	if online {
+		status = "online"
+		logPontos.Info("ponto voltou online", "ponto", ponto)
+	} else {
+		logPontos.Warn("ponto offline", "ponto", ponto, "motivo", motivo)
+	}
+	registrarEventoDisponibilidade(ponto, status, motivo)
+	anunciarStatusPonto(ponto, status, motivo)
+
+	// Publica a mudança (retida) para que novos assinantes saibam o estado atual
+	if mqttClient != nil && mqttClient.IsConnected() {
+		publicarEnvelope(mqttClient, "pontos/"+ponto+"/status", "STATUS", MensagemPonto{Ponto: ponto, Status: status, Motivo: motivo}, true)
+	}
+
+	if !online {
+		cancelarReservasPontoOffline(ponto)
+	}
+}
+
+// Handler para heartbeats dos pontos (codigo OK quando sem falha)
+func handleHeartbeatMqtt(client mqtt.Client, msg mqtt.Message) {
+	var dados MensagemPonto
+	envelope, ok := receberMensagem(client, msg, envelopePontoDeCSV, &dados)
+	if !ok || envelope.Tipo != "HEARTBEAT" {
+		return
+	}
+	ponto := dados.Ponto
+	if !pontoDaEmpresa(ponto) {
+		return
+	}
+	codigo := dados.Codigo
+	if codigo == "" {
+		codigo = "OK"
+	}
+
+	saude_pontos.Lock()
+	saude := saude_pontos.pontos[ponto]
+	saude.UltimoHeartbeat = time.Now()
+	if codigo == "OK" {
+		// Heartbeat sem falha limpa falhas anteriores, exceto bloqueio manual
+		if saude.CodigoFalha != codigoBloqueioManual {
+			saude.CodigoFalha = ""
+			saude.DescricaoFalha = ""
+		}
+	} else if saude.CodigoFalha == "" {
+		saude.CodigoFalha = codigo
+		saude.DescricaoFalha = "Reportada no heartbeat"
+	}
+	saude_pontos.Unlock()
+
+	online, motivo := avaliarSaudePonto(ponto, time.Now())
+	atualizarStatusPonto(ponto, online, motivo)
+}
+
+// Handler para falhas reportadas pelos pontos (código e descrição)
+func handleFalhaPontoMqtt(client mqtt.Client, msg mqtt.Message) {
+	var dados MensagemPonto
+	envelope, ok := receberMensagem(client, msg, envelopePontoDeCSV, &dados)
+	if !ok || envelope.Tipo != "FALHA" || dados.Codigo == "" {
+		return
+	}
+	ponto := dados.Ponto
+	if !pontoDaEmpresa(ponto) {
+		return
+	}
+	descricao := dados.Descricao
+
+	saude_pontos.Lock()
+	saude := saude_pontos.pontos[ponto]
+	saude.UltimoHeartbeat = time.Now()
+	if saude.CodigoFalha != codigoBloqueioManual {
+		saude.CodigoFalha = dados.Codigo
+		saude.DescricaoFalha = descricao
+	}
+	saude_pontos.Unlock()
+
+	logPontos.Warn("falha reportada", "ponto", ponto, "codigo", dados.Codigo, "descricao", descricao)
+	online, motivo := avaliarSaudePonto(ponto, time.Now())
+	atualizarStatusPonto(ponto, online, motivo)
+}
+
+// Código usado quando um ponto é colocado offline manualmente (STATUS_UPDATE)
+const codigoBloqueioManual = "MANUAL"
+
+// Bloqueia ou libera manualmente um ponto, independentemente dos heartbeats
+func definirBloqueioManual(ponto string, bloqueado bool, descricao string) {
+	saude_pontos.Lock()
+	saude, existe := saude_pontos.pontos[ponto]
+	if !existe {
+		saude_pontos.Unlock()
+		return
+	}
+	if bloqueado {
+		saude.CodigoFalha = codigoBloqueioManual
+		saude.DescricaoFalha = descricao
+	} else if saude.CodigoFalha == codigoBloqueioManual {
+		saude.CodigoFalha = ""
+		saude.DescricaoFalha = ""
+		// Dá um novo período de tolerância até o próximo heartbeat
+		saude.UltimoHeartbeat = time.Now()
+	}
+	saude_pontos.Unlock()
+
+	online, motivo := avaliarSaudePonto(ponto, time.Now())
+	atualizarStatusPonto(ponto, online, motivo)
+}
+
+// Registra um evento no histórico de disponibilidade do ponto e persiste em disco
+func registrarEventoDisponibilidade(ponto, status, motivo string) {
+	historico_disponibilidade.Lock()
+	defer historico_disponibilidade.Unlock()
+
+	eventos := append(historico_disponibilidade.eventos[ponto], EventoDisponibilidade{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Status:    status,
+		Motivo:    motivo,
+	})
+	if len(eventos) > maxEventosDisponibilidade {
+		eventos = eventos[len(eventos)-maxEventosDisponibilidade:]
+	}
+	historico_disponibilidade.eventos[ponto] = eventos
+
+	if erro := salvarHistoricoDisponibilidadeInterno(); erro != nil {
+		logPontos.Error("falha ao salvar histórico de disponibilidade", "erro", erro)
+	}
+}
+
+// Carrega o histórico de disponibilidade do arquivo
+func carregarHistoricoDisponibilidade() {
+	historico_disponibilidade.Lock()
+	defer historico_disponibilidade.Unlock()
+
+	fileName := fmt.Sprintf("data/disponibilidade_%s.json", empresa.ID)
+	if err := persistencia.LerJSON(fileName, &historico_disponibilidade.eventos); errors.Is(err, fs.ErrNotExist) {
+		return
+	} else if err != nil {
+		logPontos.Error("histórico de disponibilidade inválido", "erro", err)
+		historico_disponibilidade.eventos = make(map[string][]EventoDisponibilidade)
+	}
+}
+
+// Função interna para salvar sem lock (deve ser chamada dentro de um lock)
+func salvarHistoricoDisponibilidadeInterno() error {
+	fileName := fmt.Sprintf("data/disponibilidade_%s.json", empresa.ID)
+	return persistencia.GravarJSON(fileName, historico_disponibilidade.eventos, 0644)
+}
+
+// Calcula o percentual de tempo online a partir do histórico de eventos
+func calcularDisponibilidade(eventos []EventoDisponibilidade, agora time.Time) float64 {
+	var online, total time.Duration
+	for i, evento := range eventos {
+		inicio, erro := time.Parse(time.RFC3339, evento.Timestamp)
+		if erro != nil {
+			continue
+		}
+		fim := agora
+		if i+1 < len(eventos) {
+			if proximo, erro := time.Parse(time.RFC3339, eventos[i+1].Timestamp); erro == nil {
+				fim = proximo
+			}
+		}
+		duracao := fim.Sub(inicio)
+		total += duracao
+		if evento.Status == "online" {
+			online += duracao
+		}
+	}
+	if total <= 0 {
+		return 100.0
+	}
+	return float64(online) / float64(total) * 100
+}
+
+// Handler para histórico de disponibilidade de um ponto (ou de todos)
+func handleDisponibilidadePontos(w http.ResponseWriter, r *http.Request) {
+	ponto := r.URL.Query().Get("ponto")
+	if ponto != "" && !pontoDaEmpresa(ponto) {
+		http.Error(w, "Ponto não pertence a esta empresa", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	agora := time.Now()
+
+	historico_disponibilidade.Lock()
+	resultado := make(map[string]interface{})
+	for _, p := range empresa.Pontos {
+		if ponto != "" && p != ponto {
+			continue
+		}
+		eventos := append([]EventoDisponibilidade(nil), historico_disponibilidade.eventos[p]...)
+		resultado[p] = map[string]interface{}{
+			"disponibilidade_percentual": calcularDisponibilidade(eventos, agora),
+			"eventos":                    eventos,
+		}
+	}
+	historico_disponibilidade.Unlock()
+
+	response := map[string]interface{}{
+		"empresa_id": empresa.ID,
+		"pontos":     resultado,
+		"timestamp":  agora.Format(time.RFC3339),
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"persistencia"
+)
+
+// Segredos dos veículos
+// O segredo de uma placa é registrado na primeira empresa que emite credencial para ela e
+// replicado para as demais (POST /peer/veiculos/segredo). Uma empresa que não conhece a placa
+// consulta as outras (GET /peer/veiculos/segredo) antes de aceitar um novo registro. Se duas
+// empresas registrarem a mesma placa ao mesmo tempo, prevalece o registro mais antigo (empate
+// pelo ID da empresa emissora). Tokens de veículo levam a impressão do segredo registrado e só
+// são aceitos se ela corresponder ao registro que prevalece.
+
+const tempoConsultaSegredo = 3 * time.Second
+
+// Registro do segredo de uma placa
+type SegredoVeiculo struct {
+	Hash         string `json:"hash"`          // sha256 (hex) do segredo
+	Emissor      string `json:"emissor"`       // empresa onde foi registrado
+	RegistradoEm int64  `json:"registrado_em"` // unix (nanossegundos)
+}
+
+// Registro de cada placa
+var segredosVeiculos = struct {
+	sync.Mutex
+	registros map[string]SegredoVeiculo
+}{registros: make(map[string]SegredoVeiculo)}
+
+// Indica se o registro prevalece sobre outro da mesma placa
+func (s SegredoVeiculo) anterior(outro SegredoVeiculo) bool {
+	if s.RegistradoEm != outro.RegistradoEm {
+		return s.RegistradoEm < outro.RegistradoEm
+	}
+	return s.Emissor < outro.Emissor
+}
+
+// Impressão do hash do segredo levada nos tokens de veículo
+func impressaoSegredo(hash string) string {
+	impressao := sha256.Sum256([]byte("credencial:" + hash))
+	return hex.EncodeToString(impressao[:8])
+}
+
+// Recupera os segredos de veículos conhecidos por esta empresa
+func carregarSegredosVeiculos() {
+	segredosVeiculos.Lock()
+	defer segredosVeiculos.Unlock()
+	var salvos map[string]json.RawMessage
+	if erro := persistencia.LerJSON("data/segredos_veiculos_"+empresa.ID+".json", &salvos); errors.Is(erro, fs.ErrNotExist) {
+		return
+	} else if erro != nil {
+		logCredencial.Error("erro ao decodificar segredos de veículos", "erro", erro)
+		return
+	}
+	for placa, dados := range salvos {
+		var registro SegredoVeiculo
+		// Arquivos antigos guardavam só o hash, registrado nesta empresa
+		if json.Unmarshal(dados, &registro.Hash) == nil {
+			registro.Emissor = empresa.ID
+		} else if erro := json.Unmarshal(dados, &registro); erro != nil {
+			logCredencial.Error("segredo de veículo inválido", "placa", placa, "erro", erro)
+			continue
+		}
+		segredosVeiculos.registros[placa] = registro
+	}
+}
+
+// Salva os segredos de veículos; deve ser chamada com segredosVeiculos travado
+func salvarSegredosVeiculosInterno() error {
+	return persistencia.GravarJSON("data/segredos_veiculos_"+empresa.ID+".json", segredosVeiculos.registros, 0600)
+}
+
+// Guarda o registro se a placa ainda não tiver um ou se ele prevalecer sobre o atual
+// Retorna o registro que prevalece
+func guardarSegredoVeiculo(placa string, registro SegredoVeiculo) (SegredoVeiculo, error) {
+	segredosVeiculos.Lock()
+	defer segredosVeiculos.Unlock()
+	atual, existe := segredosVeiculos.registros[placa]
+	if existe && !registro.anterior(atual) {
+		return atual, nil
+	}
+	segredosVeiculos.registros[placa] = registro
+	if erro := salvarSegredosVeiculosInterno(); erro != nil {
+		if existe {
+			segredosVeiculos.registros[placa] = atual
+		} else {
+			delete(segredosVeiculos.registros, placa)
+		}
+		return atual, fmt.Errorf("erro ao registrar segredo: %v", erro)
+	}
+	if existe {
+		logCredencial.Warn("segredo do veículo substituído por registro anterior", "placa", placa, "emissor", registro.Emissor)
+	}
+	return registro, nil
+}
+
+// Registro da placa nesta empresa ou, se ela não o conhecer, nas demais
+func segredoDaPlaca(ctx context.Context, placa string) (SegredoVeiculo, bool) {
+	segredosVeiculos.Lock()
+	registro, existe := segredosVeiculos.registros[placa]
+	segredosVeiculos.Unlock()
+	if existe {
+		return registro, true
+	}
+
+	ctx, cancelar := context.WithTimeout(ctx, tempoConsultaSegredo)
+	defer cancelar()
+	respostas := make(chan SegredoVeiculo, len(empresasAPI))
+	var grupo sync.WaitGroup
+	for id, api := range empresasAPI {
+		if id == empresa.ID {
+			continue
+		}
+		grupo.Add(1)
+		go func(id, api string) {
+			defer grupo.Done()
+			var remoto SegredoVeiculo
+			if erro := consultarSegredoPeer(ctx, api, placa, &remoto); erro != nil {
+				logCredencial.DebugContext(ctx, "placa não obtida da empresa", "empresa", id, "placa", placa, "erro", erro)
+				return
+			}
+			respostas <- remoto
+		}(id, api)
+	}
+	grupo.Wait()
+	close(respostas)
+
+	for remoto := range respostas {
+		if !existe || remoto.anterior(registro) {
+			registro, existe = remoto, true
+		}
+	}
+	if !existe {
+		return registro, false
+	}
+	if prevalece, erro := guardarSegredoVeiculo(placa, registro); erro == nil {
+		registro = prevalece
+	}
+	return registro, true
+}
+
+// GET assinado do registro de uma placa em outra empresa
+func consultarSegredoPeer(ctx context.Context, api, placa string, registro *SegredoVeiculo) error {
+	req, erro := novaRequisicaoPeer(ctx, http.MethodGet, api+"/peer/veiculos/segredo?placa="+url.QueryEscape(placa), nil)
+	if erro != nil {
+		return erro
+	}
+	resp, erro := (&http.Client{Timeout: tempoConsultaSegredo}).Do(req.WithContext(ctx))
+	if erro != nil {
+		return erro
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(registro)
+}
+
+// Envia um registro novo às demais empresas; devolve o registro anterior que alguma delas já tinha
+func propagarSegredo(ctx context.Context, placa string, registro SegredoVeiculo) SegredoVeiculo {
+	corpo, _ := json.Marshal(struct {
+		Placa string `json:"placa"`
+		SegredoVeiculo
+	}{placa, registro})
+	prevalece := registro
+	for id, api := range empresasAPI {
+		if id == empresa.ID {
+			continue
+		}
+		resp, erro := postPeer(ctx, api+"/peer/veiculos/segredo", corpo)
+		if erro != nil {
+			logCredencial.WarnContext(ctx, "segredo não replicado", "empresa", id, "placa", placa, "erro", erro)
+			continue
+		}
+		var remoto SegredoVeiculo
+		if resp.StatusCode == http.StatusConflict && json.NewDecoder(resp.Body).Decode(&remoto) == nil && remoto.anterior(prevalece) {
+			prevalece = remoto
+		}
+		resp.Body.Close()
+	}
+	return prevalece
+}
+
+// Confere o segredo da placa; no primeiro acesso em todas as empresas o segredo é registrado
+// Retorna o registro que prevalece para a placa
+func autenticarVeiculo(ctx context.Context, placa, segredo string) (SegredoVeiculo, error) {
+	hash := sha256.Sum256([]byte(segredo))
+	hashHex := hex.EncodeToString(hash[:])
+
+	registro, existe := segredoDaPlaca(ctx, placa)
+	if !existe {
+		novo := SegredoVeiculo{Hash: hashHex, Emissor: empresa.ID, RegistradoEm: time.Now().UnixNano()}
+		var erro error
+		if registro, erro = guardarSegredoVeiculo(placa, novo); erro != nil {
+			return registro, erro
+		}
+		if registro == novo {
+			logCredencial.InfoContext(ctx, "segredo do veículo registrado", "placa", placa)
+			if anterior := propagarSegredo(ctx, placa, novo); anterior != novo {
+				if registro, erro = guardarSegredoVeiculo(placa, anterior); erro != nil {
+					return registro, erro
+				}
+			}
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(registro.Hash), []byte(hashHex)) != 1 {
+		return registro, errors.New("segredo inválido para a placa")
+	}
+	return registro, nil
+}
+
+// GET devolve o registro da placa; POST recebe o registro feito em outra empresa e responde 409
+// com o registro anterior quando o desta empresa prevalece
+func handleSegredoPeer(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		segredosVeiculos.Lock()
+		registro, existe := segredosVeiculos.registros[r.URL.Query().Get("placa")]
+		segredosVeiculos.Unlock()
+		if !existe {
+			http.Error(w, "Placa não registrada", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(registro)
+	case http.MethodPost:
+		var recebido struct {
+			Placa string `json:"placa"`
+			SegredoVeiculo
+		}
+		if json.NewDecoder(r.Body).Decode(&recebido) != nil || !placaValida(recebido.Placa) || recebido.Hash == "" {
+			http.Error(w, "Registro inválido", http.StatusBadRequest)
+			return
+		}
+		if recebido.Emissor != r.Header.Get("X-Empresa-ID") {
+			http.Error(w, "Emissor não corresponde à empresa remetente", http.StatusForbidden)
+			return
+		}
+		prevalece, erro := guardarSegredoVeiculo(recebido.Placa, recebido.SegredoVeiculo)
+		if erro != nil {
+			logCredencial.ErrorContext(r.Context(), "erro ao guardar segredo replicado", "placa", recebido.Placa, "erro", erro)
+			http.Error(w, "Erro ao registrar segredo", http.StatusInternalServerError)
+			return
+		}
+		if prevalece != recebido.SegredoVeiculo {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(prevalece)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+	}
+}
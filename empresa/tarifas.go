@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Tarifas dos pontos de recarga
+// Cada empresa publica na blockchain transações TARIFA assinadas para os seus pontos. A tarifa
+// vigente de um ponto é a de maior VigenteDesde que já começou a valer, e é ela que define o
+// valor das recargas e das cotações em qualquer empresa da rede.
+
+// Tarifa de um ponto de recarga
+type Tarifa struct {
+	PrecoKWh       float64 `json:"preco_kwh"`       // R$ por kWh entregue
+	TaxaSessao     float64 `json:"taxa_sessao"`     // R$ fixo por recarga
+	TaxaOciosidade float64 `json:"taxa_ociosidade"` // R$ por minuto conectado após o fim da carga
+	VigenteDesde   string  `json:"vigente_desde"`   // RFC3339
+}
+
+// Cotação de uma recarga em um ponto
+type Cotacao struct {
+	Ponto           string   `json:"ponto"`
+	Empresa         string   `json:"empresa"`
+	HashTarifa      string   `json:"hash_tarifa"`
+	Tarifa          Tarifa   `json:"tarifa"`
+	Multiplicador   float64  `json:"multiplicador"`
+	Regras          []string `json:"regras,omitempty"`
+	KWh             float64  `json:"kwh"`
+	MinutosOciosos  float64  `json:"minutos_ociosos"`
+	ValorEnergia    float64  `json:"valor_energia"`
+	ValorOciosidade float64  `json:"valor_ociosidade"`
+	ValorTotal      float64  `json:"valor_total"`
+}
+
+var errSemTarifa = errors.New("nenhuma tarifa vigente para o ponto")
+
+// Dados da tarifa incluídos no hash do bloco
+func (t *Tarifa) dadosHash() string {
+	return fmt.Sprintf("%.4f%.2f%.2f%s", t.PrecoKWh, t.TaxaSessao, t.TaxaOciosidade, t.VigenteDesde)
+}
+
+// Valida os campos de uma tarifa antes da publicação
+func (t *Tarifa) validar() error {
+	if t.PrecoKWh <= 0 {
+		return errors.New("preço por kWh deve ser positivo")
+	}
+	if t.TaxaSessao < 0 || t.TaxaOciosidade < 0 {
+		return errors.New("taxas não podem ser negativas")
+	}
+	if _, erro := time.Parse(time.RFC3339, t.VigenteDesde); erro != nil {
+		return fmt.Errorf("vigente_desde inválido (use RFC3339): %s", t.VigenteDesde)
+	}
+	return nil
+}
+
+// Verifica se o ponto pertence à empresa informada, consultando o cadastro em data/
+func empresaPossuiPonto(id, ponto string) bool {
+	if id == empresa.ID {
+		return pontoDaEmpresa(ponto)
+	}
+	file, erro := os.ReadFile("data/empresa_" + id + ".json")
+	if erro != nil {
+		return false
+	}
+	var outra Empresa
+	if erro := json.Unmarshal(file, &outra); erro != nil {
+		return false
+	}
+	for _, p := range outra.Pontos {
+		if p == ponto {
+			return true
+		}
+	}
+	return false
+}
+
+// Carrega a tabela de tarifas padrão da empresa (data/tarifas_<id>.json)
+func carregarTabelaTarifas() map[string]Tarifa {
+	tabela := make(map[string]Tarifa)
+	file, erro := os.ReadFile("data/tarifas_" + empresa.ID + ".json")
+	if erro != nil {
+		return tabela
+	}
+	if erro := json.Unmarshal(file, &tabela); erro != nil {
+		logPrecos.Error("erro ao decodificar tabela de tarifas", "erro", erro)
+	}
+	return tabela
+}
+
+// Busca na blockchain a tarifa vigente de um ponto no instante informado
+// Retorna a tarifa e o hash do bloco que a publicou
+func tarifaVigente(ponto string, em time.Time) (Tarifa, string, bool) {
+	var vigente Tarifa
+	var hash string
+	var inicioVigente time.Time
+	encontrada := false
+	for _, bloco := range chainAtual() {
+		transacao := bloco.Transacao
+		if transacao.Tipo != "TARIFA" || transacao.Ponto != ponto || transacao.Tarifa == nil {
+			continue
+		}
+		inicio, erro := time.Parse(time.RFC3339, transacao.Tarifa.VigenteDesde)
+		if erro != nil || inicio.After(em) {
+			continue
+		}
+		// Em caso de empate vale a publicada por último
+		if !encontrada || !inicio.Before(inicioVigente) {
+			vigente = *transacao.Tarifa
+			hash = bloco.Hash
+			inicioVigente = inicio
+			encontrada = true
+		}
+	}
+	return vigente, hash, encontrada
+}
+
+// Lista as tarifas já publicadas para um ponto (incluindo futuras)
+func historicoTarifas(ponto string) []Bloco {
+	var historico []Bloco
+	for _, bloco := range chainAtual() {
+		if bloco.Transacao.Tipo == "TARIFA" && bloco.Transacao.Ponto == ponto {
+			historico = append(historico, bloco)
+		}
+	}
+	return historico
+}
+
+// Tarifa usada para cobrar uma recarga; na falta de tarifa publicada, usa a tabela padrão da empresa
+func tarifaParaRecarga(ponto string, em time.Time) (Tarifa, string, error) {
+	if tarifa, hash, ok := tarifaVigente(ponto, em); ok {
+		return tarifa, hash, nil
+	}
+	if tarifa, existe := carregarTabelaTarifas()[ponto]; existe && pontoDaEmpresa(ponto) {
+		logPrecos.Warn("ponto sem tarifa na blockchain; usando a tabela padrão", "ponto", ponto)
+		return tarifa, "", nil
+	}
+	return Tarifa{}, "", errSemTarifa
+}
+
+// Calcula o valor de uma recarga pela tarifa
+func calcularValorRecarga(tarifa Tarifa, kwh, minutosOciosos float64) float64 {
+	return tarifa.TaxaSessao + kwh*tarifa.PrecoKWh + minutosOciosos*tarifa.TaxaOciosidade
+}
+
+// Monta a cotação estimada (não assinada) de uma recarga no ponto com a tarifa vigente agora
+func cotarRecarga(ponto string, kwh, minutosOciosos float64) (Cotacao, error) {
+	agora := time.Now()
+	tarifa, hash, ok := tarifaVigente(ponto, agora)
+	if !ok {
+		return Cotacao{}, errSemTarifa
+	}
+	// Só a empresa dona do ponto conhece a ocupação e as regras de preço dele
+	multiplicador, regras := 1.0, []string(nil)
+	if pontoDaEmpresa(ponto) {
+		tarifa, multiplicador, regras = tarifaDinamica(ponto, tarifa, agora)
+	}
+	cotacao := Cotacao{
+		Ponto:           ponto,
+		HashTarifa:      hash,
+		Tarifa:          tarifa,
+		Multiplicador:   multiplicador,
+		Regras:          regras,
+		KWh:             kwh,
+		MinutosOciosos:  minutosOciosos,
+		ValorEnergia:    kwh * tarifa.PrecoKWh,
+		ValorOciosidade: minutosOciosos * tarifa.TaxaOciosidade,
+		ValorTotal:      calcularValorRecarga(tarifa, kwh, minutosOciosos),
+	}
+	for _, bloco := range historicoTarifas(ponto) {
+		if bloco.Hash == hash {
+			cotacao.Empresa = bloco.Transacao.Empresa
+		}
+	}
+	return cotacao, nil
+}
+
+// Publica uma tarifa de um ponto desta empresa na blockchain
+func publicarTarifa(ctx context.Context, ponto string, tarifa Tarifa) (Bloco, error) {
+	if !pontoDaEmpresa(ponto) {
+		return Bloco{}, fmt.Errorf("ponto %s não pertence a esta empresa", ponto)
+	}
+	if tarifa.VigenteDesde == "" {
+		tarifa.VigenteDesde = time.Now().UTC().Format(time.RFC3339)
+	}
+	if erro := tarifa.validar(); erro != nil {
+		return Bloco{}, erro
+	}
+	transacao := Transacao{
+		Tipo:    "TARIFA",
+		Ponto:   ponto,
+		Empresa: empresa.ID,
+		Tarifa:  &tarifa,
+	}
+	bloco, erro := registrarTransacao(ctx, transacao, registrarReplicacao(ctx, "Tarifa do ponto "+ponto))
+	if erro != nil {
+		return Bloco{}, erro
+	}
+	logPrecos.InfoContext(ctx, "tarifa publicada", "ponto", ponto, "preco_kwh", tarifa.PrecoKWh, "taxa_sessao", tarifa.TaxaSessao,
+		"taxa_ociosidade", tarifa.TaxaOciosidade, "vigente_desde", tarifa.VigenteDesde, "hash", bloco.Hash)
+	return bloco, nil
+}
+
+// Publica a tabela padrão para os pontos que ainda não têm tarifa na blockchain
+// Repete até conseguir, caso a gravação falhe
+func publicarTarifasIniciais() {
+	tabela := carregarTabelaTarifas()
+	for {
+		pendentes := 0
+		for _, ponto := range empresa.Pontos {
+			if len(historicoTarifas(ponto)) > 0 {
+				continue
+			}
+			tarifa, existe := tabela[ponto]
+			if !existe {
+				logPrecos.Warn("ponto sem tarifa na tabela padrão", "ponto", ponto)
+				continue
+			}
+			if _, erro := publicarTarifa(context.Background(), ponto, tarifa); erro != nil {
+				logPrecos.Error("erro ao publicar tarifa", "ponto", ponto, "erro", erro)
+				pendentes++
+			}
+		}
+		if pendentes == 0 {
+			return
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// Handler para consultar (GET) e publicar (POST, só com o token de operador) tarifas
+func handleTarifas(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+		pontos := empresa.Pontos
+		if ponto := r.URL.Query().Get("ponto"); ponto != "" {
+			pontos = []string{ponto}
+		}
+		agora := time.Now()
+		w.Header().Set("Content-Type", "application/json")
+		resultado := make(map[string]interface{})
+		for _, ponto := range pontos {
+			tarifa, hash, ok := tarifaVigente(ponto, agora)
+			info := map[string]interface{}{"historico": historicoTarifas(ponto)}
+			if ok {
+				info["vigente"] = tarifa
+				info["hash_vigente"] = hash
+			}
+			resultado[ponto] = info
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"empresa_id": empresa.ID,
+			"tarifas":    resultado,
+			"timestamp":  agora.Format(time.RFC3339),
+		})
+
+	case http.MethodPost:
+		apenasOperador(handlePublicarTarifa)(w, r)
+
+	default:
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+// Publica uma tarifa nova para um ponto desta empresa (ação de operador)
+func handlePublicarTarifa(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Ponto string `json:"ponto"`
+		Tarifa
+	}
+	if erro := json.NewDecoder(r.Body).Decode(&req); erro != nil {
+		http.Error(w, "Erro ao decodificar JSON", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	bloco, erro := publicarTarifa(r.Context(), req.Ponto, req.Tarifa)
+	if erro != nil {
+		status := http.StatusBadRequest
+		if errors.Is(erro, errGravacaoBloco) {
+			status = statusErroEscrita(erro)
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": erro.Error()})
+		return
+	}
+	logPrecos.InfoContext(r.Context(), "tarifa publicada pelo operador", "ponto", req.Ponto, "hash", bloco.Hash, "remoto", r.RemoteAddr)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"hash":   bloco.Hash,
+		"tarifa": bloco.Transacao.Tarifa,
+	})
+}
+
+// Handler de cotação: /api/cotacao?ponto=<ponto>&kwh=<kwh>&ocioso_min=<minutos>
+// Funciona para pontos de qualquer empresa, pois as tarifas estão na blockchain
+func handleCotacao(w http.ResponseWriter, r *http.Request) {
+	ponto := r.URL.Query().Get("ponto")
+	if ponto == "" {
+		http.Error(w, "Parâmetro ponto é obrigatório", http.StatusBadRequest)
+		return
+	}
+	kwh, _ := strconv.ParseFloat(r.URL.Query().Get("kwh"), 64)
+	minutos, _ := strconv.ParseFloat(r.URL.Query().Get("ocioso_min"), 64)
+	if kwh < 0 || minutos < 0 {
+		http.Error(w, "Parâmetros kwh e ocioso_min não podem ser negativos", http.StatusBadRequest)
+		return
+	}
+
+	cotacao, erro := cotarRecarga(ponto, kwh, minutos)
+	w.Header().Set("Content-Type", "application/json")
+	if erro != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": erro.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(cotacao)
+}
@@ -0,0 +1,16 @@
+module estacao
+
+go 1.24.1
+
+require (
+	github.com/eclipse/paho.mqtt.golang v1.5.0
+	persistencia v0.0.0
+)
+
+require (
+	github.com/gorilla/websocket v1.5.3 // indirect
+	golang.org/x/net v0.27.0 // indirect
+	golang.org/x/sync v0.7.0 // indirect
+)
+
+replace persistencia => ../persistencia
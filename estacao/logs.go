@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Logs estruturados do simulador em JSON (log/slog) na saída padrão, com nível, componente e a
+// empresa das estações. O nível mínimo vem de LOG_LEVEL (debug, info, warn ou error; padrão info).
+
+var logBase = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: nivelLog()})).
+	With("empresa", os.Getenv("EMPRESA_ID"))
+
+var (
+	logEstacao   = logBase.With("componente", "estacao")
+	logMQTT      = logBase.With("componente", "mqtt")
+	logProtocolo = logBase.With("componente", "protocolo")
+)
+
+// Nível mínimo configurado em LOG_LEVEL
+func nivelLog() slog.Level {
+	var nivel slog.Level
+	if erro := nivel.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); erro != nil {
+		return slog.LevelInfo
+	}
+	return nivel
+}
+
+// Registra o erro e encerra o processo
+func encerrarComErro(logger *slog.Logger, mensagem string, atributos ...any) {
+	logger.Error(mensagem, atributos...)
+	os.Exit(1)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Simulador das estações de recarga de uma empresa
+// Cada ponto publica heartbeats periódicos e pode reportar falhas, simulando o hardware
+// que as empresas monitoram para saber se um ponto está apto a receber reservas.
+// Os pontos também executam as recargas e medem a energia entregue (ver medidor.go).
+
+type Empresa struct {
+	ID     string   `json:"id"`
+	Nome   string   `json:"nome"`
+	Pontos []string `json:"pontos"`
+}
+
+// Estado simulado de um ponto de recarga
+type PontoSimulado struct {
+	sync.Mutex
+	Nome           string
+	Ligado         bool
+	CodigoFalha    string
+	DescricaoFalha string
+	Sessao         *SessaoMedidor
+}
+
+// Códigos de falha sorteados na injeção aleatória
+var codigosFalha = map[string]string{
+	"E01": "Falha de comunicação com o medidor",
+	"E02": "Sobretemperatura no conector",
+	"E03": "Falha de isolamento",
+	"E04": "Disjuntor desarmado",
+}
+
+var (
+	mqttClient      mqtt.Client
+	pontos          = make(map[string]*PontoSimulado)
+	intervalo       = 10 * time.Second
+	probFalha       = 0.0
+	duracaoFalha    = 60 * time.Second
+	empresaSimulada Empresa
+)
+
+// Lê variáveis de ambiente de configuração do simulador
+func carregarConfiguracao() {
+	empresa_id := os.Getenv("EMPRESA_ID")
+	if empresa_id == "" {
+		encerrarComErro(logEstacao, "EMPRESA_ID indefinido")
+	}
+
+	file, erro := os.ReadFile("data/empresa_" + empresa_id + ".json")
+	if erro != nil {
+		encerrarComErro(logEstacao, "erro ao carregar empresa", "erro", erro)
+	}
+	if erro := json.Unmarshal(file, &empresaSimulada); erro != nil {
+		encerrarComErro(logEstacao, "erro ao decodificar empresa", "erro", erro)
+	}
+
+	if valor := os.Getenv("HEARTBEAT_INTERVALO_SEGUNDOS"); valor != "" {
+		if segundos, erro := strconv.Atoi(valor); erro == nil && segundos > 0 {
+			intervalo = time.Duration(segundos) * time.Second
+		}
+	}
+	if valor := os.Getenv("PROB_FALHA"); valor != "" {
+		if prob, erro := strconv.ParseFloat(valor, 64); erro == nil {
+			probFalha = prob
+		}
+	}
+	if valor := os.Getenv("DURACAO_FALHA_SEGUNDOS"); valor != "" {
+		if segundos, erro := strconv.Atoi(valor); erro == nil && segundos > 0 {
+			duracaoFalha = time.Duration(segundos) * time.Second
+		}
+	}
+
+	for _, nome := range empresaSimulada.Pontos {
+		pontos[nome] = &PontoSimulado{Nome: nome, Ligado: true}
+	}
+}
+
+// Publica mensagem de um ponto em um tópico MQTT
+func publicar(topico, tipo string, dados MensagemPonto) {
+	publicarEnvelope(topico, tipo, dados, qosMqtt)
+}
+
+// Inicializa a conexão MQTT e assina os comandos dos pontos
+func inicializaMqtt() {
+	opts := mqtt.NewClientOptions().AddBroker(urlBroker)
+	opts.SetClientID("estacao_" + empresaSimulada.ID)
+	remetenteProtocolo = "estacao_" + empresaSimulada.ID
+	opts.SetCredentialsProvider(credencialMqtt)
+	opts.SetCleanSession(false)
+	// Handlers publicam e aguardam o PUBACK (QoS 1+); com ordem estrita isso bloquearia o cliente
+	opts.SetOrderMatters(false)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(2 * time.Second)
+
+	opts.OnConnect = func(c mqtt.Client) {
+		logMQTT.Info("estações conectadas ao broker")
+		// Um filtro por ponto: a ACL do broker só libera os comandos dos pontos desta empresa
+		for nome := range pontos {
+			if token := c.Subscribe("pontos/"+nome+"/comando", qosMqtt, handleComando); token.Wait() && token.Error() != nil {
+				logMQTT.Error("erro ao assinar comandos", "ponto", nome, "erro", token.Error())
+			}
+		}
+		if token := c.Subscribe("mensagens/erro/"+remetenteProtocolo, qosMqtt, handleErroProtocolo); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico de erros", "erro", token.Error())
+		}
+	}
+	opts.OnConnectionLost = func(c mqtt.Client, err error) {
+		logMQTT.Warn("conexão perdida", "erro", err)
+	}
+
+	mqttClient = mqtt.NewClient(opts)
+	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
+		encerrarComErro(logMQTT, "erro ao conectar ao broker", "erro", token.Error())
+	}
+}
+
+// Processa comandos de simulação enviados para pontos/<ponto>/comando
+// DESLIGAR | LIGAR | FALHA (codigo, descricao) | REPARAR | INICIAR (placa, sessao, kwh_alvo) | PARAR (placa, sessao)
+func handleComando(client mqtt.Client, msg mqtt.Message) {
+	topico := strings.Split(msg.Topic(), "/")
+	if len(topico) != 3 {
+		return
+	}
+	ponto, existe := pontos[topico[1]]
+	if !existe {
+		return
+	}
+
+	envelope, dados, erro := decodificarComando(ponto.Nome, msg.Payload())
+	if erro != nil {
+		publicarErroProtocolo(msg.Topic(), envelope, erro)
+		return
+	}
+	switch envelope.Tipo {
+	case "INICIAR":
+		if dados.Placa == "" || dados.Sessao == "" {
+			publicarErroProtocolo(msg.Topic(), envelope, errors.New("INICIAR exige placa e sessao"))
+			return
+		}
+		iniciarRecarga(ponto, dados.Placa, dados.Sessao, dados.KWhAlvo)
+	case "PARAR":
+		pararRecarga(ponto, dados.Placa, dados.Sessao)
+	case "DESLIGAR":
+		ponto.Lock()
+		ponto.Ligado = false
+		ponto.Unlock()
+		logEstacao.Info("ponto desligado (heartbeats suspensos)", "ponto", ponto.Nome)
+	case "LIGAR":
+		ponto.Lock()
+		ponto.Ligado = true
+		ponto.Unlock()
+		logEstacao.Info("ponto religado", "ponto", ponto.Nome)
+		enviarHeartbeat(ponto)
+	case "FALHA":
+		codigo, descricao := "E99", "Falha simulada"
+		if dados.Codigo != "" {
+			codigo = dados.Codigo
+		}
+		if dados.Descricao != "" {
+			descricao = dados.Descricao
+		}
+		reportarFalha(ponto, codigo, descricao)
+	case "REPARAR":
+		repararFalha(ponto)
+	default:
+		publicarErroProtocolo(msg.Topic(), envelope, fmt.Errorf("comando desconhecido: %s", envelope.Tipo))
+	}
+}
+
+// Exibe erros de protocolo reportados pelas empresas
+func handleErroProtocolo(client mqtt.Client, msg mqtt.Message) {
+	envelope, erro := decodificarEnvelope(msg.Payload())
+	var dados ErroProtocolo
+	if erro != nil || json.Unmarshal(envelope.Payload, &dados) != nil {
+		return
+	}
+	logProtocolo.Warn("mensagem rejeitada", "remetente", envelope.Remetente, "id", dados.IDOriginal, "topico", dados.Topico, "motivo", dados.Motivo)
+}
+
+// Publica heartbeat do ponto com o código de falha atual (OK quando saudável)
+func enviarHeartbeat(ponto *PontoSimulado) {
+	ponto.Lock()
+	ligado := ponto.Ligado
+	codigo := ponto.CodigoFalha
+	ponto.Unlock()
+
+	if !ligado {
+		return
+	}
+	if codigo == "" {
+		codigo = "OK"
+	}
+	publicar("pontos/"+ponto.Nome+"/heartbeat", "HEARTBEAT", MensagemPonto{Ponto: ponto.Nome, Codigo: codigo})
+}
+
+// Coloca o ponto em falha e publica o código imediatamente
+func reportarFalha(ponto *PontoSimulado, codigo, descricao string) {
+	ponto.Lock()
+	ponto.CodigoFalha = codigo
+	ponto.DescricaoFalha = descricao
+	ponto.Unlock()
+
+	logEstacao.Warn("falha no ponto", "ponto", ponto.Nome, "codigo", codigo, "descricao", descricao)
+	publicar("pontos/"+ponto.Nome+"/falha", "FALHA", MensagemPonto{Ponto: ponto.Nome, Codigo: codigo, Descricao: descricao})
+}
+
+// Remove a falha do ponto; o próximo heartbeat informa a recuperação
+func repararFalha(ponto *PontoSimulado) {
+	ponto.Lock()
+	ponto.CodigoFalha = ""
+	ponto.DescricaoFalha = ""
+	ponto.Unlock()
+
+	logEstacao.Info("ponto reparado", "ponto", ponto.Nome)
+	enviarHeartbeat(ponto)
+}
+
+// Sorteia uma falha aleatória e agenda o reparo automático
+func injetarFalhaAleatoria(ponto *PontoSimulado) {
+	ponto.Lock()
+	emFalha := ponto.CodigoFalha != ""
+	ponto.Unlock()
+	if emFalha || rand.Float64() >= probFalha {
+		return
+	}
+
+	codigos := make([]string, 0, len(codigosFalha))
+	for codigo := range codigosFalha {
+		codigos = append(codigos, codigo)
+	}
+	codigo := codigos[rand.Intn(len(codigos))]
+	reportarFalha(ponto, codigo, codigosFalha[codigo])
+
+	time.AfterFunc(duracaoFalha, func() {
+		repararFalha(ponto)
+	})
+}
+
+// Laço de heartbeats de um ponto
+func simularPonto(ponto *PontoSimulado) {
+	enviarHeartbeat(ponto)
+	for {
+		time.Sleep(intervalo)
+		if probFalha > 0 {
+			injetarFalhaAleatoria(ponto)
+		}
+		enviarHeartbeat(ponto)
+	}
+}
+
+// Função principal do simulador de estações
+func main() {
+	carregarConfiguracao()
+	carregarConfiguracaoMedidor()
+	inicializaMqtt()
+
+	logEstacao.Info("simulando pontos da empresa", "pontos", len(pontos), "nome", empresaSimulada.Nome,
+		"heartbeat", intervalo.String(), "potencia_kw", potenciaKW)
+
+	for _, ponto := range pontos {
+		go simularPonto(ponto)
+	}
+
+	// Mantém o programa em execução
+	select {}
+}
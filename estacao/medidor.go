@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"persistencia"
+)
+
+// Medidor de energia simulado
+// Ao receber INICIAR, o ponto carrega o veículo publicando amostras de energia e potência
+// em pontos/<ponto>/medicao e, ao final, a leitura assinada em pontos/<ponto>/leitura.
+// A empresa só registra a RECARGA a partir dessa leitura.
+
+// Sessão de recarga em andamento no ponto
+type SessaoMedidor struct {
+	ID     string
+	Placa  string
+	KWh    float64
+	Alvo   float64
+	Inicio time.Time
+	parar  chan struct{}
+}
+
+var (
+	potenciaKW         = 50.0
+	fatorTempo         = 300.0
+	chave_privada_path string
+)
+
+// Lê configuração do medidor e garante o par de chaves usado para assinar as leituras
+func carregarConfiguracaoMedidor() {
+	if valor := os.Getenv("POTENCIA_KW"); valor != "" {
+		if kw, erro := strconv.ParseFloat(valor, 64); erro == nil && kw > 0 {
+			potenciaKW = kw
+		}
+	}
+	if valor := os.Getenv("FATOR_TEMPO"); valor != "" {
+		if fator, erro := strconv.ParseFloat(valor, 64); erro == nil && fator > 0 {
+			fatorTempo = fator
+		}
+	}
+
+	chave_privada_path = "data/estacao_" + empresaSimulada.ID + "_private.pem"
+	chave_publica_path := "data/estacao_" + empresaSimulada.ID + "_public.pem"
+	if _, erro := os.Stat(chave_privada_path); os.IsNotExist(erro) {
+		logEstacao.Info("gerando chaves do medidor")
+		if erro := gerarChaves(chave_privada_path, chave_publica_path); erro != nil {
+			encerrarComErro(logEstacao, "erro ao gerar chaves do medidor", "erro", erro)
+		}
+	}
+}
+
+// Gera par de chaves RSA do medidor; a pública é lida pela empresa para validar as leituras
+// As chaves são gravadas de forma atômica: uma queda no meio não deixa chave truncada
+func gerarChaves(privada_path, publica_path string) error {
+	privada, erro := rsa.GenerateKey(rand.Reader, 2048)
+	if erro != nil {
+		return erro
+	}
+	privada_pem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privada)})
+	if erro := persistencia.GravarArquivo(privada_path, privada_pem, 0600); erro != nil {
+		return erro
+	}
+	pub_pem := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&privada.PublicKey)})
+	return persistencia.GravarArquivo(publica_path, pub_pem, 0644)
+}
+
+// Assina o hash da leitura com a chave privada do medidor (mesmo esquema dos blocos)
+func assinarLeitura(hash string) (string, error) {
+	privada_pem, erro := os.ReadFile(chave_privada_path)
+	if erro != nil {
+		return "", erro
+	}
+	block, _ := pem.Decode(privada_pem)
+	if block == nil {
+		return "", fmt.Errorf("chave privada inválida em %s", chave_privada_path)
+	}
+	privada, erro := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if erro != nil {
+		return "", erro
+	}
+	hash_sum := sha256.Sum256([]byte(hash))
+	assinatura, erro := rsa.SignPKCS1v15(rand.Reader, privada, crypto.SHA256, hash_sum[:])
+	if erro != nil {
+		return "", erro
+	}
+	return hex.EncodeToString(assinatura), nil
+}
+
+// Calcula o hash da leitura final (deve coincidir com calcularHashLeitura da empresa)
+func calcularHashLeitura(ponto, placa, sessao string, kwh float64, inicio, fim string) string {
+	dados := strings.Join([]string{ponto, placa, sessao, strconv.FormatFloat(kwh, 'f', 3, 64), inicio, fim}, "|")
+	hash := sha256.Sum256([]byte(dados))
+	return hex.EncodeToString(hash[:])
+}
+
+// Publica evento de sessão (INICIADA, RECUSADA, ENCERRADA) com detalhe
+func publicarSessao(ponto *PontoSimulado, sessao, estado, detalhe string) {
+	publicar("pontos/"+ponto.Nome+"/sessao", "SESSAO", MensagemPonto{Ponto: ponto.Nome, Sessao: sessao, Estado: estado, Detalhe: detalhe})
+}
+
+// Inicia uma recarga no ponto (comando INICIAR)
+func iniciarRecarga(ponto *PontoSimulado, placa, id string, alvo float64) {
+	ponto.Lock()
+	motivo := ""
+	switch {
+	case !ponto.Ligado:
+		motivo = "Ponto desligado"
+	case ponto.CodigoFalha != "":
+		motivo = "Ponto em falha " + ponto.CodigoFalha
+	case ponto.Sessao != nil:
+		motivo = "Conector ocupado"
+	case alvo <= 0:
+		motivo = "Energia alvo inválida"
+	}
+	if motivo != "" {
+		ponto.Unlock()
+		logEstacao.Warn("recarga recusada", "placa", placa, "ponto", ponto.Nome, "sessao", id, "motivo", motivo)
+		publicarSessao(ponto, id, "RECUSADA", motivo)
+		return
+	}
+	sessao := &SessaoMedidor{ID: id, Placa: placa, Alvo: alvo, Inicio: time.Now(), parar: make(chan struct{})}
+	ponto.Sessao = sessao
+	ponto.Unlock()
+
+	logEstacao.Info("recarga iniciada", "placa", placa, "ponto", ponto.Nome, "sessao", id, "alvo_kwh", alvo)
+	publicarSessao(ponto, id, "INICIADA", sessao.Inicio.UTC().Format(time.RFC3339))
+	go medirRecarga(ponto, sessao)
+}
+
+// Interrompe a recarga em andamento (comando PARAR)
+func pararRecarga(ponto *PontoSimulado, placa, id string) {
+	ponto.Lock()
+	defer ponto.Unlock()
+	if ponto.Sessao == nil || ponto.Sessao.ID != id || ponto.Sessao.Placa != placa {
+		return
+	}
+	select {
+	case <-ponto.Sessao.parar:
+	default:
+		close(ponto.Sessao.parar)
+	}
+}
+
+// Simula a entrega de energia: uma amostra por segundo, acelerada por fatorTempo,
+// com redução de potência perto do alvo e pequena variação aleatória
+func medirRecarga(ponto *PontoSimulado, sessao *SessaoMedidor) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	motivo := "Concluída"
+	for sessao.KWh < sessao.Alvo {
+		select {
+		case <-sessao.parar:
+			motivo = "Interrompida"
+		case <-ticker.C:
+		}
+		if motivo != "Concluída" {
+			break
+		}
+
+		ponto.Lock()
+		emFalha := ponto.CodigoFalha != "" || !ponto.Ligado
+		ponto.Unlock()
+		if emFalha {
+			motivo = "Interrompida por falha"
+			break
+		}
+
+		potencia := potenciaKW * (0.95 + mrand.Float64()*0.05)
+		if restante := sessao.Alvo - sessao.KWh; restante < sessao.Alvo*0.2 {
+			// Redução de potência na fase final da carga
+			potencia *= 0.3 + 0.7*restante/(sessao.Alvo*0.2)
+		}
+		sessao.KWh += potencia * fatorTempo / 3600
+		if sessao.KWh > sessao.Alvo {
+			sessao.KWh = sessao.Alvo
+		}
+		publicar("pontos/"+ponto.Nome+"/medicao", "MEDICAO", MensagemPonto{
+			Ponto:  ponto.Nome,
+			Sessao: sessao.ID,
+			KWh:    math.Round(sessao.KWh*1000) / 1000,
+			KW:     math.Round(potencia*10) / 10,
+		})
+	}
+
+	fim := time.Now()
+	enviarLeitura(ponto, sessao, fim)
+	logEstacao.Info("recarga encerrada", "placa", sessao.Placa, "ponto", ponto.Nome, "sessao", sessao.ID, "motivo", strings.ToLower(motivo), "kwh", sessao.KWh)
+	publicarSessao(ponto, sessao.ID, "ENCERRADA", motivo)
+
+	ponto.Lock()
+	ponto.Sessao = nil
+	ponto.Unlock()
+}
+
+// Publica a leitura final assinada (QoS mínima 1, pois dela depende o registro da RECARGA)
+func enviarLeitura(ponto *PontoSimulado, sessao *SessaoMedidor, fim time.Time) {
+	kwh, _ := strconv.ParseFloat(strconv.FormatFloat(sessao.KWh, 'f', 3, 64), 64)
+	inicio := sessao.Inicio.UTC().Format(time.RFC3339)
+	termino := fim.UTC().Format(time.RFC3339)
+
+	hash := calcularHashLeitura(ponto.Nome, sessao.Placa, sessao.ID, kwh, inicio, termino)
+	assinatura, erro := assinarLeitura(hash)
+	if erro != nil {
+		logEstacao.Error("erro ao assinar leitura", "sessao", sessao.ID, "erro", erro)
+		return
+	}
+	publicarEnvelope("pontos/"+ponto.Nome+"/leitura", "LEITURA", MensagemPonto{
+		Ponto:      ponto.Nome,
+		Placa:      sessao.Placa,
+		Sessao:     sessao.ID,
+		KWh:        kwh,
+		Inicio:     inicio,
+		Fim:        termino,
+		Assinatura: assinatura,
+	}, max(qosMqtt, 1))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocolo de mensagens MQTT (mesmo envelope usado pelas empresas e veículos)
+// Toda mensagem é um envelope JSON versionado (tipo, versão, ID, timestamp, remetente e payload).
+// Comandos CSV antigos continuam aceitos enquanto PROTOCOLO_CSV_LEGADO não for "false".
+// Comandos malformados são reportados à empresa dona dos pontos em mensagens/erro/empresa_<id>:
+// só ela publica os comandos (ACL do broker), e o remetente do envelope não é autenticado.
+
+const versaoProtocolo = 1
+
+// Envelope comum a todas as mensagens
+// Correlacao e ResponderPara só são usados em requisições de veículos e nas respectivas respostas
+type Envelope struct {
+	Tipo          string          `json:"tipo"`
+	Versao        int             `json:"versao"`
+	ID            string          `json:"id"`
+	Timestamp     string          `json:"timestamp"`
+	Remetente     string          `json:"remetente"`
+	Correlacao    string          `json:"correlacao,omitempty"`
+	ResponderPara string          `json:"responder_para,omitempty"`
+	Confirmar     bool            `json:"confirmar,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+}
+
+// Payload da mensagem de erro enviada ao remetente de uma mensagem malformada
+type ErroProtocolo struct {
+	IDOriginal string `json:"id_original,omitempty"`
+	Topico     string `json:"topico"`
+	Motivo     string `json:"motivo"`
+}
+
+// Dados trocados entre empresas e estações de recarga
+type MensagemPonto struct {
+	Ponto      string  `json:"ponto"`
+	Codigo     string  `json:"codigo,omitempty"`
+	Descricao  string  `json:"descricao,omitempty"`
+	Status     string  `json:"status,omitempty"`
+	Motivo     string  `json:"motivo,omitempty"`
+	Placa      string  `json:"placa,omitempty"`
+	Sessao     string  `json:"sessao,omitempty"`
+	Estado     string  `json:"estado,omitempty"`
+	Detalhe    string  `json:"detalhe,omitempty"`
+	KWh        float64 `json:"kwh,omitempty"`
+	KW         float64 `json:"kw,omitempty"`
+	KWhAlvo    float64 `json:"kwh_alvo,omitempty"`
+	Inicio     string  `json:"inicio,omitempty"`
+	Fim        string  `json:"fim,omitempty"`
+	Assinatura string  `json:"assinatura,omitempty"`
+}
+
+var (
+	errMensagemLegada     = errors.New("mensagem no formato CSV legado")
+	errVersaoNaoSuportada = errors.New("versão de protocolo não suportada")
+)
+
+// Aceita comandos CSV antigos durante a janela de transição
+var aceitaCSVLegado = os.Getenv("PROTOCOLO_CSV_LEGADO") != "false"
+
+// Identificador deste nó nos envelopes enviados
+var remetenteProtocolo string
+
+// QoS usada nas publicações e inscrições (MQTT_QOS: 0, 1 ou 2; padrão 1)
+var qosMqtt = lerQosMqtt()
+
+// Lê a QoS configurada; valores inválidos usam o padrão
+func lerQosMqtt() byte {
+	switch os.Getenv("MQTT_QOS") {
+	case "0":
+		return 0
+	case "2":
+		return 2
+	}
+	return 1
+}
+
+// URL do broker MQTT (MQTT_BROKER_URL; padrão: container do Mosquitto)
+var urlBroker = lerUrlBroker()
+
+// Lê a URL do broker do ambiente
+func lerUrlBroker() string {
+	if url := os.Getenv("MQTT_BROKER_URL"); url != "" {
+		return url
+	}
+	return "tcp://broker:1883"
+}
+
+// Declarações do token de acesso ao broker (mesmo formato emitido pelas empresas)
+type CredencialMqtt struct {
+	Papel   string `json:"papel"`
+	Sujeito string `json:"sujeito"`
+	Emissor string `json:"emissor"`
+	Expira  int64  `json:"expira"`
+}
+
+const validadeCredencial = time.Hour
+
+// Usuário e token da estação para o broker, assinado com a chave do medidor
+// Um token novo é gerado a cada (re)conexão
+func credencialMqtt() (string, string) {
+	usuario := "estacao_" + empresaSimulada.ID
+	dados, _ := json.Marshal(CredencialMqtt{
+		Papel:   "estacao",
+		Sujeito: empresaSimulada.ID,
+		Emissor: empresaSimulada.ID,
+		Expira:  time.Now().Add(validadeCredencial).Unix(),
+	})
+	corpo := base64.RawURLEncoding.EncodeToString(dados)
+	assinatura, erro := assinarLeitura(corpo)
+	if erro != nil {
+		logMQTT.Error("erro ao assinar credencial", "erro", erro)
+		return usuario, ""
+	}
+	return usuario, corpo + "." + assinatura
+}
+
+// Gera identificador aleatório de mensagem
+func gerarIDMensagem() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Monta um envelope com o payload serializado
+func codificarEnvelope(tipo string, payload interface{}) ([]byte, error) {
+	envelope := Envelope{
+		Tipo:      tipo,
+		Versao:    versaoProtocolo,
+		ID:        gerarIDMensagem(),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Remetente: remetenteProtocolo,
+	}
+	if payload != nil {
+		dados, erro := json.Marshal(payload)
+		if erro != nil {
+			return nil, erro
+		}
+		envelope.Payload = dados
+	}
+	return json.Marshal(envelope)
+}
+
+// Decodifica um envelope; retorna errMensagemLegada se a mensagem não for JSON
+func decodificarEnvelope(bruto []byte) (Envelope, error) {
+	var envelope Envelope
+	bruto = bytes.TrimSpace(bruto)
+	if len(bruto) == 0 || bruto[0] != '{' {
+		return envelope, errMensagemLegada
+	}
+	if erro := json.Unmarshal(bruto, &envelope); erro != nil {
+		return envelope, fmt.Errorf("JSON inválido: %v", erro)
+	}
+	if envelope.Versao < 1 || envelope.Versao > versaoProtocolo {
+		return envelope, fmt.Errorf("%w: %d", errVersaoNaoSuportada, envelope.Versao)
+	}
+	if envelope.Tipo == "" {
+		return envelope, errors.New("campo tipo ausente")
+	}
+	return envelope, nil
+}
+
+// Publica um envelope em um tópico com a QoS informada
+func publicarEnvelope(topico, tipo string, payload interface{}, qos byte) {
+	dados, erro := codificarEnvelope(tipo, payload)
+	if erro != nil {
+		logMQTT.Error("erro ao codificar mensagem", "tipo", tipo, "erro", erro)
+		return
+	}
+	token := mqttClient.Publish(topico, qos, false, dados)
+	token.Wait()
+}
+
+// Reporta à empresa dos pontos que o comando recebido não pôde ser processado
+func publicarErroProtocolo(topico string, envelope Envelope, motivo error) {
+	logProtocolo.Warn("comando inválido", "remetente_declarado", envelope.Remetente, "topico", topico, "motivo", motivo)
+	publicarEnvelope("mensagens/erro/empresa_"+empresaSimulada.ID, "erro", ErroProtocolo{
+		IDOriginal: envelope.ID,
+		Topico:     topico,
+		Motivo:     motivo.Error(),
+	}, qosMqtt)
+}
+
+// Converte comando CSV antigo: DESLIGAR | LIGAR | FALHA,codigo,descricao | REPARAR |
+// INICIAR,placa,sessao,kwh_alvo | PARAR,placa,sessao
+func comandoDeCSV(ponto, texto string) (Envelope, MensagemPonto, error) {
+	partes := strings.SplitN(texto, ",", 4)
+	tipo := strings.TrimSpace(partes[0])
+	dados := MensagemPonto{Ponto: ponto}
+	switch tipo {
+	case "DESLIGAR", "LIGAR", "REPARAR":
+	case "FALHA":
+		if len(partes) >= 2 {
+			dados.Codigo = partes[1]
+		}
+		if len(partes) >= 3 {
+			dados.Descricao = strings.Join(partes[2:], ",")
+		}
+	case "INICIAR":
+		if len(partes) != 4 {
+			return Envelope{}, dados, errors.New("comando CSV INICIAR inválido")
+		}
+		dados.Placa, dados.Sessao = partes[1], partes[2]
+		dados.KWhAlvo, _ = strconv.ParseFloat(partes[3], 64)
+	case "PARAR":
+		if len(partes) < 3 {
+			return Envelope{}, dados, errors.New("comando CSV PARAR inválido")
+		}
+		dados.Placa, dados.Sessao = partes[1], partes[2]
+	default:
+		return Envelope{}, dados, fmt.Errorf("comando desconhecido: %s", tipo)
+	}
+	return Envelope{Tipo: tipo}, dados, nil
+}
+
+// Decodifica um comando recebido (envelope ou CSV legado)
+// Comandos sem payload (LIGAR, DESLIGAR, REPARAR) são aceitos no envelope
+func decodificarComando(ponto string, bruto []byte) (Envelope, MensagemPonto, error) {
+	envelope, erro := decodificarEnvelope(bruto)
+	if errors.Is(erro, errMensagemLegada) {
+		if !aceitaCSVLegado {
+			return envelope, MensagemPonto{}, errors.New("formato CSV legado desativado; use o envelope JSON versionado")
+		}
+		return comandoDeCSV(ponto, string(bruto))
+	}
+	dados := MensagemPonto{Ponto: ponto}
+	if erro != nil {
+		return envelope, dados, erro
+	}
+	if len(envelope.Payload) > 0 {
+		if erro := json.Unmarshal(envelope.Payload, &dados); erro != nil {
+			return envelope, dados, fmt.Errorf("payload inválido para %s: %v", envelope.Tipo, erro)
+		}
+	}
+	return envelope, dados, nil
+}
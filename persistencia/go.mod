@@ -0,0 +1,3 @@
+module persistencia
+
+go 1.24.1
@@ -0,0 +1,170 @@
+// Pacote persistencia grava e lê os arquivos de estado da empresa e do veículo.
+//
+// Toda gravação vai para um arquivo temporário no mesmo diretório, que recebe fsync e então
+// substitui o original por rename (atômico no mesmo sistema de arquivos), seguido do fsync do
+// diretório: quem lê vê a versão anterior inteira ou a nova inteira, mesmo com o processo caindo
+// no meio da gravação.
+// Os arquivos de estado em JSON são gravados num envelope com o SHA-256 dos dados,
+// {"formato": 1, "sha256": "...", "dados": ...}, e a versão anterior fica em <arquivo>.bak.
+// Na leitura, um arquivo com checksum errado ou JSON inválido é trocado pelo .bak; arquivos
+// sem envelope (gravados por versões antigas) continuam sendo lidos e ganham o envelope na
+// próxima gravação. Arquivos de configuração editados à mão e lidos por outros nós são gravados
+// só de forma atômica (GravarArquivo), sem envelope.
+// Arquivos alterados por mais de um processo são lidos e gravados com um lock advisory em
+// <arquivo>.lock (Travar; flock em sistemas unix).
+package persistencia
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+const formatoRegistro = 1
+
+type registroArquivo struct {
+	Formato int             `json:"formato"`
+	SHA256  string          `json:"sha256"`
+	Dados   json.RawMessage `json:"dados"`
+}
+
+var ErrChecksum = errors.New("checksum não confere")
+
+// Log dos arquivos corrompidos; cada programa troca pelo próprio logger
+var Log = slog.Default()
+
+// Grava o arquivo de forma atômica (temporário, fsync e rename)
+func GravarArquivo(caminho string, dados []byte, permissao os.FileMode) error {
+	diretorio := filepath.Dir(caminho)
+	temporario, erro := os.CreateTemp(diretorio, "."+filepath.Base(caminho)+".tmp-*")
+	if erro != nil {
+		return erro
+	}
+	renomeado := false
+	defer func() {
+		if !renomeado {
+			os.Remove(temporario.Name())
+		}
+	}()
+	if _, erro := temporario.Write(dados); erro != nil {
+		temporario.Close()
+		return erro
+	}
+	if erro := temporario.Chmod(permissao); erro != nil {
+		temporario.Close()
+		return erro
+	}
+	if erro := temporario.Sync(); erro != nil {
+		temporario.Close()
+		return erro
+	}
+	if erro := temporario.Close(); erro != nil {
+		return erro
+	}
+	if erro := os.Rename(temporario.Name(), caminho); erro != nil {
+		return erro
+	}
+	renomeado = true
+	return sincronizarDiretorio(diretorio)
+}
+
+// Grava o valor em JSON, no envelope com checksum, mantendo a versão atual em .bak
+func GravarJSON(caminho string, valor interface{}, permissao os.FileMode) error {
+	dados, erro := json.Marshal(valor)
+	if erro != nil {
+		return erro
+	}
+	return GravarRegistro(caminho, dados, permissao)
+}
+
+// Grava dados JSON já codificados no envelope com checksum, mantendo a versão atual em .bak
+func GravarRegistro(caminho string, dados []byte, permissao os.FileMode) error {
+	soma := sha256.Sum256(dados)
+	registro, erro := json.MarshalIndent(registroArquivo{Formato: formatoRegistro, SHA256: hex.EncodeToString(soma[:]), Dados: dados}, "", "  ")
+	if erro != nil {
+		return erro
+	}
+	guardarCopiaAnterior(caminho)
+	return GravarArquivo(caminho, registro, permissao)
+}
+
+// Faz da versão atual o .bak com um link físico (a cópia não custa uma nova escrita do arquivo)
+// O link é criado com nome temporário e renomeado sobre o .bak, de modo que o .bak anterior só
+// deixa de existir quando o novo já está no lugar: uma queda em qualquer ponto deixa um .bak
+func guardarCopiaAnterior(caminho string) {
+	sufixo := make([]byte, 8)
+	rand.Read(sufixo)
+	temporario := filepath.Join(filepath.Dir(caminho), "."+filepath.Base(caminho)+".bak.tmp-"+hex.EncodeToString(sufixo))
+	if os.Link(caminho, temporario) != nil {
+		return
+	}
+	os.Rename(temporario, caminho+".bak")
+	// Se o .bak já era o mesmo arquivo, o rename não remove o nome temporário
+	os.Remove(temporario)
+}
+
+// Lê, altera e grava um arquivo JSON com o lock do arquivo; um arquivo inexistente é lido como
+// o valor zero de destino. Nada é gravado se alterar retornar false ou se o arquivo estiver
+// corrompido sem cópia anterior válida
+func AtualizarJSON(caminho string, destino interface{}, permissao os.FileMode, alterar func() bool) error {
+	trava, erro := Travar(caminho)
+	if erro != nil {
+		return erro
+	}
+	defer trava.Destravar()
+	if erro := LerJSON(caminho, destino); erro != nil && !errors.Is(erro, fs.ErrNotExist) {
+		return erro
+	}
+	if !alterar() {
+		return nil
+	}
+	return GravarJSON(caminho, destino, permissao)
+}
+
+// Lê um arquivo JSON (com ou sem envelope) no destino; se estiver corrompido, usa o .bak
+// Um arquivo inexistente retorna erro com fs.ErrNotExist, mesmo que exista o .bak
+func LerJSON(caminho string, destino interface{}) error {
+	erro := decodificarArquivo(caminho, destino)
+	if erro == nil || errors.Is(erro, fs.ErrNotExist) {
+		return erro
+	}
+	if erroBak := decodificarArquivo(caminho+".bak", destino); erroBak != nil {
+		Log.Error("arquivo corrompido e sem cópia anterior válida", "arquivo", caminho, "erro", erro, "erro_bak", erroBak)
+		return erro
+	}
+	Log.Warn("arquivo corrompido; usando a cópia anterior", "arquivo", caminho, "erro", erro)
+	return nil
+}
+
+func decodificarArquivo(caminho string, destino interface{}) error {
+	bruto, erro := os.ReadFile(caminho)
+	if erro != nil {
+		return erro
+	}
+	var registro registroArquivo
+	if json.Unmarshal(bruto, &registro) == nil && registro.Formato > 0 && registro.SHA256 != "" {
+		// O checksum é do JSON compacto; o arquivo é gravado indentado
+		var dados bytes.Buffer
+		if erro := json.Compact(&dados, registro.Dados); erro != nil {
+			return fmt.Errorf("%s: %v", caminho, erro)
+		}
+		soma := sha256.Sum256(dados.Bytes())
+		if hex.EncodeToString(soma[:]) != registro.SHA256 {
+			return fmt.Errorf("%s: %w", caminho, ErrChecksum)
+		}
+		return json.Unmarshal(dados.Bytes(), destino)
+	}
+	// Arquivo sem envelope (versões antigas)
+	if !json.Valid(bruto) {
+		return fmt.Errorf("%s: JSON inválido", caminho)
+	}
+	return json.Unmarshal(bruto, destino)
+}
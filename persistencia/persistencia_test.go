@@ -0,0 +1,209 @@
+package persistencia
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type estadoTeste struct {
+	Nome  string `json:"nome"`
+	Valor int    `json:"valor"`
+}
+
+func TestGravarArquivo(t *testing.T) {
+	caminho := filepath.Join(t.TempDir(), "config.json")
+	if erro := GravarArquivo(caminho, []byte(`{"a":1}`), 0600); erro != nil {
+		t.Fatal(erro)
+	}
+	if erro := GravarArquivo(caminho, []byte(`{"a":2}`), 0600); erro != nil {
+		t.Fatal(erro)
+	}
+	lido, erro := os.ReadFile(caminho)
+	if erro != nil {
+		t.Fatal(erro)
+	}
+	if string(lido) != `{"a":2}` {
+		t.Errorf("conteúdo %q, esperado %q", lido, `{"a":2}`)
+	}
+	info, erro := os.Stat(caminho)
+	if erro != nil {
+		t.Fatal(erro)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("permissão %v, esperada 0600", info.Mode().Perm())
+	}
+	// Sem envelope e sem .bak; nenhum temporário fica para trás
+	entradas, _ := os.ReadDir(filepath.Dir(caminho))
+	if len(entradas) != 1 {
+		t.Errorf("arquivos no diretório: %v", entradas)
+	}
+}
+
+func TestGravarRegistroELerJSON(t *testing.T) {
+	caminho := filepath.Join(t.TempDir(), "estado.json")
+	if erro := GravarRegistro(caminho, []byte(`{"nome":"primeiro","valor":1}`), 0644); erro != nil {
+		t.Fatal(erro)
+	}
+	if _, erro := os.Stat(caminho + ".bak"); !errors.Is(erro, fs.ErrNotExist) {
+		t.Errorf("primeira gravação criou .bak: %v", erro)
+	}
+	if erro := GravarJSON(caminho, estadoTeste{"segundo", 2}, 0644); erro != nil {
+		t.Fatal(erro)
+	}
+
+	var lido estadoTeste
+	if erro := LerJSON(caminho, &lido); erro != nil {
+		t.Fatal(erro)
+	}
+	if lido != (estadoTeste{"segundo", 2}) {
+		t.Errorf("lido %+v", lido)
+	}
+	var anterior estadoTeste
+	if erro := decodificarArquivo(caminho+".bak", &anterior); erro != nil || anterior != (estadoTeste{"primeiro", 1}) {
+		t.Errorf(".bak com %+v (erro %v), esperada a versão anterior", anterior, erro)
+	}
+	entradas, _ := os.ReadDir(filepath.Dir(caminho))
+	if len(entradas) != 2 {
+		t.Errorf("arquivos no diretório: %v", entradas)
+	}
+}
+
+func TestLerJSONChecksum(t *testing.T) {
+	caminho := filepath.Join(t.TempDir(), "estado.json")
+	if erro := GravarJSON(caminho, estadoTeste{"original", 7}, 0644); erro != nil {
+		t.Fatal(erro)
+	}
+	bruto, _ := os.ReadFile(caminho)
+	// JSON válido, mas com os dados alterados: só o checksum denuncia
+	alterado := bytes.Replace(bruto, []byte(`"original"`), []byte(`"alterado"`), 1)
+	if bytes.Equal(alterado, bruto) {
+		t.Fatalf("dados não encontrados no arquivo: %s", bruto)
+	}
+	if erro := os.WriteFile(caminho, alterado, 0644); erro != nil {
+		t.Fatal(erro)
+	}
+	var lido estadoTeste
+	if erro := decodificarArquivo(caminho, &lido); !errors.Is(erro, ErrChecksum) {
+		t.Errorf("erro %v, esperado ErrChecksum", erro)
+	}
+	// Sem .bak, LerJSON devolve o erro do arquivo
+	if erro := LerJSON(caminho, &lido); !errors.Is(erro, ErrChecksum) {
+		t.Errorf("LerJSON sem .bak retornou %v, esperado ErrChecksum", erro)
+	}
+}
+
+func TestLerJSONUsaBakComArquivoTruncado(t *testing.T) {
+	caminho := filepath.Join(t.TempDir(), "estado.json")
+	if erro := GravarJSON(caminho, estadoTeste{"anterior", 1}, 0644); erro != nil {
+		t.Fatal(erro)
+	}
+	if erro := GravarJSON(caminho, estadoTeste{"atual", 2}, 0644); erro != nil {
+		t.Fatal(erro)
+	}
+	bruto, _ := os.ReadFile(caminho)
+	if erro := os.WriteFile(caminho, bruto[:len(bruto)/2], 0644); erro != nil {
+		t.Fatal(erro)
+	}
+	var lido estadoTeste
+	if erro := LerJSON(caminho, &lido); erro != nil {
+		t.Fatal(erro)
+	}
+	if lido != (estadoTeste{"anterior", 1}) {
+		t.Errorf("lido %+v, esperada a versão do .bak", lido)
+	}
+}
+
+func TestLerJSONSemEnvelopeEInexistente(t *testing.T) {
+	diretorio := t.TempDir()
+	antigo := filepath.Join(diretorio, "antigo.json")
+	if erro := os.WriteFile(antigo, []byte(`{"nome":"antigo","valor":3}`), 0644); erro != nil {
+		t.Fatal(erro)
+	}
+	var lido estadoTeste
+	if erro := LerJSON(antigo, &lido); erro != nil || lido != (estadoTeste{"antigo", 3}) {
+		t.Errorf("arquivo sem envelope lido como %+v (erro %v)", lido, erro)
+	}
+
+	// Um arquivo inexistente é fs.ErrNotExist mesmo com .bak
+	ausente := filepath.Join(diretorio, "ausente.json")
+	if erro := os.WriteFile(ausente+".bak", []byte(`{}`), 0644); erro != nil {
+		t.Fatal(erro)
+	}
+	if erro := LerJSON(ausente, &lido); !errors.Is(erro, fs.ErrNotExist) {
+		t.Errorf("erro %v, esperado fs.ErrNotExist", erro)
+	}
+}
+
+func TestAtualizarJSON(t *testing.T) {
+	caminho := filepath.Join(t.TempDir(), "contador.json")
+	incrementar := func() error {
+		var estado estadoTeste
+		return AtualizarJSON(caminho, &estado, 0644, func() bool {
+			estado.Valor++
+			return true
+		})
+	}
+	// Arquivo inexistente é lido como o valor zero
+	for i := 0; i < 3; i++ {
+		if erro := incrementar(); erro != nil {
+			t.Fatal(erro)
+		}
+	}
+	var lido estadoTeste
+	if erro := LerJSON(caminho, &lido); erro != nil || lido.Valor != 3 {
+		t.Fatalf("valor %d (erro %v), esperado 3", lido.Valor, erro)
+	}
+
+	// Atualizações simultâneas não se perdem
+	var grupo sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		grupo.Add(1)
+		go func() {
+			defer grupo.Done()
+			for i := 0; i < 5; i++ {
+				if erro := incrementar(); erro != nil {
+					t.Error(erro)
+				}
+			}
+		}()
+	}
+	grupo.Wait()
+	if erro := LerJSON(caminho, &lido); erro != nil || lido.Valor != 43 {
+		t.Fatalf("valor %d (erro %v) depois das atualizações simultâneas, esperado 43", lido.Valor, erro)
+	}
+
+	// alterar retornando false não grava
+	var estado estadoTeste
+	if erro := AtualizarJSON(caminho, &estado, 0644, func() bool {
+		estado.Valor = 100
+		return false
+	}); erro != nil {
+		t.Fatal(erro)
+	}
+	if erro := LerJSON(caminho, &lido); erro != nil || lido.Valor != 43 {
+		t.Errorf("valor %d (erro %v) depois de alterar sem gravar, esperado 43", lido.Valor, erro)
+	}
+
+	// Arquivo corrompido sem cópia válida: nada é gravado e o erro volta
+	if erro := os.WriteFile(caminho, []byte("{corrompido"), 0644); erro != nil {
+		t.Fatal(erro)
+	}
+	if erro := os.WriteFile(caminho+".bak", []byte("{corrompido"), 0644); erro != nil {
+		t.Fatal(erro)
+	}
+	chamado := false
+	if erro := AtualizarJSON(caminho, &estado, 0644, func() bool {
+		chamado = true
+		return true
+	}); erro == nil || chamado {
+		t.Errorf("AtualizarJSON com arquivo corrompido retornou %v e chamou alterar: %v", erro, chamado)
+	}
+	if bruto, _ := os.ReadFile(caminho); string(bruto) != "{corrompido" {
+		t.Errorf("arquivo corrompido regravado: %q", bruto)
+	}
+}
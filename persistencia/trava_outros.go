@@ -0,0 +1,24 @@
+//go:build !unix
+
+package persistencia
+
+import "sync"
+
+// Fora de sistemas unix não há lock entre processos: o lock só serializa as gravações deste
+// processo, e o diretório não recebe fsync
+type Trava struct{}
+
+var travaProcesso sync.Mutex
+
+func Travar(caminho string) (*Trava, error) {
+	travaProcesso.Lock()
+	return &Trava{}, nil
+}
+
+func (t *Trava) Destravar() {
+	travaProcesso.Unlock()
+}
+
+func sincronizarDiretorio(caminho string) error {
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build unix
+
+package persistencia
+
+import (
+	"os"
+	"syscall"
+)
+
+// Lock advisory (flock) em <arquivo>.lock, compartilhado pelos processos que usam o mesmo data/
+// O lock fica num arquivo à parte porque o rename da gravação troca o inode do arquivo de dados
+type Trava struct {
+	arquivo *os.File
+}
+
+// Espera o lock exclusivo do arquivo
+func Travar(caminho string) (*Trava, error) {
+	arquivo, erro := os.OpenFile(caminho+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if erro != nil {
+		return nil, erro
+	}
+	for {
+		erro = syscall.Flock(int(arquivo.Fd()), syscall.LOCK_EX)
+		if erro != syscall.EINTR {
+			break
+		}
+	}
+	if erro != nil {
+		arquivo.Close()
+		return nil, erro
+	}
+	return &Trava{arquivo: arquivo}, nil
+}
+
+func (t *Trava) Destravar() {
+	syscall.Flock(int(t.arquivo.Fd()), syscall.LOCK_UN)
+	t.arquivo.Close()
+}
+
+// fsync do diretório, para que o rename sobreviva a uma queda do sistema
+func sincronizarDiretorio(caminho string) error {
+	diretorio, erro := os.Open(caminho)
+	if erro != nil {
+		return erro
+	}
+	defer diretorio.Close()
+	return diretorio.Sync()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// API REST do veículo
+// Endpoints JSON sobre a camada de serviço (servico.go):
+//   POST /api/login {placa}                 login ou cadastro; conecta ao MQTT
+//   POST /api/logout                        encerra a sessão do veículo
+//   GET  /api/veiculo                       estado do veículo conectado
+//   GET  /api/cidades                       pontos de recarga atendidos
+//   POST /api/viagens/planejar {origem, destino}
+//   POST /api/viagens {origem, destino, pagar}
+//   GET  /api/viagens                       viagens registradas
+//   POST /api/reservas {pontos}             reserva atômica (todos ou nenhum)
+//   POST /api/reservas/cancelar {pontos}
+//   POST /api/recargas {ponto, hash_reserva}
+//   GET  /api/recargas/pendentes
+//   POST /api/pagamentos                    paga todas as recargas pendentes
+//   GET  /api/extrato
+//   GET  /api/historico
+//   GET  /api/verificar?hash=<hash>
+// Erros respondem {"status": "error", "message": ...}.
+
+type LoginRequest struct {
+	Placa string `json:"placa"`
+}
+
+type ViagemRequest struct {
+	Origem  string `json:"origem"`
+	Destino string `json:"destino"`
+	Pagar   bool   `json:"pagar,omitempty"`
+}
+
+type PontosRequest struct {
+	Pontos []string `json:"pontos"`
+}
+
+type RecargaRequest struct {
+	Ponto       string `json:"ponto"`
+	HashReserva string `json:"hash_reserva"`
+}
+
+// Sobe a API do veículo no endereço informado e retorna o endereço efetivo
+func iniciarServicoVeiculo(endereco string) (string, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/login", apenasMetodo(http.MethodPost, handleLogin))
+	mux.HandleFunc("/api/logout", apenasMetodo(http.MethodPost, handleLogout))
+	mux.HandleFunc("/api/veiculo", apenasMetodo(http.MethodGet, handleEstadoVeiculo))
+	mux.HandleFunc("/api/cidades", apenasMetodo(http.MethodGet, handleCidades))
+	mux.HandleFunc("/api/viagens/planejar", apenasMetodo(http.MethodPost, handlePlanejarViagem))
+	mux.HandleFunc("/api/viagens", handleViagens)
+	mux.HandleFunc("/api/reservas", apenasMetodo(http.MethodPost, handleReservar))
+	mux.HandleFunc("/api/reservas/cancelar", apenasMetodo(http.MethodPost, handleCancelarReservas))
+	mux.HandleFunc("/api/recargas", apenasMetodo(http.MethodPost, handleRecarregar))
+	mux.HandleFunc("/api/recargas/pendentes", apenasMetodo(http.MethodGet, handleRecargasPendentes))
+	mux.HandleFunc("/api/pagamentos", apenasMetodo(http.MethodPost, handlePagar))
+	mux.HandleFunc("/api/extrato", apenasMetodo(http.MethodGet, handleExtrato))
+	mux.HandleFunc("/api/historico", apenasMetodo(http.MethodGet, handleHistorico))
+	mux.HandleFunc("/api/verificar", apenasMetodo(http.MethodGet, handleVerificar))
+
+	listener, erro := net.Listen("tcp", endereco)
+	if erro != nil {
+		return "", erro
+	}
+	go http.Serve(listener, mux)
+	return listener.Addr().String(), nil
+}
+
+// Recusa outros métodos com 405
+func apenasMetodo(metodo string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != metodo {
+			http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func responderJSON(w http.ResponseWriter, status int, dados interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(dados)
+}
+
+// Converte os erros da camada de serviço em status HTTP
+func responderErro(w http.ResponseWriter, erro error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(erro, errEntradaInvalida):
+		status = http.StatusBadRequest
+	case errors.Is(erro, errSemVeiculo):
+		status = http.StatusUnauthorized
+	case errors.Is(erro, errHashNaoEncontrado):
+		status = http.StatusNotFound
+	case errors.Is(erro, errPlacaEmUso), errors.Is(erro, errOperacaoEmAndamento), errors.Is(erro, errReservaFalhou):
+		status = http.StatusConflict
+	}
+	responderJSON(w, status, map[string]string{"status": "error", "message": erro.Error()})
+}
+
+// Decodifica o corpo JSON; responde 400 em caso de erro
+func lerCorpo(w http.ResponseWriter, r *http.Request, destino interface{}) bool {
+	if erro := json.NewDecoder(r.Body).Decode(destino); erro != nil {
+		responderJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "JSON inválido"})
+		return false
+	}
+	return true
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if !lerCorpo(w, r, &req) {
+		return
+	}
+	estado, erro := entrarVeiculo(req.Placa)
+	if erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	responderJSON(w, http.StatusOK, estado)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if erro := sairVeiculo(); erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	responderJSON(w, http.StatusOK, map[string]string{"status": "success"})
+}
+
+func handleEstadoVeiculo(w http.ResponseWriter, r *http.Request) {
+	estado, erro := estadoVeiculo()
+	if erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	responderJSON(w, http.StatusOK, estado)
+}
+
+func handleCidades(w http.ResponseWriter, r *http.Request) {
+	responderJSON(w, http.StatusOK, pontosDeRecarga)
+}
+
+func handlePlanejarViagem(w http.ResponseWriter, r *http.Request) {
+	var req ViagemRequest
+	if !lerCorpo(w, r, &req) {
+		return
+	}
+	plano, erro := planejarViagem(req.Origem, req.Destino)
+	if erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	responderJSON(w, http.StatusOK, plano)
+}
+
+// GET lista as viagens registradas; POST executa uma viagem (responde ao final dela)
+func handleViagens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		veiculo, erro := historicoViagens()
+		if erro != nil {
+			responderErro(w, erro)
+			return
+		}
+		responderJSON(w, http.StatusOK, veiculo)
+	case http.MethodPost:
+		var req ViagemRequest
+		if !lerCorpo(w, r, &req) {
+			return
+		}
+		resultado, erro := realizarViagem(req.Origem, req.Destino, req.Pagar)
+		if erro != nil {
+			if resultado.Status != "" {
+				// Viagem planejada, mas não realizada: devolve o plano junto com o erro
+				responderJSON(w, http.StatusConflict, map[string]interface{}{"status": "error", "message": erro.Error(), "viagem": resultado})
+				return
+			}
+			responderErro(w, erro)
+			return
+		}
+		responderJSON(w, http.StatusOK, resultado)
+	default:
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleReservar(w http.ResponseWriter, r *http.Request) {
+	var req PontosRequest
+	if !lerCorpo(w, r, &req) {
+		return
+	}
+	reservas, erro := reservarPontos(req.Pontos)
+	if erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	responderJSON(w, http.StatusOK, map[string]interface{}{"reservas": reservas})
+}
+
+func handleCancelarReservas(w http.ResponseWriter, r *http.Request) {
+	var req PontosRequest
+	if !lerCorpo(w, r, &req) {
+		return
+	}
+	if erro := cancelarReservas(req.Pontos); erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	responderJSON(w, http.StatusOK, map[string]string{"status": "success"})
+}
+
+func handleRecarregar(w http.ResponseWriter, r *http.Request) {
+	var req RecargaRequest
+	if !lerCorpo(w, r, &req) {
+		return
+	}
+	recarga, erro := recarregarNoPonto(req.Ponto, req.HashReserva)
+	if erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	responderJSON(w, http.StatusOK, recarga)
+}
+
+func handleRecargasPendentes(w http.ResponseWriter, r *http.Request) {
+	placa, _, erro := veiculoAtual()
+	if erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	pendentes, blockchain := listarRecargasPendentes(placa)
+	if pendentes == nil {
+		pendentes = []RecargaInfo{}
+	}
+	responderJSON(w, http.StatusOK, map[string]interface{}{"recargas": pendentes, "blockchain": blockchain})
+}
+
+func handlePagar(w http.ResponseWriter, r *http.Request) {
+	resultado, erro := pagarRecargasPendentes()
+	if erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	responderJSON(w, http.StatusOK, resultado)
+}
+
+func handleExtrato(w http.ResponseWriter, r *http.Request) {
+	extrato, erro := extratoVeiculo()
+	if erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	responderJSON(w, http.StatusOK, extrato)
+}
+
+func handleHistorico(w http.ResponseWriter, r *http.Request) {
+	historico, erro := historicoCompleto()
+	if erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	responderJSON(w, http.StatusOK, historico)
+}
+
+func handleVerificar(w http.ResponseWriter, r *http.Request) {
+	encontrado, erro := buscarHash(r.URL.Query().Get("hash"))
+	if erro != nil {
+		responderErro(w, erro)
+		return
+	}
+	responderJSON(w, http.StatusOK, encontrado)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Teste de carga das reservas de uma empresa:
+//   veiculo carga --empresa 001 [--duracao 30s] [--concorrencia N] [--token T] [--json]
+// Cada trabalhador fica com um ponto da empresa e repete: reserva o ponto (POST /reserva) com
+// uma placa nova e o libera pela ação de operador (POST /painel/acoes/liberar, que exige o
+// OPERADOR_TOKEN da empresa). Assim cada ciclo grava exatamente um bloco RESERVA e os
+// trabalhadores não disputam pontos. Os limites por placa e por IP da empresa
+// (data/limites_<id>.json) precisam comportar a taxa medida; recusas 429 são contadas à parte.
+
+type ResultadoCarga struct {
+	Empresa          string         `json:"empresa"`
+	Concorrencia     int            `json:"concorrencia"`
+	DuracaoSegundos  float64        `json:"duracao_segundos"`
+	Reservas         int            `json:"reservas"`
+	ReservasSegundo  float64        `json:"reservas_por_segundo"`
+	LatenciaMediaMs  float64        `json:"latencia_media_ms"`
+	LatenciaP50Ms    float64        `json:"latencia_p50_ms"`
+	LatenciaP95Ms    float64        `json:"latencia_p95_ms"`
+	LatenciaP99Ms    float64        `json:"latencia_p99_ms"`
+	Recusas          map[string]int `json:"recusas"` // status HTTP (ou "erro") das reservas e liberações que falharam
+	LiberacoesFalhas int            `json:"liberacoes_falhas"`
+}
+
+var clienteCarga = &http.Client{Timeout: 30 * time.Second}
+
+// Estado compartilhado pelos trabalhadores da carga
+type medicaoCarga struct {
+	sync.Mutex
+	latencias        []time.Duration
+	recusas          map[string]int
+	liberacoesFalhas int
+}
+
+func (m *medicaoCarga) recusa(motivo string) {
+	m.Lock()
+	m.recusas[motivo]++
+	m.Unlock()
+}
+
+func comandoCarga(args []string) int {
+	fs := novoFlagSet("carga")
+	empresaID := fs.String("empresa", "", "empresa alvo (ID em EMPRESAS_API)")
+	duracao := fs.Duration("duracao", 30*time.Second, "duração da medição")
+	concorrencia := fs.Int("concorrencia", 0, "reservas simultâneas (padrão e máximo: um por ponto da empresa)")
+	token := fs.String("token", os.Getenv("OPERADOR_TOKEN"), "token de operador da empresa, para liberar os pontos")
+	comoJSON := fs.Bool("json", false, "resultado em JSON")
+	posicionais, codigo, ok := analisarArgumentos(fs, args)
+	if !ok {
+		return codigo
+	}
+	if len(posicionais) > 0 {
+		return erroUso(fs, "argumento inesperado: "+posicionais[0])
+	}
+	api, existe := empresasAPI[*empresaID]
+	if !existe {
+		return erroUso(fs, "informe --empresa com um ID de EMPRESAS_API")
+	}
+	if *token == "" {
+		return erroUso(fs, "informe --token ou OPERADOR_TOKEN: os pontos são liberados pela ação de operador")
+	}
+	if *duracao <= 0 || *concorrencia < 0 {
+		return erroUso(fs, "--duracao e --concorrencia devem ser positivos")
+	}
+
+	execucao := iniciarExecucao(*comoJSON)
+	pontos, erro := pontosDaEmpresaCarga(api)
+	if erro != nil {
+		return execucao.falha(erro, nil)
+	}
+	if len(pontos) == 0 {
+		return execucao.falha(fmt.Errorf("empresa %s sem pontos", *empresaID), nil)
+	}
+	trabalhadores := len(pontos)
+	if *concorrencia > 0 && *concorrencia < trabalhadores {
+		trabalhadores = *concorrencia
+	}
+
+	fmt.Printf("🔧 Carga em %s: %d pontos simultâneos por %s\n", *empresaID, trabalhadores, *duracao)
+	medicao := &medicaoCarga{recusas: make(map[string]int)}
+	inicio := time.Now()
+	fim := inicio.Add(*duracao)
+	var grupo sync.WaitGroup
+	for i := 0; i < trabalhadores; i++ {
+		grupo.Add(1)
+		go func(trabalhador int, ponto string) {
+			defer grupo.Done()
+			for n := 0; time.Now().Before(fim); n++ {
+				ciclarReservaCarga(api, *token, *empresaID, ponto, fmt.Sprintf("CG%02d%06d", trabalhador, n), medicao)
+			}
+		}(i, pontos[i])
+	}
+	grupo.Wait()
+	decorrido := time.Since(inicio)
+
+	resultado := resumirCarga(medicao, decorrido)
+	resultado.Empresa = *empresaID
+	resultado.Concorrencia = trabalhadores
+	if !execucao.json {
+		exibirCarga(resultado)
+	}
+	execucao.resultado(resultado)
+	if resultado.Reservas == 0 {
+		return saidaFalha
+	}
+	return saidaSucesso
+}
+
+// Pontos da empresa, em ordem alfabética
+func pontosDaEmpresaCarga(api string) ([]string, error) {
+	resp, erro := clienteCarga.Get(api + "/api/pontos/status")
+	if erro != nil {
+		return nil, fmt.Errorf("empresa indisponível: %v", erro)
+	}
+	defer resp.Body.Close()
+	var status struct {
+		Pontos map[string]bool `json:"pontos"`
+	}
+	if erro := json.NewDecoder(resp.Body).Decode(&status); erro != nil {
+		return nil, fmt.Errorf("resposta inválida de /api/pontos/status: %v", erro)
+	}
+	var pontos []string
+	for ponto := range status.Pontos {
+		pontos = append(pontos, ponto)
+	}
+	sort.Strings(pontos)
+	return pontos, nil
+}
+
+// Um ciclo: reserva o ponto e, se conseguiu, libera pela ação de operador
+func ciclarReservaCarga(api, token, empresaID, ponto, placa string, medicao *medicaoCarga) {
+	corpo, _ := json.Marshal(Transacao{Tipo: "RESERVA", Placa: placa, Ponto: ponto, Empresa: empresaID})
+	inicio := time.Now()
+	req, _ := http.NewRequest(http.MethodPost, api+"/reserva", bytes.NewReader(corpo))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(cabecalhoRequisicao, novaRequisicaoID())
+	resp, erro := clienteCarga.Do(req)
+	if erro != nil {
+		medicao.recusa("erro")
+		time.Sleep(100 * time.Millisecond)
+		return
+	}
+	resp.Body.Close()
+	latencia := time.Since(inicio)
+	if resp.StatusCode != http.StatusCreated {
+		medicao.recusa(fmt.Sprint(resp.StatusCode))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			time.Sleep(time.Second)
+		}
+		return
+	}
+	medicao.Lock()
+	medicao.latencias = append(medicao.latencias, latencia)
+	medicao.Unlock()
+
+	corpo, _ = json.Marshal(map[string]string{"ponto": ponto, "motivo": "teste de carga"})
+	req, _ = http.NewRequest(http.MethodPost, api+"/painel/acoes/liberar", bytes.NewReader(corpo))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, erro = clienteCarga.Do(req)
+	if erro == nil {
+		resp.Body.Close()
+	}
+	if erro != nil || resp.StatusCode != http.StatusOK {
+		medicao.Lock()
+		medicao.liberacoesFalhas++
+		medicao.Unlock()
+	}
+}
+
+func resumirCarga(medicao *medicaoCarga, decorrido time.Duration) ResultadoCarga {
+	latencias := medicao.latencias
+	sort.Slice(latencias, func(i, j int) bool { return latencias[i] < latencias[j] })
+	resultado := ResultadoCarga{
+		DuracaoSegundos:  decorrido.Seconds(),
+		Reservas:         len(latencias),
+		ReservasSegundo:  float64(len(latencias)) / decorrido.Seconds(),
+		Recusas:          medicao.recusas,
+		LiberacoesFalhas: medicao.liberacoesFalhas,
+	}
+	if len(latencias) == 0 {
+		return resultado
+	}
+	var soma time.Duration
+	for _, latencia := range latencias {
+		soma += latencia
+	}
+	milissegundos := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	percentil := func(p float64) float64 { return milissegundos(latencias[int(p*float64(len(latencias)-1))]) }
+	resultado.LatenciaMediaMs = milissegundos(soma / time.Duration(len(latencias)))
+	resultado.LatenciaP50Ms = percentil(0.50)
+	resultado.LatenciaP95Ms = percentil(0.95)
+	resultado.LatenciaP99Ms = percentil(0.99)
+	return resultado
+}
+
+func exibirCarga(resultado ResultadoCarga) {
+	fmt.Printf("✅ %d reservas em %.1f s: %.1f reservas/s\n", resultado.Reservas, resultado.DuracaoSegundos, resultado.ReservasSegundo)
+	fmt.Printf("   Latência: média %.1f ms, p50 %.1f ms, p95 %.1f ms, p99 %.1f ms\n",
+		resultado.LatenciaMediaMs, resultado.LatenciaP50Ms, resultado.LatenciaP95Ms, resultado.LatenciaP99Ms)
+	for motivo, total := range resultado.Recusas {
+		fmt.Printf("   Recusas %s: %d\n", motivo, total)
+	}
+	if resultado.LiberacoesFalhas > 0 {
+		fmt.Printf("   ⚠️  %d pontos não foram liberados\n", resultado.LiberacoesFalhas)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Cliente da API do veículo, usado pelo menu interativo e pelos comandos de linha de comando
+
+// URL base do serviço do veículo
+var urlServicoVeiculo string
+
+// API subiu neste processo (sem VEICULO_API): a sessão do veículo termina com ele
+var servicoLocal bool
+
+// Sem timeout: a resposta de uma viagem só chega depois de todas as recargas
+var clienteServicoVeiculo = &http.Client{}
+
+// Usa o serviço em VEICULO_API ou sobe a API neste processo, apenas na interface local
+func conectarServicoVeiculo() error {
+	if api := os.Getenv("VEICULO_API"); api != "" {
+		urlServicoVeiculo = strings.TrimSuffix(api, "/")
+		return nil
+	}
+	endereco, erro := iniciarServicoVeiculo("127.0.0.1:0")
+	if erro != nil {
+		return fmt.Errorf("erro ao iniciar o serviço do veículo: %v", erro)
+	}
+	urlServicoVeiculo = "http://" + endereco
+	servicoLocal = true
+	configurarTratamentoSinais()
+	return nil
+}
+
+// Resposta de erro do serviço do veículo, com o status HTTP
+type ErroServico struct {
+	Status   int
+	Mensagem string
+}
+
+func (e *ErroServico) Error() string {
+	return e.Mensagem
+}
+
+// Chama a API do veículo; respostas de erro viram *ErroServico com a mensagem do serviço
+func chamarServicoVeiculo(metodo, caminho string, corpo, resposta interface{}) error {
+	var leitor *bytes.Reader
+	if corpo != nil {
+		dados, erro := json.Marshal(corpo)
+		if erro != nil {
+			return erro
+		}
+		leitor = bytes.NewReader(dados)
+	} else {
+		leitor = bytes.NewReader(nil)
+	}
+	req, erro := http.NewRequest(metodo, urlServicoVeiculo+caminho, leitor)
+	if erro != nil {
+		return erro
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, erro := clienteServicoVeiculo.Do(req)
+	if erro != nil {
+		return fmt.Errorf("serviço do veículo indisponível: %v", erro)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var falha struct {
+			Message string          `json:"message"`
+			Viagem  json.RawMessage `json:"viagem"`
+		}
+		json.NewDecoder(resp.Body).Decode(&falha)
+		// Viagem não realizada: o resultado parcial acompanha o erro
+		if len(falha.Viagem) > 0 && resposta != nil {
+			json.Unmarshal(falha.Viagem, resposta)
+		}
+		if falha.Message == "" {
+			falha.Message = resp.Status
+		}
+		return &ErroServico{Status: resp.StatusCode, Mensagem: falha.Message}
+	}
+	if resposta == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(resposta)
+}
+
+func apiEntrar(placa string) (EstadoVeiculo, error) {
+	var estado EstadoVeiculo
+	erro := chamarServicoVeiculo(http.MethodPost, "/api/login", LoginRequest{Placa: placa}, &estado)
+	return estado, erro
+}
+
+func apiSair() error {
+	return chamarServicoVeiculo(http.MethodPost, "/api/logout", nil, nil)
+}
+
+func apiPlanejarViagem(origem, destino string) (PlanoViagem, error) {
+	var plano PlanoViagem
+	erro := chamarServicoVeiculo(http.MethodPost, "/api/viagens/planejar", ViagemRequest{Origem: origem, Destino: destino}, &plano)
+	return plano, erro
+}
+
+func apiRealizarViagem(origem, destino string, pagar bool) (ResultadoViagem, error) {
+	var resultado ResultadoViagem
+	erro := chamarServicoVeiculo(http.MethodPost, "/api/viagens", ViagemRequest{Origem: origem, Destino: destino, Pagar: pagar}, &resultado)
+	return resultado, erro
+}
+
+func apiViagens() (VeiculoCompleto, error) {
+	var veiculo VeiculoCompleto
+	erro := chamarServicoVeiculo(http.MethodGet, "/api/viagens", nil, &veiculo)
+	return veiculo, erro
+}
+
+func apiRecargasPendentes() ([]RecargaInfo, error) {
+	var resposta struct {
+		Recargas []RecargaInfo `json:"recargas"`
+	}
+	erro := chamarServicoVeiculo(http.MethodGet, "/api/recargas/pendentes", nil, &resposta)
+	return resposta.Recargas, erro
+}
+
+func apiPagar() (ResultadoPagamento, error) {
+	var resultado ResultadoPagamento
+	erro := chamarServicoVeiculo(http.MethodPost, "/api/pagamentos", nil, &resultado)
+	return resultado, erro
+}
+
+func apiExtrato() ([]Bloco, error) {
+	var extrato []Bloco
+	erro := chamarServicoVeiculo(http.MethodGet, "/api/extrato", nil, &extrato)
+	return extrato, erro
+}
+
+func apiHistorico() (HistoricoVeiculo, error) {
+	var historico HistoricoVeiculo
+	erro := chamarServicoVeiculo(http.MethodGet, "/api/historico", nil, &historico)
+	return historico, erro
+}
+
+func apiVerificarHash(hash string) (HashEncontrado, error) {
+	var encontrado HashEncontrado
+	erro := chamarServicoVeiculo(http.MethodGet, "/api/verificar?hash="+url.QueryEscape(hash), nil, &encontrado)
+	return encontrado, erro
+}
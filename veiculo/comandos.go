@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Comandos de execução única, para testes e automação:
+//   veiculo viagem --placa X --origem Salvador --destino Natal [--sim] [--pagar] [--json]
+//   veiculo pagar --placa X [--json]
+//   veiculo extrato --placa X [--json]
+//   veiculo verificar <hash> [--json]
+//   veiculo carga --empresa 001 [--duracao 30s] [--concorrencia N] [--token T] [--json]  (carga.go)
+// Nenhum comando lê a entrada padrão: sem --sim, uma viagem com recargas só exibe o plano.
+// Com --json, o resultado vai para a saída padrão e o progresso para a saída de erros.
+// Usam o serviço em VEICULO_API ou sobem a API neste processo, como o menu.
+
+// Códigos de saída dos comandos
+const (
+	saidaSucesso       = 0
+	saidaFalha         = 1
+	saidaUso           = 2 // argumentos ou entrada inválidos
+	saidaNaoEncontrado = 3 // hash não encontrado
+	saidaConflito      = 4 // placa em uso, operação em andamento ou reserva não concluída
+)
+
+var comandosVeiculo = map[string]func(args []string) int{
+	"viagem":    comandoViagem,
+	"pagar":     comandoPagar,
+	"extrato":   comandoExtrato,
+	"verificar": comandoVerificar,
+	"carga":     comandoCarga,
+}
+
+func usoComandos() {
+	fmt.Fprintln(os.Stderr, "Uso:")
+	fmt.Fprintln(os.Stderr, "  veiculo                      menu interativo")
+	fmt.Fprintln(os.Stderr, "  veiculo servico              API do veículo em VEICULO_ENDERECO")
+	fmt.Fprintln(os.Stderr, "  veiculo viagem --placa X --origem Salvador --destino Natal [--sim] [--pagar] [--json]")
+	fmt.Fprintln(os.Stderr, "  veiculo pagar --placa X [--json]")
+	fmt.Fprintln(os.Stderr, "  veiculo extrato --placa X [--json]")
+	fmt.Fprintln(os.Stderr, "  veiculo verificar <hash> [--json]")
+	fmt.Fprintln(os.Stderr, "  veiculo carga --empresa 001 [--duracao 30s] [--concorrencia N] [--token T] [--json]")
+}
+
+// Execução de um comando: formato da saída e destino do resultado
+type execucaoComando struct {
+	json  bool
+	saida *os.File // saída padrão original; com --json, os.Stdout passa a ser a saída de erros
+}
+
+func novoFlagSet(nome string) *flag.FlagSet {
+	fs := flag.NewFlagSet(nome, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+// Analisa as flags aceitando argumentos posicionais em qualquer posição
+func analisarArgumentos(fs *flag.FlagSet, args []string) ([]string, int, bool) {
+	var posicionais []string
+	for {
+		if erro := fs.Parse(args); erro != nil {
+			if errors.Is(erro, flag.ErrHelp) {
+				return nil, saidaSucesso, false
+			}
+			return nil, saidaUso, false
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return posicionais, 0, true
+		}
+		posicionais = append(posicionais, args[0])
+		args = args[1:]
+	}
+}
+
+func erroUso(fs *flag.FlagSet, mensagem string) int {
+	fmt.Fprintf(os.Stderr, "%s\n", mensagem)
+	fs.Usage()
+	return saidaUso
+}
+
+// Com --json, redireciona o progresso (fmt.Print*) para a saída de erros
+func iniciarExecucao(comoJSON bool) execucaoComando {
+	execucao := execucaoComando{json: comoJSON, saida: os.Stdout}
+	if comoJSON {
+		os.Stdout = os.Stderr
+	}
+	return execucao
+}
+
+// Conecta ao serviço do veículo e entra com a placa
+func entrarComando(placa string) error {
+	if erro := conectarServicoVeiculo(); erro != nil {
+		return erro
+	}
+	estado, erro := apiEntrar(placa)
+	if erro != nil {
+		return erro
+	}
+	fmt.Printf("🚗 Veículo %s conectado\n", estado.Placa)
+	return nil
+}
+
+// Encerra a sessão apenas quando a API subiu neste processo; a de VEICULO_API continua com o veículo
+func encerrarComando() {
+	if !servicoLocal {
+		return
+	}
+	if erro := apiSair(); erro != nil {
+		fmt.Printf("⚠️  Aviso: %v\n", erro)
+	}
+}
+
+// Código de saída correspondente ao status HTTP do erro do serviço
+func codigoSaida(erro error) int {
+	var erroServico *ErroServico
+	if !errors.As(erro, &erroServico) {
+		return saidaFalha
+	}
+	switch erroServico.Status {
+	case http.StatusBadRequest:
+		return saidaUso
+	case http.StatusNotFound:
+		return saidaNaoEncontrado
+	case http.StatusConflict:
+		return saidaConflito
+	}
+	return saidaFalha
+}
+
+func (e execucaoComando) resultado(dados interface{}) {
+	if !e.json {
+		return
+	}
+	codificador := json.NewEncoder(e.saida)
+	codificador.SetIndent("", "  ")
+	codificador.Encode(dados)
+}
+
+// Reporta a falha (em JSON com --json, junto do resultado parcial) e retorna o código de saída
+func (e execucaoComando) falha(erro error, parcial interface{}) int {
+	if e.json {
+		resposta := map[string]interface{}{"status": "error", "message": erro.Error()}
+		if parcial != nil {
+			resposta["resultado"] = parcial
+		}
+		e.resultado(resposta)
+	} else {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", erro)
+	}
+	return codigoSaida(erro)
+}
+
+// Resposta fixa para as confirmações de programarViagem
+func responder(resposta bool) func() bool {
+	return func() bool { return resposta }
+}
+
+func comandoViagem(args []string) int {
+	fs := novoFlagSet("viagem")
+	placa := fs.String("placa", "", "placa do veículo")
+	origem := fs.String("origem", "", "cidade de origem (nome ou número de 1 a 9)")
+	destino := fs.String("destino", "", "cidade de destino (nome ou número de 1 a 9)")
+	sim := fs.Bool("sim", false, "confirma a viagem sem perguntar; sem ela, uma viagem com recargas só é planejada")
+	pagar := fs.Bool("pagar", false, "paga as recargas ao final da viagem")
+	comoJSON := fs.Bool("json", false, "resultado em JSON")
+	posicionais, codigo, ok := analisarArgumentos(fs, args)
+	if !ok {
+		return codigo
+	}
+	if len(posicionais) > 0 {
+		return erroUso(fs, "argumento inesperado: "+posicionais[0])
+	}
+	if *placa == "" || *origem == "" || *destino == "" {
+		return erroUso(fs, "informe --placa, --origem e --destino")
+	}
+
+	execucao := iniciarExecucao(*comoJSON)
+	if erro := entrarComando(*placa); erro != nil {
+		return execucao.falha(erro, nil)
+	}
+	defer encerrarComando()
+
+	viagem, erro := programarViagem(*origem, *destino, responder(*sim), responder(*pagar))
+	if erro != nil {
+		if viagem.Status != "" {
+			return execucao.falha(erro, viagem)
+		}
+		return execucao.falha(erro, nil)
+	}
+	execucao.resultado(viagem)
+	if viagem.Pagamento != nil && len(viagem.Pagamento.Falhas) > 0 {
+		return saidaFalha
+	}
+	return saidaSucesso
+}
+
+func comandoPagar(args []string) int {
+	fs := novoFlagSet("pagar")
+	placa := fs.String("placa", "", "placa do veículo")
+	comoJSON := fs.Bool("json", false, "resultado em JSON")
+	posicionais, codigo, ok := analisarArgumentos(fs, args)
+	if !ok {
+		return codigo
+	}
+	if len(posicionais) > 0 {
+		return erroUso(fs, "argumento inesperado: "+posicionais[0])
+	}
+	if *placa == "" {
+		return erroUso(fs, "informe --placa")
+	}
+
+	execucao := iniciarExecucao(*comoJSON)
+	if erro := entrarComando(*placa); erro != nil {
+		return execucao.falha(erro, nil)
+	}
+	defer encerrarComando()
+
+	pagamento, erro := pagarRecargas()
+	if erro != nil {
+		return execucao.falha(erro, nil)
+	}
+	execucao.resultado(pagamento)
+	if len(pagamento.Falhas) > 0 {
+		return saidaFalha
+	}
+	return saidaSucesso
+}
+
+func comandoExtrato(args []string) int {
+	fs := novoFlagSet("extrato")
+	placa := fs.String("placa", "", "placa do veículo")
+	comoJSON := fs.Bool("json", false, "resultado em JSON")
+	posicionais, codigo, ok := analisarArgumentos(fs, args)
+	if !ok {
+		return codigo
+	}
+	if len(posicionais) > 0 {
+		return erroUso(fs, "argumento inesperado: "+posicionais[0])
+	}
+	if *placa == "" {
+		return erroUso(fs, "informe --placa")
+	}
+
+	execucao := iniciarExecucao(*comoJSON)
+	if erro := entrarComando(*placa); erro != nil {
+		return execucao.falha(erro, nil)
+	}
+	defer encerrarComando()
+
+	extrato, erro := verExtrato()
+	if erro != nil {
+		return execucao.falha(erro, nil)
+	}
+	if extrato == nil {
+		extrato = []Bloco{}
+	}
+	execucao.resultado(extrato)
+	return saidaSucesso
+}
+
+// Não precisa de placa: a busca percorre as blockchains das empresas
+func comandoVerificar(args []string) int {
+	fs := novoFlagSet("verificar")
+	comoJSON := fs.Bool("json", false, "resultado em JSON")
+	posicionais, codigo, ok := analisarArgumentos(fs, args)
+	if !ok {
+		return codigo
+	}
+	if len(posicionais) != 1 || posicionais[0] == "" {
+		return erroUso(fs, "informe um hash: veiculo verificar <hash>")
+	}
+
+	execucao := iniciarExecucao(*comoJSON)
+	if erro := conectarServicoVeiculo(); erro != nil {
+		return execucao.falha(erro, nil)
+	}
+	encontrado, erro := verificarHash(posicionais[0])
+	if erro != nil {
+		return execucao.falha(erro, nil)
+	}
+	execucao.resultado(encontrado)
+	return saidaSucesso
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stream de eventos das empresas (GET /api/eventos, Server-Sent Events)
+// O veículo acompanha os blocos da própria placa para descobrir o hash das transações que
+// registra, sem baixar a blockchain inteira após cada requisição. Como todas as empresas
+// mantêm a mesma blockchain, ao cair a conexão o veículo tenta a próxima empresa e retoma
+// a partir do último bloco recebido (Last-Event-ID).
+
+const (
+	esperaBlocoEvento     = 5 * time.Second // depois disso, o hash é procurado na blockchain completa
+	blocosGuardadosEvento = 100
+	intervaloReconexao    = 2 * time.Second
+)
+
+// Bloco recebido pelo stream, numerado na ordem de chegada
+type blocoRecebido struct {
+	sequencia int
+	bloco     Bloco
+}
+
+var streamEventos = struct {
+	sync.Mutex
+	cancelar     context.CancelFunc
+	conectado    bool
+	ultimoIndice int // índice do último bloco recebido (-1: nenhum)
+	sequencia    int
+	blocos       []blocoRecebido
+	aviso        chan struct{} // fechado a cada bloco recebido
+}{ultimoIndice: -1, aviso: make(chan struct{})}
+
+var clienteEventos = &http.Client{}
+
+// Passa a acompanhar os blocos da placa
+func iniciarStreamEventos(placa string) {
+	ctx, cancelar := context.WithCancel(context.Background())
+	streamEventos.Lock()
+	if streamEventos.cancelar != nil {
+		streamEventos.cancelar()
+	}
+	streamEventos.cancelar = cancelar
+	streamEventos.ultimoIndice = -1
+	streamEventos.blocos = nil
+	streamEventos.Unlock()
+	go acompanharEventos(ctx, placa)
+}
+
+func encerrarStreamEventos() {
+	streamEventos.Lock()
+	if streamEventos.cancelar != nil {
+		streamEventos.cancelar()
+		streamEventos.cancelar = nil
+	}
+	streamEventos.conectado = false
+	streamEventos.Unlock()
+}
+
+// Mantém o stream conectado, alternando entre as empresas
+func acompanharEventos(ctx context.Context, placa string) {
+	ids := []string{"001", "002", "003"}
+	for tentativa := 0; ctx.Err() == nil; tentativa++ {
+		id := ids[tentativa%len(ids)]
+		conectou, erro := false, fmt.Errorf("endereço da empresa %s desconhecido", id)
+		if api, existe := empresasAPI[id]; existe {
+			conectou, erro = lerEventos(ctx, api, placa)
+		}
+		streamEventos.Lock()
+		streamEventos.conectado = false
+		streamEventos.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		// Sem empresa disponível, as tentativas seguem em silêncio
+		if conectou {
+			logEventos.Warn("stream da empresa encerrado", "empresa", id, "erro", erro)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(intervaloReconexao):
+		}
+	}
+}
+
+// Lê o stream de uma empresa até a conexão cair; conectou indica se a empresa aceitou o stream
+func lerEventos(ctx context.Context, api, placa string) (conectou bool, erro error) {
+	parametros := url.Values{}
+	parametros.Set("placa", placa)
+	parametros.Set("tipo", "bloco")
+	req, erro := http.NewRequestWithContext(ctx, http.MethodGet, api+"/api/eventos?"+parametros.Encode(), nil)
+	if erro != nil {
+		return false, erro
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	streamEventos.Lock()
+	if streamEventos.ultimoIndice >= 0 {
+		req.Header.Set("Last-Event-ID", strconv.Itoa(streamEventos.ultimoIndice))
+	}
+	streamEventos.Unlock()
+
+	resp, erro := clienteEventos.Do(req)
+	if erro != nil {
+		return false, erro
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	streamEventos.Lock()
+	streamEventos.conectado = true
+	streamEventos.Unlock()
+
+	leitor := bufio.NewScanner(resp.Body)
+	leitor.Buffer(make([]byte, 64*1024), 1024*1024)
+	var evento, dados string
+	for leitor.Scan() {
+		linha := leitor.Text()
+		switch {
+		case linha == "":
+			if evento == "bloco" && dados != "" {
+				var bloco Bloco
+				if json.Unmarshal([]byte(dados), &bloco) == nil {
+					registrarBlocoEvento(bloco)
+				}
+			}
+			evento, dados = "", ""
+		case strings.HasPrefix(linha, "event:"):
+			evento = strings.TrimSpace(strings.TrimPrefix(linha, "event:"))
+		case strings.HasPrefix(linha, "data:"):
+			dados += strings.TrimPrefix(strings.TrimPrefix(linha, "data:"), " ")
+		}
+	}
+	if erro := leitor.Err(); erro != nil {
+		return true, erro
+	}
+	return true, fmt.Errorf("conexão encerrada pela empresa")
+}
+
+func registrarBlocoEvento(bloco Bloco) {
+	streamEventos.Lock()
+	defer streamEventos.Unlock()
+	if bloco.Index <= streamEventos.ultimoIndice {
+		return
+	}
+	streamEventos.ultimoIndice = bloco.Index
+	streamEventos.sequencia++
+	streamEventos.blocos = append(streamEventos.blocos, blocoRecebido{sequencia: streamEventos.sequencia, bloco: bloco})
+	if len(streamEventos.blocos) > blocosGuardadosEvento {
+		streamEventos.blocos = streamEventos.blocos[len(streamEventos.blocos)-blocosGuardadosEvento:]
+	}
+	close(streamEventos.aviso)
+	streamEventos.aviso = make(chan struct{})
+}
+
+// Marca a posição atual do stream; tomada antes de enviar a transação
+func marcaEventos() int {
+	streamEventos.Lock()
+	defer streamEventos.Unlock()
+	return streamEventos.sequencia
+}
+
+// Aguarda um bloco recebido após a marca que satisfaça o critério
+func aguardarBlocoEvento(marca int, criterio func(Bloco) bool, espera time.Duration) (Bloco, bool) {
+	limite := time.NewTimer(espera)
+	defer limite.Stop()
+	for {
+		streamEventos.Lock()
+		if !streamEventos.conectado {
+			streamEventos.Unlock()
+			return Bloco{}, false
+		}
+		for _, recebido := range streamEventos.blocos {
+			if recebido.sequencia > marca && criterio(recebido.bloco) {
+				streamEventos.Unlock()
+				return recebido.bloco, true
+			}
+		}
+		aviso := streamEventos.aviso
+		streamEventos.Unlock()
+
+		select {
+		case <-aviso:
+		case <-limite.C:
+			return Bloco{}, false
+		}
+	}
+}
+
+// Hash da transação registrada após a marca: pelo stream de eventos ou, sem ele, pela blockchain completa
+func hashDaTransacao(marca int, criterio func(Bloco) bool) (string, bool) {
+	if bloco, ok := aguardarBlocoEvento(marca, criterio, esperaBlocoEvento); ok {
+		return bloco.Hash, true
+	}
+	chain := buscarBlockchain()
+	for i := len(chain.Chain) - 1; i >= 0; i-- {
+		if criterio(chain.Chain[i]) {
+			return chain.Chain[i].Hash, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"persistencia"
+)
+
+// Logs técnicos do veículo em JSON (log/slog) na saída de erro, deixando a saída padrão para
+// o menu e para os relatórios (--json). O nível mínimo vem de LOG_LEVEL (padrão info).
+// Cada operação (reserva de viagem, recarga, pagamento, cancelamento) ganha um ID de requisição,
+// levado no contexto da operação e enviado no campo requisicao_id do envelope MQTT e no cabeçalho
+// X-Request-ID do fallback HTTP, para que as empresas registrem a operação com o mesmo ID.
+
+const cabecalhoRequisicao = "X-Request-ID"
+
+type chaveContexto int
+
+const (
+	chaveRequisicao chaveContexto = iota
+	chaveRastreamento
+)
+
+var logBase = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: nivelLog()}))
+
+var (
+	logMQTT    = logBase.With("componente", "mqtt")
+	logEventos = logBase.With("componente", "eventos")
+	logHTTP    = logBase.With("componente", "http")
+	logDados   = logBase.With("componente", "dados")
+)
+
+func init() {
+	persistencia.Log = logDados
+}
+
+// Nível mínimo configurado em LOG_LEVEL
+func nivelLog() slog.Level {
+	var nivel slog.Level
+	if erro := nivel.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); erro != nil {
+		return slog.LevelInfo
+	}
+	return nivel
+}
+
+// Novo ID de requisição para uma operação do veículo
+func novaRequisicaoID() string {
+	return gerarIDMensagem()
+}
+
+// Contexto de uma nova operação do veículo, com ID de requisição próprio
+func novaOperacao() context.Context {
+	return context.WithValue(context.Background(), chaveRequisicao, novaRequisicaoID())
+}
+
+func requisicaoDoContexto(ctx context.Context) string {
+	requisicao, _ := ctx.Value(chaveRequisicao).(string)
+	return requisicao
+}
+
+// POST JSON para uma empresa levando o ID de requisição (X-Request-ID) e o span corrente
+// (traceparent) da operação
+func postRequisicao(ctx context.Context, url string, corpo []byte) (*http.Response, error) {
+	req, erro := http.NewRequest(http.MethodPost, url, bytes.NewReader(corpo))
+	if erro != nil {
+		return nil, erro
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if requisicao := requisicaoDoContexto(ctx); requisicao != "" {
+		req.Header.Set(cabecalhoRequisicao, requisicao)
+	}
+	if traceparent := traceparentDoContexto(ctx); traceparent != "" {
+		req.Header.Set(cabecalhoTraceparent, traceparent)
+	}
+	// Com o token da placa, a empresa conta limites e conflitos pela placa em vez do IP
+	if remetenteProtocolo != "" {
+		if token := obterCredencialMqtt(remetenteProtocolo); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	logHTTP.DebugContext(ctx, "requisição enviada", "url", url, "requisicao_id", requisicaoDoContexto(ctx))
+	return http.DefaultClient.Do(req)
+}
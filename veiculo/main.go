@@ -2,16 +2,20 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 	"time"
+
+	"persistencia"
 )
 
 type Transacao struct {
@@ -20,6 +24,7 @@ type Transacao struct {
 	Valor   float64 `json:"valor"`
 	Ponto   string  `json:"ponto"`
 	Empresa string  `json:"empresa"`
+	Cotacao string  `json:"cotacao,omitempty"`
 }
 
 // Estruturas para sistema de reservas
@@ -62,15 +67,35 @@ type Blockchain struct {
 	Chain []Bloco `json:"blocos"`
 }
 
-var empresasAPI = map[string]string{
-	"001": "http://empresa_001:8001",
-	"002": "http://empresa_002:8002",
-	"003": "http://empresa_003:8003",
+var empresasAPI = lerEmpresasAPI()
+
+// Lê os endereços das APIs das empresas de EMPRESAS_API ("001=http://localhost:8001,002=...")
+// Sem a variável, usa os nomes dos containers
+func lerEmpresasAPI() map[string]string {
+	apis := map[string]string{
+		"001": "http://empresa_001:8001",
+		"002": "http://empresa_002:8002",
+		"003": "http://empresa_003:8003",
+	}
+	valor := os.Getenv("EMPRESAS_API")
+	if valor == "" {
+		return apis
+	}
+	configuradas := make(map[string]string)
+	for _, item := range strings.Split(valor, ",") {
+		id, url, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || id == "" || url == "" {
+			fmt.Printf("[REDE] Entrada inválida em EMPRESAS_API ignorada: %q\n", item)
+			continue
+		}
+		configuradas[id] = strings.TrimSuffix(url, "/")
+	}
+	if len(configuradas) == 0 {
+		return apis
+	}
+	return configuradas
 }
 
-var placa_veiculo string
-var veiculo_atual VeiculoCompleto
-
 // Estruturas para recargas e pagamentos
 type RecargaInfo struct {
 	Ponto         string  `json:"ponto"`
@@ -108,38 +133,76 @@ func limpezaSistema(placa string) {
 }
 
 // Configura tratamento de sinais para limpeza automática em caso de interrupção do programa
-func configurarTratamentoSinais(placa *string) {
+// Encerra a sessão do veículo atendido por este processo, se houver
+func configurarTratamentoSinais() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 
 	go func() {
 		<-c
 		fmt.Println("\n🛑 Sinal de interrupção recebido...")
-
-		if placa != nil && *placa != "" {
-			limpezaSistema(*placa)
-		}
-
+		sairVeiculo()
 		fmt.Println("👋 Sistema encerrado com sucesso!")
 		os.Exit(0)
 	}()
 }
 
-// Função principal do sistema de veículos elétricos - controla o menu e fluxo do programa
+// Função principal do sistema de veículos elétricos
+// "veiculo servico" sobe apenas a API do veículo; "veiculo <comando>" executa um comando único (comandos.go);
+// sem argumentos, abre o menu interativo
 func main() {
+	if len(os.Args) > 1 {
+		if os.Args[1] == "servico" {
+			executarServico()
+			return
+		}
+		if comando, existe := comandosVeiculo[os.Args[1]]; existe {
+			os.Exit(comando(os.Args[2:]))
+		}
+		fmt.Fprintf(os.Stderr, "comando desconhecido: %s\n\n", os.Args[1])
+		usoComandos()
+		os.Exit(saidaUso)
+	}
+	executarMenu()
+}
+
+// Modo serviço: API JSON do veículo em VEICULO_ENDERECO (padrão 127.0.0.1:9000)
+// Com VEICULO_PLACA, o veículo já entra conectado
+func executarServico() {
+	endereco := os.Getenv("VEICULO_ENDERECO")
+	if endereco == "" {
+		endereco = "127.0.0.1:9000"
+	}
+	configurarTratamentoSinais()
+	ouvindo, erro := iniciarServicoVeiculo(endereco)
+	if erro != nil {
+		fmt.Printf("[SERVIÇO] Erro ao iniciar a API do veículo: %v\n", erro)
+		os.Exit(1)
+	}
+	fmt.Printf("[SERVIÇO] API do veículo em http://%s\n", ouvindo)
+	if placa := os.Getenv("VEICULO_PLACA"); placa != "" {
+		if _, erro := entrarVeiculo(placa); erro != nil {
+			fmt.Printf("[SERVIÇO] Erro ao conectar o veículo %s: %v\n", placa, erro)
+		}
+	}
+	select {}
+}
+
+// Menu interativo: cliente da API do veículo
+// Usa o serviço em VEICULO_API, se informado; caso contrário sobe a API neste processo
+func executarMenu() {
 	fmt.Println("🚗 Sistema de Veículos Elétricos com Blockchain")
 	fmt.Println("============================================")
+
+	if erro := conectarServicoVeiculo(); erro != nil {
+		fmt.Printf("❌ %v\n", erro)
+		os.Exit(1)
+	}
 	fmt.Println("Para iniciar, informe a placa do seu veículo...")
 
 	leitor := bufio.NewReader(os.Stdin)
-	placa_validada := false
-	var clienteID string
-	var placa_veiculo string
-
-	// Configura tratamento de sinais para limpeza automática
-	configurarTratamentoSinais(&placa_veiculo)
-
-	for !placa_validada {
+	var estado EstadoVeiculo
+	for {
 		fmt.Print("Placa: ")
 		placa, _ := leitor.ReadString('\n')
 		placa = strings.TrimSpace(placa)
@@ -149,48 +212,20 @@ func main() {
 			continue
 		}
 
-		// Verifica se a placa já está sendo usada
-		placaAtiva, mensagem := verificarPlacaAtiva(placa)
-		if placaAtiva {
-			fmt.Println(mensagem)
+		var erro error
+		estado, erro = apiEntrar(placa)
+		if erro == nil {
+			break
+		}
+		fmt.Printf("❌ %v\n", erro)
+		if strings.Contains(erro.Error(), "já está sendo usada") {
 			fmt.Println("🔒 Não é possível usar uma placa que já está ativa no sistema.")
 			fmt.Println("⏳ Aguarde o outro veículo encerrar a sessão ou use uma placa diferente.")
-			continue
-		}
-
-		// Tenta login ou cadastro
-		veiculo, isLogin, err := loginOuCadastro(placa)
-		if err != nil {
-			fmt.Printf("❌ Erro ao processar veículo: %v\n", err)
-			continue
-		}
-
-		// Registra sessão ativa
-		clienteID, err = registrarSessaoAtiva(placa)
-		if err != nil {
-			fmt.Printf("❌ Erro ao registrar sessão: %v\n", err)
-			continue
-		}
-
-		veiculo_atual = veiculo
-		placa_veiculo = placa
-		placa_validada = true
-
-		if !isLogin {
-			// Só cadastra na lista de placas ativas se for novo veículo
-			if !cadastrarPlaca(placa) {
-				fmt.Println("⚠️  Aviso: Erro ao registrar placa na lista ativa")
-			}
-		}
-		// Inicializa MQTT para este veículo usando ID único
-		fmt.Println("🔌 Conectando ao sistema MQTT...")
-		inicializaMqttVeiculoComID(placa, clienteID)
-		if mqttConectado() {
-			fmt.Println("✅ Conectado ao sistema de comunicação!")
-		} else {
-			fmt.Println("⚠️  Aviso: Sistema MQTT não disponível, usando apenas HTTP")
 		}
 	}
+	exibirLogin(estado)
+	placa := estado.Placa
+
 	for {
 		fmt.Println("\n ============== Menu ==============")
 		fmt.Println("1 - Programar viagem")
@@ -205,20 +240,26 @@ func main() {
 		opcao = strings.TrimSpace(opcao)
 		switch opcao {
 		case "1":
-			programarViagem(placa_veiculo, leitor)
+			programarViagemMenu(leitor)
 		case "2":
-			pagarRecargasPendentes(placa_veiculo)
+			if _, erro := pagarRecargas(); erro != nil {
+				fmt.Printf("❌ %v\n", erro)
+			}
 		case "3":
-			verExtrato(placa_veiculo)
+			if _, erro := verExtrato(); erro != nil {
+				fmt.Printf("❌ %v\n", erro)
+			}
 		case "4":
-			verificarHash(leitor)
+			verificarHashMenu(leitor)
 		case "5":
-			verHistoricoCompleto(placa_veiculo)
+			verHistoricoCompleto(placa)
 		case "6":
-			verHistoricoViagens(placa_veiculo)
+			verHistoricoViagens(placa)
 		case "0":
 			fmt.Println("👋 Encerrando sistema...")
-			limpezaSistema(placa_veiculo)
+			if erro := apiSair(); erro != nil {
+				fmt.Printf("⚠️  Aviso: %v\n", erro)
+			}
 			fmt.Println("✅ Sistema encerrado com sucesso!")
 			return
 		default:
@@ -227,6 +268,26 @@ func main() {
 	}
 }
 
+// Exibe os dados do veículo após login ou cadastro
+func exibirLogin(estado EstadoVeiculo) {
+	veiculo := estado.Veiculo
+	if estado.Novo {
+		fmt.Printf("✅ Veículo %s cadastrado com sucesso!\n", estado.Placa)
+		fmt.Printf("📊 Bateria inicial: %.1f%%\n", veiculo.NivelBateriaAtual)
+		fmt.Printf("🔋 Autonomia: %.0f km\n", veiculo.Autonomia)
+	} else {
+		fmt.Printf("🚗 Bem-vindo de volta, veículo %s!\n", estado.Placa)
+		fmt.Printf("📊 Bateria atual: %.1f%%\n", veiculo.NivelBateriaAtual)
+		fmt.Printf("🔋 Autonomia: %.0f km\n", veiculo.Autonomia)
+		fmt.Printf("📅 Último login: %s\n", veiculo.UltimoLogin)
+	}
+	if estado.MqttConectado {
+		fmt.Println("✅ Conectado ao sistema de comunicação!")
+	} else {
+		fmt.Println("⚠️  Aviso: Sistema MQTT não disponível, usando apenas HTTP")
+	}
+}
+
 // Exibe lista das cidades nordestinas com serviço de recarga disponível
 func listCapitaisNordeste() {
 	fmt.Println("\n======= Cidades com Servico de Recarga =======")
@@ -280,19 +341,21 @@ func realizarRecarga(placa string, leitor *bufio.Reader) {
 		return
 	}
 
-	// Tenta primeiro via MQTT se disponível
+	// Tenta primeiro via MQTT se disponível; o fallback HTTP mantém o ID da operação
+	ctx := novaOperacao()
 	if mqttConectado() {
 		fmt.Println("📡 Enviando recarga via MQTT...")
-		solicitarRecargaMqtt(placa, ponto, valor)
-
-		// Aguarda resposta por alguns segundos
-		resposta := aguardarRespostaMqtt(5 * time.Second)
-		if resposta != "" {
-			partes := strings.Split(resposta, ",")
-			if len(partes) >= 4 && partes[0] == "recarga_confirmada" {
-				fmt.Printf("✅ Recarga confirmada! Hash: %s\n", partes[3])
-				return
-			}
+		pendente := solicitarRecargaMqtt(ctx, placa, ponto, valor, 5*time.Second)
+
+		// Aguarda a resposta desta requisição por alguns segundos
+		resposta := pendente.aguardar()
+		pendente.encerrar()
+		switch resposta.Tipo {
+		case "recarga_confirmada":
+			fmt.Printf("✅ Recarga confirmada! Hash: %s\n", resposta.Dados.Hash)
+			return
+		case "recarga_negada", "recarga_erro":
+			return
 		}
 		fmt.Println("⚠️  Timeout MQTT, tentando via HTTP...")
 	}
@@ -307,7 +370,7 @@ func realizarRecarga(placa string, leitor *bufio.Reader) {
 	}
 	json_data, _ := json.Marshal(transacao)
 	fmt.Printf("🔄 Enviando recarga para %s\n", empresasAPI[empresa_id]+"/recarga")
-	resp, err := http.Post(empresasAPI[empresa_id]+"/recarga", "application/json", bytes.NewBuffer(json_data))
+	resp, err := postRequisicao(ctx, empresasAPI[empresa_id]+"/recarga", json_data)
 	if err != nil || resp.StatusCode != 201 {
 		fmt.Printf("❌ Erro ao registrar recarga: %v, status: %v\n", err, resp)
 		return
@@ -315,91 +378,58 @@ func realizarRecarga(placa string, leitor *bufio.Reader) {
 	fmt.Println("✅ Recarga registrada com sucesso!")
 }
 
-// Processa pagamento de todas as recargas pendentes do veículo via HTTP
-func pagarRecargasPendentes(placa string) {
+// Paga as recargas pendentes pelo serviço do veículo e exibe o resultado
+func pagarRecargas() (ResultadoPagamento, error) {
 	fmt.Println("\n💳 ========== Pagar Recargas Pendentes ==========")
-
-	// Verificar se há recargas no novo sistema
-	recargas, exists := recargasPendentesStorage[placa]
-	if exists && len(recargas) > 0 {
-		fmt.Printf("📋 Recargas pendentes encontradas: %d\n", len(recargas))
-
-		pendentes := 0
-		for _, recarga := range recargas {
-			if !recarga.Pago {
-				pendentes++
-			}
-		}
-
-		if pendentes > 0 {
-			fmt.Printf("💰 Recargas não pagas: %d\n", pendentes)
-			processarPagamentosRecargas(placa)
-			return
-		} else {
-			fmt.Println("✅ Todas as recargas do sistema novo já foram pagas!")
-		}
+	pendentes, erro := apiRecargasPendentes()
+	if erro != nil {
+		return ResultadoPagamento{}, erro
 	}
-
-	// Fallback para o sistema antigo (blockchain)
-	fmt.Println("🔍 Verificando recargas no sistema blockchain...")
-	chain := buscarBlockchain()
-	pendentes := recargasPendentes(placa, chain)
-
 	if len(pendentes) == 0 {
 		fmt.Println("📭 Nenhuma recarga pendente encontrada")
-		return
+		return ResultadoPagamento{Pagas: []RecargaInfo{}}, nil
 	}
+	fmt.Printf("💰 Recargas não pagas: %d\n", len(pendentes))
+	resultado, erro := apiPagar()
+	if erro != nil {
+		return resultado, erro
+	}
+	exibirPagamento(resultado)
+	return resultado, nil
+}
 
-	fmt.Printf("📋 Recargas pendentes no blockchain: %d\n", len(pendentes))
-
-	for _, rec := range pendentes {
-		fmt.Printf("💰 Processando pagamento para recarga em %s - empresa (%s) valor: R$ %.2f\n", rec.Ponto, rec.Empresa, rec.Valor)
-		transacao := Transacao{
-			Tipo:    "PAGAMENTO",
-			Placa:   placa,
-			Valor:   rec.Valor,
-			Ponto:   rec.Ponto,
-			Empresa: rec.Empresa,
-		}
-		json_data, _ := json.Marshal(transacao)
-
-		resp, err := http.Post(empresasAPI[rec.Empresa]+"/pagamento", "application/json", bytes.NewBuffer(json_data))
-		if err != nil || resp.StatusCode != 201 {
-			fmt.Printf("❌ Erro ao pagar recarga em %s!\n", rec.Ponto)
-			continue
-		}
-
-		// Buscar hash do pagamento
-		chainAtualizada := buscarBlockchain()
-		hashPagamento := ""
-		if len(chainAtualizada.Chain) > 0 {
-			for i := len(chainAtualizada.Chain) - 1; i >= 0; i-- {
-				bloco := chainAtualizada.Chain[i]
-				if bloco.Transacao.Placa == placa &&
-					bloco.Transacao.Tipo == "PAGAMENTO" &&
-					bloco.Transacao.Ponto == rec.Ponto &&
-					bloco.Transacao.Valor == rec.Valor {
-					hashPagamento = bloco.Hash
-					break
-				}
-			}
-		}
-		fmt.Printf("✅ Pagamento realizado para recarga em %s!\n", rec.Ponto)
-		if hashPagamento != "" {
-			fmt.Printf("🧾 Hash do pagamento: %s\n", hashPagamento)
+// Exibe o resumo de um pagamento
+func exibirPagamento(resultado ResultadoPagamento) {
+	for _, recarga := range resultado.Pagas {
+		fmt.Printf("✅ Pagamento realizado para recarga em %s: R$ %.2f\n", recarga.Ponto, recarga.Valor)
+		if recarga.HashPagamento != "" {
+			fmt.Printf("🧾 Hash do pagamento: %s\n", recarga.HashPagamento)
 		}
 	}
+	for _, recarga := range resultado.Falhas {
+		fmt.Printf("❌ Erro ao pagar recarga em %s!\n", recarga.Ponto)
+	}
+	fmt.Printf("\n📊 ========== Resumo Final ==========\n")
+	fmt.Printf("✅ Pagamentos processados: %d/%d\n", len(resultado.Pagas), len(resultado.Pagas)+len(resultado.Falhas))
+	fmt.Printf("💰 Total pago: R$ %.2f\n", resultado.TotalPago)
+	if resultado.Pendentes > 0 {
+		fmt.Printf("⚠️  Recargas ainda pendentes: %d\n", resultado.Pendentes)
+	} else {
+		fmt.Println("🎉 Todas as recargas foram pagas!")
+	}
 }
 
 // Exibe extrato simplificado das transações do veículo na blockchain
-func verExtrato(placa string) {
-	chain := buscarBlockchain()
+func verExtrato() ([]Bloco, error) {
+	extrato, erro := apiExtrato()
+	if erro != nil {
+		return nil, erro
+	}
 	fmt.Println("\nExtrato de transações:")
-	for _, bloco := range chain.Chain {
-		if bloco.Transacao.Placa == placa {
-			fmt.Printf("%s | %s     | %s    | %s | R$ %.2f\n", bloco.Timestamp, bloco.Transacao.Tipo, bloco.Transacao.Ponto, bloco.Transacao.Empresa, bloco.Transacao.Valor)
-		}
+	for _, bloco := range extrato {
+		fmt.Printf("%s | %s     | %s    | %s | R$ %.2f\n", bloco.Timestamp, bloco.Transacao.Tipo, bloco.Transacao.Ponto, bloco.Transacao.Empresa, bloco.Transacao.Valor)
 	}
+	return extrato, nil
 }
 
 // Busca blockchain completa de qualquer empresa disponível para consulta
@@ -421,6 +451,80 @@ func buscarBlockchain() Blockchain {
 	return Blockchain{}
 }
 
+// Tarifa de um ponto publicada pela empresa na blockchain
+type Tarifa struct {
+	PrecoKWh       float64 `json:"preco_kwh"`
+	TaxaSessao     float64 `json:"taxa_sessao"`
+	TaxaOciosidade float64 `json:"taxa_ociosidade"`
+	VigenteDesde   string  `json:"vigente_desde"`
+}
+
+// Cotação de recarga retornada pelas empresas
+type Cotacao struct {
+	Ponto      string  `json:"ponto"`
+	Empresa    string  `json:"empresa"`
+	HashTarifa string  `json:"hash_tarifa"`
+	Tarifa     Tarifa  `json:"tarifa"`
+	KWh        float64 `json:"kwh"`
+	ValorTotal float64 `json:"valor_total"`
+}
+
+// Consulta a cotação de uma recarga no ponto; tenta primeiro a empresa dona do ponto e depois as demais,
+// já que as tarifas estão replicadas na blockchain de todas
+func buscarCotacao(ponto string, kwh float64) (Cotacao, bool) {
+	ids := []string{pontoParaEmpresa[ponto], "001", "002", "003"}
+	parametros := url.Values{}
+	parametros.Set("ponto", ponto)
+	parametros.Set("kwh", fmt.Sprintf("%.3f", kwh))
+	for _, id := range ids {
+		api, existe := empresasAPI[id]
+		if !existe {
+			continue
+		}
+		resp, err := http.Get(api + "/api/cotacao?" + parametros.Encode())
+		if err != nil {
+			continue
+		}
+		var cotacao Cotacao
+		erro := json.NewDecoder(resp.Body).Decode(&cotacao)
+		resp.Body.Close()
+		if erro == nil && resp.StatusCode == http.StatusOK {
+			return cotacao, true
+		}
+	}
+	return Cotacao{}, false
+}
+
+// Cotação assinada pela empresa dona do ponto, vinculada à reserva
+type CotacaoAssinada struct {
+	Hash           string   `json:"hash"`
+	Ponto          string   `json:"ponto"`
+	PrecoKWh       float64  `json:"preco_kwh"`
+	TaxaSessao     float64  `json:"taxa_sessao"`
+	TaxaOciosidade float64  `json:"taxa_ociosidade"`
+	Multiplicador  float64  `json:"multiplicador"`
+	Regras         []string `json:"regras"`
+	ExpiraEm       string   `json:"expira_em"`
+}
+
+// Solicita à empresa dona do ponto uma cotação assinada para a placa
+func solicitarCotacaoAssinada(ctx context.Context, placa, ponto, empresaID string) (CotacaoAssinada, bool) {
+	ctx, span := iniciarSpan(ctx, "cotacao", "ponto", ponto, "empresa", empresaID)
+	defer span.finalizar()
+	jsonData, _ := json.Marshal(map[string]string{"ponto": ponto, "placa": placa})
+	resp, err := postRequisicao(ctx, empresasAPI[empresaID]+"/api/cotacoes", jsonData)
+	if err != nil {
+		span.falhar(err)
+		return CotacaoAssinada{}, false
+	}
+	defer resp.Body.Close()
+	var cotacao CotacaoAssinada
+	if resp.StatusCode != http.StatusCreated || json.NewDecoder(resp.Body).Decode(&cotacao) != nil {
+		return CotacaoAssinada{}, false
+	}
+	return cotacao, true
+}
+
 // Identifica recargas não pagas comparando transações de recarga e pagamento na blockchain
 func recargasPendentes(placa string, chain Blockchain) []Transacao {
 	var recargas []Transacao
@@ -435,11 +539,14 @@ func recargasPendentes(placa string, chain Blockchain) []Transacao {
 		}
 	}
 	fmt.Printf("Total de recargas: %d, pagamentos: %d\n", len(recargas), len(pagamentos))
+	// Cada pagamento quita uma única recarga de mesmo ponto, valor e empresa
 	var pendentes []Transacao
+	usados := make([]bool, len(pagamentos))
 	for _, recarga := range recargas {
 		pago := false
-		for _, pagamento := range pagamentos {
-			if pagamento.Ponto == recarga.Ponto && pagamento.Valor == recarga.Valor && pagamento.Empresa == recarga.Empresa {
+		for i, pagamento := range pagamentos {
+			if !usados[i] && pagamento.Ponto == recarga.Ponto && pagamento.Valor == recarga.Valor && pagamento.Empresa == recarga.Empresa {
+				usados[i] = true
 				pago = true
 				break
 			}
@@ -463,48 +570,44 @@ func empresaPorPonto(ponto string) string {
 
 // Cadastra nova placa no arquivo de veículos ativos do sistema
 func cadastrarPlaca(placa string) bool {
-	path := "data/veiculos.json"
 	var veiculos Veiculos
-
-	file, err := os.ReadFile(path)
-	if err == nil {
-		json.Unmarshal(file, &veiculos)
-	} else {
-		veiculos.Placas = make(map[string]bool)
-	}
-	if veiculos.Placas[placa] {
-		return false
-	}
-	veiculos.Placas[placa] = true
-	data, _ := json.MarshalIndent(veiculos, "", "  ")
-	os.WriteFile(path, data, 0644)
-	return true
+	cadastrada := false
+	err := persistencia.AtualizarJSON("data/veiculos.json", &veiculos, 0644, func() bool {
+		if veiculos.Placas[placa] {
+			return false
+		}
+		if veiculos.Placas == nil {
+			veiculos.Placas = make(map[string]bool)
+		}
+		veiculos.Placas[placa] = true
+		cadastrada = true
+		return true
+	})
+	return err == nil && cadastrada
 }
 
 // Remove placa do arquivo de veículos ativos durante o logout
 func removerPlaca(placa string) {
-	path := "data/veiculos.json"
 	var veiculos Veiculos
-	file, err := os.ReadFile(path)
-	if err == nil {
-		json.Unmarshal(file, &veiculos)
-		if veiculos.Placas[placa] {
-			delete(veiculos.Placas, placa)
-			data, _ := json.MarshalIndent(veiculos, "", "  ")
-			os.WriteFile(path, data, 0644)
-			fmt.Printf("Placa %s removida do registro.\n", placa)
+	removida := false
+	err := persistencia.AtualizarJSON("data/veiculos.json", &veiculos, 0644, func() bool {
+		if !veiculos.Placas[placa] {
+			return false
 		}
+		delete(veiculos.Placas, placa)
+		removida = true
+		return true
+	})
+	if err == nil && removida {
+		fmt.Printf("Placa %s removida do registro.\n", placa)
 	}
 }
 
 // Programar viagem com reservas
-// Gerencia planejamento completo de viagem incluindo reservas atômicas e simulação de recargas
-func programarViagem(placa string, leitor *bufio.Reader) {
+// Lê origem e destino no menu e pede as confirmações pelo terminal
+func programarViagemMenu(leitor *bufio.Reader) {
 	fmt.Println("\n========== Programar Viagem ==========")
 
-	// Limpa registros de reservas confirmadas da viagem anterior
-	limparReservasConfirmadas()
-
 	// Selecionar origem
 	origem := selecionarCidade("origem", leitor)
 	if origem == "" {
@@ -521,76 +624,107 @@ func programarViagem(placa string, leitor *bufio.Reader) {
 		fmt.Println("❌ Origem e destino não podem ser iguais!")
 		return
 	}
-	// Calcular rota e pontos necessários
-	rota := calcularRotaViagem(origem, destino)
-	distanciaTotal := calcularDistanciaTotal(rota)
-	pontosNecessarios := calcularPontosRecarga(rota, &veiculo_atual)
-
-	fmt.Printf("\n🗺️  Rota planejada: %s → %s\n", cidadeParaID[origem], cidadeParaID[destino])
-	fmt.Printf("📍 Cidades na rota: %v\n", rota)
-	fmt.Printf("📏 Distância total: %.1f km\n", distanciaTotal)
 
-	if len(pontosNecessarios) == 0 {
-		fmt.Println("✅ Para este trajeto não será necessário recarregar!")
-		salvarViagem(placa, cidadeParaID[origem], cidadeParaID[destino], rota, "COMPLETA_SEM_RECARGA")
-		simularViagemSemRecarga(placa, cidadeParaID[origem], cidadeParaID[destino])
-		return
+	confirmar := perguntarSimNao(leitor, "Deseja confirmar esta viagem?")
+	pagar := perguntarSimNao(leitor, "Deseja efetuar o pagamento agora?")
+	if _, erro := programarViagem(origem, destino, confirmar, pagar); erro != nil {
+		fmt.Printf("\n❌ %v\n", erro)
 	}
+}
 
-	fmt.Printf("\n🔋 Pontos necessários para recarga:\n")
-	for i, ponto := range pontosNecessarios {
-		empresaID := pontoParaEmpresa[ponto]
-		fmt.Printf("   [%d] %s (Empresa: %s)\n", i+1, ponto, empresaID)
+// Retorna uma confirmação (S/N) lida do terminal
+func perguntarSimNao(leitor *bufio.Reader, pergunta string) func() bool {
+	return func() bool {
+		fmt.Printf("\n❓ %s (S/N): ", pergunta)
+		resposta, _ := leitor.ReadString('\n')
+		resposta = strings.TrimSpace(strings.ToLower(resposta))
+		return resposta == "s" || resposta == "sim"
 	}
+}
 
-	// Confirmar viagem
-	fmt.Print("\n❓ Deseja confirmar esta viagem? (S/N): ")
-	confirmacao, _ := leitor.ReadString('\n')
-	confirmacao = strings.TrimSpace(strings.ToLower(confirmacao))
+// Planeja a viagem pelo serviço do veículo, pede confirmação e acompanha reservas, recargas e pagamento
+// Viagem recusada em confirmar retorna status CANCELADA; pagar só é consultada se houve recargas
+func programarViagem(origem, destino string, confirmar, pagar func() bool) (ResultadoViagem, error) {
+	plano, erro := apiPlanejarViagem(origem, destino)
+	if erro != nil {
+		return ResultadoViagem{}, erro
+	}
+	exibirPlano(plano)
 
-	if confirmacao != "s" && confirmacao != "sim" {
-		fmt.Println("❌ Viagem cancelada!")
-		return
+	if len(plano.PontosRecarga) > 0 {
+		if !confirmar() {
+			fmt.Println("❌ Viagem cancelada!")
+			return ResultadoViagem{Plano: plano, Status: "CANCELADA"}, nil
+		}
+		fmt.Println("\n🔄 Realizando reservas atômicas...")
+		fmt.Println("⚠️  Todos os pontos devem ser reservados com sucesso, ou nenhum será reservado!")
 	}
-	// Realizar reservas atômicas - todos os pontos devem ser reservados com sucesso
-	fmt.Println("\n🔄 Realizando reservas atômicas...")
-	fmt.Println("⚠️  Todos os pontos devem ser reservados com sucesso, ou nenhum será reservado!")
-	reservasConfirmadas := fazerReservasAtomicas(placa, pontosNecessarios)
 
-	// Verificar se todas as reservas foram confirmadas
-	if len(reservasConfirmadas) == 0 {
-		fmt.Println("\n❌ Não foi possível realizar nenhuma reserva! Pontos não disponíveis.")
-		fmt.Println("💡 Tente novamente mais tarde quando os pontos estiverem disponíveis.")
-		return
+	resultado, erro := apiRealizarViagem(origem, destino, false)
+	if erro != nil {
+		if resultado.Status == "RESERVA_FALHOU" {
+			fmt.Println("💡 Tente novamente mais tarde quando todos os pontos estiverem disponíveis.")
+		}
+		return resultado, erro
 	}
+	if resultado.Status == "COMPLETA_SEM_RECARGA" {
+		fmt.Println("✅ Viagem concluída sem necessidade de recarga")
+		return resultado, nil
+	}
+	fmt.Printf("\n✅ Viagem concluída! %d pontos reservados e %d recargas realizadas.\n", len(resultado.Reservas), len(resultado.Recargas))
 
-	if len(reservasConfirmadas) < len(pontosNecessarios) {
-		fmt.Printf("\n❌ Reserva atômica falhou! Apenas %d/%d pontos estavam disponíveis.\n", len(reservasConfirmadas), len(pontosNecessarios))
-		fmt.Println("💡 Tente novamente mais tarde quando todos os pontos estiverem disponíveis.")
-		// Nota: O cancelamento das reservas parciais já foi feito na função fazerReservasAtomicas
-		return
+	if len(resultado.Recargas) == 0 {
+		return resultado, nil
 	}
+	fmt.Printf("\n💳 ========== Resumo Financeiro ==========\n")
+	for _, recarga := range resultado.Recargas {
+		fmt.Printf("💰 %s: R$ %.2f (%.1f kWh) - Hash: %s\n", recarga.Ponto, recarga.Valor, recarga.WattsHora, recarga.HashRecarga)
+	}
+	fmt.Printf("💵 Total a pagar: R$ %.2f\n", resultado.TotalAPagar)
+	fmt.Println("ℹ️  Use o menu 'Pagar recargas pendentes' para efetuar o pagamento")
 
-	// Todas as reservas foram bem-sucedidas
-	status := "RESERVAS_COMPLETAS"
-	fmt.Printf("\n✅ Reserva atômica bem-sucedida! %d/%d pontos reservados com sucesso!\n", len(reservasConfirmadas), len(pontosNecessarios))
+	// Perguntar se deseja pagar agora
+	if pagar() {
+		pagamento, erro := apiPagar()
+		if erro != nil {
+			return resultado, erro
+		}
+		exibirPagamento(pagamento)
+		resultado.Pagamento = &pagamento
+	}
+	return resultado, nil
+}
 
-	// Iniciar simulação da viagem
-	fmt.Println("\n🚗 Iniciando simulação da viagem...")
-	simularViagemComRecargas(placa, cidadeParaID[origem], cidadeParaID[destino], reservasConfirmadas, leitor)
+// Exibe rota, distância e pontos de recarga de um plano de viagem
+func exibirPlano(plano PlanoViagem) {
+	fmt.Printf("\n🗺️  Rota planejada: %s → %s\n", plano.Origem, plano.Destino)
+	fmt.Printf("📍 Cidades na rota: %v\n", plano.Rota)
+	fmt.Printf("📏 Distância total: %.1f km\n", plano.DistanciaKm)
 
-	// Salvar viagem no histórico
-	pontosReservados := make([]string, 0, len(reservasConfirmadas))
-	for ponto := range reservasConfirmadas {
-		pontosReservados = append(pontosReservados, ponto)
+	if len(plano.PontosRecarga) == 0 {
+		fmt.Println("✅ Para este trajeto não será necessário recarregar!")
+		return
+	}
+	fmt.Printf("\n🔋 Pontos necessários para recarga:\n")
+	for i, ponto := range plano.PontosRecarga {
+		if ponto.TarifaOk {
+			fmt.Printf("   [%d] %s (Empresa: %s) - R$ %.2f/kWh + R$ %.2f/sessão ≈ R$ %.2f\n",
+				i+1, ponto.Ponto, ponto.Empresa, ponto.PrecoKWh, ponto.TaxaSessao, ponto.ValorEstimado)
+		} else {
+			fmt.Printf("   [%d] %s (Empresa: %s) - tarifa indisponível\n", i+1, ponto.Ponto, ponto.Empresa)
+		}
+	}
+	if plano.CustoEstimado > 0 {
+		fmt.Printf("💵 Custo estimado das recargas (%.1f kWh cada): R$ %.2f\n", plano.KWhPorRecarga, plano.CustoEstimado)
 	}
-	salvarViagem(placa, cidadeParaID[origem], cidadeParaID[destino], pontosReservados, status)
 }
 
 // Fazer reserva atômica com melhor controle de concorrência
-// Executa reserva única com tentativa MQTT primeiro e fallback HTTP
-func fazerReservaAtomica(placa, ponto, empresaID string) string {
+// Executa reserva única com tentativa MQTT primeiro e fallback HTTP, no span "reserva" da operação
+func fazerReservaAtomica(ctx context.Context, placa, ponto, empresaID, cotacao string) string {
 	// fmt.Printf("🔄 Fazendo reserva para %s no ponto %s...\n", placa, ponto)
+	ctx, span := iniciarSpan(ctx, "reserva", "ponto", ponto, "empresa", empresaID)
+	defer span.finalizar()
 
 	// Canal para controlar timeout e resposta
 	respChan := make(chan string, 1)
@@ -599,25 +733,28 @@ func fazerReservaAtomica(placa, ponto, empresaID string) string {
 	go func() {
 		if mqttConectado() {
 			fmt.Println("📡 Enviando reserva via MQTT...")
-			solicitarReservaMqtt(placa, ponto)
-
-			// Aguarda resposta específica para esta reserva
-			deadline := time.Now().Add(3 * time.Second)
-			for time.Now().Before(deadline) {
-				resposta := aguardarRespostaMqtt(100 * time.Millisecond)
-				if resposta != "" {
-					partes := strings.Split(resposta, ",")
-					if len(partes) >= 3 && partes[0] == "reserva_confirmada" && partes[1] == ponto {
-						respChan <- partes[2] // Hash da reserva
-						return
-					}
-				}
+			ctxMqtt, spanMqtt := iniciarSpan(ctx, "reserva.mqtt")
+			pendente := solicitarReservaMqtt(ctxMqtt, placa, ponto, cotacao, 3*time.Second)
+
+			// Aguarda a resposta desta reserva (roteada pela correlação)
+			resposta := pendente.aguardar()
+			pendente.encerrar()
+			spanMqtt.definir("resposta", resposta.Tipo)
+			spanMqtt.finalizar()
+			switch resposta.Tipo {
+			case "reserva_confirmada":
+				respChan <- resposta.Dados.Hash // Hash da reserva
+				return
+			case "reserva_erro", "ponto_desconectado":
+				// Recusa explícita da empresa: o HTTP teria o mesmo resultado
+				respChan <- ""
+				return
 			}
 		}
 
 		// Fallback para HTTP
 		fmt.Println("⚠️  Timeout MQTT, tentando via HTTP...")
-		hash := tentarReservaHTTP(placa, ponto, empresaID)
+		hash := tentarReservaHTTP(ctx, placa, ponto, empresaID, cotacao)
 		respChan <- hash
 	}()
 
@@ -625,10 +762,13 @@ func fazerReservaAtomica(placa, ponto, empresaID string) string {
 	select {
 	case hash := <-respChan:
 		if hash != "" {
+			span.definir("hash", hash)
 			return hash
 		}
+		span.falhar(errors.New("reserva recusada"))
 	case <-time.After(5 * time.Second):
 		fmt.Println("⏰ Timeout na reserva")
+		span.falhar(errors.New("timeout"))
 	}
 
 	return ""
@@ -636,35 +776,38 @@ func fazerReservaAtomica(placa, ponto, empresaID string) string {
 
 // Tenta reserva via HTTP
 // Executa reserva via HTTP e busca hash da transação na blockchain
-func tentarReservaHTTP(placa, ponto, empresaID string) string {
+func tentarReservaHTTP(ctx context.Context, placa, ponto, empresaID, cotacao string) string {
+	ctx, span := iniciarSpan(ctx, "reserva.http")
+	defer span.finalizar()
 	transacao := Transacao{
 		Tipo:    "RESERVA",
 		Placa:   placa,
 		Valor:   0.0,
 		Ponto:   ponto,
 		Empresa: empresaID,
+		Cotacao: cotacao,
 	}
 
 	jsonData, _ := json.Marshal(transacao)
-	resp, err := http.Post(empresasAPI[empresaID]+"/reserva", "application/json", bytes.NewBuffer(jsonData))
+	marca := marcaEventos()
+	resp, err := postRequisicao(ctx, empresasAPI[empresaID]+"/reserva", jsonData)
 
 	if err != nil || resp.StatusCode != 201 {
+		if err == nil {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		span.falhar(err)
 		fmt.Printf("❌ Erro HTTP na reserva: %v\n", err)
 		return ""
 	}
 
-	// Busca o hash da transação criada
-	chain := buscarBlockchain()
-	if len(chain.Chain) > 0 {
-		// Busca a transação mais recente desta placa/ponto
-		for i := len(chain.Chain) - 1; i >= 0; i-- {
-			bloco := chain.Chain[i]
-			if bloco.Transacao.Placa == placa &&
-				bloco.Transacao.Tipo == "RESERVA" &&
-				bloco.Transacao.Ponto == ponto {
-				return bloco.Hash
-			}
-		}
+	// Busca o hash da transação criada (stream de eventos ou blockchain completa)
+	if hash, ok := hashDaTransacao(marca, func(bloco Bloco) bool {
+		return bloco.Transacao.Placa == placa &&
+			bloco.Transacao.Tipo == "RESERVA" &&
+			bloco.Transacao.Ponto == ponto
+	}); ok {
+		return hash
 	}
 
 	return "HASH_HTTP_" + ponto + "_" + time.Now().Format("150405")
@@ -675,17 +818,16 @@ func fazerReserva(placa, ponto, empresaID string) string {
 	fmt.Printf("🔄 Fazendo reserva para %s no ponto %s...\n", placa, ponto)
 
 	// Tenta primeiro via MQTT se disponível
+	ctx := novaOperacao()
 	if mqttConectado() {
 		fmt.Println("📡 Enviando reserva via MQTT...")
-		solicitarReservaMqtt(placa, ponto)
-
-		// Aguarda resposta por alguns segundos
-		resposta := aguardarRespostaMqtt(5 * time.Second)
-		if resposta != "" {
-			partes := strings.Split(resposta, ",")
-			if len(partes) >= 3 && partes[0] == "reserva_confirmada" {
-				return partes[2] // Retorna o hash
-			}
+		pendente := solicitarReservaMqtt(ctx, placa, ponto, "", 5*time.Second)
+
+		// Aguarda a resposta desta requisição por alguns segundos
+		resposta := pendente.aguardar()
+		pendente.encerrar()
+		if resposta.Tipo == "reserva_confirmada" {
+			return resposta.Dados.Hash // Retorna o hash
 		}
 		fmt.Println("⚠️  Timeout MQTT, tentando via HTTP...")
 	}
@@ -702,19 +844,18 @@ func fazerReserva(placa, ponto, empresaID string) string {
 	jsonData, _ := json.Marshal(transacao)
 
 	// Simula reserva criando transação no blockchain
-	resp, err := http.Post(empresasAPI[empresaID]+"/reserva", "application/json", bytes.NewBuffer(jsonData))
+	marca := marcaEventos()
+	resp, err := postRequisicao(ctx, empresasAPI[empresaID]+"/reserva", jsonData)
 	if err != nil || resp.StatusCode != 201 {
 		fmt.Printf("❌ Erro HTTP na reserva: %v\n", err)
 		return ""
 	}
 
-	// Busca o último bloco para obter o hash da reserva
-	chain := buscarBlockchain()
-	if len(chain.Chain) > 0 {
-		ultimoBloco := chain.Chain[len(chain.Chain)-1]
-		if ultimoBloco.Transacao.Placa == placa && ultimoBloco.Transacao.Tipo == "RESERVA" && ultimoBloco.Transacao.Ponto == ponto {
-			return ultimoBloco.Hash
-		}
+	// Obtém o hash da reserva pelo stream de eventos ou pela blockchain
+	if hash, ok := hashDaTransacao(marca, func(bloco Bloco) bool {
+		return bloco.Transacao.Placa == placa && bloco.Transacao.Tipo == "RESERVA" && bloco.Transacao.Ponto == ponto
+	}); ok {
+		return hash
 	}
 
 	return "HASH_SIMULADO_" + ponto + "_" + placa
@@ -722,7 +863,7 @@ func fazerReserva(placa, ponto, empresaID string) string {
 
 // Verificar hash de transação
 // Interface para verificação de autenticidade de hash de transações
-func verificarHash(leitor *bufio.Reader) {
+func verificarHashMenu(leitor *bufio.Reader) {
 	fmt.Println("\n========== Verificar Hash ==========")
 	fmt.Print("Digite o hash a ser verificado: ")
 
@@ -733,30 +874,42 @@ func verificarHash(leitor *bufio.Reader) {
 		fmt.Println("Hash inválido!")
 		return
 	}
+	if _, erro := verificarHash(hash); erro != nil {
+		fmt.Printf("❌ %v\n", erro)
+	}
+}
 
+// Procura o hash nas blockchains das empresas pelo serviço do veículo e exibe a transação
+func verificarHash(hash string) (HashEncontrado, error) {
 	fmt.Printf("Verificando hash: %s\n", hash)
-
-	// Procura o hash em todas as empresas
-	encontrado := false
-	for empresaID, api := range empresasAPI {
-		if verificarHashEmpresa(hash, empresaID, api) {
-			encontrado = true
-			break
-		}
+	encontrado, erro := apiVerificarHash(hash)
+	if erro != nil {
+		return encontrado, erro
 	}
+	exibirHash(encontrado)
+	return encontrado, nil
+}
 
-	if !encontrado {
-		fmt.Println("❌ Hash não encontrado no sistema!")
-	}
+// Exibe os detalhes da transação encontrada pelo hash
+func exibirHash(encontrado HashEncontrado) {
+	bloco := encontrado.Bloco
+	fmt.Printf("✅ Hash encontrado na empresa %s!\n", encontrado.Empresa)
+	fmt.Printf("📄 Detalhes da transação:\n")
+	fmt.Printf("   Tipo: %s\n", bloco.Transacao.Tipo)
+	fmt.Printf("   Veículo: %s\n", bloco.Transacao.Placa)
+	fmt.Printf("   Ponto: %s\n", bloco.Transacao.Ponto)
+	fmt.Printf("   Valor: R$ %.2f\n", bloco.Transacao.Valor)
+	fmt.Printf("   Data/Hora: %s\n", bloco.Timestamp)
+	fmt.Printf("   Empresa: %s\n", bloco.Transacao.Empresa)
+	fmt.Printf("   Índice do Bloco: %d\n", bloco.Index)
 }
 
-// Verificar hash em uma empresa específica
 // Verifica se hash existe na blockchain de uma empresa específica
-func verificarHashEmpresa(hash, empresaID, api string) bool {
+func buscarHashEmpresa(hash, api string) (Bloco, bool) {
 	// Busca blockchain da empresa
 	resp, err := http.Get(api + "/blockchain")
 	if err != nil {
-		return false
+		return Bloco{}, false
 	}
 	defer resp.Body.Close()
 
@@ -766,20 +919,10 @@ func verificarHashEmpresa(hash, empresaID, api string) bool {
 	// Procura o hash na blockchain
 	for _, bloco := range chain.Chain {
 		if bloco.Hash == hash {
-			fmt.Printf("✅ Hash encontrado na empresa %s!\n", empresaID)
-			fmt.Printf("📄 Detalhes da transação:\n")
-			fmt.Printf("   Tipo: %s\n", bloco.Transacao.Tipo)
-			fmt.Printf("   Veículo: %s\n", bloco.Transacao.Placa)
-			fmt.Printf("   Ponto: %s\n", bloco.Transacao.Ponto)
-			fmt.Printf("   Valor: R$ %.2f\n", bloco.Transacao.Valor)
-			fmt.Printf("   Data/Hora: %s\n", bloco.Timestamp)
-			fmt.Printf("   Empresa: %s\n", bloco.Transacao.Empresa)
-			fmt.Printf("   Índice do Bloco: %d\n", bloco.Index)
-			return true
+			return bloco, true
 		}
 	}
-
-	return false
+	return Bloco{}, false
 }
 
 // Ver histórico completo do veículo
@@ -788,67 +931,24 @@ func verHistoricoCompleto(placa string) {
 	fmt.Println("\n========== Histórico Completo ==========")
 	fmt.Printf("Veículo: %s\n", placa)
 
-	var todasTransacoes []Bloco
-	totalRecargas := 0
-	totalPagamentos := 0
-	totalReservas := 0
-	valorTotalRecargas := 0.0
-	valorTotalPagamentos := 0.0
-
-	// Coleta transações de todas as empresas
-	for empresaID, api := range empresasAPI {
-		resp, err := http.Get(api + "/blockchain")
-		if err != nil {
-			fmt.Printf("⚠️  Erro ao conectar com empresa %s\n", empresaID)
-			continue
-		}
-		defer resp.Body.Close()
-
-		var chain Blockchain
-		json.NewDecoder(resp.Body).Decode(&chain)
-
-		// Filtra transações do veículo
-		for _, bloco := range chain.Chain {
-			if bloco.Transacao.Placa == placa {
-				todasTransacoes = append(todasTransacoes, bloco)
-
-				switch bloco.Transacao.Tipo {
-				case "RECARGA":
-					totalRecargas++
-					valorTotalRecargas += bloco.Transacao.Valor
-				case "PAGAMENTO":
-					totalPagamentos++
-					valorTotalPagamentos += bloco.Transacao.Valor
-				case "RESERVA":
-					totalReservas++
-				}
-			}
-		}
+	historico, erro := apiHistorico()
+	if erro != nil {
+		fmt.Printf("❌ %v\n", erro)
+		return
 	}
-
-	if len(todasTransacoes) == 0 {
+	if len(historico.Transacoes) == 0 {
 		fmt.Println("Nenhuma transação encontrada para este veículo.")
 		return
 	}
 
-	// Ordena por índice do bloco (aproximadamente cronológico)
-	for i := 0; i < len(todasTransacoes)-1; i++ {
-		for j := 0; j < len(todasTransacoes)-i-1; j++ {
-			if todasTransacoes[j].Index > todasTransacoes[j+1].Index {
-				todasTransacoes[j], todasTransacoes[j+1] = todasTransacoes[j+1], todasTransacoes[j]
-			}
-		}
-	}
-
 	// Exibe resumo
 	fmt.Printf("\n📊 Resumo:\n")
-	fmt.Printf("   Total de reservas: %d\n", totalReservas)
-	fmt.Printf("   Total de recargas: %d (R$ %.2f)\n", totalRecargas, valorTotalRecargas)
-	fmt.Printf("   Total de pagamentos: %d (R$ %.2f)\n", totalPagamentos, valorTotalPagamentos)
+	fmt.Printf("   Total de reservas: %d\n", historico.Reservas)
+	fmt.Printf("   Total de recargas: %d (R$ %.2f)\n", historico.Recargas, historico.ValorRecargas)
+	fmt.Printf("   Total de pagamentos: %d (R$ %.2f)\n", historico.Pagamentos, historico.ValorPagamentos)
 
-	saldoPendente := valorTotalRecargas - valorTotalPagamentos
-	if saldoPendente > 0 {
-		fmt.Printf("   💰 Saldo pendente: R$ %.2f\n", saldoPendente)
+	if historico.SaldoPendente > 0 {
+		fmt.Printf("   💰 Saldo pendente: R$ %.2f\n", historico.SaldoPendente)
 	} else {
 		fmt.Printf("   ✅ Todas as recargas foram pagas\n")
 	}
@@ -858,7 +958,7 @@ func verHistoricoCompleto(placa string) {
 	fmt.Println("   Data/Hora          | Tipo      | Ponto        | Empresa | Valor    | Hash")
 	fmt.Println("   -------------------|-----------|--------------|---------|----------|------------------")
 
-	for _, bloco := range todasTransacoes {
+	for _, bloco := range historico.Transacoes {
 		tipoIcon := ""
 		switch bloco.Transacao.Tipo {
 		case "RESERVA":
@@ -888,21 +988,15 @@ func verHistoricoCompleto(placa string) {
 			hashCompleto)
 	}
 
-	fmt.Printf("\n📝 Total de transações exibidas: %d\n", len(todasTransacoes))
+	fmt.Printf("\n📝 Total de transações exibidas: %d\n", len(historico.Transacoes))
 }
 
 // Ver histórico de viagens específicas do veículo
 // Exibe histórico específico de viagens realizadas pelo veículo
 func verHistoricoViagens(placa string) {
-	dados, err := carregarDadosVeiculos()
-	if err != nil {
-		fmt.Printf("❌ Erro ao carregar dados: %v\n", err)
-		return
-	}
-
-	veiculo, exists := dados.Veiculos[placa]
-	if !exists {
-		fmt.Println("❌ Veículo não encontrado!")
+	veiculo, erro := apiViagens()
+	if erro != nil {
+		fmt.Printf("❌ %v\n", erro)
 		return
 	}
 
@@ -961,20 +1055,15 @@ func simularViagemSemRecarga(placa, origem, destino string) {
 }
 
 // Simular viagem com recargas
-// Simula viagem completa com paradas para recarga nos pontos reservados
-func simularViagemComRecargas(placa, origem, destino string, reservasConfirmadas map[string]string, leitor *bufio.Reader) {
+// Simula viagem completa com paradas para recarga nos pontos reservados, na ordem da rota
+// As recargas concluídas ficam guardadas para pagamento posterior
+func simularViagemComRecargas(placa, origem, destino string, pontos []string, reservasConfirmadas map[string]string) []RecargaInfo {
 	fmt.Println("\n🚗 ========== Simulação da Viagem ==========")
 	fmt.Printf("🚀 Iniciando viagem: %s → %s\n", origem, destino)
 	fmt.Printf("🔌 %d pontos de recarga reservados\n", len(reservasConfirmadas))
 
 	recargasRealizadas := []RecargaInfo{}
 
-	// Converter map para slice para iteração ordenada
-	pontos := make([]string, 0, len(reservasConfirmadas))
-	for ponto := range reservasConfirmadas {
-		pontos = append(pontos, ponto)
-	}
-
 	// Simula viagem com paradas para recarga
 	for i, ponto := range pontos {
 		fmt.Printf("\n📍 ========== Parada %d/%d ==========\n", i+1, len(pontos))
@@ -1005,221 +1094,276 @@ func simularViagemComRecargas(placa, origem, destino string, reservasConfirmadas
 
 	// Armazenar recargas pendentes para pagamento posterior
 	if len(recargasRealizadas) > 0 {
-		recargasPendentesStorage[placa] = append(recargasPendentesStorage[placa], recargasRealizadas...)
-
-		fmt.Printf("\n💳 ========== Resumo Financeiro ==========\n")
-		valorTotal := 0.0
-		for _, recarga := range recargasRealizadas {
-			valorTotal += recarga.Valor
-			fmt.Printf("💰 %s: R$ %.2f (%.1f kWh)\n", recarga.Ponto, recarga.Valor, recarga.WattsHora)
-		}
-		fmt.Printf("💵 Total a pagar: R$ %.2f\n", valorTotal)
-		fmt.Println("ℹ️  Use o menu 'Pagar recargas pendentes' para efetuar o pagamento")
-
-		// Perguntar se deseja pagar agora
-		fmt.Print("\n❓ Deseja efetuar o pagamento agora? (S/N): ")
-		resposta, _ := leitor.ReadString('\n')
-		resposta = strings.TrimSpace(strings.ToLower(resposta))
-
-		if resposta == "s" || resposta == "sim" {
-			processarPagamentosRecargas(placa)
-		}
+		guardarRecargasPendentes(placa, recargasRealizadas)
 	}
+	return recargasRealizadas
 }
 
-// Realizar recarga simulada com cálculo de valores
-// Executa processo completo de recarga simulada com cálculo de valores e registro na blockchain
+// Capacidade da bateria e nível com que o veículo chega ao ponto (usados para pedir a energia da recarga)
+const (
+	capacidadeBateriaKWh     = 60.0
+	nivelBateriaChegada      = 20.0
+	prazoRecargaCompleta     = 3 * time.Minute
+	intervaloConsultaLeitura = 2 * time.Second
+)
+
+// Realizar recarga no ponto reservado
+// Solicita a recarga à empresa, acompanha a medição da estação e usa o valor calculado pela empresa
+// a partir da leitura final do medidor
 func realizarRecargaSimulada(placa, ponto, empresaID, hashReserva string) RecargaInfo {
 	fmt.Printf("🔌 Iniciando recarga no ponto %s...\n", ponto)
 
-	// Valores simulados por ponto (kWh fixo para recarga completa e preço por kWh)
-	pontosCaracteristicas := map[string]struct {
-		KWhCompleto float64 // kWh para recarga completa (100%)
-		PrecoPorKWh float64
-	}{
-		"Salvador":    {KWhCompleto: 50.0, PrecoPorKWh: 0.85},
-		"Aracaju":     {KWhCompleto: 50.0, PrecoPorKWh: 0.78},
-		"Maceio":      {KWhCompleto: 50.0, PrecoPorKWh: 0.82},
-		"Recife":      {KWhCompleto: 50.0, PrecoPorKWh: 0.80},
-		"Joao Pessoa": {KWhCompleto: 50.0, PrecoPorKWh: 0.75},
-		"Natal":       {KWhCompleto: 50.0, PrecoPorKWh: 0.77},
-		"Fortaleza":   {KWhCompleto: 50.0, PrecoPorKWh: 0.84},
-		"Teresina":    {KWhCompleto: 50.0, PrecoPorKWh: 0.81},
-		"Sao Luis":    {KWhCompleto: 50.0, PrecoPorKWh: 0.79},
-	}
-
-	caracteristicas, exists := pontosCaracteristicas[ponto]
-	if !exists {
-		// Valores padrão - recarga completa sempre 50 kWh
-		caracteristicas.KWhCompleto = 50.0
-		caracteristicas.PrecoPorKWh = 0.80
-	}
-
-	// Simular processo de recarga
+	kwhAlvo := capacidadeBateriaKWh * (100 - nivelBateriaChegada) / 100
+	if cotacao, ok := buscarCotacao(ponto, kwhAlvo); ok {
+		fmt.Printf("🏷️  Tarifa vigente: R$ %.2f/kWh + R$ %.2f/sessão (R$ %.2f/min ocioso)\n",
+			cotacao.Tarifa.PrecoKWh, cotacao.Tarifa.TaxaSessao, cotacao.Tarifa.TaxaOciosidade)
+	}
+	requisicao := map[string]interface{}{
+		"placa":        placa,
+		"ponto":        ponto,
+		"hash_reserva": hashReserva,
+		"kwh_alvo":     kwhAlvo,
+	}
+
+	// As notificações MQTT da sessão ecoam esta correlação até a leitura final
+	var pendente *RequisicaoPendente
+	ctx := novaOperacao()
+	if mqttConectado() {
+		pendente = registrarRequisicao(ctx, prazoRecargaCompleta)
+		requisicao["correlacao"] = pendente.Correlacao
+		defer pendente.encerrar()
+	}
+
 	fmt.Println("⚡ Conectando ao ponto de recarga...")
-	time.Sleep(1 * time.Second)
+	jsonData, _ := json.Marshal(requisicao)
+	resp, err := postRequisicao(ctx, empresasAPI[empresaID]+"/recarga/iniciar", jsonData)
+	if err != nil {
+		fmt.Printf("❌ Erro ao contatar empresa %s: %v\n", empresaID, err)
+		return RecargaInfo{}
+	}
+	var inicio map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&inicio)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		fmt.Printf("❌ Recarga recusada pela empresa: %v\n", inicio["message"])
+		return RecargaInfo{}
+	}
+	fmt.Printf("🔋 Carregando até %.1f kWh (sessão %v)...\n", kwhAlvo, inicio["sessao"])
 
-	fmt.Println("🔋 Iniciando carregamento...")
-	for i := 10; i <= 100; i += 20 {
-		fmt.Printf("🔋 Carregando: %d%%\n", i)
-		time.Sleep(500 * time.Millisecond)
+	var recarga RecargaInfo
+	if pendente != nil && mqttConectado() {
+		recarga = aguardarRecargaMqtt(pendente, ponto, empresaID)
+	} else {
+		recarga = aguardarRecargaHTTP(ctx, placa, ponto, empresaID)
+	}
+	if recarga.HashRecarga == "" {
+		return recarga
 	}
 
 	fmt.Println("✅ Recarga concluída - Bateria 100%!")
+	if recarga.WattsHora > 0 {
+		fmt.Printf("💰 Valor da recarga: R$ %.2f (%.3f kWh medidos)\n", recarga.Valor, recarga.WattsHora)
+	} else {
+		fmt.Printf("💰 Valor da recarga: R$ %.2f\n", recarga.Valor)
+	}
+	return recarga
+}
 
-	// AGORA que a recarga foi concluída, calcula e mostra o valor
-	valor := caracteristicas.KWhCompleto * caracteristicas.PrecoPorKWh
-	fmt.Printf("💰 Valor da recarga: R$ %.2f (%.1f kWh × R$ %.2f/kWh)\n",
-		valor, caracteristicas.KWhCompleto, caracteristicas.PrecoPorKWh)
+// Aguarda a confirmação da recarga enviada pela empresa via MQTT após a leitura final do medidor
+func aguardarRecargaMqtt(pendente *RequisicaoPendente, ponto, empresaID string) RecargaInfo {
+	kwh := 0.0
+	for {
+		mensagem := pendente.aguardar()
+		if mensagem.Tipo == "" {
+			break
+		}
+		switch mensagem.Tipo {
+		case "recarga_medicao":
+			kwh = mensagem.Dados.KWh
+		case "recarga_confirmada":
+			if mensagem.Dados.KWh > 0 {
+				kwh = mensagem.Dados.KWh
+			}
+			return RecargaInfo{
+				Ponto:       ponto,
+				Empresa:     empresaID,
+				Valor:       mensagem.Dados.Valor,
+				WattsHora:   kwh,
+				HashRecarga: mensagem.Dados.Hash,
+				Pago:        false,
+			}
+		case "recarga_negada", "recarga_erro":
+			return RecargaInfo{}
+		}
+	}
+	fmt.Println("⏰ Tempo esgotado aguardando a leitura final do medidor")
+	return RecargaInfo{}
+}
 
-	// Criar transação de recarga
+// Sem MQTT, consulta a empresa até que a leitura final do medidor seja registrada na blockchain
+func aguardarRecargaHTTP(ctx context.Context, placa, ponto, empresaID string) RecargaInfo {
 	transacao := Transacao{
 		Tipo:    "RECARGA",
 		Placa:   placa,
-		Valor:   valor,
 		Ponto:   ponto,
 		Empresa: empresaID,
 	}
-
-	// Tentar registrar via HTTP
 	jsonData, _ := json.Marshal(transacao)
-	resp, err := http.Post(empresasAPI[empresaID]+"/recarga", "application/json", bytes.NewBuffer(jsonData))
-
-	hashRecarga := ""
-	if err == nil && resp.StatusCode == 201 {
-		// Buscar hash da blockchain
-		chain := buscarBlockchain()
-		if len(chain.Chain) > 0 {
-			// Procurar a transação mais recente
-			for i := len(chain.Chain) - 1; i >= 0; i-- {
-				bloco := chain.Chain[i]
-				if bloco.Transacao.Placa == placa &&
-					bloco.Transacao.Tipo == "RECARGA" &&
-					bloco.Transacao.Ponto == ponto &&
-					bloco.Transacao.Valor == valor {
-					hashRecarga = bloco.Hash
-					break
-				}
+
+	prazo := time.Now().Add(prazoRecargaCompleta)
+	for time.Now().Before(prazo) {
+		time.Sleep(intervaloConsultaLeitura)
+		resp, err := postRequisicao(ctx, empresasAPI[empresaID]+"/recarga", jsonData)
+		if err != nil {
+			continue
+		}
+		var resultado struct {
+			Hash    string  `json:"hash"`
+			Valor   float64 `json:"valor"`
+			KWh     float64 `json:"kwh"`
+			Message string  `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&resultado)
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+			return RecargaInfo{
+				Ponto:       ponto,
+				Empresa:     empresaID,
+				Valor:       resultado.Valor,
+				WattsHora:   resultado.KWh,
+				HashRecarga: resultado.Hash,
+				Pago:        false,
 			}
+		case http.StatusConflict:
+			// Medição ainda em andamento
+			fmt.Println("🔋 Carregando...")
+		default:
+			fmt.Printf("❌ Erro ao registrar recarga: %s\n", resultado.Message)
+			return RecargaInfo{}
 		}
 	}
-
-	if hashRecarga == "" {
-		// Hash simulado se não conseguir registrar
-		hashRecarga = fmt.Sprintf("RECARGA_%s_%s_%d", ponto, placa, time.Now().Unix())
-	}
-
-	return RecargaInfo{
-		Ponto:       ponto,
-		Empresa:     empresaID,
-		Valor:       valor,
-		WattsHora:   caracteristicas.KWhCompleto,
-		HashRecarga: hashRecarga,
-		Pago:        false,
-	}
+	fmt.Println("⏰ Tempo esgotado aguardando a leitura final do medidor")
+	return RecargaInfo{}
 }
 
 // Processar pagamentos das recargas
-// Processa pagamentos de todas as recargas pendentes com registro na blockchain
-func processarPagamentosRecargas(placa string) {
+// Processa pagamentos de todas as recargas pendentes desta execução com registro na blockchain
+func processarPagamentosRecargas(placa string) ResultadoPagamento {
 	fmt.Println("\n💳 ========== Processando Pagamentos ==========")
+	resultado := ResultadoPagamento{Pagas: []RecargaInfo{}}
 
-	recargas, exists := recargasPendentesStorage[placa]
-	if !exists || len(recargas) == 0 {
+	recargasPendentesMutex.Lock()
+	recargas := append([]RecargaInfo(nil), recargasPendentesStorage[placa]...)
+	recargasPendentesMutex.Unlock()
+	if len(recargas) == 0 {
 		fmt.Println("📭 Nenhuma recarga pendente para pagamento")
-		return
+		return resultado
 	}
 
-	totalPago := 0.0
-	pagamentosRealizados := 0
-
 	for i, recarga := range recargas {
 		if recarga.Pago {
 			continue // Pula recargas já pagas
 		}
 
-		fmt.Printf("\n💰 Processando pagamento %d/%d\n", pagamentosRealizados+1, len(recargas))
+		fmt.Printf("\n💰 Processando pagamento %d/%d\n", len(resultado.Pagas)+1, len(recargas))
 		fmt.Printf("🔌 Ponto: %s\n", recarga.Ponto)
 		fmt.Printf("💵 Valor: R$ %.2f\n", recarga.Valor)
 
-		// Criar transação de pagamento
-		transacao := Transacao{
-			Tipo:    "PAGAMENTO",
-			Placa:   placa,
-			Valor:   recarga.Valor,
-			Ponto:   recarga.Ponto,
-			Empresa: recarga.Empresa,
-		}
-
-		// Registrar pagamento
-		jsonData, _ := json.Marshal(transacao)
-		resp, err := http.Post(empresasAPI[recarga.Empresa]+"/pagamento", "application/json", bytes.NewBuffer(jsonData))
-
-		if err == nil && resp.StatusCode == 201 {
-			// Buscar hash do pagamento
-			chain := buscarBlockchain()
-			hashPagamento := ""
-			if len(chain.Chain) > 0 {
-				// Procurar a transação mais recente
-				for j := len(chain.Chain) - 1; j >= 0; j-- {
-					bloco := chain.Chain[j]
-					if bloco.Transacao.Placa == placa &&
-						bloco.Transacao.Tipo == "PAGAMENTO" &&
-						bloco.Transacao.Ponto == recarga.Ponto &&
-						bloco.Transacao.Valor == recarga.Valor {
-						hashPagamento = bloco.Hash
-						break
-					}
-				}
-			}
-
-			if hashPagamento == "" {
-				hashPagamento = fmt.Sprintf("PAGAMENTO_%s_%s_%d", recarga.Ponto, placa, time.Now().Unix())
-			}
-			// Atualizar status da recarga
-			recargas[i].Pago = true
-			recargas[i].HashPagamento = hashPagamento
-
-			fmt.Printf("✅ Pagamento realizado com sucesso!\n")
-			fmt.Printf("🧾 Hash do pagamento: %s\n", hashPagamento)
-
-			totalPago += recarga.Valor
-			pagamentosRealizados++
-		} else {
+		hashPagamento, ok := registrarPagamento(placa, recarga)
+		if !ok {
 			fmt.Printf("❌ Erro ao processar pagamento para %s\n", recarga.Ponto)
+			resultado.Falhas = append(resultado.Falhas, recarga)
+			continue
+		}
+		if hashPagamento == "" {
+			hashPagamento = fmt.Sprintf("PAGAMENTO_%s_%s_%d", recarga.Ponto, placa, time.Now().Unix())
 		}
+		// Atualizar status da recarga
+		recargas[i].Pago = true
+		recargas[i].HashPagamento = hashPagamento
+		resultado.Pagas = append(resultado.Pagas, recargas[i])
+		resultado.TotalPago += recarga.Valor
+
+		fmt.Printf("✅ Pagamento realizado com sucesso!\n")
+		fmt.Printf("🧾 Hash do pagamento: %s\n", hashPagamento)
 
 		time.Sleep(1 * time.Second)
 	}
 
-	// Atualizar storage
-	recargasPendentesStorage[placa] = recargas
-
-	fmt.Printf("\n📊 ========== Resumo Final ==========\n")
-	fmt.Printf("✅ Pagamentos processados: %d/%d\n", pagamentosRealizados, len(recargas))
-	fmt.Printf("💰 Total pago: R$ %.2f\n", totalPago)
+	// Atualizar storage; limpa quando tudo estiver pago
+	resultado.Pendentes = len(resultado.Falhas)
+	recargasPendentesMutex.Lock()
+	if resultado.Pendentes > 0 {
+		recargasPendentesStorage[placa] = recargas
+	} else {
+		delete(recargasPendentesStorage, placa)
+	}
+	recargasPendentesMutex.Unlock()
+	return resultado
+}
 
-	// Verificar se ainda há pendências
-	pendentes := 0
-	for _, recarga := range recargas {
-		if !recarga.Pago {
-			pendentes++
+// Paga as recargas sem pagamento correspondente na blockchain (de execuções anteriores)
+func pagarRecargasBlockchain(placa string) ResultadoPagamento {
+	fmt.Println("🔍 Verificando recargas no sistema blockchain...")
+	resultado := ResultadoPagamento{Pagas: []RecargaInfo{}, Blockchain: true}
+	for _, rec := range recargasPendentes(placa, buscarBlockchain()) {
+		recarga := RecargaInfo{Ponto: rec.Ponto, Empresa: rec.Empresa, Valor: rec.Valor}
+		fmt.Printf("💰 Processando pagamento para recarga em %s - empresa (%s) valor: R$ %.2f\n", rec.Ponto, rec.Empresa, rec.Valor)
+		hashPagamento, ok := registrarPagamento(placa, recarga)
+		if !ok {
+			fmt.Printf("❌ Erro ao pagar recarga em %s!\n", rec.Ponto)
+			resultado.Falhas = append(resultado.Falhas, recarga)
+			continue
 		}
+		recarga.Pago = true
+		recarga.HashPagamento = hashPagamento
+		resultado.Pagas = append(resultado.Pagas, recarga)
+		resultado.TotalPago += recarga.Valor
 	}
+	resultado.Pendentes = len(resultado.Falhas)
+	return resultado
+}
 
-	if pendentes > 0 {
-		fmt.Printf("⚠️  Recargas ainda pendentes: %d\n", pendentes)
-	} else {
-		fmt.Println("🎉 Todas as recargas foram pagas!")
-		// Limpar storage quando tudo estiver pago
-		delete(recargasPendentesStorage, placa)
+// Registra o pagamento de uma recarga na empresa e busca o hash da transação criada
+func registrarPagamento(placa string, recarga RecargaInfo) (string, bool) {
+	transacao := Transacao{
+		Tipo:    "PAGAMENTO",
+		Placa:   placa,
+		Valor:   recarga.Valor,
+		Ponto:   recarga.Ponto,
+		Empresa: recarga.Empresa,
+	}
+	jsonData, _ := json.Marshal(transacao)
+	marca := marcaEventos()
+	resp, err := postRequisicao(novaOperacao(), empresasAPI[recarga.Empresa]+"/pagamento", jsonData)
+	if err != nil {
+		return "", false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", false
 	}
+
+	// Hash do pagamento pelo stream de eventos ou, sem ele, pela transação mais recente na blockchain
+	hash, _ := hashDaTransacao(marca, func(bloco Bloco) bool {
+		return bloco.Transacao.Placa == placa &&
+			bloco.Transacao.Tipo == "PAGAMENTO" &&
+			bloco.Transacao.Ponto == recarga.Ponto &&
+			bloco.Transacao.Valor == recarga.Valor
+	})
+	return hash, true
 }
 
 // Fazer reservas atômicas - todos os pontos devem ser reservados ou nenhum
 // Implementa reserva atômica: todos os pontos devem ser reservados com sucesso ou nenhum é reservado
+// A viagem é uma única operação: um ID de requisição e o span raiz "viagem" do trace
 func fazerReservasAtomicas(placa string, pontosNecessarios []string) map[string]string {
 	fmt.Println("🔄 Iniciando processo de reserva atômica...")
+	ctx, span := iniciarSpan(novaOperacao(), "viagem", "placa", placa, "pontos", len(pontosNecessarios))
+	defer span.finalizar()
+	fmt.Printf("🔎 ID da requisição: %s\n", requisicaoDoContexto(ctx))
 
 	// Fase 1: Verificar disponibilidade de todos os pontos
 	fmt.Println("📋 Fase 1: Verificando disponibilidade de todos os pontos...")
@@ -1235,6 +1379,18 @@ func fazerReservasAtomicas(placa string, pontosNecessarios []string) map[string]
 		fmt.Printf("✓ Ponto %s mapeado para empresa %s\n", ponto, empresaID)
 	}
 
+	// Solicita às empresas cotações assinadas; o preço cotado fica vinculado à reserva
+	cotacoes := make(map[string]string) // ponto -> hash da cotação
+	for ponto, empresaID := range pontosDisponiveis {
+		if cotacao, ok := solicitarCotacaoAssinada(ctx, placa, ponto, empresaID); ok {
+			cotacoes[ponto] = cotacao.Hash
+			fmt.Printf("🏷️  Preço garantido em %s: R$ %.4f/kWh + R$ %.2f/sessão até %s\n",
+				ponto, cotacao.PrecoKWh, cotacao.TaxaSessao, cotacao.ExpiraEm)
+		} else {
+			fmt.Printf("⚠️  Sem cotação para %s - será cobrado o preço do início da recarga\n", ponto)
+		}
+	}
+
 	// Fase 2: Tentar reservar todos os pontos simultaneamente
 	fmt.Println("📋 Fase 2: Tentando reservar todos os pontos simultaneamente...")
 	reservasConfirmadas := make(map[string]string) // ponto -> hash
@@ -1243,7 +1399,7 @@ func fazerReservasAtomicas(placa string, pontosNecessarios []string) map[string]
 	// Tenta reservar cada ponto
 	for ponto, empresaID := range pontosDisponiveis {
 		fmt.Printf("🔄 Reservando %s na empresa %s...\n", ponto, empresaID)
-		hash := fazerReservaAtomica(placa, ponto, empresaID)
+		hash := fazerReservaAtomica(ctx, placa, ponto, empresaID, cotacoes[ponto])
 		if hash != "" {
 			reservasConfirmadas[ponto] = hash
 			fmt.Printf("✅ Sucesso: %s reservado - Hash: %s\n", ponto, hash)
@@ -1259,7 +1415,8 @@ func fazerReservasAtomicas(placa string, pontosNecessarios []string) map[string]
 		fmt.Println("🔄 Cancelando reservas parciais...")
 
 		// Cancela todas as reservas que foram feitas com sucesso
-		cancelarReservasParciais(placa, reservasConfirmadas)
+		span.falhar(fmt.Errorf("pontos não reservados: %v", reservasFalhas))
+		cancelarReservasParciais(ctx, placa, reservasConfirmadas)
 		return make(map[string]string) // Retorna vazio
 	}
 
@@ -1269,7 +1426,7 @@ func fazerReservasAtomicas(placa string, pontosNecessarios []string) map[string]
 
 // Cancela reservas que foram feitas parcialmente quando a reserva atômica falha
 // Cancela reservas que foram feitas parcialmente quando a reserva atômica falha
-func cancelarReservasParciais(placa string, reservasParciais map[string]string) {
+func cancelarReservasParciais(ctx context.Context, placa string, reservasParciais map[string]string) {
 	if len(reservasParciais) == 0 {
 		return
 	}
@@ -1292,10 +1449,10 @@ func cancelarReservasParciais(placa string, reservasParciais map[string]string)
 
 		// Tenta cancelar via MQTT primeiro
 		if mqttConectado() {
-			cancelarReservaMqtt(placa, ponto)
+			cancelarReservaMqtt(ctx, placa, ponto)
 		} else {
 			// Fallback para HTTP
-			cancelarReservaHTTP(placa, ponto, empresaID)
+			cancelarReservaHTTP(ctx, placa, ponto, empresaID)
 		}
 	}
 
@@ -1303,17 +1460,17 @@ func cancelarReservasParciais(placa string, reservasParciais map[string]string)
 }
 
 // Cancela reserva via MQTT
-func cancelarReservaMqtt(placa, ponto string) {
+func cancelarReservaMqtt(ctx context.Context, placa, ponto string) {
 	if mqttClientVeiculo != nil && mqttClientVeiculo.IsConnected() {
-		mensagem := fmt.Sprintf("CANCELAR,%s,%s", placa, ponto)
-		token := mqttClientVeiculo.Publish("mensagens/cliente", 0, false, mensagem)
+		mensagem, _ := codificarEnvelope(ctx, "CANCELAR", MensagemVeiculo{Placa: placa, Ponto: ponto}, "", "")
+		token := mqttClientVeiculo.Publish(topicoRequisicao(placa), qosMqtt, false, mensagem)
 		token.Wait()
 		fmt.Printf("📡 Cancelamento enviado via MQTT para %s\n", ponto)
 	}
 }
 
 // Cancela reserva via HTTP
-func cancelarReservaHTTP(placa, ponto, empresaID string) {
+func cancelarReservaHTTP(ctx context.Context, placa, ponto, empresaID string) {
 	type CancelRequest struct {
 		PlacaVeiculo string   `json:"placa_veiculo"`
 		Pontos       []string `json:"pontos"`
@@ -1325,7 +1482,7 @@ func cancelarReservaHTTP(placa, ponto, empresaID string) {
 	}
 
 	jsonData, _ := json.Marshal(req)
-	resp, err := http.Post(empresasAPI[empresaID]+"/cancelamento", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := postRequisicao(ctx, empresasAPI[empresaID]+"/cancelamento", jsonData)
 
 	if err != nil || resp.StatusCode != 200 {
 		fmt.Printf("⚠️  Erro ao cancelar via HTTP: %v\n", err)
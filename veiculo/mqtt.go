@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 var mqttClientVeiculo mqtt.Client
-var mensagemRecebida chan string
 var reservasConfirmadas map[string]bool // Para evitar mensagens duplicadas
 var suprimirMensagensCancelamento bool  // Para controlar quando não exibir mensagens de cancelamento automático
 
@@ -46,36 +51,49 @@ var suprimirMensagensCancelamento bool  // Para controlar quando não exibir men
 // 	}
 // }
 
-// Inicializa cliente MQTT para o veículo com ID único para evitar conflitos
-// Inicializa cliente MQTT com ID único para evitar conflitos entre sessões simultâneas
+// Inicializa cliente MQTT para o veículo com ID estável (veiculo_<placa>)
+// A sessão é persistente: o broker guarda as mensagens QoS 1+ enquanto o veículo está desconectado
+// e as entrega na próxima conexão com o mesmo ID (o login impede sessões simultâneas da mesma placa)
 func inicializaMqttVeiculoComID(placa, clienteID string) {
 	reservasConfirmadas = make(map[string]bool)
-	mensagemRecebida = make(chan string, 10)
-
-	opts := mqtt.NewClientOptions().AddBroker("tcp://broker:1883")
-	opts.SetClientID(clienteID) // Usa ID único ao invés de apenas a placa
+	remetenteProtocolo = placa
+
+	opts := mqtt.NewClientOptions().AddBroker(urlBroker)
+	opts.SetClientID(clienteID)
+	// Token emitido por uma empresa, renovado antes de expirar a cada (re)conexão
+	opts.SetCredentialsProvider(func() (string, string) {
+		return placa, obterCredencialMqtt(placa)
+	})
+	opts.SetCleanSession(false)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(30 * time.Second)
 
 	opts.OnConnect = func(c mqtt.Client) {
 		// fmt.Printf("[MQTT] Conectado com ID único: %s\n", clienteID)
 
 		// Subscribe para mensagens direcionadas a este veículo
 		topico := "mensagens/cliente/" + placa
-		if token := c.Subscribe(topico, 0, handleMensagemVeiculo); token.Wait() && token.Error() != nil {
-			fmt.Printf("[MQTT] Erro ao assinar tópico %s: %v\n", topico, token.Error())
+		if token := c.Subscribe(topico, qosMqtt, handleMensagemVeiculo); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", topico, "erro", token.Error())
 		}
 
 		// Subscribe para mensagens gerais
-		if token := c.Subscribe("mensagens/geral", 0, handleMensagemGeral); token.Wait() && token.Error() != nil {
-			fmt.Printf("[MQTT] Erro ao assinar tópico geral: %v\n", token.Error())
+		if token := c.Subscribe("mensagens/geral", qosMqtt, handleMensagemGeral); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", "mensagens/geral", "erro", token.Error())
+		}
+
+		// Subscribe para erros de protocolo das requisições deste veículo
+		if token := c.Subscribe("mensagens/erro/"+placa, qosMqtt, handleErroProtocolo); token.Wait() && token.Error() != nil {
+			logMQTT.Error("erro ao assinar tópico", "topico", "mensagens/erro/"+placa, "erro", token.Error())
 		}
 	}
 	opts.OnConnectionLost = func(c mqtt.Client, err error) {
-		fmt.Printf("[MQTT] Conexão perdida: %v\n", err)
+		logMQTT.Warn("conexão perdida; reconectando", "erro", err)
 	}
 
 	mqttClientVeiculo = mqtt.NewClient(opts)
 	if token := mqttClientVeiculo.Connect(); token.Wait() && token.Error() != nil {
-		fmt.Printf("[MQTT] Erro ao conectar: %v\n", token.Error())
+		logMQTT.Error("erro ao conectar", "erro", token.Error())
 		return
 	}
 }
@@ -83,20 +101,85 @@ func inicializaMqttVeiculoComID(placa, clienteID string) {
 // Handler para mensagens direcionadas ao veículo
 // Processa mensagens MQTT recebidas direcionadas especificamente ao veículo
 func handleMensagemVeiculo(client mqtt.Client, msg mqtt.Message) {
-	mensagem := string(msg.Payload())
-	fmt.Printf("\n[MQTT] 📨 Mensagem recebida: %s\n", mensagem)
+	mensagem, erro := decodificarMensagemVeiculo(msg.Payload())
+	if erro != nil {
+		logMQTT.Warn("mensagem inválida descartada", "erro", erro)
+		return
+	}
 
-	// Envia para o canal para processamento
-	select {
-	case mensagemRecebida <- mensagem:
-	default:
-		fmt.Println("[MQTT] ⚠️  Canal de mensagens cheio, descartando mensagem")
+	// Confirma o recebimento (inclusive de duplicatas, caso o ACK anterior tenha se perdido)
+	// e descarta mensagens já processadas, reenviadas pela outbox ou pelo broker
+	if mensagem.Confirmar {
+		confirmarRecebimento(mensagem.ID)
+	}
+	if mensagemDuplicada(mensagem.ID) {
+		return
+	}
+
+	if mensagem.Tipo != "recarga_medicao" {
+		fmt.Printf("\n[MQTT] 📨 Mensagem recebida: %s (%s)\n", mensagem.Tipo, mensagem.Dados.Ponto)
+	}
+
+	// Entrega a resposta à requisição que a aguarda (pela correlação)
+	if mensagem.Correlacao != "" && !entregarResposta(mensagem) && mensagem.Tipo != "recarga_medicao" {
+		logMQTT.Warn("resposta sem requisição pendente (prazo esgotado)", "correlacao", mensagem.Correlacao, "tipo", mensagem.Tipo, "requisicao_id", mensagem.Requisicao)
 	}
 
 	// Processa mensagem imediatamente para feedback visual
 	processarMensagemVeiculo(mensagem)
 }
 
+// IDs das mensagens já processadas, com o horário de recebimento
+var mensagensProcessadas = struct {
+	sync.Mutex
+	ids map[string]time.Time
+}{ids: make(map[string]time.Time)}
+
+// Janela em que um ID repetido é tratado como duplicata (igual à validade da outbox das empresas)
+const janelaDuplicatas = 24 * time.Hour
+
+// Registra o ID e informa se a mensagem já havia sido processada
+func mensagemDuplicada(id string) bool {
+	if id == "" {
+		return false
+	}
+	agora := time.Now()
+	mensagensProcessadas.Lock()
+	defer mensagensProcessadas.Unlock()
+	if _, existe := mensagensProcessadas.ids[id]; existe {
+		return true
+	}
+	for antigo, recebidaEm := range mensagensProcessadas.ids {
+		if agora.Sub(recebidaEm) > janelaDuplicatas {
+			delete(mensagensProcessadas.ids, antigo)
+		}
+	}
+	mensagensProcessadas.ids[id] = agora
+	return false
+}
+
+// Envia o ACK de uma mensagem recebida (Correlacao = ID da mensagem confirmada)
+func confirmarRecebimento(id string) {
+	if id == "" || !mqttConectado() {
+		return
+	}
+	mensagem, erro := codificarEnvelope(context.Background(), "ACK", MensagemVeiculo{Placa: remetenteProtocolo}, id, "")
+	if erro != nil {
+		return
+	}
+	mqttClientVeiculo.Publish(topicoRequisicao(remetenteProtocolo), qosMqtt, false, mensagem)
+}
+
+// Exibe erros de protocolo reportados pelas empresas
+func handleErroProtocolo(client mqtt.Client, msg mqtt.Message) {
+	envelope, erro := decodificarEnvelope(msg.Payload())
+	var dados ErroProtocolo
+	if erro != nil || json.Unmarshal(envelope.Payload, &dados) != nil {
+		return
+	}
+	fmt.Printf("\n[MQTT] ⚠️  %s rejeitou a mensagem %s: %s\n", envelope.Remetente, dados.IDOriginal, dados.Motivo)
+}
+
 // Handler para mensagens gerais
 // Processa mensagens gerais do sistema (broadcasts para todos os veículos)
 func handleMensagemGeral(client mqtt.Client, msg mqtt.Message) {
@@ -106,111 +189,89 @@ func handleMensagemGeral(client mqtt.Client, msg mqtt.Message) {
 
 // Processa mensagens recebidas pelo veículo
 // Analisa e processa diferentes tipos de mensagens recebidas via MQTT
-func processarMensagemVeiculo(mensagem string) {
-	partes := strings.Split(mensagem, ",")
-	if len(partes) < 2 {
-		return
-	}
-
-	tipo := partes[0]
-	switch tipo {
+func processarMensagemVeiculo(mensagem MensagemRecebida) {
+	dados := mensagem.Dados
+	ponto := dados.Ponto
+	switch mensagem.Tipo {
 	case "reserva_confirmada":
-		if len(partes) >= 3 {
-			ponto := partes[1]
-			hash := partes[2]
-
-			// Evita mensagens duplicadas para o mesmo ponto
-			chaveReserva := fmt.Sprintf("reserva_%s", ponto)
-			if !reservasConfirmadas[chaveReserva] {
-				reservasConfirmadas[chaveReserva] = true
-				fmt.Printf("✅ Reserva confirmada para %s\n", ponto)
-				fmt.Printf("🔑 Hash completo: %s\n", hash)
-				fmt.Printf("📝 Anote este hash para verificação posterior!\n")
-			}
+		// Evita mensagens duplicadas para o mesmo ponto
+		chaveReserva := fmt.Sprintf("reserva_%s", ponto)
+		if !reservasConfirmadas[chaveReserva] {
+			reservasConfirmadas[chaveReserva] = true
+			fmt.Printf("✅ Reserva confirmada para %s\n", ponto)
+			fmt.Printf("🔑 Hash completo: %s\n", dados.Hash)
+			fmt.Printf("📝 Anote este hash para verificação posterior!\n")
 		}
 	case "reserva_erro":
-		if len(partes) >= 3 {
-			ponto := partes[1]
-			erro := partes[2]
-			fmt.Printf("⚠️  Erro na reserva para %s - Erro: %s\n", ponto, erro)
-		}
+		fmt.Printf("⚠️  Erro na reserva para %s - Erro: %s\n", ponto, dados.Mensagem)
 	case "recarga_confirmada":
-		if len(partes) >= 4 {
-			ponto := partes[1]
-			valor := partes[2]
-			hash := partes[3]
-			fmt.Printf("🔋 Recarga confirmada em %s - Valor: R$ %s\n", ponto, valor)
-			fmt.Printf("🔑 Hash completo: %s\n", hash)
-			fmt.Printf("📝 Anote este hash para verificação posterior!\n")
-		}
+		fmt.Printf("🔋 Recarga confirmada em %s - Valor: R$ %.2f\n", ponto, dados.Valor)
+		fmt.Printf("🔑 Hash completo: %s\n", dados.Hash)
+		fmt.Printf("📝 Anote este hash para verificação posterior!\n")
+	case "recarga_iniciada":
+		fmt.Printf("🔌 Estação iniciou a recarga em %s\n", ponto)
+	case "recarga_medicao":
+		fmt.Printf("🔋 %s: %.3f kWh entregues (%.1f kW)\n", ponto, dados.KWh, dados.KW)
+	case "recarga_erro":
+		fmt.Printf("⚠️  Erro na recarga em %s - Erro: %s\n", ponto, dados.Mensagem)
 	case "recarga_negada":
-		if len(partes) >= 3 {
-			ponto := partes[1]
-			motivo := partes[2]
-			fmt.Printf("❌ Recarga negada em %s - Motivo: %s\n", ponto, motivo)
-		}
+		fmt.Printf("❌ Recarga negada em %s - Motivo: %s\n", ponto, dados.Mensagem)
 	case "pagamento_confirmado":
-		if len(partes) >= 4 {
-			ponto := partes[1]
-			valor := partes[2]
-			hash := partes[3]
-			fmt.Printf("💳 Pagamento confirmado para %s - Valor: R$ %s\n", ponto, valor)
-			fmt.Printf("🔑 Hash completo: %s\n", hash)
-			fmt.Printf("📝 Anote este hash para verificação posterior!\n")
-		}
+		fmt.Printf("💳 Pagamento confirmado para %s - Valor: R$ %.2f\n", ponto, dados.Valor)
+		fmt.Printf("🔑 Hash completo: %s\n", dados.Hash)
+		fmt.Printf("📝 Anote este hash para verificação posterior!\n")
 	case "ponto_liberado":
-		if len(partes) >= 3 {
-			ponto := partes[1]
-			motivo := partes[2]
-			fmt.Printf("🔓 Ponto %s foi liberado automaticamente - %s\n", ponto, motivo)
-		}
+		fmt.Printf("🔓 Ponto %s foi liberado automaticamente - %s\n", ponto, dados.Mensagem)
 	case "status_resposta":
-		if len(partes) >= 6 {
-			recargas := partes[1]
-			pagamentos := partes[2]
-			valorRecargas := partes[3]
-			valorPagamentos := partes[4]
-			saldo := partes[5]
-			fmt.Printf("📊 Status: %s recargas (R$ %s), %s pagamentos (R$ %s), Saldo: R$ %s\n",
-				recargas, valorRecargas, pagamentos, valorPagamentos, saldo)
+		if resumo := dados.Resumo; resumo != nil {
+			fmt.Printf("📊 Status: %d recargas (R$ %.2f), %d pagamentos (R$ %.2f), Saldo: R$ %.2f\n",
+				resumo.Recargas, resumo.ValorRecargas, resumo.Pagamentos, resumo.ValorPagamentos, resumo.SaldoPendente)
 		}
 	case "reserva_cancelada":
-		if len(partes) >= 3 && !suprimirMensagensCancelamento {
-			ponto := partes[1]
-			motivo := partes[2]
-			// Só exibe se não estiver suprimindo mensagens de cancelamento automático
-			if !strings.Contains(motivo, "Nenhuma reserva encontrada") {
-				fmt.Printf("🚫 Reserva cancelada para %s - Motivo: %s\n", ponto, motivo)
-			}
+		// Só exibe se não estiver suprimindo mensagens de cancelamento automático
+		if !suprimirMensagensCancelamento && !strings.Contains(dados.Mensagem, "Nenhuma reserva encontrada") {
+			fmt.Printf("🚫 Reserva cancelada para %s - Motivo: %s\n", ponto, dados.Mensagem)
 		}
 	case "ponto_desconectado":
-		if len(partes) >= 3 {
-			ponto := partes[1]
-			mensagem := partes[2]
-			fmt.Printf("📴 Ponto %s desconectado - %s\n", ponto, mensagem)
-		}
+		fmt.Printf("📴 Ponto %s desconectado - %s\n", ponto, dados.Mensagem)
 	default:
-		// fmt.Printf("❓ Mensagem não reconhecida: %s\n", mensagem)
+		// fmt.Printf("❓ Mensagem não reconhecida: %s\n", mensagem.Tipo)
 	}
 }
 
+// Tópico em que o veículo publica as requisições (único liberado pela ACL do broker para a placa)
+func topicoRequisicao(placa string) string {
+	return "mensagens/requisicao/" + placa
+}
+
 // Envia mensagem via MQTT
-// Envia mensagem para tópico específico via MQTT
-func enviarMensagemMqtt(topico, mensagem string) {
+// Envia mensagem no envelope versionado para tópico específico via MQTT
+// Com requisição pendente, a mensagem leva a sua correlação e o tópico de resposta do veículo
+func enviarMensagemMqtt(topico, tipo string, dados MensagemVeiculo, pendente *RequisicaoPendente) {
 	if mqttClientVeiculo != nil && mqttClientVeiculo.IsConnected() {
-		token := mqttClientVeiculo.Publish(topico, 0, false, mensagem)
+		ctx, correlacao, responderPara := context.Background(), "", ""
+		if pendente != nil {
+			ctx, correlacao, responderPara = pendente.ctx, pendente.Correlacao, "mensagens/cliente/"+remetenteProtocolo
+		}
+		mensagem, erro := codificarEnvelope(ctx, tipo, dados, correlacao, responderPara)
+		if erro != nil {
+			logMQTT.Error("erro ao codificar mensagem", "tipo", tipo, "erro", erro)
+			return
+		}
+		token := mqttClientVeiculo.Publish(topico, qosMqtt, false, mensagem)
 		token.Wait()
-		fmt.Printf("[MQTT] ➡️  Mensagem enviada para %s: %s\n", topico, mensagem)
+		logMQTT.Info("mensagem enviada", "tipo", tipo, "topico", topico, "placa", dados.Placa, "ponto", dados.Ponto, "requisicao_id", requisicaoDoContexto(ctx))
 	} else {
-		fmt.Println("[MQTT] ⚠️  Cliente MQTT não conectado")
+		logMQTT.Warn("cliente MQTT não conectado")
 	}
 }
 
 // Solicita reserva via MQTT
-// Solicita reserva de ponto de recarga via MQTT
-func solicitarReservaMqtt(placa, ponto string) {
-	mensagem := fmt.Sprintf("RESERVA,%s,%s", placa, ponto)
-	enviarMensagemMqtt("mensagens/cliente", mensagem)
+// Solicita reserva de ponto de recarga via MQTT; a resposta é aguardada na requisição retornada
+func solicitarReservaMqtt(ctx context.Context, placa, ponto, cotacao string, prazo time.Duration) *RequisicaoPendente {
+	pendente := registrarRequisicao(ctx, prazo)
+	enviarMensagemMqtt(topicoRequisicao(placa), "RESERVA", MensagemVeiculo{Placa: placa, Ponto: ponto, Cotacao: cotacao}, pendente)
+	return pendente
 }
 
 // Limpa o registro de reservas confirmadas (usado no início de nova viagem)
@@ -221,42 +282,99 @@ func limparReservasConfirmadas() {
 
 // Solicita recarga via MQTT
 // Solicita início de recarga em ponto específico via MQTT
-func solicitarRecargaMqtt(placa, ponto string, valor float64) {
-	mensagem := fmt.Sprintf("RECARGA,%s,%s,%.2f", placa, ponto, valor)
-	enviarMensagemMqtt("mensagens/cliente", mensagem)
+func solicitarRecargaMqtt(ctx context.Context, placa, ponto string, valor float64, prazo time.Duration) *RequisicaoPendente {
+	pendente := registrarRequisicao(ctx, prazo)
+	enviarMensagemMqtt(topicoRequisicao(placa), "RECARGA", MensagemVeiculo{Placa: placa, Ponto: ponto, Valor: valor}, pendente)
+	return pendente
 }
 
 // Solicita pagamento via MQTT
 // Solicita pagamento de recarga via MQTT
 // func solicitarPagamentoMqtt(placa, ponto string, valor float64) {
-// 	mensagem := fmt.Sprintf("PAGAMENTO,%s,%s,%.2f", placa, ponto, valor)
-// 	enviarMensagemMqtt("mensagens/cliente", mensagem)
+// 	enviarMensagemMqtt(topicoRequisicao(placa), "PAGAMENTO", MensagemVeiculo{Placa: placa, Ponto: ponto, Valor: valor}, nil)
 // }
 
 // Solicita status via MQTT
 // Solicita status atual do veículo via MQTT
 // func solicitarStatusMqtt(placa string) {
-// 	mensagem := fmt.Sprintf("STATUS,%s", placa)
-// 	enviarMensagemMqtt("mensagens/cliente", mensagem)
+// 	enviarMensagemMqtt(topicoRequisicao(placa), "STATUS", MensagemVeiculo{Placa: placa}, nil)
 // }
 
-// Aguarda resposta MQTT com timeout
-// Aguarda resposta MQTT com timeout configurável
-func aguardarRespostaMqtt(timeout time.Duration) string {
+// Requisição MQTT aguardando resposta, identificada pela correlação
+// Cada requisição tem o seu próprio prazo; respostas de outras requisições nunca são consumidas aqui
+type RequisicaoPendente struct {
+	Correlacao string
+	ctx        context.Context // operação (ID de requisição e span) enviada no envelope
+	Prazo      time.Time
+	respostas  chan MensagemRecebida
+}
+
+// Tabela de requisições pendentes do veículo
+var requisicoesPendentes = struct {
+	sync.Mutex
+	requisicoes map[string]*RequisicaoPendente
+}{requisicoes: make(map[string]*RequisicaoPendente)}
+
+// Registra uma nova requisição pendente da operação com o prazo informado
+func registrarRequisicao(ctx context.Context, prazo time.Duration) *RequisicaoPendente {
+	pendente := &RequisicaoPendente{
+		Correlacao: gerarIDMensagem(),
+		ctx:        ctx,
+		Prazo:      time.Now().Add(prazo),
+		respostas:  make(chan MensagemRecebida, 16),
+	}
+	requisicoesPendentes.Lock()
+	requisicoesPendentes.requisicoes[pendente.Correlacao] = pendente
+	requisicoesPendentes.Unlock()
+	return pendente
+}
+
+// Entrega a resposta à requisição pendente; retorna false se ela não existe mais
+func entregarResposta(mensagem MensagemRecebida) bool {
+	requisicoesPendentes.Lock()
+	pendente, existe := requisicoesPendentes.requisicoes[mensagem.Correlacao]
+	requisicoesPendentes.Unlock()
+	if !existe {
+		return false
+	}
+	select {
+	case pendente.respostas <- mensagem:
+	default:
+		// Só amostras de medição chegam em rajada; descartar uma delas não perde a confirmação
+		logMQTT.Warn("fila da requisição cheia; descartando mensagem", "correlacao", pendente.Correlacao, "tipo", mensagem.Tipo, "requisicao_id", requisicaoDoContexto(pendente.ctx))
+	}
+	return true
+}
+
+// Aguarda a próxima resposta da requisição até o seu prazo (Tipo vazio quando o prazo esgota)
+func (pendente *RequisicaoPendente) aguardar() MensagemRecebida {
+	if pendente == nil {
+		return MensagemRecebida{}
+	}
 	select {
-	case mensagem := <-mensagemRecebida:
+	case mensagem := <-pendente.respostas:
 		return mensagem
-	case <-time.After(timeout):
-		return ""
+	case <-time.After(time.Until(pendente.Prazo)):
+		return MensagemRecebida{}
 	}
 }
 
+// Remove a requisição da tabela; respostas tardias passam a ser apenas exibidas
+func (pendente *RequisicaoPendente) encerrar() {
+	if pendente == nil {
+		return
+	}
+	requisicoesPendentes.Lock()
+	delete(requisicoesPendentes.requisicoes, pendente.Correlacao)
+	requisicoesPendentes.Unlock()
+}
+
 // Desconecta cliente MQTT
 // Desconecta cliente MQTT de forma segura
 func desconectarMqtt() {
 	if mqttClientVeiculo != nil && mqttClientVeiculo.IsConnected() {
 		mqttClientVeiculo.Disconnect(250)
-		fmt.Println("[MQTT] 🔌 Desconectado do broker")
+		logMQTT.Info("desconectado do broker")
 	}
 }
 
@@ -265,3 +383,61 @@ func desconectarMqtt() {
 func mqttConectado() bool {
 	return mqttClientVeiculo != nil && mqttClientVeiculo.IsConnected()
 }
+
+// Credencial MQTT do veículo, emitida por uma empresa e reaproveitada até perto de expirar
+var credencialVeiculo struct {
+	sync.Mutex
+	token  string
+	expira time.Time
+}
+
+const margemRenovacaoCredencial = 5 * time.Minute
+
+var clienteCredencial = &http.Client{Timeout: 5 * time.Second}
+
+// Obtém o token de acesso ao broker em POST /api/veiculos/credencial, autenticando com o
+// segredo do veículo; tenta as empresas em ordem até uma responder
+func obterCredencialMqtt(placa string) string {
+	credencialVeiculo.Lock()
+	defer credencialVeiculo.Unlock()
+	if credencialVeiculo.token != "" && time.Until(credencialVeiculo.expira) > margemRenovacaoCredencial {
+		return credencialVeiculo.token
+	}
+
+	segredo, erro := carregarSegredoVeiculo(placa)
+	if erro != nil {
+		logMQTT.Error("erro ao carregar segredo do veículo", "placa", placa, "erro", erro)
+		return credencialVeiculo.token
+	}
+	corpo, _ := json.Marshal(map[string]string{"placa": placa, "segredo": segredo})
+
+	ids := make([]string, 0, len(empresasAPI))
+	for id := range empresasAPI {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		resp, erro := clienteCredencial.Post(empresasAPI[id]+"/api/veiculos/credencial", "application/json", bytes.NewBuffer(corpo))
+		if erro != nil {
+			continue
+		}
+		var credencial struct {
+			Token    string `json:"token"`
+			ExpiraEm string `json:"expira_em"`
+		}
+		erro = json.NewDecoder(resp.Body).Decode(&credencial)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			logMQTT.Warn("empresa recusou o segredo da placa", "empresa", id, "placa", placa)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK || erro != nil {
+			continue
+		}
+		expira, _ := time.Parse(time.RFC3339, credencial.ExpiraEm)
+		credencialVeiculo.token, credencialVeiculo.expira = credencial.Token, expira
+		return credencial.Token
+	}
+	logMQTT.Error("nenhuma empresa emitiu credencial para o broker", "placa", placa)
+	return credencialVeiculo.token
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocolo de mensagens MQTT (mesmo envelope usado pelas empresas e estações)
+// Toda mensagem é um envelope JSON versionado (tipo, versão, ID, timestamp, remetente e payload).
+// Respostas CSV de empresas antigas continuam aceitas enquanto PROTOCOLO_CSV_LEGADO não for "false".
+// Cada requisição leva um ID de correlação e o tópico de resposta; as respostas ecoam a correlação
+// e são entregues à requisição pendente correspondente (ver mqtt.go).
+
+const versaoProtocolo = 1
+
+// Envelope comum a todas as mensagens
+// Correlacao e ResponderPara só são usados em requisições e nas respectivas respostas
+// Confirmar pede ao destinatário um ACK com Correlacao = ID
+// Requisicao é o ID da operação do veículo, registrado nos logs de todas as empresas envolvidas
+// Traceparent é o span do veículo que enviou a requisição (ver rastreamento.go)
+type Envelope struct {
+	Tipo          string          `json:"tipo"`
+	Versao        int             `json:"versao"`
+	ID            string          `json:"id"`
+	Timestamp     string          `json:"timestamp"`
+	Remetente     string          `json:"remetente"`
+	Correlacao    string          `json:"correlacao,omitempty"`
+	ResponderPara string          `json:"responder_para,omitempty"`
+	Confirmar     bool            `json:"confirmar,omitempty"`
+	Requisicao    string          `json:"requisicao_id,omitempty"`
+	Traceparent   string          `json:"traceparent,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+}
+
+// Payload da mensagem de erro recebida quando uma requisição é malformada
+type ErroProtocolo struct {
+	IDOriginal string `json:"id_original,omitempty"`
+	Topico     string `json:"topico"`
+	Motivo     string `json:"motivo"`
+}
+
+// Dados trocados entre veículos e empresas; cada tipo usa apenas os campos de que precisa
+type MensagemVeiculo struct {
+	Placa    string        `json:"placa,omitempty"`
+	Ponto    string        `json:"ponto,omitempty"`
+	Hash     string        `json:"hash,omitempty"`
+	Cotacao  string        `json:"cotacao,omitempty"`
+	Valor    float64       `json:"valor,omitempty"`
+	Mensagem string        `json:"mensagem,omitempty"`
+	Sessao   string        `json:"sessao,omitempty"`
+	KWh      float64       `json:"kwh,omitempty"`
+	KW       float64       `json:"kw,omitempty"`
+	Resumo   *ResumoStatus `json:"resumo,omitempty"`
+}
+
+// Resumo financeiro recebido em status_resposta
+type ResumoStatus struct {
+	Recargas        int     `json:"recargas"`
+	Pagamentos      int     `json:"pagamentos"`
+	ValorRecargas   float64 `json:"valor_recargas"`
+	ValorPagamentos float64 `json:"valor_pagamentos"`
+	SaldoPendente   float64 `json:"saldo_pendente"`
+}
+
+// Mensagem já decodificada entregue ao fluxo que aguarda respostas
+type MensagemRecebida struct {
+	ID         string
+	Tipo       string
+	Correlacao string
+	Requisicao string
+	Confirmar  bool
+	Dados      MensagemVeiculo
+}
+
+var errMensagemLegada = errors.New("mensagem no formato CSV legado")
+
+// Aceita respostas CSV antigas durante a janela de transição
+var aceitaCSVLegado = os.Getenv("PROTOCOLO_CSV_LEGADO") != "false"
+
+// Identificador deste veículo nos envelopes enviados (a placa)
+var remetenteProtocolo string
+
+// QoS usada nas publicações e inscrições (MQTT_QOS: 0, 1 ou 2; padrão 1)
+var qosMqtt = lerQosMqtt()
+
+// Lê a QoS configurada; valores inválidos usam o padrão
+func lerQosMqtt() byte {
+	switch os.Getenv("MQTT_QOS") {
+	case "0":
+		return 0
+	case "2":
+		return 2
+	}
+	return 1
+}
+
+// URL do broker MQTT (MQTT_BROKER_URL; padrão: container do Mosquitto)
+var urlBroker = lerUrlBroker()
+
+// Lê a URL do broker do ambiente
+func lerUrlBroker() string {
+	if url := os.Getenv("MQTT_BROKER_URL"); url != "" {
+		return url
+	}
+	return "tcp://broker:1883"
+}
+
+// Gera identificador aleatório de mensagem
+func gerarIDMensagem() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Monta um envelope com o payload serializado (correlacao e responderPara vazios quando
+// nenhuma resposta é esperada), com o ID de requisição e o span da operação de ctx
+func codificarEnvelope(ctx context.Context, tipo string, payload interface{}, correlacao, responderPara string) ([]byte, error) {
+	envelope := Envelope{
+		Tipo:          tipo,
+		Versao:        versaoProtocolo,
+		ID:            gerarIDMensagem(),
+		Timestamp:     time.Now().UTC().Format(time.RFC3339),
+		Remetente:     remetenteProtocolo,
+		Correlacao:    correlacao,
+		ResponderPara: responderPara,
+		Requisicao:    requisicaoDoContexto(ctx),
+		Traceparent:   traceparentDoContexto(ctx),
+	}
+	if payload != nil {
+		dados, erro := json.Marshal(payload)
+		if erro != nil {
+			return nil, erro
+		}
+		envelope.Payload = dados
+	}
+	return json.Marshal(envelope)
+}
+
+// Decodifica um envelope; retorna errMensagemLegada se a mensagem não for JSON
+func decodificarEnvelope(bruto []byte) (Envelope, error) {
+	var envelope Envelope
+	bruto = bytes.TrimSpace(bruto)
+	if len(bruto) == 0 || bruto[0] != '{' {
+		return envelope, errMensagemLegada
+	}
+	if erro := json.Unmarshal(bruto, &envelope); erro != nil {
+		return envelope, fmt.Errorf("JSON inválido: %v", erro)
+	}
+	if envelope.Versao < 1 || envelope.Versao > versaoProtocolo {
+		return envelope, fmt.Errorf("versão de protocolo não suportada: %d", envelope.Versao)
+	}
+	if envelope.Tipo == "" {
+		return envelope, errors.New("campo tipo ausente")
+	}
+	return envelope, nil
+}
+
+// Decodifica uma mensagem recebida no tópico do veículo (envelope ou CSV legado)
+func decodificarMensagemVeiculo(bruto []byte) (MensagemRecebida, error) {
+	envelope, erro := decodificarEnvelope(bruto)
+	if errors.Is(erro, errMensagemLegada) {
+		if !aceitaCSVLegado {
+			return MensagemRecebida{}, errors.New("formato CSV legado desativado")
+		}
+		return mensagemVeiculoDeCSV(string(bruto))
+	}
+	if erro != nil {
+		return MensagemRecebida{}, erro
+	}
+	recebida := MensagemRecebida{
+		ID:         envelope.ID,
+		Tipo:       envelope.Tipo,
+		Correlacao: envelope.Correlacao,
+		Requisicao: envelope.Requisicao,
+		Confirmar:  envelope.Confirmar,
+	}
+	if len(envelope.Payload) > 0 {
+		if erro := json.Unmarshal(envelope.Payload, &recebida.Dados); erro != nil {
+			return MensagemRecebida{}, fmt.Errorf("payload inválido para %s: %v", envelope.Tipo, erro)
+		}
+	}
+	return recebida, nil
+}
+
+// Converte resposta CSV antiga: "tipo,ponto,..." (status_resposta traz apenas números)
+func mensagemVeiculoDeCSV(texto string) (MensagemRecebida, error) {
+	partes := strings.Split(texto, ",")
+	if len(partes) < 2 {
+		return MensagemRecebida{}, errors.New("mensagem CSV incompleta")
+	}
+	recebida := MensagemRecebida{Tipo: partes[0]}
+	dados := &recebida.Dados
+	numero := func(i int) float64 {
+		if i >= len(partes) {
+			return 0
+		}
+		valor, _ := strconv.ParseFloat(partes[i], 64)
+		return valor
+	}
+
+	switch recebida.Tipo {
+	case "status_resposta":
+		if len(partes) < 6 {
+			return MensagemRecebida{}, errors.New("status_resposta incompleto")
+		}
+		dados.Resumo = &ResumoStatus{
+			Recargas:        int(numero(1)),
+			Pagamentos:      int(numero(2)),
+			ValorRecargas:   numero(3),
+			ValorPagamentos: numero(4),
+			SaldoPendente:   numero(5),
+		}
+		return recebida, nil
+	case "reserva_confirmada":
+		if len(partes) >= 3 {
+			dados.Hash = partes[2]
+		}
+	case "recarga_confirmada", "pagamento_confirmado":
+		dados.Valor = numero(2)
+		if len(partes) >= 4 {
+			dados.Hash = partes[3]
+		}
+	case "recarga_iniciada":
+		if len(partes) >= 3 {
+			dados.Sessao = partes[2]
+		}
+	case "recarga_medicao":
+		dados.KWh = numero(2)
+		dados.KW = numero(3)
+	default:
+		if len(partes) >= 3 {
+			dados.Mensagem = strings.Join(partes[2:], ",")
+		}
+	}
+	dados.Ponto = partes[1]
+	return recebida, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Rastreamento das operações do veículo (W3C Trace Context)
+// A reserva de uma viagem é a raiz do trace: cada cotação e cada reserva de ponto é um span
+// filho, cujo traceparent segue no envelope MQTT e no cabeçalho do fallback HTTP, de modo que
+// os spans das empresas (reserva, assinatura, gravação, replicação) entram no mesmo trace.
+// Com RASTREAMENTO_ARQUIVO, os spans do veículo são gravados no arquivo, um JSON por linha;
+// a árvore completa fica em GET /api/rastreamento/{requisicao} de qualquer empresa.
+
+const cabecalhoTraceparent = "traceparent"
+
+type Span struct {
+	Trace      string            `json:"trace_id"`
+	ID         string            `json:"span_id"`
+	Pai        string            `json:"pai_id,omitempty"`
+	Nome       string            `json:"nome"`
+	No         string            `json:"no"`
+	Requisicao string            `json:"requisicao_id,omitempty"`
+	Inicio     time.Time         `json:"inicio"`
+	Fim        time.Time         `json:"fim"`
+	DuracaoMs  float64           `json:"duracao_ms"`
+	Atributos  map[string]string `json:"atributos,omitempty"`
+	Erro       string            `json:"erro,omitempty"`
+}
+
+type contextoRastreamento struct {
+	trace string
+	span  string
+}
+
+var arquivoSpans = struct {
+	sync.Mutex
+	caminho string
+}{caminho: os.Getenv("RASTREAMENTO_ARQUIVO")}
+
+// Inicia um span filho do span corrente de ctx (ou a raiz de um trace novo)
+func iniciarSpan(ctx context.Context, nome string, atributos ...any) (context.Context, *Span) {
+	pai, _ := ctx.Value(chaveRastreamento).(contextoRastreamento)
+	span := &Span{
+		Trace:      pai.trace,
+		ID:         gerarIDMensagem(),
+		Pai:        pai.span,
+		Nome:       nome,
+		No:         "veiculo_" + remetenteProtocolo,
+		Requisicao: requisicaoDoContexto(ctx),
+		Inicio:     time.Now(),
+	}
+	if span.Trace == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		span.Trace = hex.EncodeToString(b)
+	}
+	span.definir(atributos...)
+	return context.WithValue(ctx, chaveRastreamento, contextoRastreamento{trace: span.Trace, span: span.ID}), span
+}
+
+// Acrescenta atributos em pares chave, valor
+func (s *Span) definir(atributos ...any) {
+	for i := 0; i+1 < len(atributos); i += 2 {
+		if s.Atributos == nil {
+			s.Atributos = make(map[string]string)
+		}
+		s.Atributos[fmt.Sprint(atributos[i])] = fmt.Sprint(atributos[i+1])
+	}
+}
+
+// Marca o span com o erro (nada se erro for nil)
+func (s *Span) falhar(erro error) {
+	if erro != nil {
+		s.Erro = erro.Error()
+	}
+}
+
+// Grava o span no arquivo de rastreamento (se configurado)
+func (s *Span) finalizar() {
+	s.Fim = time.Now()
+	s.DuracaoMs = float64(s.Fim.Sub(s.Inicio).Microseconds()) / 1000
+	if arquivoSpans.caminho == "" {
+		return
+	}
+	linha, _ := json.Marshal(s)
+	arquivoSpans.Lock()
+	defer arquivoSpans.Unlock()
+	arquivo, erro := os.OpenFile(arquivoSpans.caminho, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if erro != nil {
+		logBase.Error("erro ao gravar span", "arquivo", arquivoSpans.caminho, "erro", erro)
+		return
+	}
+	defer arquivo.Close()
+	arquivo.Write(append(linha, '\n'))
+}
+
+// Valor de traceparent para o span corrente de ctx ("" fora de um trace)
+func traceparentDoContexto(ctx context.Context) string {
+	atual, ok := ctx.Value(chaveRastreamento).(contextoRastreamento)
+	if !ok {
+		return ""
+	}
+	return "00-" + atual.trace + "-" + atual.span + "-01"
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Camada de serviço do veículo
+// Operações do veículo sem interação com o terminal: recebem parâmetros e devolvem resultados.
+// São expostas como JSON pela API do veículo (api.go), usada tanto pelo menu quanto por sistemas
+// de frota. Cada processo atende um único veículo, já que o client ID MQTT, a credencial e a sessão
+// ativa são por placa.
+
+var (
+	errEntradaInvalida     = errors.New("entrada inválida")
+	errSemVeiculo          = errors.New("nenhum veículo conectado")
+	errPlacaEmUso          = errors.New("placa em uso")
+	errOperacaoEmAndamento = errors.New("outra operação do veículo está em andamento")
+	errReservaFalhou       = errors.New("nem todos os pontos puderam ser reservados")
+	errHashNaoEncontrado   = errors.New("hash não encontrado no sistema")
+)
+
+// Veículo atendido por este processo
+var veiculoConectado = struct {
+	sync.Mutex
+	placa   string
+	veiculo VeiculoCompleto
+	novo    bool
+}{}
+
+// Serializa as operações que reservam, recarregam ou pagam
+var operacaoVeiculo sync.Mutex
+
+// Recargas realizadas nesta execução e ainda não pagas (placa -> recargas)
+var recargasPendentesMutex sync.Mutex
+
+// Plano de viagem calculado pela rota e autonomia do veículo
+type PlanoViagem struct {
+	Origem        string         `json:"origem"`
+	Destino       string         `json:"destino"`
+	Rota          []string       `json:"rota"`
+	DistanciaKm   float64        `json:"distancia_km"`
+	PontosRecarga []CotacaoPonto `json:"pontos_recarga"`
+	KWhPorRecarga float64        `json:"kwh_por_recarga"`
+	CustoEstimado float64        `json:"custo_estimado"`
+}
+
+// Ponto de recarga do plano com a tarifa vigente, quando disponível
+type CotacaoPonto struct {
+	Ponto         string  `json:"ponto"`
+	Empresa       string  `json:"empresa"`
+	TarifaOk      bool    `json:"tarifa_disponivel"`
+	PrecoKWh      float64 `json:"preco_kwh,omitempty"`
+	TaxaSessao    float64 `json:"taxa_sessao,omitempty"`
+	ValorEstimado float64 `json:"valor_estimado,omitempty"`
+}
+
+// Resultado de uma viagem executada
+type ResultadoViagem struct {
+	Plano       PlanoViagem         `json:"plano"`
+	Status      string              `json:"status"`
+	Reservas    map[string]string   `json:"reservas,omitempty"` // ponto -> hash da reserva
+	Recargas    []RecargaInfo       `json:"recargas,omitempty"`
+	TotalAPagar float64             `json:"total_a_pagar"`
+	Pagamento   *ResultadoPagamento `json:"pagamento,omitempty"`
+}
+
+// Resultado do pagamento das recargas pendentes
+type ResultadoPagamento struct {
+	Pagas      []RecargaInfo `json:"pagas"`
+	Falhas     []RecargaInfo `json:"falhas,omitempty"`
+	TotalPago  float64       `json:"total_pago"`
+	Pendentes  int           `json:"pendentes"`
+	Blockchain bool          `json:"blockchain"` // pendências encontradas na blockchain, não nesta execução
+}
+
+// Resumo e transações do veículo em todas as empresas
+type HistoricoVeiculo struct {
+	Placa           string  `json:"placa"`
+	Reservas        int     `json:"reservas"`
+	Recargas        int     `json:"recargas"`
+	Pagamentos      int     `json:"pagamentos"`
+	ValorRecargas   float64 `json:"valor_recargas"`
+	ValorPagamentos float64 `json:"valor_pagamentos"`
+	SaldoPendente   float64 `json:"saldo_pendente"`
+	Transacoes      []Bloco `json:"transacoes"`
+}
+
+// Transação encontrada pelo hash
+type HashEncontrado struct {
+	Empresa string `json:"empresa"`
+	Bloco   Bloco  `json:"bloco"`
+}
+
+// Estado do veículo conectado
+type EstadoVeiculo struct {
+	Placa         string          `json:"placa"`
+	Novo          bool            `json:"novo"`
+	Veiculo       VeiculoCompleto `json:"veiculo"`
+	MqttConectado bool            `json:"mqtt_conectado"`
+}
+
+// Reserva a vez para uma operação longa; falha se outra estiver em andamento
+func iniciarOperacao() error {
+	if !operacaoVeiculo.TryLock() {
+		return errOperacaoEmAndamento
+	}
+	return nil
+}
+
+// Placa e dados do veículo conectado
+func veiculoAtual() (string, VeiculoCompleto, error) {
+	veiculoConectado.Lock()
+	defer veiculoConectado.Unlock()
+	if veiculoConectado.placa == "" {
+		return "", VeiculoCompleto{}, errSemVeiculo
+	}
+	return veiculoConectado.placa, veiculoConectado.veiculo, nil
+}
+
+func estadoVeiculo() (EstadoVeiculo, error) {
+	veiculoConectado.Lock()
+	defer veiculoConectado.Unlock()
+	if veiculoConectado.placa == "" {
+		return EstadoVeiculo{}, errSemVeiculo
+	}
+	return EstadoVeiculo{
+		Placa:         veiculoConectado.placa,
+		Novo:          veiculoConectado.novo,
+		Veiculo:       veiculoConectado.veiculo,
+		MqttConectado: mqttConectado(),
+	}, nil
+}
+
+// Login ou cadastro da placa: registra a sessão ativa e conecta ao MQTT
+// Repetir o login da placa já conectada apenas devolve o estado atual
+func entrarVeiculo(placa string) (EstadoVeiculo, error) {
+	placa = strings.TrimSpace(placa)
+	if placa == "" || strings.ContainsAny(placa, "/\\.+# \t") {
+		return EstadoVeiculo{}, fmt.Errorf("%w: placa inválida", errEntradaInvalida)
+	}
+
+	veiculoConectado.Lock()
+	defer veiculoConectado.Unlock()
+	if veiculoConectado.placa == placa {
+		return EstadoVeiculo{Placa: placa, Veiculo: veiculoConectado.veiculo, Novo: veiculoConectado.novo, MqttConectado: mqttConectado()}, nil
+	}
+	if veiculoConectado.placa != "" {
+		return EstadoVeiculo{}, fmt.Errorf("%w: este serviço já atende a placa %s", errPlacaEmUso, veiculoConectado.placa)
+	}
+
+	// Registra a sessão antes de tudo: falha se a placa já estiver sendo usada
+	clienteID, err := registrarSessaoAtiva(placa)
+	if errors.Is(err, errPlacaEmUso) {
+		return EstadoVeiculo{}, err
+	}
+	if err != nil {
+		return EstadoVeiculo{}, fmt.Errorf("erro ao registrar sessão: %v", err)
+	}
+
+	veiculo, isLogin, err := loginOuCadastro(placa)
+	if err != nil {
+		removerSessaoAtiva(placa)
+		return EstadoVeiculo{}, fmt.Errorf("erro ao processar veículo: %v", err)
+	}
+	if !isLogin && !cadastrarPlaca(placa) {
+		fmt.Println("⚠️  Aviso: Erro ao registrar placa na lista ativa")
+	}
+
+	veiculoConectado.placa = placa
+	veiculoConectado.veiculo = veiculo
+	veiculoConectado.novo = !isLogin
+
+	fmt.Println("🔌 Conectando ao sistema MQTT...")
+	inicializaMqttVeiculoComID(placa, clienteID)
+	iniciarStreamEventos(placa)
+	return EstadoVeiculo{Placa: placa, Veiculo: veiculo, Novo: !isLogin, MqttConectado: mqttConectado()}, nil
+}
+
+// Encerra a sessão do veículo conectado (MQTT, placa ativa e sessão)
+func sairVeiculo() error {
+	veiculoConectado.Lock()
+	defer veiculoConectado.Unlock()
+	if veiculoConectado.placa == "" {
+		return errSemVeiculo
+	}
+	encerrarStreamEventos()
+	limpezaSistema(veiculoConectado.placa)
+	veiculoConectado.placa = ""
+	veiculoConectado.veiculo = VeiculoCompleto{}
+	veiculoConectado.novo = false
+	return nil
+}
+
+// Aceita o número do menu ("1".."9") ou o nome da cidade e devolve o número
+func resolverCidade(valor string) (string, error) {
+	valor = strings.TrimSpace(valor)
+	if _, existe := cidadeParaID[valor]; existe {
+		return valor, nil
+	}
+	for id, cidade := range cidadeParaID {
+		if strings.EqualFold(cidade, valor) || strings.EqualFold(strings.ReplaceAll(cidade, " ", ""), strings.ReplaceAll(valor, " ", "")) {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("%w: cidade desconhecida: %q", errEntradaInvalida, valor)
+}
+
+// Calcula rota, distância e pontos de recarga necessários, com a estimativa de custo
+func planejarViagem(origem, destino string) (PlanoViagem, error) {
+	_, veiculo, err := veiculoAtual()
+	if err != nil {
+		return PlanoViagem{}, err
+	}
+	idOrigem, err := resolverCidade(origem)
+	if err != nil {
+		return PlanoViagem{}, err
+	}
+	idDestino, err := resolverCidade(destino)
+	if err != nil {
+		return PlanoViagem{}, err
+	}
+	if idOrigem == idDestino {
+		return PlanoViagem{}, fmt.Errorf("%w: origem e destino não podem ser iguais", errEntradaInvalida)
+	}
+
+	rota := calcularRotaViagem(idOrigem, idDestino)
+	plano := PlanoViagem{
+		Origem:        cidadeParaID[idOrigem],
+		Destino:       cidadeParaID[idDestino],
+		Rota:          rota,
+		DistanciaKm:   calcularDistanciaTotal(rota),
+		PontosRecarga: []CotacaoPonto{},
+		KWhPorRecarga: capacidadeBateriaKWh * (100 - nivelBateriaChegada) / 100,
+	}
+	for _, ponto := range calcularPontosRecarga(rota, &veiculo) {
+		item := CotacaoPonto{Ponto: ponto, Empresa: pontoParaEmpresa[ponto]}
+		if cotacao, ok := buscarCotacao(ponto, plano.KWhPorRecarga); ok {
+			item.TarifaOk = true
+			item.PrecoKWh = cotacao.Tarifa.PrecoKWh
+			item.TaxaSessao = cotacao.Tarifa.TaxaSessao
+			item.ValorEstimado = cotacao.ValorTotal
+			plano.CustoEstimado += cotacao.ValorTotal
+		}
+		plano.PontosRecarga = append(plano.PontosRecarga, item)
+	}
+	return plano, nil
+}
+
+// Executa a viagem: reserva atomicamente os pontos do plano, recarrega em cada parada e registra
+// a viagem no histórico; com pagar, quita as recargas ao final
+func realizarViagem(origem, destino string, pagar bool) (ResultadoViagem, error) {
+	if err := iniciarOperacao(); err != nil {
+		return ResultadoViagem{}, err
+	}
+	defer operacaoVeiculo.Unlock()
+
+	plano, err := planejarViagem(origem, destino)
+	if err != nil {
+		return ResultadoViagem{}, err
+	}
+	placa, _, err := veiculoAtual()
+	if err != nil {
+		return ResultadoViagem{}, err
+	}
+	resultado := ResultadoViagem{Plano: plano}
+
+	// Limpa registros de reservas confirmadas da viagem anterior
+	limparReservasConfirmadas()
+
+	if len(plano.PontosRecarga) == 0 {
+		simularViagemSemRecarga(placa, plano.Origem, plano.Destino)
+		resultado.Status = "COMPLETA_SEM_RECARGA"
+		salvarViagem(placa, plano.Origem, plano.Destino, plano.Rota, resultado.Status)
+		return resultado, nil
+	}
+
+	pontos := make([]string, 0, len(plano.PontosRecarga))
+	for _, item := range plano.PontosRecarga {
+		pontos = append(pontos, item.Ponto)
+	}
+	// Reserva atômica: todos os pontos devem ser reservados com sucesso, ou nenhum será reservado
+	reservas := fazerReservasAtomicas(placa, pontos)
+	if len(reservas) < len(pontos) {
+		resultado.Status = "RESERVA_FALHOU"
+		return resultado, fmt.Errorf("%w (%d/%d)", errReservaFalhou, len(reservas), len(pontos))
+	}
+	resultado.Reservas = reservas
+	resultado.Status = "RESERVAS_COMPLETAS"
+
+	resultado.Recargas = simularViagemComRecargas(placa, plano.Origem, plano.Destino, pontos, reservas)
+	for _, recarga := range resultado.Recargas {
+		resultado.TotalAPagar += recarga.Valor
+	}
+	salvarViagem(placa, plano.Origem, plano.Destino, pontos, resultado.Status)
+
+	if pagar && len(resultado.Recargas) > 0 {
+		pagamento := processarPagamentosRecargas(placa)
+		resultado.Pagamento = &pagamento
+	}
+	return resultado, nil
+}
+
+// Reserva atomicamente os pontos informados (todos ou nenhum)
+func reservarPontos(pontos []string) (map[string]string, error) {
+	if len(pontos) == 0 {
+		return nil, fmt.Errorf("%w: nenhum ponto informado", errEntradaInvalida)
+	}
+	for _, ponto := range pontos {
+		if _, existe := pontoParaEmpresa[ponto]; !existe {
+			return nil, fmt.Errorf("%w: ponto desconhecido: %q", errEntradaInvalida, ponto)
+		}
+	}
+	if err := iniciarOperacao(); err != nil {
+		return nil, err
+	}
+	defer operacaoVeiculo.Unlock()
+	placa, _, err := veiculoAtual()
+	if err != nil {
+		return nil, err
+	}
+
+	reservas := fazerReservasAtomicas(placa, pontos)
+	if len(reservas) < len(pontos) {
+		return nil, errReservaFalhou
+	}
+	return reservas, nil
+}
+
+// Cancela reservas do veículo nos pontos informados
+func cancelarReservas(pontos []string) error {
+	placa, _, err := veiculoAtual()
+	if err != nil {
+		return err
+	}
+	reservas := make(map[string]string)
+	for _, ponto := range pontos {
+		if _, existe := pontoParaEmpresa[ponto]; !existe {
+			return fmt.Errorf("%w: ponto desconhecido: %q", errEntradaInvalida, ponto)
+		}
+		reservas[ponto] = ""
+	}
+	cancelarReservasParciais(novaOperacao(), placa, reservas)
+	return nil
+}
+
+// Recarrega no ponto reservado e guarda a recarga para pagamento
+func recarregarNoPonto(ponto, hashReserva string) (RecargaInfo, error) {
+	empresaID, existe := pontoParaEmpresa[ponto]
+	if !existe {
+		return RecargaInfo{}, fmt.Errorf("%w: ponto desconhecido: %q", errEntradaInvalida, ponto)
+	}
+	if err := iniciarOperacao(); err != nil {
+		return RecargaInfo{}, err
+	}
+	defer operacaoVeiculo.Unlock()
+	placa, _, err := veiculoAtual()
+	if err != nil {
+		return RecargaInfo{}, err
+	}
+
+	recarga := realizarRecargaSimulada(placa, ponto, empresaID, hashReserva)
+	if recarga.HashRecarga == "" {
+		return RecargaInfo{}, fmt.Errorf("recarga em %s não foi concluída", ponto)
+	}
+	guardarRecargasPendentes(placa, []RecargaInfo{recarga})
+	return recarga, nil
+}
+
+func guardarRecargasPendentes(placa string, recargas []RecargaInfo) {
+	recargasPendentesMutex.Lock()
+	recargasPendentesStorage[placa] = append(recargasPendentesStorage[placa], recargas...)
+	recargasPendentesMutex.Unlock()
+}
+
+// Recargas ainda não pagas: as desta execução ou, sem elas, as pendentes na blockchain
+func listarRecargasPendentes(placa string) ([]RecargaInfo, bool) {
+	recargasPendentesMutex.Lock()
+	var pendentes []RecargaInfo
+	for _, recarga := range recargasPendentesStorage[placa] {
+		if !recarga.Pago {
+			pendentes = append(pendentes, recarga)
+		}
+	}
+	recargasPendentesMutex.Unlock()
+	if len(pendentes) > 0 {
+		return pendentes, false
+	}
+
+	for _, transacao := range recargasPendentes(placa, buscarBlockchain()) {
+		pendentes = append(pendentes, RecargaInfo{Ponto: transacao.Ponto, Empresa: transacao.Empresa, Valor: transacao.Valor})
+	}
+	return pendentes, true
+}
+
+// Paga todas as recargas pendentes do veículo
+func pagarRecargasPendentes() (ResultadoPagamento, error) {
+	if err := iniciarOperacao(); err != nil {
+		return ResultadoPagamento{}, err
+	}
+	defer operacaoVeiculo.Unlock()
+	placa, _, err := veiculoAtual()
+	if err != nil {
+		return ResultadoPagamento{}, err
+	}
+
+	recargasPendentesMutex.Lock()
+	locais := len(recargasPendentesStorage[placa]) > 0
+	recargasPendentesMutex.Unlock()
+	if locais {
+		return processarPagamentosRecargas(placa), nil
+	}
+	return pagarRecargasBlockchain(placa), nil
+}
+
+// Transações do veículo na blockchain (extrato)
+func extratoVeiculo() ([]Bloco, error) {
+	placa, _, err := veiculoAtual()
+	if err != nil {
+		return nil, err
+	}
+	extrato := []Bloco{}
+	for _, bloco := range buscarBlockchain().Chain {
+		if bloco.Transacao.Placa == placa {
+			extrato = append(extrato, bloco)
+		}
+	}
+	return extrato, nil
+}
+
+// Histórico completo do veículo coletado em todas as empresas, com resumo financeiro
+func historicoCompleto() (HistoricoVeiculo, error) {
+	placa, _, err := veiculoAtual()
+	if err != nil {
+		return HistoricoVeiculo{}, err
+	}
+	historico := HistoricoVeiculo{Placa: placa, Transacoes: []Bloco{}}
+	vistos := make(map[string]bool)
+
+	// Coleta transações de todas as empresas
+	for empresaID, api := range empresasAPI {
+		resp, err := http.Get(api + "/blockchain")
+		if err != nil {
+			fmt.Printf("⚠️  Erro ao conectar com empresa %s\n", empresaID)
+			continue
+		}
+		var chain Blockchain
+		json.NewDecoder(resp.Body).Decode(&chain)
+		resp.Body.Close()
+
+		// Filtra transações do veículo (as cadeias são replicadas: cada bloco conta uma vez)
+		for _, bloco := range chain.Chain {
+			if bloco.Transacao.Placa != placa || vistos[bloco.Hash] {
+				continue
+			}
+			vistos[bloco.Hash] = true
+			historico.Transacoes = append(historico.Transacoes, bloco)
+			switch bloco.Transacao.Tipo {
+			case "RECARGA":
+				historico.Recargas++
+				historico.ValorRecargas += bloco.Transacao.Valor
+			case "PAGAMENTO":
+				historico.Pagamentos++
+				historico.ValorPagamentos += bloco.Transacao.Valor
+			case "RESERVA":
+				historico.Reservas++
+			}
+		}
+	}
+
+	// Ordena por índice do bloco (aproximadamente cronológico)
+	sort.SliceStable(historico.Transacoes, func(i, j int) bool {
+		return historico.Transacoes[i].Index < historico.Transacoes[j].Index
+	})
+	historico.SaldoPendente = historico.ValorRecargas - historico.ValorPagamentos
+	return historico, nil
+}
+
+// Viagens registradas do veículo conectado
+func historicoViagens() (VeiculoCompleto, error) {
+	placa, _, err := veiculoAtual()
+	if err != nil {
+		return VeiculoCompleto{}, err
+	}
+	dados, err := carregarDadosVeiculos()
+	if err != nil {
+		return VeiculoCompleto{}, fmt.Errorf("erro ao carregar dados: %v", err)
+	}
+	veiculo, existe := dados.Veiculos[placa]
+	if !existe {
+		return VeiculoCompleto{}, fmt.Errorf("veículo %s não encontrado", placa)
+	}
+	if veiculo.Historico == nil {
+		veiculo.Historico = []Viagem{}
+	}
+	return veiculo, nil
+}
+
+// Procura o hash na blockchain de cada empresa
+func buscarHash(hash string) (HashEncontrado, error) {
+	hash = strings.TrimSpace(hash)
+	if hash == "" {
+		return HashEncontrado{}, fmt.Errorf("%w: hash vazio", errEntradaInvalida)
+	}
+	ids := make([]string, 0, len(empresasAPI))
+	for id := range empresasAPI {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, empresaID := range ids {
+		if bloco, ok := buscarHashEmpresa(hash, empresasAPI[empresaID]); ok {
+			return HashEncontrado{Empresa: empresaID, Bloco: bloco}, nil
+		}
+	}
+	return HashEncontrado{}, errHashNaoEncontrado
+}
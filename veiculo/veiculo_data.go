@@ -2,16 +2,26 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/fs"
 	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+
+	"persistencia"
 )
 
+// Os dados dos veículos (veiculos_completos.json), as sessões ativas (sessoes_ativas.json) e as
+// placas ativas (veiculos.json) são lidos e alterados por vários processos de veículo ao mesmo
+// tempo; cada alteração passa por persistencia.AtualizarJSON, que lê e grava o arquivo com o lock
+// do arquivo, de modo que nenhum processo sobrescreve a alteração de outro.
+
 // Estrutura completa do veículo com dados de bateria e autonomia
 type VeiculoCompleto struct {
 	Placa             string   `json:"placa"`
@@ -105,72 +115,46 @@ func gerarDadosIniciais() (float64, float64) {
 	return bateria, autonomia
 }
 
-// Carrega dados completos dos veículos
-// Carrega dados completos dos veículos do arquivo JSON com múltiplas tentativas de caminho
-func carregarDadosVeiculos() (DadosVeiculosCompletos, error) {
-	var dados DadosVeiculosCompletos
+const arquivoSessoesAtivas = "data/sessoes_ativas.json"
 
-	// Tenta primeiro o caminho do container, depois caminho local
+// Arquivo dos dados dos veículos: o caminho do container, se o diretório existir, ou o local
+func caminhoDadosVeiculos() string {
 	caminhos := []string{
 		"/app/data/veiculos_completos.json",       // Caminho no container
 		"../empresa/data/veiculos_completos.json", // Caminho local (relativo)
 	}
-
-	var file *os.File
-	var err error
-
 	for _, caminho := range caminhos {
-		file, err = os.Open(caminho)
-		if err == nil {
-			break // Arquivo encontrado
+		if _, err := os.Stat(filepath.Dir(caminho)); err == nil {
+			return caminho
 		}
 	}
+	return caminhos[len(caminhos)-1]
+}
 
-	if err != nil {
-		// Se não existe em nenhum local, cria estrutura vazia
-		dados.Veiculos = make(map[string]VeiculoCompleto)
-		return dados, nil
+// Carrega dados completos dos veículos
+// Carrega dados completos dos veículos do arquivo JSON (vazio se o arquivo ainda não existir)
+func carregarDadosVeiculos() (DadosVeiculosCompletos, error) {
+	var dados DadosVeiculosCompletos
+	if err := persistencia.LerJSON(caminhoDadosVeiculos(), &dados); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return dados, err
 	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&dados)
-	if err != nil {
+	if dados.Veiculos == nil {
 		dados.Veiculos = make(map[string]VeiculoCompleto)
 	}
-
 	return dados, nil
 }
 
-// Salva dados completos dos veículos
-// Salva dados dos veículos no arquivo JSON com múltiplas tentativas de caminho
-func salvarDadosVeiculos(dados DadosVeiculosCompletos) error {
-	// Tenta primeiro o caminho do container, depois caminho local
-	caminhos := []string{
-		"/app/data/veiculos_completos.json",       // Caminho no container
-		"../empresa/data/veiculos_completos.json", // Caminho local (relativo)
-	}
-
-	var err error
-	for _, caminho := range caminhos {
-		// Verifica se o diretório existe
-		dir := filepath.Dir(caminho)
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			continue // Diretório não existe, tenta próximo caminho
-		}
-
-		file, err := os.Create(caminho)
-		if err != nil {
-			continue // Erro ao criar arquivo, tenta próximo caminho
+// Altera os dados dos veículos com o arquivo travado: lê a versão atual, aplica alterar e grava,
+// sem perder o que outros veículos gravaram no meio tempo
+func atualizarDadosVeiculos(alterar func(dados *DadosVeiculosCompletos)) error {
+	var dados DadosVeiculosCompletos
+	return persistencia.AtualizarJSON(caminhoDadosVeiculos(), &dados, 0644, func() bool {
+		if dados.Veiculos == nil {
+			dados.Veiculos = make(map[string]VeiculoCompleto)
 		}
-		defer file.Close()
-
-		encoder := json.NewEncoder(file)
-		encoder.SetIndent("", "  ")
-		return encoder.Encode(dados)
-	}
-
-	return fmt.Errorf("não foi possível salvar dados de veículos em nenhum local: %v", err)
+		alterar(&dados)
+		return true
+	})
 }
 
 // Carrega controle de sessões ativas
@@ -178,17 +162,13 @@ func carregarSessoesAtivas() (ControleSessoes, error) {
 	var controle ControleSessoes
 	controle.SessoesAtivas = make(map[string]SessaoAtiva) // Inicializa o map sempre
 
-	file, err := os.ReadFile("data/sessoes_ativas.json")
+	err := persistencia.LerJSON(arquivoSessoesAtivas, &controle)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			return controle, nil
 		}
-		return controle, err
-	}
-
-	err = json.Unmarshal(file, &controle)
-	if err != nil {
-		// Se falhou o unmarshalling, retorna o controle com map inicializado
+		// Sessões ilegíveis (sem cópia anterior válida) são descartadas
+		controle.SessoesAtivas = make(map[string]SessaoAtiva)
 		return controle, nil
 	}
 
@@ -200,41 +180,31 @@ func carregarSessoesAtivas() (ControleSessoes, error) {
 	return controle, nil
 }
 
-// Salva controle de sessões ativas
-func salvarSessoesAtivas(controle ControleSessoes) error {
-	file, err := json.MarshalIndent(controle, "", "  ")
+// Altera as sessões ativas com o arquivo travado (vários veículos registram sessões ao mesmo tempo)
+// Nada é gravado se alterar retornar false
+func atualizarSessoesAtivas(alterar func(controle *ControleSessoes) bool) error {
+	trava, err := persistencia.Travar(arquivoSessoesAtivas)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile("data/sessoes_ativas.json", file, 0644)
-}
-
-// Verifica se uma placa já está ativa no sistema
-// Verifica se placa já está sendo usada em sessão ativa para evitar login duplo
-func verificarPlacaAtiva(placa string) (bool, string) {
+	defer trava.Destravar()
 	controle, err := carregarSessoesAtivas()
 	if err != nil {
-		return false, ""
+		return err
 	}
-
-	if sessao, existe := controle.SessoesAtivas[placa]; existe {
-		return true, fmt.Sprintf("❌ Placa %s já está sendo usada desde %s (Cliente: %s)",
-			placa, sessao.HorarioLogin, sessao.ClienteID)
+	if !alterar(&controle) {
+		return nil
 	}
-
-	return false, ""
+	return persistencia.GravarJSON(arquivoSessoesAtivas, controle, 0644)
 }
 
 // Registra uma nova sessão ativa
 // Registra nova sessão ativa e gera ID único para cliente MQTT
+// A verificação de placa já ativa (login duplo) é feita com o arquivo travado, então dois
+// processos entrando com a mesma placa ao mesmo tempo não registram as duas sessões
 func registrarSessaoAtiva(placa string) (string, error) {
-	controle, err := carregarSessoesAtivas()
-	if err != nil {
-		return "", err
-	}
-
-	// Gera um ID único para esta sessão
-	clienteID := fmt.Sprintf("veiculo_%s_%d", placa, time.Now().Unix())
+	// ID estável por placa, para que o broker mantenha a sessão MQTT persistente entre logins
+	clienteID := "veiculo_" + placa
 
 	sessao := SessaoAtiva{
 		Placa:        placa,
@@ -243,11 +213,22 @@ func registrarSessaoAtiva(placa string) (string, error) {
 		ProcessID:    os.Getpid(),
 	}
 
-	controle.SessoesAtivas[placa] = sessao
-	err = salvarSessoesAtivas(controle)
+	var existente SessaoAtiva
+	ativa := false
+	err := atualizarSessoesAtivas(func(controle *ControleSessoes) bool {
+		if existente, ativa = controle.SessoesAtivas[placa]; ativa {
+			return false
+		}
+		controle.SessoesAtivas[placa] = sessao
+		return true
+	})
 	if err != nil {
 		return "", err
 	}
+	if ativa {
+		return "", fmt.Errorf("%w: placa %s já está sendo usada desde %s (Cliente: %s)",
+			errPlacaEmUso, placa, existente.HorarioLogin, existente.ClienteID)
+	}
 
 	fmt.Printf("✅ Sessão registrada: %s\n", clienteID)
 	return clienteID, nil
@@ -256,73 +237,83 @@ func registrarSessaoAtiva(placa string) (string, error) {
 // Remove uma sessão ativa
 // Remove sessão ativa do veículo durante logout ou limpeza do sistema
 func removerSessaoAtiva(placa string) error {
-	controle, err := carregarSessoesAtivas()
-	if err != nil {
-		return err
-	}
-
-	if _, existe := controle.SessoesAtivas[placa]; existe {
-		delete(controle.SessoesAtivas, placa)
-		err = salvarSessoesAtivas(controle)
-		if err == nil {
-			fmt.Printf("✅ Sessão da placa %s removida com sucesso\n", placa)
+	removida := false
+	err := atualizarSessoesAtivas(func(controle *ControleSessoes) bool {
+		if _, existe := controle.SessoesAtivas[placa]; !existe {
+			return false
 		}
+		delete(controle.SessoesAtivas, placa)
+		removida = true
+		return true
+	})
+	if err == nil && removida {
+		fmt.Printf("✅ Sessão da placa %s removida com sucesso\n", placa)
 	}
 
 	return err
 }
 
-// Verifica se a placa existe e faz login ou cadastro
-// Gerencia login de veículo existente ou cadastro de novo veículo no sistema
-func loginOuCadastro(placa string) (VeiculoCompleto, bool, error) {
-	dados, err := carregarDadosVeiculos()
+// Lê o segredo do veículo usado para obter credenciais MQTT, gerando-o no primeiro uso
+// A primeira empresa consultada registra o segredo; depois ele passa a ser exigido para a placa
+func carregarSegredoVeiculo(placa string) (string, error) {
+	if strings.ContainsAny(placa, "/\\.") {
+		return "", fmt.Errorf("placa inválida: %s", placa)
+	}
+	caminho := "data/segredo_veiculo_" + placa
+	// Travado para que dois processos da mesma placa não gerem segredos diferentes
+	trava, err := persistencia.Travar(caminho)
 	if err != nil {
-		return VeiculoCompleto{}, false, err
+		return "", err
 	}
-
-	// Verifica se veículo já existe (login)
-	if veiculo, exists := dados.Veiculos[placa]; exists {
-		veiculo.UltimoLogin = time.Now().Format("15:04:05 02/01/2006")
-		dados.Veiculos[placa] = veiculo
-		salvarDadosVeiculos(dados)
-
-		fmt.Printf("🚗 Bem-vindo de volta, veículo %s!\n", placa)
-		fmt.Printf("📊 Bateria atual: %.1f%%\n", veiculo.NivelBateriaAtual)
-		fmt.Printf("🔋 Autonomia: %.0f km\n", veiculo.Autonomia)
-		fmt.Printf("📅 Último login: %s\n", veiculo.UltimoLogin)
-
-		return veiculo, true, nil // true = login
+	defer trava.Destravar()
+	if segredo, err := os.ReadFile(caminho); err == nil {
+		return strings.TrimSpace(string(segredo)), nil
 	}
-
-	// Novo veículo (cadastro)
-	bateria, autonomia := gerarDadosIniciais()
-	novoVeiculo := VeiculoCompleto{
-		Placa:             placa,
-		Autonomia:         autonomia,
-		NivelBateriaAtual: bateria,
-		UltimoLogin:       time.Now().Format("15:04:05 02/01/2006"),
-		Historico:         []Viagem{},
+	b := make([]byte, 24)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
 	}
+	segredo := hex.EncodeToString(b)
+	if err := persistencia.GravarArquivo(caminho, []byte(segredo), 0600); err != nil {
+		return "", err
+	}
+	return segredo, nil
+}
 
-	dados.Veiculos[placa] = novoVeiculo
-	salvarDadosVeiculos(dados)
-
-	fmt.Printf("✅ Veículo %s cadastrado com sucesso!\n", placa)
-	fmt.Printf("📊 Bateria inicial: %.1f%%\n", bateria)
-	fmt.Printf("🔋 Autonomia: %.0f km\n", autonomia)
+// Verifica se a placa existe e faz login ou cadastro
+// Gerencia login de veículo existente ou cadastro de novo veículo no sistema
+func loginOuCadastro(placa string) (VeiculoCompleto, bool, error) {
+	var veiculo VeiculoCompleto
+	login := false
+	err := atualizarDadosVeiculos(func(dados *DadosVeiculosCompletos) {
+		// Verifica se veículo já existe (login)
+		if existente, exists := dados.Veiculos[placa]; exists {
+			existente.UltimoLogin = time.Now().Format("15:04:05 02/01/2006")
+			dados.Veiculos[placa] = existente
+			veiculo, login = existente, true
+			return
+		}
 
-	return novoVeiculo, false, nil // false = cadastro
+		// Novo veículo (cadastro)
+		bateria, autonomia := gerarDadosIniciais()
+		veiculo = VeiculoCompleto{
+			Placa:             placa,
+			Autonomia:         autonomia,
+			NivelBateriaAtual: bateria,
+			UltimoLogin:       time.Now().Format("15:04:05 02/01/2006"),
+			Historico:         []Viagem{},
+		}
+		dados.Veiculos[placa] = veiculo
+	})
+	if err != nil {
+		return VeiculoCompleto{}, false, err
+	}
+	return veiculo, login, nil // true = login, false = cadastro
 }
 
 // Salva uma viagem no histórico
 // Registra viagem no histórico do veículo com informações de pontos visitados e status
 func salvarViagem(placa string, origem, destino string, pontos []string, status string) error {
-	dados, err := carregarDadosVeiculos()
-	if err != nil {
-		return err
-	}
-
-	veiculo := dados.Veiculos[placa]
 	novaViagem := Viagem{
 		Data:    time.Now().Format("15:04:05 02/01/2006"),
 		Origem:  origem,
@@ -331,10 +322,11 @@ func salvarViagem(placa string, origem, destino string, pontos []string, status
 		Status:  status,
 	}
 
-	veiculo.Historico = append(veiculo.Historico, novaViagem)
-	dados.Veiculos[placa] = veiculo
-
-	return salvarDadosVeiculos(dados)
+	return atualizarDadosVeiculos(func(dados *DadosVeiculosCompletos) {
+		veiculo := dados.Veiculos[placa]
+		veiculo.Historico = append(veiculo.Historico, novaViagem)
+		dados.Veiculos[placa] = veiculo
+	})
 }
 
 // Calcula distância entre dois pontos usando fórmula de Haversine